@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// serveAdmin runs the admin HTTP API
+func serveAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", streamEvents)
+	mux.HandleFunc("/archive", listArchived)
+	mux.HandleFunc("/backup", backup)
+	mux.HandleFunc("/corrupt", listCorrupt)
+	mux.HandleFunc("/corrupt/delete", deleteCorrupt)
+	mux.HandleFunc("/dead", listDead)
+	mux.HandleFunc("/dead/delete", deleteDead)
+	mux.HandleFunc("/dead/retry", retryDead)
+	mux.HandleFunc("/dead/stats", deadStats)
+	mux.HandleFunc("/fsck", fsck)
+	mux.HandleFunc("/journal", listJournal)
+	mux.Handle("/metrics", expvar.Handler())
+	mux.HandleFunc("/pause", pause)
+	mux.HandleFunc("/queue", listPending)
+	mux.HandleFunc("/queue/delete", deletePending)
+	mux.HandleFunc("/queue/kill", killPending)
+	mux.HandleFunc("/quarantine", quarantine)
+	mux.HandleFunc("/quarantine/release", releaseQuarantined)
+	mux.HandleFunc("/quarantine/delete", deleteQuarantined)
+	mux.HandleFunc("/resume", resume)
+
+	log.Println("Admin API listening on", addr)
+	log.Println(http.ListenAndServe(addr, mux))
+}
+
+// streamEvents tails delivery events as Server-Sent Events, one JSON object per event
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := events.subscribe()
+	defer events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	for {
+		select {
+		case e := <-ch:
+			data, err := json.Marshal(e)
+			if err != nil {
+				log.Println("Error encoding event:", err)
+				continue
+			}
+
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// fsck checks queue integrity, ?repair=1 releases leases of messages stuck for over an hour
+func fsck(w http.ResponseWriter, r *http.Request) {
+	c, ok := q.(checker)
+	if !ok {
+		http.Error(w, "Queue does not support checks", http.StatusNotImplemented)
+		return
+	}
+
+	report, err := c.Check(staleOutgoing, r.FormValue("repair") == "1")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
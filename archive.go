@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/oliverjanik/scalemail/emailq"
+)
+
+// archiver keeps delivered messages for looking up what was sent
+type archiver interface {
+	ListArchived(ctx context.Context, f emailq.Filter) ([]emailq.Delivery, error)
+	PurgeArchive(retention time.Duration) (int, error)
+}
+
+var archivePurged = expvar.NewInt("archive_purged")
+
+// archiveFor reads the -archive flag
+func archiveFor(mode string) (emailq.Archive, error) {
+	switch mode {
+	case "":
+		return emailq.ArchiveOff, nil
+	case "headers":
+		return emailq.ArchiveHeaders, nil
+	case "full":
+		return emailq.ArchiveFull, nil
+	}
+
+	return emailq.ArchiveOff, fmt.Errorf("Unknown archive mode: %s", mode)
+}
+
+// archiveLoop enforces the archive retention every hour
+func archiveLoop(a archiver, retention time.Duration) {
+	for {
+		n, err := a.PurgeArchive(retention)
+		if err != nil {
+			log.Println("Error purging archive:", err)
+		} else if n > 0 {
+			archivePurged.Add(int64(n))
+			log.Println("Purged", n, "archived messages")
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
+
+// listArchived lists delivered messages kept in the archive, see listFilter for the parameters
+func listArchived(w http.ResponseWriter, r *http.Request) {
+	a, ok := q.(archiver)
+	if !ok {
+		http.Error(w, "Queue does not support the archive", http.StatusNotImplemented)
+		return
+	}
+
+	listPage(w, r, a.ListArchived)
+}
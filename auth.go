@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/oliverjanik/scalemail/daemon"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// how long an external credential check may take
+const authTimeout = 10 * time.Second
+
+// htpasswd checks credentials against "username:password" lines as written by htpasswd -B or -s,
+// passwords are bcrypt hashes, {SHA} hashes or plain text
+type htpasswd map[string]string
+
+// loadUsers reads an htpasswd file, blank lines and # comments are skipped
+func loadUsers(path string) (htpasswd, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(htpasswd)
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected username:password", path, n)
+		}
+
+		// MD5 and crypt hashes would otherwise pass as plain text passwords
+		if strings.HasPrefix(kv[1], "$") && !isBcrypt(kv[1]) {
+			return nil, fmt.Errorf("%s:%d: unsupported password hash, use bcrypt (htpasswd -B)", path, n)
+		}
+		users[kv[0]] = kv[1]
+	}
+
+	if err = s.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// Authenticate checks the password against the user's entry
+func (h htpasswd) Authenticate(username, password string) error {
+	expected, ok := h[username]
+	if !ok {
+		return daemon.ErrInvalidCredentials
+	}
+
+	var valid bool
+	switch {
+	case isBcrypt(expected):
+		valid = bcrypt.CompareHashAndPassword([]byte(expected), []byte(password)) == nil
+	case strings.HasPrefix(expected, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		valid = subtle.ConstantTimeCompare([]byte(expected[5:]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	default:
+		valid = subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+	}
+
+	if !valid {
+		return daemon.ErrInvalidCredentials
+	}
+
+	return nil
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// authenticator builds the -auth-check credential lookup, an http(s) URL or a command
+func authenticator(spec string) daemon.Authenticator {
+	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		return httpAuth(spec)
+	}
+
+	return commandAuth(strings.Fields(spec))
+}
+
+// commandAuth runs a command with the username and password on separate lines of its stdin.
+// Exit status 0 accepts them and 1 rejects them, anything else is a temporary failure.
+type commandAuth []string
+
+// Authenticate runs the command
+func (args commandAuth) Authenticate(username, password string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(username + "\n" + password + "\n")
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == 1 {
+		return daemon.ErrInvalidCredentials
+	}
+
+	return err
+}
+
+// httpAuth POSTs the username and password as a form. A 2xx status accepts them and 401 or
+// 403 rejects them, anything else is a temporary failure.
+type httpAuth string
+
+// Authenticate posts the credentials
+func (u httpAuth) Authenticate(username, password string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+	defer cancel()
+
+	form := url.Values{"username": {username}, "password": {password}}
+	req, err := http.NewRequest("POST", string(u), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return daemon.ErrInvalidCredentials
+	}
+
+	return fmt.Errorf("Authentication endpoint returned %s", resp.Status)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/oliverjanik/scalemail/emailq"
+)
+
+// backuper snapshots the queue while it's in use
+type backuper interface {
+	Backup(w io.Writer) (int64, error)
+}
+
+// backup streams a consistent copy of emails.db, a tar archive of the files with -shards
+func backup(w http.ResponseWriter, r *http.Request) {
+	b, ok := q.(backuper)
+	if !ok {
+		http.Error(w, "Queue does not support backup", http.StatusNotImplemented)
+		return
+	}
+
+	name := "emails-" + time.Now().UTC().Format("20060102-150405") + ".db"
+	if _, ok := q.(*emailq.Sharded); ok {
+		name += ".tar"
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+
+	start := time.Now()
+	n, err := b.Backup(w)
+	if err != nil {
+		// the headers are out, all that's left is to cut the download short
+		log.Println("Error backing up queue:", err)
+		return
+	}
+
+	log.Printf("Backed up queue, %d bytes in %v\n", n, time.Since(start))
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"time"
+)
+
+// collector drops blobs of message bodies nothing in the queue refers to anymore
+type collector interface {
+	CollectBlobs(grace time.Duration) (int, error)
+}
+
+var blobsCollected = expvar.NewInt("blobs_collected")
+
+// collectLoop sweeps the blob directory every hour, blobs younger than that are left alone
+// in case their message is still being pushed
+func collectLoop(c collector) {
+	for {
+		time.Sleep(time.Hour)
+
+		n, err := c.CollectBlobs(time.Hour)
+		if err != nil {
+			log.Println("Error collecting blobs:", err)
+		} else if n > 0 {
+			blobsCollected.Add(int64(n))
+			log.Println("Collected", n, "blobs")
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"math/rand"
+	"net/textproto"
+)
+
+// chaos injects delivery failures at configurable rates so that retry, dead-letter and
+// recovery logic can be soak-tested without a hostile remote server
+type chaos struct {
+	timeout    float64 // connect timeouts
+	temporary  float64 // 4xx replies
+	permanent  float64 // 5xx replies
+	disconnect float64 // connection dropped mid-DATA
+}
+
+var faults chaos
+
+func (c *chaos) registerFlags() {
+	flag.Float64Var(&c.timeout, "chaos-timeout", 0, "Rate (0-1) of injected connect timeouts, for testing only")
+	flag.Float64Var(&c.temporary, "chaos-4xx", 0, "Rate (0-1) of injected 4xx replies, for testing only")
+	flag.Float64Var(&c.permanent, "chaos-5xx", 0, "Rate (0-1) of injected 5xx replies, for testing only")
+	flag.Float64Var(&c.disconnect, "chaos-disconnect", 0, "Rate (0-1) of injected mid-DATA disconnects, for testing only")
+}
+
+func (c *chaos) enabled() bool {
+	return c.timeout > 0 || c.temporary > 0 || c.permanent > 0 || c.disconnect > 0
+}
+
+// connect fails the connection attempt as if the remote server never answered
+func (c *chaos) connect() error {
+	if roll(c.timeout) {
+		return errors.New("Chaos: dial tcp: i/o timeout")
+	}
+
+	return nil
+}
+
+// reply fails the transaction with a temporary or permanent SMTP error
+func (c *chaos) reply() error {
+	if roll(c.temporary) {
+		return &textproto.Error{Code: 451, Msg: "4.3.0 Chaos: injected temporary failure"}
+	}
+
+	if roll(c.permanent) {
+		return &textproto.Error{Code: 554, Msg: "5.3.0 Chaos: injected permanent failure"}
+	}
+
+	return nil
+}
+
+// dropData reports whether the connection should be dropped half way through DATA
+func (c *chaos) dropData() bool {
+	return roll(c.disconnect)
+}
+
+func roll(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"time"
+
+	"github.com/oliverjanik/scalemail/emailq"
+)
+
+// compacter gives the free pages of bolt files back to the file system
+type compacter interface {
+	FileStats() (emailq.FileStats, error)
+	Compact() (int64, error)
+}
+
+// publishFileStats exposes the size of the queue files on /metrics
+func publishFileStats(c compacter) {
+	expvar.Publish("queue_file", expvar.Func(func() interface{} {
+		s, err := c.FileStats()
+		if err != nil {
+			return err.Error()
+		}
+		return s
+	}))
+}
+
+// compactLoop checks every hour whether more than free of the queue files is unused and
+// compacts them once nothing is waiting for delivery, every queue operation waits meanwhile
+func compactLoop(c compacter, free float64) {
+	for {
+		time.Sleep(time.Hour)
+
+		s, err := c.FileStats()
+		if err != nil {
+			log.Println("Error reading queue file stats:", err)
+			continue
+		}
+
+		if s.Size == 0 || float64(s.FreeBytes) < free*float64(s.Size) || q.Length() > 0 {
+			continue
+		}
+
+		start := time.Now()
+		saved, err := c.Compact()
+		if err != nil {
+			log.Println("Error compacting queue:", err)
+			continue
+		}
+		log.Printf("Compacted queue in %v, %d bytes freed\n", time.Since(start), saved)
+	}
+}
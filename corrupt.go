@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/oliverjanik/scalemail/emailq"
+)
+
+// corrupter keeps the queue values that failed to decode when they were popped
+type corrupter interface {
+	Corrupted() ([]emailq.Corrupt, error)
+	DeleteCorrupt(key []byte) error
+}
+
+type corruptValue struct {
+	Key   string    `json:"key"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+	Size  int       `json:"size"`
+}
+
+// listCorrupt lists values set aside, ?key= returns one raw value as it was stored
+func listCorrupt(w http.ResponseWriter, r *http.Request) {
+	c, ok := q.(corrupter)
+	if !ok {
+		http.Error(w, "Queue does not support corrupt values", http.StatusNotImplemented)
+		return
+	}
+
+	all, err := c.Corrupted()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if key := r.FormValue("key"); key != "" {
+		for _, v := range all {
+			if string(v.Key) == key {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.Write(v.Raw)
+				return
+			}
+		}
+
+		http.NotFound(w, r)
+		return
+	}
+
+	list := []corruptValue{}
+	for _, v := range all {
+		list = append(list, corruptValue{string(v.Key), v.Error, v.Time, len(v.Raw)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// deleteCorrupt drops the value ?key= once it's been looked at
+func deleteCorrupt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c, ok := q.(corrupter)
+	if !ok {
+		http.Error(w, "Queue does not support corrupt values", http.StatusNotImplemented)
+		return
+	}
+
+	key := r.FormValue("key")
+	if key == "" {
+		http.Error(w, "Missing key", http.StatusBadRequest)
+		return
+	}
+
+	if err := c.DeleteCorrupt([]byte(key)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("Corrupt value", key, "deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
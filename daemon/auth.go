@@ -0,0 +1,134 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// ErrInvalidCredentials is returned by an Authenticator for a wrong username or password
+var ErrInvalidCredentials = errors.New("Invalid credentials")
+
+// Authenticator checks credentials presented with AUTH. It returns nil when they're valid and
+// ErrInvalidCredentials when they aren't, any other error is a lookup failure the client may
+// retry after.
+type Authenticator interface {
+	Authenticate(username, password string) error
+}
+
+// AuthFunc adapts a function to an Authenticator
+type AuthFunc func(username, password string) bool
+
+// Authenticate calls f
+func (f AuthFunc) Authenticate(username, password string) error {
+	if !f(username, password) {
+		return ErrInvalidCredentials
+	}
+
+	return nil
+}
+
+// authOffered reports whether AUTH is available to the client, with Server.AuthRequiresTLS
+// only once the connection is encrypted
+func (s *session) authOffered() bool {
+	return s.srv.Auth != nil && (s.tls || !s.srv.AuthRequiresTLS)
+}
+
+// auth runs the AUTH exchange for PLAIN or LOGIN and returns the final reply
+func (s *session) auth(args []string) string {
+	if len(args) < 1 || len(args) > 2 {
+		return "501 Syntax: AUTH mechanism [initial-response]"
+	}
+
+	var initial string
+	if len(args) == 2 {
+		initial = args[1]
+	}
+
+	var username, password string
+	var ok bool
+
+	switch strings.ToUpper(args[0]) {
+	case "PLAIN":
+		username, password, ok = s.authPlain(initial)
+	case "LOGIN":
+		username, password, ok = s.authLogin(initial)
+	default:
+		return "504 Unrecognized authentication mechanism"
+	}
+
+	if !ok {
+		return "501 Authentication cancelled or malformed"
+	}
+
+	switch err := s.srv.Auth.Authenticate(username, password); err {
+	case nil:
+	case ErrInvalidCredentials:
+		s.srv.metric("rejects.auth", 1)
+		return "535 Authentication credentials invalid"
+	default:
+		s.logf(phaseAuth, "Authentication failed", "user", username, "error", err)
+		s.srv.metric("rejects.auth", 1)
+		return "454 4.7.0 Temporary authentication failure"
+	}
+
+	s.user = username
+	return "235 Authentication successful"
+}
+
+// authPlain decodes "authzid NUL authcid NUL passwd" (RFC 4616)
+func (s *session) authPlain(initial string) (username, password string, ok bool) {
+	resp, ok := s.challenge("", initial)
+	if !ok {
+		return "", "", false
+	}
+
+	parts := bytes.Split(resp, []byte{0})
+	if len(parts) != 3 {
+		return "", "", false
+	}
+
+	return string(parts[1]), string(parts[2]), true
+}
+
+func (s *session) authLogin(initial string) (username, password string, ok bool) {
+	user, ok := s.challenge("Username:", initial)
+	if !ok {
+		return "", "", false
+	}
+
+	pass, ok := s.challenge("Password:", "")
+	if !ok {
+		return "", "", false
+	}
+
+	return string(user), string(pass), true
+}
+
+// challenge sends a 334 prompt unless the client supplied an initial response and returns
+// the decoded answer, false when the client cancelled with "*" or sent garbage
+func (s *session) challenge(prompt, initial string) ([]byte, bool) {
+	line := initial
+	if line == "" {
+		write(s.text, "334 "+base64.StdEncoding.EncodeToString([]byte(prompt)))
+
+		var err error
+		if line, err = s.read(maxAuthLineLength); err != nil {
+			panic(err)
+		}
+		s.trace.line("C", "***")
+	}
+
+	if line == "*" {
+		return nil, false
+	}
+
+	// "=" stands for an empty initial response
+	if line == "=" {
+		return []byte{}, true
+	}
+
+	b, err := base64.StdEncoding.DecodeString(line)
+	return b, err == nil
+}
@@ -1,37 +1,180 @@
 package daemon
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"io"
-	"log"
 	"net"
 	"net/textproto"
-	"regexp"
 	"strings"
-)
-
-var (
-	addrRegex = regexp.MustCompile("<(.*)>")
+	"sync"
+	"time"
 )
 
 // Msg represents email message
 type Msg struct {
-	From string
+	From string // empty for the null reverse-path <>
 	To   []string
 	Data []byte
+	UTF8 bool   // client asked for SMTPUTF8, addresses and headers may contain UTF-8
+	Body string // BODY= of MAIL FROM, 7BIT or 8BITMIME, empty when not given
+	User string // authenticated submitter, empty for anonymous sessions
+	IP   string // client address
+
+	Session string // ID of the receiving session in log entries
+
+	// DSN extension (RFC 3461) options
+	Ret    string            // RET=FULL or HDRS
+	EnvID  string            // ENVID, decoded from xtext
+	Notify map[string]string // recipient -> NOTIFY, e.g. "FAILURE,DELAY" or "NEVER"
+	ORcpt  map[string]string // recipient -> ORCPT, decoded from xtext
+
+	HoldUntil time.Time // FUTURERELEASE (RFC 4865) release time, zero for immediate delivery
+
+	// sender authentication, see Server.VerifyDKIM and Server.DMARC
+	DKIM       []DKIMResult // one per signature
+	SPF        string       // SPF result for the envelope sender
+	DMARC      *DMARCResult
+	Quarantine bool // failed DMARC of a domain asking for quarantine, or matched a quarantine rule
+
+	QuarantineReason string // why Quarantine is set
+
+	// Metadata is carried to the queue with the message, filters may add e.g. a tenant or
+	// campaign ID
+	Metadata map[string]string
 }
 
 // HandlerFunc handles incoming msg
 type HandlerFunc func(msg *Msg)
 
-var defaultHandle HandlerFunc
+// SubmitFunc is a HandlerFunc that can fail, a non-empty reply such as
+// "452 4.3.1 Insufficient system storage" refuses the message after all.
+type SubmitFunc func(msg *Msg) (reply string)
+
+// FilterFunc inspects a message before it is accepted and may rewrite msg.Data. A non-empty
+// reply such as "550 Message looks like spam" rejects the message.
+type FilterFunc func(msg *Msg) (reply string)
+
+// RcptValidator checks a local recipient at RCPT time, a non-empty reply such as
+// "550 5.1.1 No such user" refuses it. Failed lookups should answer 4xx so the client retries.
+type RcptValidator func(addr string) (reply string)
+
+// Server accepts mail over SMTP and passes it to Handler. Fields must not be changed
+// once the server is serving.
+type Server struct {
+	Addr      string      // TCP address to listen on, ":587" if empty
+	Handler   HandlerFunc // called for every accepted message
+	Submit    SubmitFunc  // used instead of Handler when set
+	Filter    FilterFunc  // optional content filter run before Handler
+	TLSConfig *tls.Config // enables STARTTLS, with ClientCAs a verified client certificate authenticates like AUTH
+	MaxSize   int         // largest message in bytes, 25MB if zero
+	MaxRcpts  int         // recipients per message, 100 if zero
+	Hostname  string      // own name for the greeting and Received headers, os.Hostname() if empty
+	Banner    string      // text of the 220 greeting after the hostname, "ESMTP ready" if empty
+
+	ImplicitTLS bool // connections start with a TLS handshake (port 465) instead of STARTTLS
+	RequireTLS  bool // only EHLO, HELO, STARTTLS, NOOP, RSET and QUIT are accepted before TLS
+	RequireAuth bool // MAIL needs an authenticated client, for submission ports
+
+	GreetingDelay  time.Duration // pause before the banner, clients talking during it are dropped
+	CommandTimeout time.Duration // idle time waiting for a command, 5 minutes if zero
+	DataTimeout    time.Duration // time to receive message data, 10 minutes if zero
+
+	MaxErrors   int // rejected (5xx) commands before a session is dropped, unlimited if zero
+	CommandRate int // commands per second a session may issue, faster ones are slowed down, unlimited if zero
+
+	MaxConnections      int // concurrent sessions, unlimited if zero
+	MaxConnectionsPerIP int // concurrent sessions from one client IP, unlimited if zero
+
+	// Relaying: authenticated clients and clients from RelayNetworks may send anywhere,
+	// everyone else only to LocalDomains. Empty RelayNetworks lets anyone relay.
+	RelayNetworks []*net.IPNet
+	LocalDomains  []string
+	Auth          Authenticator // enables AUTH PLAIN and LOGIN when set
+
+	// AuthRequiresTLS withholds AUTH until STARTTLS completes, plaintext attempts get 538
+	AuthRequiresTLS bool
+
+	// UserLimits caps what each authenticated user may send, a user over the message limit
+	// is disconnected with 421 at MAIL and recipients over the limit get 452
+	UserLimits *UserLimits
 
-// HandleFunc sets HandlerFunc
-func HandleFunc(fn HandlerFunc) {
-	defaultHandle = fn
+	// MaxHold enables FUTURERELEASE (RFC 4865), clients may ask for messages to be held
+	// for delivery up to this long. Zero disables.
+	MaxHold time.Duration
+
+	// RcptValidator checks recipients in LocalDomains, unknown ones are refused during the
+	// session instead of bouncing later
+	RcptValidator RcptValidator
+
+	// Greylist reports whether a recipient of an untrusted client may pass greylisting,
+	// others get a temporary failure. Nil disables greylisting.
+	Greylist func(ip, from, to string) bool
+
+	// Metrics receives counters of connections, messages and rejects when set
+	Metrics Metrics
+
+	// Rules reject, defer or tag mail by sender, recipient, HELO, client IP and headers
+	Rules *Rules
+
+	// PTR verifies the client's reverse DNS name, see PTRCheck and PTRReject. Off when empty.
+	PTR string
+
+	// RequireFQDNHelo refuses HELO and EHLO names that aren't fully qualified domains from
+	// clients other than our own users
+	RequireFQDNHelo bool
+
+	// XClientNetworks may use XCLIENT to pass on the attributes of the client they proxy for
+	XClientNetworks []*net.IPNet
+
+	// VRFY and EXPN policy, VRFYCannot if empty. VRFYLookup asks Mailbox whether an address
+	// is delivered here.
+	VRFY    string
+	Mailbox func(addr string) bool
+
+	// DNSBL lists blocklist zones, e.g. zen.spamhaus.org, checked at MAIL for clients that
+	// are neither authenticated nor in RelayNetworks. DNSBLAction is DNSBLReject if empty.
+	DNSBL       []string
+	DNSBLAction string
+
+	// VerifyDKIM checks DKIM signatures of accepted messages, the results are stamped in an
+	// Authentication-Results header and passed to Handler in Msg.DKIM
+	VerifyDKIM bool
+
+	// DMARC checks mail from untrusted clients (see DNSBL) against the From domain's DMARC
+	// policy using SPF and DKIM. DMARCMonitor only records results, DMARCEnforce rejects
+	// when the policy says reject and sets Msg.Quarantine for quarantine. Empty disables.
+	DMARC string
+
+	// ProxyProtocol expects every connection to start with a PROXY protocol (v1 or v2)
+	// header, as sent by HAProxy or a cloud load balancer, and uses the client address
+	// from it. Only enable when all connections come through such a proxy.
+	ProxyProtocol bool
+
+	// TranscriptDir enables debug transcripts, one file per session with every command
+	// and reply. Message data is summarized and AUTH credentials are masked.
+	TranscriptDir string
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	sessions  map[*session]struct{}
+	perIP     map[string]int // open sessions by client IP
+	closed    bool
 }
 
-// ListenAndServe starts listening loop
-func ListenAndServe(addr string) error {
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown or Close
+var ErrServerClosed = errors.New("Server closed")
+
+// ListenAndServe starts a server on addr handing messages to handler
+func ListenAndServe(addr string, handler HandlerFunc) error {
+	srv := &Server{Addr: addr, Handler: handler}
+	return srv.ListenAndServe()
+}
+
+// ListenAndServe listens on srv.Addr and serves incoming connections
+func (srv *Server) ListenAndServe() error {
+	addr := srv.Addr
 	if addr == "" {
 		addr = ":587"
 	}
@@ -41,90 +184,323 @@ func ListenAndServe(addr string) error {
 		return err
 	}
 
+	return srv.Serve(l)
+}
+
+// Serve accepts connections on l, each is handled in its own goroutine
+func (srv *Server) Serve(l net.Listener) error {
+	if !srv.track(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer srv.untrack(l)
+
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			if srv.isClosed() {
+				return ErrServerClosed
+			}
 			return err
 		}
 
-		go handle(textproto.NewConn(c))
+		go srv.handle(c)
+	}
+}
+
+// Shutdown gracefully stops the server. It stops accepting connections, idle sessions are
+// told "421" and closed, sessions receiving message data may finish their transaction.
+// When ctx expires first the remaining connections are closed and ctx.Err() is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	err := srv.closeListeners()
+
+	// wake up sessions waiting for a command, they notice the shutdown and say goodbye
+	for s := range srv.sessions {
+		if !s.busy {
+			s.rawConn.SetReadDeadline(time.Now())
+		}
 	}
+	srv.mu.Unlock()
 
+	t := time.NewTicker(50 * time.Millisecond)
+	defer t.Stop()
+
+	for {
+		srv.mu.Lock()
+		n := len(srv.sessions)
+		srv.mu.Unlock()
+
+		if n == 0 {
+			return err
+		}
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			srv.Close()
+			return ctx.Err()
+		}
+	}
 }
 
-func handle(c *textproto.Conn) {
-	defer c.Close()
-	defer func() {
-		if r := recover(); r != nil {
-			log.Println("Something went wrong:", r)
+// Close immediately stops the server, closing its listeners and all open connections
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	err := srv.closeListeners()
+	for s := range srv.sessions {
+		s.rawConn.Close()
+	}
+
+	return err
+}
+
+// closeListeners marks the server closed and stops accepting, srv.mu must be held
+func (srv *Server) closeListeners() (err error) {
+	srv.closed = true
+
+	for l := range srv.listeners {
+		if e := l.Close(); e != nil {
+			err = e
 		}
-	}()
+	}
 
-	converse(c)
+	return err
 }
 
-func converse(c *textproto.Conn) {
-	write(c, "220 At your service")
+func (srv *Server) maxSize() int {
+	if srv.MaxSize > 0 {
+		return srv.MaxSize
+	}
 
-	var msg Msg
+	return 25 << 20
+}
 
-	for {
-		s, err := read(c)
-		if err == io.EOF {
+func (srv *Server) maxRcpts() int {
+	if srv.MaxRcpts > 0 {
+		return srv.MaxRcpts
+	}
+
+	return 100
+}
+
+func (srv *Server) commandTimeout() time.Duration {
+	if srv.CommandTimeout > 0 {
+		return srv.CommandTimeout
+	}
+
+	return 5 * time.Minute
+}
+
+func (srv *Server) dataTimeout() time.Duration {
+	if srv.DataTimeout > 0 {
+		return srv.DataTimeout
+	}
+
+	return 10 * time.Minute
+}
+
+func (srv *Server) isClosed() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.closed
+}
+
+func (srv *Server) track(l net.Listener) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.closed {
+		return false
+	}
+
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]struct{})
+	}
+	srv.listeners[l] = struct{}{}
+
+	return true
+}
+
+func (srv *Server) untrack(l net.Listener) {
+	srv.mu.Lock()
+	delete(srv.listeners, l)
+	srv.mu.Unlock()
+}
+
+func (srv *Server) handle(conn net.Conn) {
+	s := &session{
+		srv:     srv,
+		id:      newSessionID(),
+		rawConn: conn,
+		conn:    conn,
+		text:    textproto.NewConn(conn),
+		remote:  conn.RemoteAddr(),
+		ip:      remoteIP(conn.RemoteAddr()),
+		started: time.Now(),
+	}
+
+	if srv.ProxyProtocol {
+		conn.SetReadDeadline(time.Now().Add(srv.commandTimeout()))
+
+		addr, err := readProxyHeader(s.text.R)
+		if err != nil {
+			s.logf(phaseConnect, "Error reading PROXY header", "err", err)
+			conn.Close()
 			return
 		}
 
-		cmd := strings.ToUpper(s[:4])
-
-		switch cmd {
-		case "EHLO":
-			write(c, "250-8BITMIME")
-			fallthrough
-		case "HELO":
-			write(c, "250 I need orders")
-		case "MAIL":
-			msg.From = addrRegex.FindStringSubmatch(s)[1]
-			write(c, "250 In your name")
-		case "RCPT":
-			addr := addrRegex.FindStringSubmatch(s)[1]
-			msg.To = append(msg.To, addr)
-			write(c, "250 Defending your honour")
-		case "DATA":
-			write(c, "354 Give me a quest!")
-			data, err := c.ReadDotBytes()
-			if err != nil {
-				panic(err)
-			}
-			msg.Data = data
+		if addr != nil {
+			s.remote = addr
+		}
+	}
+
+	s.ip = remoteIP(s.remote)
+	s.relay = srv.mayRelay(s.ip)
+	s.xclientOK = inNetworks(srv.XClientNetworks, s.ip)
+
+	srv.metric("connections", 1)
 
-			defaultHandle(&msg)
+	if reply, ok := srv.register(s); !ok {
+		if reply != "" {
+			srv.metric("rejects.limit", 1)
+			s.logf(phaseConnect, "Refusing connection", "reply", reply)
+			s.bye(reply)
+		}
+		conn.Close()
+		return
+	}
+	defer srv.unregister(s)
+
+	srv.metric("sessions", 1)
+	defer srv.metric("sessions", -1)
 
-			write(c, "250 We move")
-		case "RSET":
-			write(c, "250 OK")
-		case "QUIT":
-			write(c, "221 For the king")
-		default:
-			log.Println("Unknown command:", s)
+	s.logf(phaseConnect, "Session started", "remote", s.remote.String())
+	defer func() { s.logf(s.phase(), "Session ended", "duration", time.Since(s.started).Round(time.Millisecond)) }()
+
+	if srv.TranscriptDir != "" {
+		var err error
+		if s.trace, err = openTranscript(srv.TranscriptDir, s.ip); err != nil {
+			s.logf(phaseConnect, "Error creating transcript", "err", err)
+		}
+		s.trace.line("*", "Connection from "+s.remote.String())
+		s.traceReplies()
+	}
+	defer s.trace.close()
+
+	if srv.ImplicitTLS {
+		conn.SetDeadline(time.Now().Add(srv.commandTimeout()))
+
+		// the client hello may already be buffered behind the PROXY header
+		s.conn = &bufferedConn{conn, s.text.R}
+		if err := s.startTLS(); err != nil {
+			s.logf(phaseTLS, "TLS handshake failed", "err", err)
+			conn.Close()
+			return
 		}
+		s.user = s.certUser()
 	}
+
+	defer func() { s.text.Close() }()
+	defer func() {
+		if r := recover(); r != nil {
+			s.logf(s.phase(), "Something went wrong", "err", r)
+		}
+	}()
+
+	converse(s)
 }
 
-func write(c *textproto.Conn, msg string) {
-	if err := c.Writer.PrintfLine(msg); err != nil {
-		panic(err)
+// register adds s to open sessions unless the server is closed or a connection limit is
+// reached, in which case the reply to send the client is returned
+func (srv *Server) register(s *session) (reply string, ok bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.closed {
+		return "", false
+	}
+
+	if srv.MaxConnections > 0 && len(srv.sessions) >= srv.MaxConnections {
+		return "421 Too many connections, try again later", false
 	}
+
+	if srv.MaxConnectionsPerIP > 0 && srv.perIP[s.ip] >= srv.MaxConnectionsPerIP {
+		return "421 Too many connections from your address, try again later", false
+	}
+
+	if srv.sessions == nil {
+		srv.sessions = make(map[*session]struct{})
+		srv.perIP = make(map[string]int)
+	}
+	srv.sessions[s] = struct{}{}
+	srv.perIP[s.ip]++
+
+	return "", true
 }
 
-func read(c *textproto.Conn) (string, error) {
-	s, err := c.ReadLine()
-	if err == io.EOF {
-		return s, err
+func (srv *Server) unregister(s *session) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	delete(srv.sessions, s)
+
+	if srv.perIP[s.ip]--; srv.perIP[s.ip] <= 0 {
+		delete(srv.perIP, s.ip)
 	}
+}
 
+// mayRelay checks client ip against RelayNetworks
+func (srv *Server) mayRelay(ip string) bool {
+	return len(srv.RelayNetworks) == 0 || inNetworks(srv.RelayNetworks, ip)
+}
+
+func inNetworks(networks []*net.IPNet, ip string) bool {
+	addr := net.ParseIP(ip)
+	for _, n := range networks {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isLocal reports whether addr is in one of LocalDomains
+func (srv *Server) isLocal(addr string) bool {
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return false
+	}
+
+	domain := addr[i+1:]
+	for _, d := range srv.LocalDomains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
 	if err != nil {
-		panic(err)
+		return addr.String()
 	}
 
-	return s, err
+	return host
+}
+
+// bufferedConn reads through r, holding data already read off the connection
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
 }
@@ -0,0 +1,1191 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadData(t *testing.T) {
+	data, err := readData(bufio.NewReader(strings.NewReader("Subject: hi\r\n\r\n..dot\r\nbody\r\n.\r\nQUIT\r\n")), 1024)
+	if err != nil {
+		t.Fatal("Error reading data:", err)
+	}
+
+	if string(data) != "Subject: hi\r\n\r\n.dot\r\nbody\r\n" {
+		t.Fatalf("Unexpected data: %q", data)
+	}
+}
+
+func TestReadDataSmuggling(t *testing.T) {
+	inputs := []string{
+		"body\n.\nMAIL FROM:<evil@example.com>\r\n.\r\n",
+		"body\r\n.\nMAIL FROM:<evil@example.com>\r\n.\r\n",
+		"body\r.\rMAIL FROM:<evil@example.com>\r\n.\r\n",
+	}
+
+	for _, in := range inputs {
+		r := bufio.NewReader(strings.NewReader(in + "QUIT\r\n"))
+
+		_, err := readData(r, 1024)
+		if err != errBareLineEnding {
+			t.Fatalf("Expected bare line ending error for %q, got %v", in, err)
+		}
+
+		// everything up to the real terminator must be consumed
+		rest, _ := r.ReadString('\n')
+		if rest != "QUIT\r\n" {
+			t.Fatalf("Terminator not honoured for %q, next line %q", in, rest)
+		}
+	}
+}
+
+func TestReadDataLimit(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader(strings.Repeat("0123456789\r\n", 100) + ".\r\nQUIT\r\n"))
+
+	_, err := readData(r, 1000)
+	if err != errTooBig {
+		t.Fatal("Expected too big error, got", err)
+	}
+
+	rest, _ := r.ReadString('\n')
+	if rest != "QUIT\r\n" {
+		t.Fatalf("Oversized data not consumed, next line %q", rest)
+	}
+
+	r = bufio.NewReader(strings.NewReader(strings.Repeat("x", 100000) + "\r\n.\r\n"))
+
+	_, err = readData(r, 1000)
+	if err != errTooBig {
+		t.Fatal("Expected too big error for a long line, got", err)
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	msgs := make(chan *Msg, 1)
+	c := serve(t, &Server{Handler: func(msg *Msg) { msgs <- msg }})
+
+	io.WriteString(c.W, "EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nRCPT TO:<c@example.org>\r\nDATA\r\n")
+	c.W.Flush()
+	c.expect(t, 220, 250, 250, 250, 250, 354)
+
+	io.WriteString(c.W, "Subject: pipelined\r\n\r\nbody\r\n.\r\nQUIT\r\n")
+	c.W.Flush()
+	c.expect(t, 250, 221)
+
+	got := <-msgs
+	if len(got.To) != 2 || got.From != "a@example.com" {
+		t.Fatalf("Unexpected message: %+v", got)
+	}
+}
+
+func TestChunking(t *testing.T) {
+	msgs := make(chan *Msg, 1)
+	c := serve(t, &Server{Handler: func(msg *Msg) { msgs <- msg }})
+
+	io.WriteString(c.W, "EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\n"+
+		"BDAT 12\r\nSubject: x\r\nBDAT 8 LAST\r\n\r\nbody\r\n")
+	c.W.Flush()
+	c.expect(t, 220, 250, 250, 250, 250, 250)
+
+	got := <-msgs
+	if !strings.HasSuffix(string(got.Data), "\r\nSubject: x\r\n\r\nbody\r\n") {
+		t.Fatalf("Unexpected message: %+v", got)
+	}
+}
+
+func TestDNSBL(t *testing.T) {
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		switch host {
+		case "1.0.0.127.bl.example":
+			return []string{"127.0.0.2"}, nil
+		case "1.0.0.127.refused.example":
+			return []string{"127.255.255.254"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	defer func() { lookupHost = net.DefaultResolver.LookupHost }()
+
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	msgs := make(chan *Msg, 1)
+	c := serve(t, &Server{
+		Handler:       func(msg *Msg) { msgs <- msg },
+		RelayNetworks: []*net.IPNet{n},
+		LocalDomains:  []string{"example.org"},
+		DNSBL:         []string{"refused.example", "bl.example"},
+	})
+
+	c.PrintfLine("EHLO client\r\nMAIL FROM:<a@example.com>")
+	c.expect(t, 220, 250, 554)
+
+	c = serve(t, &Server{
+		Handler:       func(msg *Msg) { msgs <- msg },
+		RelayNetworks: []*net.IPNet{n},
+		LocalDomains:  []string{"example.org"},
+		DNSBL:         []string{"bl.example"},
+		DNSBLAction:   DNSBLTag,
+	})
+
+	c.PrintfLine("EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nDATA")
+	c.expect(t, 220, 250, 250, 250, 354)
+	c.PrintfLine("Subject: x\r\n\r\nbody\r\n.")
+	c.expect(t, 250)
+
+	if got := string((<-msgs).Data); !strings.Contains(got, "\r\nX-DNSBL: [127.0.0.1] listed on bl.example\r\nSubject: x") {
+		t.Fatalf("Message not tagged: %q", got)
+	}
+
+	if r := reverseIP(net.ParseIP("2001:db8::1")); r != "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2" {
+		t.Fatal("Unexpected reverse IPv6:", r)
+	}
+}
+
+func TestXClient(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, internal, _ := net.ParseCIDR("10.0.0.0/8")
+	msgs := make(chan *Msg, 1)
+	c := serve(t, &Server{
+		Handler:         func(msg *Msg) { msgs <- msg },
+		Hostname:        "mx.example.org",
+		RelayNetworks:   []*net.IPNet{internal},
+		LocalDomains:    []string{"example.org"},
+		XClientNetworks: []*net.IPNet{loopback},
+	})
+
+	// the real client may not relay
+	c.PrintfLine("EHLO frontend\r\nXCLIENT ADDR=10.1.2.3 HELO=client.example.com PROTO=ESMTP")
+	c.expect(t, 220, 250, 220)
+
+	c.PrintfLine("EHLO client.example.com\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.net>\r\nDATA")
+	c.expect(t, 250, 250, 250, 354)
+	c.PrintfLine("Subject: x\r\n\r\nbody\r\n.")
+	c.expect(t, 250)
+
+	if got := <-msgs; got.IP != "10.1.2.3" || !strings.HasPrefix(string(got.Data), "Received: from client.example.com ([10.1.2.3])") {
+		t.Fatalf("Unexpected message: %+v", got)
+	}
+
+	c = serve(t, &Server{Handler: func(msg *Msg) {}})
+	c.PrintfLine("XCLIENT ADDR=10.1.2.3")
+	c.expect(t, 220, 550)
+}
+
+func TestRules(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(`
+# sample rules
+reject sender=@spam\.example$ 550 5.7.1 No thanks
+defer ip=127.0.0.1 helo=^unknown$ 451 4.7.1 Try later
+reject rcpt=^closed@ 550 Mailbox closed
+tag header=subject:^\[ad\] X-Advert: yes
+reject header=subject:casino
+quarantine header=subject:^invoice Suspicious invoice
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bad := range []string{"drop sender=x", "reject 250 Fine", "defer sender=x 550 No", "tag sender=x", "reject sender=( 550 No"} {
+		if _, err := ParseRules(strings.NewReader(bad)); err == nil {
+			t.Fatal("Expected error for:", bad)
+		}
+	}
+
+	msgs := make(chan *Msg, 1)
+	srv := &Server{Handler: func(msg *Msg) { msgs <- msg }, Rules: &Rules{}}
+	srv.Rules.Set(rules)
+	c := serve(t, srv)
+
+	c.PrintfLine("EHLO client\r\nMAIL FROM:<a@spam.example>\r\nMAIL FROM:<a@example.com>")
+	c.expect(t, 220, 250, 550, 250)
+
+	c.PrintfLine("RCPT TO:<closed@example.org>\r\nRCPT TO:<open@example.org>\r\nDATA")
+	c.expect(t, 550, 250, 354)
+	c.PrintfLine("Subject: [ad] cheap\r\n\r\nbody\r\n.")
+	c.expect(t, 250)
+
+	if got := <-msgs; !strings.Contains(string(got.Data), "\r\nX-Advert: yes\r\nSubject: [ad] cheap\r\n") || got.Quarantine {
+		t.Fatalf("Missing tag: %q", got.Data)
+	}
+
+	c.PrintfLine("MAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nDATA")
+	c.expect(t, 250, 250, 354)
+	c.PrintfLine("Subject: Invoice 42\r\n\r\nbody\r\n.")
+	c.expect(t, 250)
+
+	if got := <-msgs; !got.Quarantine || got.QuarantineReason != "Suspicious invoice" {
+		t.Fatal("Message not quarantined:", got.QuarantineReason)
+	}
+
+	c.PrintfLine("MAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nDATA")
+	c.expect(t, 250, 250, 354)
+	c.PrintfLine("Subject: Casino\r\n\r\nbody\r\n.")
+	c.expect(t, 550)
+
+	c.PrintfLine("HELO unknown\r\nMAIL FROM:<a@example.com>")
+	c.expect(t, 250, 451)
+
+	// reloaded rules apply to the next command
+	srv.Rules.Set(nil)
+	c.PrintfLine("MAIL FROM:<a@example.com>")
+	c.expect(t, 250)
+}
+
+func TestPTR(t *testing.T) {
+	names := map[string][]string{}
+	lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		if n, ok := names[addr]; ok {
+			return n, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+	defer func() { lookupAddr = net.DefaultResolver.LookupAddr }()
+
+	fakeDNS(t, nil, map[string][]string{
+		"mail.example.com":     {"127.0.0.1"},
+		"spoofed.example.com":  {"192.0.2.1"},
+		"host.dsl.example.net": {"127.0.0.1"},
+	}, nil)
+
+	msgs := make(chan *Msg, 1)
+	srv := &Server{Handler: func(msg *Msg) { msgs <- msg }, PTR: PTRReject}
+
+	// no PTR record
+	c := serve(t, srv)
+	c.PrintfLine("EHLO client\r\nMAIL FROM:<a@example.com>")
+	c.expect(t, 220, 250, 550)
+
+	// not forward-confirmed
+	names["127.0.0.1"] = []string{"spoofed.example.com."}
+	c = serve(t, srv)
+	c.PrintfLine("EHLO client\r\nMAIL FROM:<a@example.com>")
+	c.expect(t, 220, 250, 550)
+
+	names["127.0.0.1"] = []string{"spoofed.example.com.", "Mail.Example.com."}
+	c = serve(t, srv)
+	c.PrintfLine("EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nDATA")
+	c.expect(t, 220, 250, 250, 250, 354)
+	c.PrintfLine("Subject: x\r\n\r\nbody\r\n.")
+	c.expect(t, 250)
+
+	if got := <-msgs; !strings.HasPrefix(string(got.Data), "Received: from client (mail.example.com [127.0.0.1])") {
+		t.Fatalf("Unexpected Received header: %q", got.Data)
+	}
+
+	// rules see the name
+	rules, _ := ParseRules(strings.NewReader(`reject ptr=\.dsl\. 550 5.7.1 Use your provider's relay`))
+	names["127.0.0.1"] = []string{"host.dsl.example.net."}
+	c = serve(t, &Server{Handler: srv.Handler, PTR: PTRCheck, Rules: &Rules{rules: rules}})
+	c.PrintfLine("EHLO client\r\nMAIL FROM:<a@example.com>")
+	c.expect(t, 220, 250, 550)
+}
+
+func TestRcptValidator(t *testing.T) {
+	checked := make(chan string, 3)
+	c := serve(t, &Server{
+		Handler:      func(msg *Msg) {},
+		LocalDomains: []string{"example.org"},
+		RcptValidator: func(addr string) string {
+			checked <- addr
+			switch addr {
+			case "gone@example.org":
+				return "550 5.1.1 No such user"
+			case "busy@example.org":
+				return "451 4.3.0 Try again later"
+			}
+			return ""
+		},
+	})
+
+	c.PrintfLine("EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<gone@example.org>\r\nRCPT TO:<busy@example.org>\r\nRCPT TO:<here@example.org>\r\nRCPT TO:<someone@example.net>")
+	c.expect(t, 220, 250, 250, 550, 451, 250, 250)
+
+	// remote recipients aren't ours to check
+	close(checked)
+	var got []string
+	for addr := range checked {
+		got = append(got, addr)
+	}
+	if len(got) != 3 || got[2] != "here@example.org" {
+		t.Fatal("Unexpected lookups:", got)
+	}
+}
+
+func TestGreylist(t *testing.T) {
+	seen := make(map[string]bool)
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	srv := &Server{
+		Handler: func(msg *Msg) {},
+		Greylist: func(ip, from, to string) bool {
+			pass := seen[ip+from+to]
+			seen[ip+from+to] = true
+			return pass
+		},
+	}
+
+	c := serve(t, srv)
+	c.PrintfLine("EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nRCPT TO:<b@example.org>")
+	c.expect(t, 220, 250, 250, 451, 250)
+
+	// relay clients aren't greylisted
+	srv.RelayNetworks = []*net.IPNet{loopback}
+	c = serve(t, srv)
+	c.PrintfLine("EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<c@example.org>")
+	c.expect(t, 220, 250, 250, 250)
+}
+
+func TestBody(t *testing.T) {
+	msgs := make(chan *Msg, 1)
+	c := serve(t, &Server{Handler: func(msg *Msg) { msgs <- msg }})
+
+	c.PrintfLine("EHLO client\r\nMAIL FROM:<a@example.com> BODY=BINARYMIME\r\nMAIL FROM:<a@example.com> BODY=8bitmime")
+	c.expect(t, 220, 250, 501, 250)
+	c.PrintfLine("RCPT TO:<b@example.org>\r\nDATA")
+	c.expect(t, 250, 354)
+	c.PrintfLine("Subject: x\r\n\r\nh\xc3\xa9llo\r\n.")
+	c.expect(t, 250)
+
+	if got := <-msgs; got.Body != "8BITMIME" {
+		t.Fatal("Unexpected body type:", got.Body)
+	}
+}
+
+func TestSessionLog(t *testing.T) {
+	var buf syncBuffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	msgs := make(chan *Msg, 1)
+	c := serve(t, &Server{Handler: func(msg *Msg) { msgs <- msg }})
+	c.PrintfLine("EHLO client\r\nFOO\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nDATA")
+	c.expect(t, 220, 250, 500, 250, 250, 354)
+	c.PrintfLine("Subject: x\r\n\r\nbody\r\n.")
+	c.expect(t, 250)
+	got := <-msgs
+
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+
+		// sessions of earlier tests may still be winding down
+		if e["session"] == got.Session {
+			entries = append(entries, e)
+		}
+	}
+
+	expected := []struct{ msg, phase string }{{"Session started", "connect"}, {"Unknown command", "helo"}, {"Accepted message", "data"}}
+	if len(entries) != len(expected) {
+		t.Fatalf("Unexpected log entries: %v", entries)
+	}
+
+	for i, e := range entries {
+		if e["msg"] != expected[i].msg || e["phase"] != expected[i].phase || e["ip"] != "127.0.0.1" {
+			t.Fatalf("Unexpected log entry: %v", e)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for the server and the test to share
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestMetrics(t *testing.T) {
+	m := expvar.NewMap("inbound-test")
+	msgs := make(chan *Msg, 1)
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	c := serve(t, &Server{Handler: func(msg *Msg) { msgs <- msg }, LocalDomains: []string{"example.org"}, RelayNetworks: []*net.IPNet{n}, Metrics: m})
+	c.PrintfLine("EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.net>\r\nRCPT TO:<b@example.org>\r\nDATA")
+	c.expect(t, 220, 250, 250, 550, 250, 354)
+	c.PrintfLine("Subject: x\r\n\r\nbody\r\n.")
+	c.expect(t, 250)
+	<-msgs
+
+	expected := map[string]string{"connections": "1", "sessions": "1", "messages": "1", "bytes": "20", "rejects.relay": "1"}
+	for name, value := range expected {
+		if got := m.Get(name); got == nil || got.String() != value {
+			t.Fatalf("Expected %s of %s, got %v", name, value, got)
+		}
+	}
+}
+
+func TestRequireFQDNHelo(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"mail.example.com":   true,
+		"mail.example.com.":  true,
+		"xn--bcher-kva.de":   true,
+		"localhost":          false,
+		"192.0.2.1":          false,
+		"[192.0.2.1]":        false,
+		"[IPv6:2001:db8::1]": false,
+		"-bad.example.com":   false,
+	} {
+		if isFQDN(name) != expected {
+			t.Fatalf("Expected %v for %s", expected, name)
+		}
+	}
+
+	srv := &Server{Handler: func(msg *Msg) {}, RequireFQDNHelo: true}
+	c := serve(t, srv)
+	c.PrintfLine("EHLO localhost\r\nHELO [127.0.0.1]\r\nMAIL FROM:<a@example.com>\r\nEHLO mail.example.com")
+	c.expect(t, 220, 504, 504, 503, 250)
+
+	// relay clients are ours
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	srv = &Server{Handler: func(msg *Msg) {}, RequireFQDNHelo: true, RelayNetworks: []*net.IPNet{loopback}}
+	c = serve(t, srv)
+	c.PrintfLine("EHLO localhost")
+	c.expect(t, 220, 250)
+}
+
+func TestNoopHelp(t *testing.T) {
+	c := serve(t, &Server{Handler: func(msg *Msg) {}})
+	c.PrintfLine("NOOP\r\nNOOP hello\r\nHELP\r\nTURN\r\nXYZZY")
+	c.expect(t, 220, 250, 250, 214, 502, 500)
+}
+
+func TestVRFY(t *testing.T) {
+	c := serve(t, &Server{Handler: func(msg *Msg) {}})
+	c.PrintfLine("VRFY postmaster\r\nEXPN staff\r\nVRFY")
+	c.expect(t, 220, 252, 252, 501)
+
+	c = serve(t, &Server{Handler: func(msg *Msg) {}, VRFY: VRFYDisabled})
+	c.PrintfLine("VRFY postmaster")
+	c.expect(t, 220, 502)
+
+	c = serve(t, &Server{
+		Handler: func(msg *Msg) {},
+		VRFY:    VRFYLookup,
+		Mailbox: func(addr string) bool { return addr == "a@example.org" },
+	})
+	c.PrintfLine("VRFY <a@example.org>\r\nVRFY b@example.org\r\nEXPN a@example.org")
+	c.expect(t, 220, 250, 550, 250)
+}
+
+func TestErrorBudget(t *testing.T) {
+	c := serve(t, &Server{Handler: func(msg *Msg) {}, MaxErrors: 3})
+
+	c.PrintfLine("EHLO client\r\nFOO\r\nRCPT TO:<b@example.org>\r\nRSET\r\nBAR\r\nRSET")
+	c.expect(t, 220, 250, 500, 503, 250, 500, 421)
+
+	if _, err := c.ReadLine(); err == nil {
+		t.Fatal("Connection should be closed")
+	}
+}
+
+func TestCommandRate(t *testing.T) {
+	c := serve(t, &Server{Handler: func(msg *Msg) {}, CommandRate: 20})
+
+	start := time.Now()
+	c.PrintfLine("EHLO client\r\nRSET\r\nRSET\r\nRSET\r\nRSET")
+	c.expect(t, 220, 250, 250, 250, 250, 250)
+
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatal("Commands not throttled, took", elapsed)
+	}
+}
+
+func TestGreetingDelay(t *testing.T) {
+	srv := &Server{Handler: func(msg *Msg) {}, GreetingDelay: 100 * time.Millisecond}
+
+	c := serve(t, srv)
+	c.PrintfLine("EHLO client")
+	c.expect(t, 554)
+
+	c = serve(t, srv)
+	c.expect(t, 220)
+	c.PrintfLine("EHLO client")
+	c.expect(t, 250)
+}
+
+func TestFilter(t *testing.T) {
+	msgs := make(chan *Msg, 1)
+	c := serve(t, &Server{
+		Handler: func(msg *Msg) { msgs <- msg },
+		Filter: func(msg *Msg) string {
+			if strings.Contains(string(msg.Data), "viagra") {
+				return "550 Message looks like spam"
+			}
+
+			msg.Data = append([]byte("X-Filtered: yes\r\n"), msg.Data...)
+			return ""
+		},
+	})
+
+	c.PrintfLine("EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nDATA")
+	c.expect(t, 220, 250, 250, 250, 354)
+	c.PrintfLine("Subject: viagra\r\n\r\nbody\r\n.")
+	c.expect(t, 550)
+
+	c.PrintfLine("MAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nDATA")
+	c.expect(t, 250, 250, 354)
+	c.PrintfLine("Subject: hello\r\n\r\nbody\r\n.")
+	c.expect(t, 250)
+
+	if got := <-msgs; !strings.HasPrefix(string(got.Data), "X-Filtered: yes\r\nReceived: ") || got.IP != "127.0.0.1" {
+		t.Fatalf("Unexpected message: %+v", got)
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	var full atomic.Bool
+	full.Store(true)
+	c := serve(t, &Server{
+		Submit: func(msg *Msg) string {
+			if full.Load() {
+				return "452 4.3.1 Insufficient system storage"
+			}
+			return ""
+		},
+	})
+
+	c.PrintfLine("EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nDATA")
+	c.expect(t, 220, 250, 250, 250, 354)
+	c.PrintfLine("Subject: hello\r\n\r\nbody\r\n.")
+	c.expect(t, 452)
+
+	full.Store(false)
+	c.PrintfLine("MAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nDATA")
+	c.expect(t, 250, 250, 354)
+	c.PrintfLine("Subject: hello\r\n\r\nbody\r\n.")
+	c.expect(t, 250)
+}
+
+func TestTranscript(t *testing.T) {
+	dir := t.TempDir()
+	srv := &Server{
+		Handler:       func(msg *Msg) {},
+		Hostname:      "mx.example.org",
+		Banner:        "ESMTP Scalemail",
+		TranscriptDir: dir,
+		Auth:          AuthFunc(func(username, password string) bool { return true }),
+	}
+	c := serve(t, srv)
+
+	c.PrintfLine("EHLO client\r\nAUTH PLAIN %s\r\nAUTH LOGIN", base64.StdEncoding.EncodeToString([]byte("\x00user\x00hunter2")))
+	c.expect(t, 220, 250, 235, 503)
+	c.PrintfLine("MAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nDATA")
+	c.expect(t, 250, 250, 354)
+	c.PrintfLine("Subject: secret plans\r\n\r\nbody\r\n.\r\nQUIT")
+	c.expect(t, 250, 221)
+
+	c.Close()
+	srv.Shutdown(context.Background())
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*-127.0.0.1.log"))
+	if len(files) != 1 {
+		t.Fatal("Expected one transcript, got", files)
+	}
+
+	b, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := string(b)
+	for _, s := range []string{"S: 220 mx.example.org ESMTP Scalemail\n", "C: EHLO client\n", "S: 250-mx.example.org Hello client\n", "C: AUTH PLAIN ***\n", "C: <31 bytes of message data>\n", "S: 221 For the king\n", "Connection closed"} {
+		if !strings.Contains(got, s) {
+			t.Fatalf("Transcript is missing %q:\n%s", s, got)
+		}
+	}
+
+	if strings.Contains(got, "secret plans") || strings.Contains(got, base64.StdEncoding.EncodeToString([]byte("\x00user\x00hunter2"))) {
+		t.Fatal("Transcript leaks data or credentials:\n" + got)
+	}
+}
+
+func TestMaxRcpts(t *testing.T) {
+	msgs := make(chan *Msg, 1)
+	c := serve(t, &Server{Handler: func(msg *Msg) { msgs <- msg }, MaxRcpts: 2})
+
+	io.WriteString(c.W, "EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nRCPT TO:<c@example.org>\r\n"+
+		"RCPT TO:<d@example.org>\r\nDATA\r\nSubject: x\r\n\r\nbody\r\n.\r\n")
+	c.W.Flush()
+	c.expect(t, 220, 250, 250, 250, 250, 452, 354, 250)
+
+	if got := <-msgs; len(got.To) != 2 {
+		t.Fatalf("Unexpected recipients: %v", got.To)
+	}
+}
+
+func TestNullSender(t *testing.T) {
+	msgs := make(chan *Msg, 1)
+	c := serve(t, &Server{Handler: func(msg *Msg) { msgs <- msg }})
+
+	io.WriteString(c.W, "EHLO client\r\nMAIL FROM:<>\r\nRCPT TO:<>\r\nRCPT TO:<b@example.org>\r\nDATA\r\n")
+	c.W.Flush()
+	c.expect(t, 220, 250, 250, 501, 250, 354)
+
+	io.WriteString(c.W, "Subject: bounce\r\n\r\nbody\r\n.\r\n")
+	c.W.Flush()
+	c.expect(t, 250)
+
+	got := <-msgs
+	if got.From != "" || len(got.To) != 1 {
+		t.Fatalf("Unexpected message: %+v", got)
+	}
+}
+
+func TestReceived(t *testing.T) {
+	msgs := make(chan *Msg, 1)
+	c := serve(t, &Server{Handler: func(msg *Msg) { msgs <- msg }, Hostname: "mx.example.org"})
+
+	io.WriteString(c.W, "EHLO client.example.com\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nDATA\r\n")
+	c.W.Flush()
+	c.expect(t, 220, 250, 250, 250, 354)
+
+	io.WriteString(c.W, "Subject: traced\r\n\r\nbody\r\n.\r\n")
+	c.W.Flush()
+	c.expect(t, 250)
+
+	got := string((<-msgs).Data)
+	expected := "Received: from client.example.com ([127.0.0.1])\r\n\tby mx.example.org with ESMTP\r\n\tfor <b@example.org>; "
+	if !strings.HasPrefix(got, expected) || !strings.HasSuffix(got, "\r\nSubject: traced\r\n\r\nbody\r\n") {
+		t.Fatalf("Unexpected message: %q", got)
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	paths := map[string]string{
+		"FROM:<a@example.com>":                           "a@example.com",
+		"from: <a@example.com> BODY=8BITMIME":            "a@example.com",
+		"FROM:<>":                                        "",
+		`FROM:<"john doe>"@example.com>`:                 `"john doe>"@example.com`,
+		`FROM:<"a\"b"@example.com>`:                      `"a\"b"@example.com`,
+		"FROM:<@relay.example,@b.example:a@[192.0.2.1]>": "a@[192.0.2.1]",
+		"FROM:<Postmaster>":                              "Postmaster",
+	}
+
+	for args, expected := range paths {
+		addr, _, err := parsePath(args, "FROM:")
+		if err != nil || addr != expected {
+			t.Fatalf("Unexpected address %q from %q: %v", addr, args, err)
+		}
+	}
+
+	for _, args := range []string{"FROM:a@example.com", "FROM:<a@example.com", "FROM:<a b@example.com>", "FROM:<.a@example.com>",
+		`FROM:<"a@example.com>`, "FROM:<a@-example.com>", "FROM:<a@example..com>", "FROM:<a@example.com> =1", "FROM:<a@example.com> SIZE=",
+		"FROM:<a@example.com> SIZE=1=2", "TO:<a@example.com>", "FROM:<@relay.example a@example.com>", "FROM:<" + strings.Repeat("a", 250) + "@example.com>"} {
+		if _, _, err := parsePath(args, "FROM:"); err == nil {
+			t.Fatalf("Expected an error for %q", args)
+		}
+	}
+
+	_, params, err := parsePath("FROM:<a@example.com> SIZE=1000 ret=hdrs ENVID=QQ+2B314 SMTPUTF8", "FROM:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if params["SIZE"] != "1000" || params["RET"] != "hdrs" {
+		t.Fatalf("Unexpected params: %v", params)
+	}
+
+	if _, ok := params["SMTPUTF8"]; !ok {
+		t.Fatal("Keyword parameter missing")
+	}
+
+	if id := decodeXtext(params["ENVID"]); id != "QQ+314" {
+		t.Fatal("Unexpected ENVID:", id)
+	}
+
+	if !validNotify("FAILURE,DELAY") || validNotify("NEVER,DELAY") {
+		t.Fatal("NOTIFY validation is wrong")
+	}
+}
+
+func TestSequencing(t *testing.T) {
+	c := serve(t, &Server{Handler: func(msg *Msg) { t.Error("Out of sequence message was accepted") }})
+
+	steps := []struct {
+		cmd  string
+		code int
+	}{
+		{"MAIL FROM:<a@example.com>", 503},
+		{"HELO client", 250},
+		{"RCPT TO:<b@example.org>", 503},
+		{"DATA", 503},
+		{"MAIL FROM:<a@example.com>", 250},
+		{"MAIL FROM:<a@example.com>", 503},
+		{"DATA", 503},
+		{"RSET", 250},
+		{"RCPT TO:<b@example.org>", 503},
+	}
+
+	c.expect(t, 220)
+	for _, step := range steps {
+		c.PrintfLine("%s", step.cmd)
+
+		if _, _, err := c.ReadResponse(step.code); err != nil {
+			t.Fatalf("%v: %v", step.cmd, err)
+		}
+	}
+}
+
+func TestTransactionReset(t *testing.T) {
+	msgs := make(chan *Msg, 3)
+	c := serve(t, &Server{Handler: func(msg *Msg) { msgs <- msg }})
+
+	c.PrintfLine("EHLO client\r\nMAIL FROM:<a@example.com> RET=HDRS ENVID=one\r\nRCPT TO:<b@example.org> NOTIFY=NEVER\r\nDATA")
+	c.expect(t, 220, 250, 250, 250, 354)
+	c.PrintfLine("Subject: first\r\n\r\nbody\r\n.")
+	c.expect(t, 250)
+
+	// abandoned after RSET
+	c.PrintfLine("MAIL FROM:<x@example.com>\r\nRCPT TO:<y@example.org>\r\nRSET\r\nRCPT TO:<y@example.org>")
+	c.expect(t, 250, 250, 250, 503)
+
+	// abandoned by a new EHLO
+	c.PrintfLine("MAIL FROM:<x@example.com>\r\nRCPT TO:<z@example.org>\r\nEHLO client\r\nDATA")
+	c.expect(t, 250, 250, 250, 503)
+
+	c.PrintfLine("MAIL FROM:<c@example.com>\r\nRCPT TO:<d@example.org>\r\nBDAT 23 LAST")
+	c.W.WriteString("Subject: second\r\n\r\nhi\r\n")
+	c.W.Flush()
+	c.expect(t, 250, 250, 250)
+
+	c.PrintfLine("MAIL FROM:<e@example.com>\r\nRCPT TO:<f@example.org>\r\nDATA")
+	c.expect(t, 250, 250, 354)
+	c.PrintfLine("Subject: third\r\n\r\nbody\r\n.")
+	c.expect(t, 250)
+
+	first, second, third := <-msgs, <-msgs, <-msgs
+	if first.From != "a@example.com" || len(first.To) != 1 || first.Ret != "HDRS" || first.EnvID != "one" || first.Notify["b@example.org"] != "NEVER" {
+		t.Fatalf("Unexpected first message: %+v", first)
+	}
+
+	for _, m := range []*Msg{second, third} {
+		if len(m.To) != 1 || m.Ret != "" || m.EnvID != "" || m.Notify != nil {
+			t.Fatalf("Envelope leaked into the next transaction: %+v", m)
+		}
+	}
+
+	if second.From != "c@example.com" || second.To[0] != "d@example.org" || !strings.Contains(string(second.Data), "\r\nSubject: second\r\n") {
+		t.Fatalf("Unexpected second message: %+v", second)
+	}
+
+	if third.From != "e@example.com" || third.To[0] != "f@example.org" || strings.Contains(string(third.Data), "second") {
+		t.Fatalf("Unexpected third message: %+v", third)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Handler: func(msg *Msg) {}}
+	done := make(chan error)
+	go func() { done <- srv.Serve(l) }()
+
+	conn, err := textproto.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Error connecting:", err)
+	}
+	defer conn.Close()
+
+	c := &client{Conn: conn}
+	c.expect(t, 220)
+
+	// a transaction receiving data survives the shutdown
+	c.PrintfLine("HELO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nDATA")
+	c.expect(t, 250, 250, 250, 354)
+
+	shutdown := make(chan error)
+	go func() { shutdown <- srv.Shutdown(context.Background()) }()
+
+	if err = <-done; err != ErrServerClosed {
+		t.Fatal("Expected ErrServerClosed, got", err)
+	}
+
+	c.PrintfLine("Subject: last one\r\n\r\nbody\r\n.")
+	c.expect(t, 250, 421)
+
+	if err = <-shutdown; err != nil {
+		t.Fatal("Error shutting down:", err)
+	}
+
+	if _, err = c.ReadLine(); err == nil {
+		t.Fatal("Connection should be closed")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	srv := &Server{Handler: func(msg *Msg) {}}
+	c := serve(t, srv)
+
+	c.expect(t, 220)
+	c.PrintfLine("HELO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nDATA")
+	c.expect(t, 250, 250, 250, 354)
+
+	// client never finishes DATA
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal("Expected deadline exceeded, got", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	c := serve(t, &Server{Handler: func(msg *Msg) {}, CommandTimeout: 50 * time.Millisecond})
+
+	c.expect(t, 220)
+	c.PrintfLine("HELO client")
+	c.expect(t, 250)
+
+	// say nothing
+	c.expect(t, 421)
+
+	if _, err := c.ReadLine(); err == nil {
+		t.Fatal("Connection should be closed")
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	srv := &Server{Handler: func(msg *Msg) {}, MaxConnectionsPerIP: 1}
+	c := serve(t, srv)
+	c.expect(t, 220)
+
+	conn, err := textproto.Dial("tcp", c.addr)
+	if err != nil {
+		t.Fatal("Error connecting:", err)
+	}
+	defer conn.Close()
+
+	c2 := &client{Conn: conn}
+	c2.expect(t, 421)
+}
+
+func TestRelayNetworks(t *testing.T) {
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	c := serve(t, &Server{Handler: func(msg *Msg) {}, RelayNetworks: []*net.IPNet{n}})
+
+	c.PrintfLine("HELO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>")
+	c.expect(t, 220, 250, 250, 550)
+}
+
+func TestAuthRelay(t *testing.T) {
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	msgs := make(chan *Msg, 1)
+	c := serve(t, &Server{
+		Handler:       func(msg *Msg) { msgs <- msg },
+		RelayNetworks: []*net.IPNet{n},
+		LocalDomains:  []string{"example.net"},
+		Auth: AuthFunc(func(username, password string) bool {
+			return username == "user" && password == "secret"
+		}),
+	})
+
+	// anonymous: local domains only
+	c.PrintfLine("EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nRCPT TO:<b@EXAMPLE.net>\r\nRSET")
+	c.expect(t, 220, 250, 250, 550, 250, 250)
+
+	c.PrintfLine("AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte("\x00user\x00wrong")))
+	c.expect(t, 535)
+
+	c.PrintfLine("AUTH LOGIN")
+	c.expect(t, 334)
+	c.PrintfLine("%s", base64.StdEncoding.EncodeToString([]byte("user")))
+	c.expect(t, 334)
+	c.PrintfLine("%s", base64.StdEncoding.EncodeToString([]byte("secret")))
+	c.expect(t, 235)
+
+	c.PrintfLine("MAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nDATA")
+	c.expect(t, 250, 250, 354)
+	c.PrintfLine("Subject: relayed\r\n\r\nbody\r\n.")
+	c.expect(t, 250)
+
+	if msg := <-msgs; msg.User != "user" {
+		t.Fatal("Authenticated user not passed to handler:", msg.User)
+	}
+}
+
+type authResult struct{ err error }
+
+func (a authResult) Authenticate(username, password string) error { return a.err }
+
+func TestAuthUnavailable(t *testing.T) {
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	c := serve(t, &Server{
+		Handler:       func(msg *Msg) {},
+		RelayNetworks: []*net.IPNet{n},
+		Auth:          authResult{errors.New("Backend down")},
+	})
+
+	c.PrintfLine("EHLO client\r\nAUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret")))
+	c.expect(t, 220, 250, 454)
+
+	// still anonymous
+	c.PrintfLine("MAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>")
+	c.expect(t, 250, 550)
+}
+
+func TestUserLimits(t *testing.T) {
+	limits := &UserLimits{Messages: 2, Recipients: 3}
+	c := serve(t, &Server{
+		Handler:    func(msg *Msg) {},
+		Auth:       AuthFunc(func(username, password string) bool { return true }),
+		UserLimits: limits,
+	})
+
+	c.PrintfLine("EHLO client\r\nAUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret")))
+	c.expect(t, 220, 250, 235)
+
+	c.PrintfLine("MAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nRCPT TO:<c@example.org>\r\nDATA")
+	c.expect(t, 250, 250, 250, 354)
+	c.PrintfLine("Subject: one\r\n\r\nbody\r\n.")
+	c.expect(t, 250)
+
+	// one recipient left in the window
+	c.PrintfLine("MAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nRCPT TO:<c@example.org>\r\nDATA")
+	c.expect(t, 250, 250, 452, 354)
+	c.PrintfLine("Subject: two\r\n\r\nbody\r\n.")
+	c.expect(t, 250)
+
+	if u := limits.Usage().(map[string]UserUsage)["user"]; u.Messages != 2 || u.Recipients != 3 {
+		t.Fatal("Unexpected usage:", u)
+	}
+
+	c.PrintfLine("MAIL FROM:<a@example.com>")
+	c.expect(t, 421)
+}
+
+func TestUserLimitsPruned(t *testing.T) {
+	limits := &UserLimits{Window: 10 * time.Millisecond}
+
+	for i := 0; i < 3; i++ {
+		limits.record("user", 1)
+	}
+	time.Sleep(20 * time.Millisecond)
+	limits.record("user", 1)
+
+	if n := len(limits.users["user"]); n != 1 {
+		t.Fatal("Submissions outside the window kept:", n)
+	}
+}
+
+func TestFutureRelease(t *testing.T) {
+	msgs := make(chan *Msg, 1)
+	c := serve(t, &Server{
+		Handler: func(msg *Msg) { msgs <- msg },
+		MaxHold: 24 * time.Hour,
+	})
+
+	c.PrintfLine("EHLO client")
+	c.expect(t, 220)
+	if _, msg, err := c.ReadResponse(250); err != nil || !strings.Contains(msg, "FUTURERELEASE 86400 ") {
+		t.Fatal("FUTURERELEASE not advertised:", msg, err)
+	}
+
+	c.PrintfLine("MAIL FROM:<a@example.com> HOLDFOR=90000")
+	c.expect(t, 501)
+	c.PrintfLine("MAIL FROM:<a@example.com> HOLDFOR=60 HOLDUNTIL=%s", time.Now().Format(time.RFC3339))
+	c.expect(t, 501)
+	c.PrintfLine("MAIL FROM:<a@example.com> HOLDUNTIL=tomorrow")
+	c.expect(t, 501)
+
+	c.PrintfLine("MAIL FROM:<a@example.com> HOLDFOR=3600\r\nRCPT TO:<b@example.org>\r\nDATA")
+	c.expect(t, 250, 250, 354)
+	c.PrintfLine("Subject: later\r\n\r\nbody\r\n.")
+	c.expect(t, 250)
+
+	msg := <-msgs
+	if d := time.Until(msg.HoldUntil); d < 59*time.Minute || d > time.Hour {
+		t.Fatal("Unexpected release time:", msg.HoldUntil)
+	}
+}
+
+func TestProxyHeader(t *testing.T) {
+	v2 := append([]byte(nil), proxyV2Sig...)
+	v2 = append(v2, 0x21, 0x11, 0, 12, 192, 0, 2, 7, 10, 0, 0, 1, 0x30, 0x39, 0, 25)
+
+	headers := map[string]string{
+		"PROXY TCP4 192.0.2.7 10.0.0.1 12345 25\r\n":      "192.0.2.7:12345",
+		"PROXY TCP6 2001:db8::7 2001:db8::1 12345 25\r\n": "[2001:db8::7]:12345",
+		string(v2): "192.0.2.7:12345",
+	}
+
+	for header, expected := range headers {
+		r := bufio.NewReader(strings.NewReader(header + "EHLO client\r\n"))
+
+		addr, err := readProxyHeader(r)
+		if err != nil || addr.String() != expected {
+			t.Fatalf("Unexpected address %v for %q: %v", addr, header, err)
+		}
+
+		if line, _ := r.ReadString('\n'); line != "EHLO client\r\n" {
+			t.Fatalf("Header not fully consumed: %q", line)
+		}
+	}
+
+	if _, err := readProxyHeader(bufio.NewReader(strings.NewReader("EHLO client\r\n"))); err == nil {
+		t.Fatal("Missing header should be an error")
+	}
+}
+
+func TestMalformedCommands(t *testing.T) {
+	c := serve(t, &Server{Handler: func(msg *Msg) {}})
+
+	io.WriteString(c.W, "\r\nNO\r\nEHLO\r\n  ehlo\t client  \r\nMAIL\r\nMAIL FROM:\r\nMAILFROM:<a@example.com>\r\n"+
+		"mail from:<a@example.com>\r\nRCPT <b@example.org>\r\nDATA now\r\nRSET\r\n")
+	c.W.Flush()
+	c.expect(t, 220, 500, 500, 501, 250, 501, 501, 500, 250, 501, 501, 250)
+}
+
+func FuzzParseCommand(f *testing.F) {
+	for _, seed := range []string{"", "NO", "EHLO client", " \tmail  FROM:<a@example.com> SIZE=10 ", "BDAT 10 LAST", "\t", "EHLO \v", "HELO \u00a0\u2003"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, line string) {
+		cmd, args := parseCommand(line)
+
+		if strings.ContainsAny(cmd, " \t") || cmd != strings.ToUpper(cmd) {
+			t.Fatalf("Bad verb %q from %q", cmd, line)
+		}
+
+		if cmd == "" && args != "" {
+			t.Fatalf("Arguments %q without a verb from %q", args, line)
+		}
+
+		if strings.HasPrefix(args, " ") || strings.HasPrefix(args, "\t") {
+			t.Fatalf("Arguments %q not trimmed from %q", args, line)
+		}
+
+		// the greeting handlers take the first field of what checkSyntax lets through
+		if reply := checkSyntax(cmd, args); reply == "" && (cmd == "EHLO" || cmd == "HELO") && len(strings.Fields(args)) == 0 {
+			t.Fatalf("%s without a hostname accepted from %q", cmd, line)
+		}
+		parsePath(args, "FROM:")
+	})
+}
+
+// client is a test connection to a server listening on addr
+type client struct {
+	*textproto.Conn
+	addr string
+}
+
+// serve starts srv on a loopback port and connects a client to it
+func serve(t *testing.T, srv *Server) *client {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.Serve(l)
+
+	c, err := textproto.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Error connecting:", err)
+	}
+
+	t.Cleanup(func() {
+		c.Close()
+		srv.Close()
+	})
+
+	return &client{c, l.Addr().String()}
+}
+
+// expect reads one reply per code and fails unless each has the expected code
+func (c *client) expect(t *testing.T, codes ...int) {
+	t.Helper()
+
+	for _, code := range codes {
+		if _, _, err := c.ReadResponse(code); err != nil {
+			t.Fatal("Unexpected reply:", err)
+		}
+	}
+}
+
+func TestQuitCloses(t *testing.T) {
+	c := serve(t, &Server{Handler: func(msg *Msg) {}})
+
+	c.PrintfLine("QUIT")
+	c.expect(t, 220, 221)
+
+	if _, err := c.ReadLine(); err != io.EOF {
+		t.Fatal("Connection still open after QUIT:", err)
+	}
+}
+
+func TestInvalidChunkSize(t *testing.T) {
+	c := serve(t, &Server{Handler: func(msg *Msg) {}})
+
+	c.PrintfLine("EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nBDAT x LAST")
+	c.expect(t, 220, 250, 250, 250, 501)
+}
+
+func TestDSNParameters(t *testing.T) {
+	msgs := make(chan *Msg, 1)
+	c := serve(t, &Server{Handler: func(msg *Msg) { msgs <- msg }})
+
+	// a decoded CR LF would inject lines into the notices sent about the message
+	c.PrintfLine("EHLO client\r\nMAIL FROM:<a@example.com> ENVID=a+0D+0Ab")
+	c.expect(t, 220, 250, 501)
+
+	c.PrintfLine("MAIL FROM:<a@example.com> ENVID=%s", strings.Repeat("x", 101))
+	c.expect(t, 501)
+
+	c.PrintfLine("MAIL FROM:<a@example.com> ENVID=QQ+2Bone\r\nRCPT TO:<b@example.org> ORCPT=rfc822;b+0A@example.org")
+	c.expect(t, 250, 501)
+
+	c.PrintfLine("RCPT TO:<b@example.org> ORCPT=rfc822;alias+2Bb@example.org\r\nDATA")
+	c.expect(t, 250, 354)
+	c.PrintfLine("Subject: x\r\n\r\nbody\r\n.")
+	c.expect(t, 250)
+
+	got := <-msgs
+	if got.EnvID != "QQ+one" || got.ORcpt["b@example.org"] != "rfc822;alias+b@example.org" {
+		t.Fatalf("Unexpected DSN parameters: %q %q", got.EnvID, got.ORcpt)
+	}
+}
+
+func TestMalformedLines(t *testing.T) {
+	c := serve(t, &Server{Handler: func(msg *Msg) {}})
+	c.expect(t, 220)
+
+	// whitespace parseCommand leaves in the arguments is no hostname
+	c.PrintfLine("EHLO \v")
+	c.expect(t, 501)
+	c.PrintfLine("HELO  ")
+	c.expect(t, 501)
+
+	// dropped rather than buffered, the session goes on
+	c.PrintfLine("NOOP %s", strings.Repeat("x", 600))
+	c.expect(t, 500)
+	c.PrintfLine("EHLO client")
+	c.expect(t, 250)
+}
@@ -0,0 +1,424 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DKIM verification results, as named in Authentication-Results (RFC 8601)
+const (
+	DKIMPass      = "pass"
+	DKIMFail      = "fail"
+	DKIMNeutral   = "neutral"
+	DKIMTempError = "temperror"
+	DKIMPermError = "permerror"
+)
+
+// DKIMResult is the outcome of verifying one DKIM-Signature of a message
+type DKIMResult struct {
+	Domain   string // d= of the signature
+	Selector string // s= of the signature
+	Result   string // one of the DKIM* constants
+	Reason   string // why the signature didn't pass
+}
+
+// signatures beyond this many are ignored, verifying each costs a DNS lookup
+const maxDKIMSignatures = 5
+
+// how long the key lookups of one message may take together
+const dkimTimeout = 10 * time.Second
+
+// lookupTXT fetches DKIM keys, replaced in tests
+var lookupTXT = net.DefaultResolver.LookupTXT
+
+// the b= tag value, blanked out when the signature header itself is hashed
+var sigValueRegex = regexp.MustCompile(`([;:][ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+
+type dkimError struct {
+	result string
+	reason string
+}
+
+func (e *dkimError) Error() string {
+	return e.reason
+}
+
+func permError(reason string) error {
+	return &dkimError{DKIMPermError, reason}
+}
+
+// headerField is a raw header field including folding and the final CRLF
+type headerField struct {
+	name string // lower case
+	raw  string
+}
+
+// verifyDKIM checks every DKIM-Signature of a message (RFC 6376)
+func verifyDKIM(data []byte) []DKIMResult {
+	fields, body := splitMessage(data)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dkimTimeout)
+	defer cancel()
+
+	var results []DKIMResult
+	for _, f := range fields {
+		if f.name != "dkim-signature" {
+			continue
+		}
+
+		if len(results) == maxDKIMSignatures {
+			break
+		}
+
+		res := DKIMResult{Result: DKIMPass}
+		tags, err := parseTags(f.raw[strings.IndexByte(f.raw, ':')+1:])
+		if err == nil {
+			res.Domain, res.Selector = tags["d"], tags["s"]
+			err = verifySignature(ctx, f, tags, fields, body)
+		}
+
+		if e, ok := err.(*dkimError); ok {
+			res.Result, res.Reason = e.result, e.reason
+		} else if err != nil {
+			res.Result, res.Reason = DKIMPermError, err.Error()
+		}
+
+		results = append(results, res)
+	}
+
+	return results
+}
+
+func verifySignature(ctx context.Context, sig headerField, tags map[string]string, fields []headerField, body []byte) error {
+	for _, t := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[t]; !ok {
+			return permError("missing " + t + "= tag")
+		}
+	}
+
+	if tags["v"] != "1" {
+		return permError("unsupported version")
+	}
+
+	var newHash func() hash.Hash
+	var cryptoHash crypto.Hash
+	var keyType string
+	switch tags["a"] {
+	case "rsa-sha256":
+		newHash, cryptoHash, keyType = sha256.New, crypto.SHA256, "rsa"
+	case "rsa-sha1":
+		// SHA-1 signatures are no longer to be trusted (RFC 8301 section 3.1)
+		return permError("rsa-sha1 is not accepted")
+	case "ed25519-sha256":
+		newHash, cryptoHash, keyType = sha256.New, crypto.SHA256, "ed25519"
+	default:
+		return permError("unsupported algorithm " + tags["a"])
+	}
+
+	headerCanon, bodyCanon := "simple", "simple"
+	if c, ok := tags["c"]; ok {
+		parts := strings.SplitN(c, "/", 2)
+		headerCanon = parts[0]
+		if len(parts) == 2 {
+			bodyCanon = parts[1]
+		}
+	}
+	if !validCanon(headerCanon) || !validCanon(bodyCanon) {
+		return permError("unsupported canonicalization " + tags["c"])
+	}
+
+	signed := strings.Split(tags["h"], ":")
+	hasFrom := false
+	for i := range signed {
+		signed[i] = strings.ToLower(strings.TrimSpace(signed[i]))
+		hasFrom = hasFrom || signed[i] == "from"
+	}
+	if !hasFrom {
+		return permError("From header not signed")
+	}
+
+	if x, ok := tags["x"]; ok {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return permError("invalid x= tag")
+		}
+		if time.Now().Unix() > expires {
+			return permError("signature expired")
+		}
+	}
+
+	// body hash
+	canonBody := canonicalBody(body, bodyCanon)
+	if l, ok := tags["l"]; ok {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 || n > len(canonBody) {
+			return permError("invalid l= tag")
+		}
+		canonBody = canonBody[:n]
+	}
+
+	bh, err := base64.StdEncoding.DecodeString(tags["bh"])
+	if err != nil {
+		return permError("invalid bh= tag")
+	}
+
+	h := newHash()
+	h.Write(canonBody)
+	if !bytes.Equal(h.Sum(nil), bh) {
+		return &dkimError{DKIMFail, "body hash mismatch"}
+	}
+
+	// header hash, each listed name takes the bottom-most instance not yet used
+	h = newHash()
+	used := make(map[int]bool)
+	for _, name := range signed {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if fields[i].name == name && !used[i] {
+				used[i] = true
+				h.Write([]byte(canonicalHeader(fields[i].raw, headerCanon)))
+				break
+			}
+		}
+	}
+
+	blanked := sigValueRegex.ReplaceAllString(sig.raw, "$1")
+	h.Write([]byte(strings.TrimSuffix(canonicalHeader(blanked, headerCanon), "\r\n")))
+
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return permError("invalid b= tag")
+	}
+
+	key, err := fetchKey(ctx, tags["s"], tags["d"], keyType)
+	if err != nil {
+		return err
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(k, cryptoHash, h.Sum(nil), signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, h.Sum(nil), signature) {
+			err = errors.New("bad signature")
+		}
+	}
+
+	if err != nil {
+		return &dkimError{DKIMFail, "signature did not verify"}
+	}
+
+	return nil
+}
+
+// minRSABits is the shortest RSA key signatures are verified with
+const minRSABits = 1024
+
+// fetchKey looks up the public key published at selector._domainkey.domain
+func fetchKey(ctx context.Context, selector, domain, keyType string) (crypto.PublicKey, error) {
+	records, err := lookupTXT(ctx, selector+"._domainkey."+domain)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return nil, permError("no key for signature")
+	}
+	if err != nil {
+		return nil, &dkimError{DKIMTempError, "key unavailable"}
+	}
+
+	if len(records) == 0 {
+		return nil, permError("no key for signature")
+	}
+
+	tags, err := parseTags(strings.Join(records, ""))
+	if err != nil {
+		return nil, permError("malformed key record")
+	}
+
+	if k, ok := tags["k"]; ok && k != keyType || !ok && keyType != "rsa" {
+		return nil, permError("key type mismatch")
+	}
+
+	if tags["p"] == "" {
+		return nil, permError("key revoked")
+	}
+
+	b, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil {
+		return nil, permError("malformed key")
+	}
+
+	if keyType == "ed25519" {
+		if len(b) != ed25519.PublicKeySize {
+			return nil, permError("malformed key")
+		}
+		return ed25519.PublicKey(b), nil
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(b)
+	if err != nil {
+		// some publish a bare PKCS#1 key
+		if pub, err = x509.ParsePKCS1PublicKey(b); err != nil {
+			return nil, permError("malformed key")
+		}
+	}
+
+	rsaKey, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, permError("key type mismatch")
+	}
+
+	// RFC 8301 section 3.2
+	if rsaKey.N.BitLen() < minRSABits {
+		return nil, permError("key too short")
+	}
+
+	return rsaKey, nil
+}
+
+// parseTags parses a DKIM tag list, "v=1; a=rsa-sha256; ...", whitespace inside values dropped
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+
+	for _, part := range strings.Split(s, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, permError("malformed tag list")
+		}
+
+		name := strings.TrimSpace(kv[0])
+		if _, dup := tags[name]; dup || name == "" {
+			return nil, permError("malformed tag list")
+		}
+
+		tags[name] = strings.Join(strings.Fields(kv[1]), "")
+	}
+
+	return tags, nil
+}
+
+func validCanon(c string) bool {
+	return c == "simple" || c == "relaxed"
+}
+
+// splitMessage returns the header fields and the body of a message
+func splitMessage(data []byte) ([]headerField, []byte) {
+	var fields []headerField
+
+	for len(data) > 0 {
+		if bytes.HasPrefix(data, []byte("\r\n")) {
+			return fields, data[2:]
+		}
+
+		// a field runs until a line that doesn't start with whitespace
+		end := 0
+		for {
+			i := bytes.IndexByte(data[end:], '\n')
+			if i < 0 {
+				end = len(data)
+				break
+			}
+			end += i + 1
+
+			if end == len(data) || data[end] != ' ' && data[end] != '\t' {
+				break
+			}
+		}
+
+		raw := string(data[:end])
+		if i := strings.IndexByte(raw, ':'); i > 0 {
+			fields = append(fields, headerField{name: strings.ToLower(strings.TrimSpace(raw[:i])), raw: raw})
+		}
+
+		data = data[end:]
+	}
+
+	return fields, nil
+}
+
+// canonicalHeader applies header canonicalization (RFC 6376 section 3.4.1 and 3.4.2)
+func canonicalHeader(raw, canon string) string {
+	if canon == "simple" {
+		return raw
+	}
+
+	i := strings.IndexByte(raw, ':')
+	name := strings.ToLower(strings.TrimRight(raw[:i], " \t"))
+
+	value := strings.NewReplacer("\r\n", "", "\n", "").Replace(raw[i+1:])
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+
+	return name + ":" + value + "\r\n"
+}
+
+// canonicalBody applies body canonicalization (RFC 6376 section 3.4.3 and 3.4.4)
+func canonicalBody(body []byte, canon string) []byte {
+	lines := strings.Split(string(body), "\r\n")
+
+	// a trailing CRLF leaves an empty last element, it is restored below
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if canon == "relaxed" {
+		for i, line := range lines {
+			lines[i] = collapseWSP(strings.TrimRight(line, " \t"))
+		}
+	}
+
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) == 0 {
+		if canon == "simple" {
+			return []byte("\r\n")
+		}
+		return nil
+	}
+
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// collapseWSP reduces every run of spaces and tabs to a single space
+func collapseWSP(s string) string {
+	var b strings.Builder
+	space := false
+
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			space = true
+			continue
+		}
+
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(s[i])
+	}
+
+	if space {
+		b.WriteByte(' ')
+	}
+
+	return b.String()
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
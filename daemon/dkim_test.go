@@ -0,0 +1,134 @@
+package daemon
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalization(t *testing.T) {
+	// example from RFC 6376 section 3.4.5
+	msg := "A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"
+	fields, body := splitMessage([]byte(msg))
+
+	if len(fields) != 2 {
+		t.Fatal("Unexpected header fields:", fields)
+	}
+
+	if h := canonicalHeader(fields[0].raw, "relaxed") + canonicalHeader(fields[1].raw, "relaxed"); h != "a:X\r\nb:Y Z\r\n" {
+		t.Fatalf("Unexpected relaxed header: %q", h)
+	}
+
+	if h := canonicalHeader(fields[1].raw, "simple"); h != "B : Y\t\r\n\tZ  \r\n" {
+		t.Fatalf("Unexpected simple header: %q", h)
+	}
+
+	if b := string(canonicalBody(body, "relaxed")); b != " C\r\nD E\r\n" {
+		t.Fatalf("Unexpected relaxed body: %q", b)
+	}
+
+	if b := string(canonicalBody(body, "simple")); b != " C \r\nD \t E\r\n" {
+		t.Fatalf("Unexpected simple body: %q", b)
+	}
+
+	if b := string(canonicalBody(nil, "simple")); b != "\r\n" {
+		t.Fatalf("Unexpected empty simple body: %q", b)
+	}
+}
+
+// sign adds a relaxed/relaxed rsa-sha256 signature over From and Subject
+func sign(t *testing.T, key *rsa.PrivateKey, msg string) string {
+	fields, body := splitMessage([]byte(msg))
+
+	bh := sha256.Sum256(canonicalBody(body, "relaxed"))
+	sig := "DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=sel;\r\n" +
+		"\th=from:subject; bh=" + base64.StdEncoding.EncodeToString(bh[:]) + "; b="
+
+	h := sha256.New()
+	for _, f := range fields {
+		io.WriteString(h, canonicalHeader(f.raw, "relaxed"))
+	}
+	io.WriteString(h, strings.TrimSuffix(canonicalHeader(sig+"\r\n", "relaxed"), "\r\n"))
+
+	b, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sig + base64.StdEncoding.EncodeToString(b) + "\r\n" + msg
+}
+
+func TestVerifyDKIM(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+
+	// a 512 bit key, too short to be trusted
+	n, _ := new(big.Int).SetString("c3d6ab8a9e6f4f1b7b6a1d2f3e4c5b6a7d8e9f0a1b2c3d4e5f60718293a4b5c6"+
+		"d7e8f90123456789abcdef0123456789abcdef0123456789abcdef0123456789", 16)
+	short, _ := x509.MarshalPKIXPublicKey(&rsa.PublicKey{N: n, E: 65537})
+
+	lookupTXT = func(ctx context.Context, name string) ([]string, error) {
+		switch name {
+		case "sel._domainkey.example.com":
+			return []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)}, nil
+		case "short._domainkey.example.com":
+			return []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(short)}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	defer func() { lookupTXT = net.DefaultResolver.LookupTXT }()
+
+	signed := sign(t, key, "From: a@example.com\r\nSubject: hi\r\n\r\nbody  text\r\n\r\n")
+
+	cases := map[string]string{
+		signed: DKIMPass,
+		strings.Replace(signed, "Subject: hi", "Subject:   hi ", 1): DKIMPass, // relaxed tolerates whitespace
+		strings.Replace(signed, "Subject: hi", "Subject: ho", 1):    DKIMFail,
+		strings.Replace(signed, "body", "bogus", 1):                 DKIMFail,
+		strings.Replace(signed, "s=sel", "s=gone", 1):               DKIMPermError,
+		strings.Replace(signed, "a=rsa-sha256", "a=rsa-sha1", 1):    DKIMPermError,
+		strings.Replace(signed, "s=sel", "s=short", 1):              DKIMPermError,
+	}
+
+	for msg, expected := range cases {
+		results := verifyDKIM([]byte(msg))
+		if len(results) != 1 || results[0].Result != expected {
+			t.Fatalf("Expected %s, got %+v for:\n%s", expected, results, msg)
+		}
+	}
+
+	if results := verifyDKIM([]byte("From: a@example.com\r\n\r\nbody\r\n")); len(results) != 0 {
+		t.Fatal("Unsigned message has results:", results)
+	}
+
+	// end to end, results reach the handler and the header
+	msgs := make(chan *Msg, 1)
+	c := serve(t, &Server{Handler: func(msg *Msg) { msgs <- msg }, Hostname: "mx.example.org", VerifyDKIM: true})
+
+	c.PrintfLine("EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.org>\r\nDATA")
+	c.expect(t, 220, 250, 250, 250, 354)
+	c.PrintfLine("%s.", signed)
+	c.expect(t, 250)
+
+	got := <-msgs
+	if len(got.DKIM) != 1 || got.DKIM[0].Result != DKIMPass || got.DKIM[0].Domain != "example.com" {
+		t.Fatalf("Unexpected results: %+v", got.DKIM)
+	}
+
+	if !strings.Contains(string(got.Data), "Authentication-Results: mx.example.org;\r\n\tdkim=pass header.d=example.com header.s=sel\r\n") {
+		t.Fatalf("Missing Authentication-Results: %q", got.Data)
+	}
+}
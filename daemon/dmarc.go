@@ -0,0 +1,153 @@
+package daemon
+
+import (
+	"context"
+	"math/rand"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// DMARC modes of Server.DMARC
+const (
+	DMARCMonitor = "monitor" // evaluate and record the result only
+	DMARCEnforce = "enforce" // also apply the domain's policy
+)
+
+// DMARC results
+const (
+	DMARCPass      = "pass"
+	DMARCFail      = "fail"
+	DMARCNone      = "none" // the domain publishes no policy
+	DMARCTempError = "temperror"
+	DMARCPermError = "permerror"
+)
+
+// how long the SPF, DKIM and DMARC lookups of one message may take together
+const authTimeout = 20 * time.Second
+
+// DMARCResult is the DMARC (RFC 7489) evaluation of a message
+type DMARCResult struct {
+	Domain string // domain of the From header
+	Result string // one of the DMARC* results
+	Policy string // none, quarantine or reject, after pct sampling
+}
+
+// checkDMARC evaluates the From domain's policy against the SPF result for the envelope
+// sender (spfDomain) and the DKIM results
+func checkDMARC(ctx context.Context, data []byte, spf, spfDomain string, dkim []DKIMResult) *DMARCResult {
+	fields, _ := splitMessage(data)
+
+	var from []string
+	for _, f := range fields {
+		if f.name == "from" {
+			from = append(from, f.raw[strings.IndexByte(f.raw, ':')+1:])
+		}
+	}
+
+	if len(from) != 1 {
+		return &DMARCResult{Result: DMARCPermError}
+	}
+
+	addrs, err := mail.ParseAddressList(strings.TrimSpace(from[0]))
+	if err != nil || len(addrs) == 0 || !strings.Contains(addrs[0].Address, "@") {
+		return &DMARCResult{Result: DMARCPermError}
+	}
+
+	res := &DMARCResult{Domain: domainOf(addrs[0].Address), Result: DMARCNone}
+
+	tags, result := dmarcRecord(ctx, res.Domain)
+	org := orgDomain(res.Domain)
+	if result == DMARCNone && org != res.Domain {
+		if tags, result = dmarcRecord(ctx, org); tags != nil && tags["sp"] != "" {
+			tags["p"] = tags["sp"]
+		}
+	}
+
+	if tags == nil {
+		res.Result = result
+		return res
+	}
+
+	res.Policy = strings.ToLower(tags["p"])
+	if res.Policy != "none" && res.Policy != "quarantine" && res.Policy != "reject" {
+		res.Policy = "none"
+	}
+
+	aligned := func(domain, mode string) bool {
+		domain = strings.ToLower(domain)
+		if mode == "s" {
+			return domain == res.Domain
+		}
+		return orgDomain(domain) == org
+	}
+
+	res.Result = DMARCFail
+	if spf == SPFPass && aligned(spfDomain, tags["aspf"]) {
+		res.Result = DMARCPass
+	}
+	for _, d := range dkim {
+		if d.Result == DKIMPass && aligned(d.Domain, tags["adkim"]) {
+			res.Result = DMARCPass
+		}
+	}
+
+	// pct applies the policy to a sample of failing mail, the rest gets the next milder one
+	if pct, err := strconv.Atoi(tags["pct"]); err == nil && pct < 100 && rand.Intn(100) >= pct {
+		switch res.Policy {
+		case "reject":
+			res.Policy = "quarantine"
+		case "quarantine":
+			res.Policy = "none"
+		}
+	}
+
+	return res
+}
+
+// dmarcRecord fetches the policy published at _dmarc.domain
+func dmarcRecord(ctx context.Context, domain string) (map[string]string, string) {
+	txts, err := lookupTXT(ctx, "_dmarc."+domain)
+	if isNotFound(err) {
+		return nil, DMARCNone
+	}
+	if err != nil {
+		return nil, DMARCTempError
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if strings.HasPrefix(strings.TrimSpace(txt), "v=DMARC1") {
+			records = append(records, txt)
+		}
+	}
+
+	if len(records) != 1 {
+		return nil, DMARCNone
+	}
+
+	tags, err := parseTags(records[0])
+	if err != nil || tags["v"] != "DMARC1" {
+		return nil, DMARCNone
+	}
+
+	return tags, ""
+}
+
+// orgDomain is the registered domain under a public suffix, e.g. example.co.uk for mail.example.co.uk
+func orgDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+
+	return org
+}
+
+// trusted sessions are our own users, their mail isn't checked against sender policies
+func (s *session) trusted() bool {
+	return s.user != "" || s.relay && len(s.srv.RelayNetworks) > 0
+}
@@ -0,0 +1,139 @@
+package daemon
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeDNS answers lookups from fixed records until the test ends
+func fakeDNS(t *testing.T, txt, hosts map[string][]string, mx map[string][]*net.MX) {
+	notFound := func(name string) error {
+		return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	lookupTXT = func(ctx context.Context, name string) ([]string, error) {
+		if r, ok := txt[name]; ok {
+			return r, nil
+		}
+		return nil, notFound(name)
+	}
+	lookupHost = func(ctx context.Context, name string) ([]string, error) {
+		if r, ok := hosts[name]; ok {
+			return r, nil
+		}
+		return nil, notFound(name)
+	}
+	lookupMX = func(ctx context.Context, name string) ([]*net.MX, error) {
+		if r, ok := mx[name]; ok {
+			return r, nil
+		}
+		return nil, notFound(name)
+	}
+
+	t.Cleanup(func() {
+		lookupTXT = net.DefaultResolver.LookupTXT
+		lookupHost = net.DefaultResolver.LookupHost
+		lookupMX = net.DefaultResolver.LookupMX
+	})
+}
+
+func TestSPF(t *testing.T) {
+	fakeDNS(t, map[string][]string{
+		"example.com":      {"v=spf1 ip4:192.0.2.0/24 include:_spf.example.net -all", "unrelated"},
+		"_spf.example.net": {"v=spf1 a:out.example.net/30 mx ~all"},
+		"redirect.example": {"v=spf1 redirect=example.com"},
+		"macro.example":    {"v=spf1 exists:%{ir}.%{l1r-}.allow.example -all"},
+		"loop.example":     {"v=spf1 include:loop.example -all"},
+		"twice.example":    {"v=spf1 -all", "v=spf1 +all"},
+		"v6.example":       {"v=spf1 ip6:2001:db8::/32 -all"},
+	}, map[string][]string{
+		"out.example.net":           {"198.51.100.1"},
+		"mx.example.net":            {"203.0.113.7"},
+		"1.2.0.192.b.allow.example": {"127.0.0.2"},
+	}, map[string][]*net.MX{
+		"_spf.example.net": {{Host: "mx.example.net.", Pref: 10}},
+	})
+
+	cases := []struct {
+		ip, sender, expected string
+	}{
+		{"192.0.2.55", "user@example.com", SPFPass},
+		{"198.51.100.3", "user@example.com", SPFPass},
+		{"198.51.100.4", "user@example.com", SPFFail},
+		{"203.0.113.7", "user@example.com", SPFPass},
+		{"203.0.113.8", "user@redirect.example", SPFFail},
+		{"192.0.2.1", "b-a@macro.example", SPFPass},
+		{"192.0.2.2", "b-a@macro.example", SPFFail},
+		{"192.0.2.1", "user@loop.example", SPFPermError},
+		{"192.0.2.1", "user@twice.example", SPFPermError},
+		{"192.0.2.1", "user@nothing.example", SPFNone},
+		{"2001:db8::1", "user@v6.example", SPFPass},
+		{"192.0.2.1", "", SPFPass}, // null sender, checked against the HELO name
+	}
+
+	for _, c := range cases {
+		if got := checkSPF(context.Background(), net.ParseIP(c.ip), "example.com", c.sender); got != c.expected {
+			t.Fatalf("Expected %s for %s from %s, got %s", c.expected, c.sender, c.ip, got)
+		}
+	}
+}
+
+func TestDMARC(t *testing.T) {
+	fakeDNS(t, map[string][]string{
+		"example.com":          {"v=spf1 ip4:127.0.0.1 -all"},
+		"_dmarc.example.com":   {"v=DMARC1; p=reject; sp=quarantine; aspf=r"},
+		"other.example":        {"v=spf1 -all"},
+		"_dmarc.other.example": {"v=DMARC1; p=reject"},
+	}, nil, nil)
+
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	msgs := make(chan *Msg, 1)
+	srv := &Server{
+		Handler:       func(msg *Msg) { msgs <- msg },
+		Hostname:      "mx.example.org",
+		RelayNetworks: []*net.IPNet{n},
+		LocalDomains:  []string{"example.org"},
+		DMARC:         DMARCEnforce,
+	}
+
+	send := func(from, header string, code int) {
+		t.Helper()
+
+		c := serve(t, srv)
+		c.PrintfLine("EHLO client\r\nMAIL FROM:<%s>\r\nRCPT TO:<b@example.org>\r\nDATA", from)
+		c.expect(t, 220, 250, 250, 250, 354)
+		c.PrintfLine("From: %s\r\nSubject: x\r\n\r\nbody\r\n.", header)
+		c.expect(t, code)
+	}
+
+	// aligned, but the envelope domain has no SPF record to pass
+	send("bounce@mail.example.com", "a@example.com", 550)
+
+	send("a@example.com", "Alice <a@example.com>", 250)
+	got := <-msgs
+	if got.SPF != SPFPass || got.DMARC.Result != DMARCPass || got.Quarantine {
+		t.Fatalf("Unexpected results: %s %+v", got.SPF, got.DMARC)
+	}
+
+	if !strings.Contains(string(got.Data), "\r\n\tspf=pass smtp.mailfrom=example.com;\r\n\tdkim=none;\r\n\tdmarc=pass (p=reject) header.from=example.com\r\n") {
+		t.Fatalf("Unexpected Authentication-Results: %q", got.Data)
+	}
+
+	// spoofed header From
+	send("a@other.example", "a@example.com", 550)
+
+	// subdomain without its own record gets sp=
+	send("a@other.example", "a@news.example.com", 250)
+	if got = <-msgs; !got.Quarantine || got.DMARC.Policy != "quarantine" {
+		t.Fatalf("Expected quarantine: %+v", got.DMARC)
+	}
+
+	// monitoring only records
+	srv = &Server{Handler: srv.Handler, RelayNetworks: srv.RelayNetworks, LocalDomains: srv.LocalDomains, DMARC: DMARCMonitor}
+	send("a@other.example", "a@example.com", 250)
+	if got = <-msgs; got.DMARC.Result != DMARCFail || got.Quarantine {
+		t.Fatalf("Unexpected results: %+v", got.DMARC)
+	}
+}
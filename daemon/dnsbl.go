@@ -0,0 +1,89 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// What happens to sessions from clients listed on a DNS blocklist
+const (
+	DNSBLReject = "reject" // MAIL is refused with 554
+	DNSBLTag    = "tag"    // mail is accepted with an X-DNSBL header
+	DNSBLLog    = "log"    // hit is only logged
+)
+
+// how long all blocklist queries of a session may take together
+const dnsblTimeout = 10 * time.Second
+
+// lookupHost resolves blocklist queries, replaced in tests
+var lookupHost = net.DefaultResolver.LookupHost
+
+// blocklisted returns the first zone of Server.DNSBL listing the client, empty if none does.
+// Clients that may relay or have authenticated are never checked. The answer is cached for
+// the rest of the session.
+func (s *session) blocklisted() string {
+	if s.dnsblChecked || s.trusted() {
+		return s.dnsbl
+	}
+	s.dnsblChecked = true
+
+	ip := net.ParseIP(s.ip)
+	if ip == nil {
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsblTimeout)
+	defer cancel()
+
+	for _, zone := range s.srv.DNSBL {
+		if listed(ctx, ip, zone) {
+			s.logf(phaseMail, "Client is blocklisted", "zone", zone)
+			s.dnsbl = zone
+			break
+		}
+	}
+
+	return s.dnsbl
+}
+
+func (srv *Server) dnsblAction() string {
+	if srv.DNSBLAction != "" {
+		return srv.DNSBLAction
+	}
+
+	return DNSBLReject
+}
+
+// listed queries zone for ip. Only 127.0.0.0/8 answers count, 127.255.255.0/24 are error
+// codes (e.g. Spamhaus refusing queries from public resolvers). Lookup failures count as not listed.
+func listed(ctx context.Context, ip net.IP, zone string) bool {
+	addrs, err := lookupHost(ctx, reverseIP(ip)+"."+zone)
+	if err != nil {
+		return false
+	}
+
+	for _, a := range addrs {
+		if ans := net.ParseIP(a).To4(); ans != nil && ans[0] == 127 && !(ans[1] == 255 && ans[2] == 255) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reverseIP formats ip for a blocklist query: octets reversed for IPv4, nibbles for IPv6
+func reverseIP(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", v4[3], v4[2], v4[1], v4[0])
+	}
+
+	var nibbles []string
+	for i := len(ip) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, fmt.Sprintf("%x.%x", ip[i]&0xf, ip[i]>>4))
+	}
+
+	return strings.Join(nibbles, ".")
+}
@@ -0,0 +1,53 @@
+package daemon
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// futureRelease is the FUTURERELEASE keyword (RFC 4865) advertising how far ahead a client
+// may ask for the message to be held
+func (srv *Server) futureRelease(now time.Time) string {
+	return fmt.Sprintf("FUTURERELEASE %d %s", int(srv.MaxHold.Seconds()), now.Add(srv.MaxHold).UTC().Format(time.RFC3339))
+}
+
+// holdUntil reads HOLDFOR or HOLDUNTIL of MAIL FROM into the release time, zero when neither
+// is given. Returns an error reply when the parameters are invalid or too far ahead.
+func (srv *Server) holdUntil(params map[string]string, now time.Time) (time.Time, string) {
+	holdFor, isFor := params["HOLDFOR"]
+	holdUntil, isUntil := params["HOLDUNTIL"]
+
+	if !isFor && !isUntil {
+		return time.Time{}, ""
+	}
+
+	if srv.MaxHold <= 0 {
+		return time.Time{}, "555 5.5.4 FUTURERELEASE not supported"
+	}
+
+	if isFor && isUntil {
+		return time.Time{}, "501 5.5.4 HOLDFOR and HOLDUNTIL are mutually exclusive"
+	}
+
+	var until time.Time
+	if isFor {
+		secs, err := strconv.ParseUint(holdFor, 10, 32)
+		if err != nil {
+			return time.Time{}, "501 5.5.4 Invalid HOLDFOR parameter"
+		}
+		until = now.Add(time.Duration(secs) * time.Second)
+	} else {
+		t, err := time.Parse(time.RFC3339, holdUntil)
+		if err != nil {
+			return time.Time{}, "501 5.5.4 Invalid HOLDUNTIL parameter"
+		}
+		until = t
+	}
+
+	if until.After(now.Add(srv.MaxHold)) {
+		return time.Time{}, "501 5.5.4 Requested release time too far in the future"
+	}
+
+	return until.UTC(), ""
+}
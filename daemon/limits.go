@@ -0,0 +1,120 @@
+package daemon
+
+import (
+	"sync"
+	"time"
+)
+
+// UserLimits caps the mail each authenticated user may send over a rolling window. One
+// UserLimits can be shared by several servers so a user's submissions count on all of them.
+type UserLimits struct {
+	Window     time.Duration // length of the rolling window, an hour if zero
+	Messages   int           // accepted messages per window, unlimited if zero
+	Recipients int           // recipients of accepted messages per window, unlimited if zero
+
+	mu    sync.Mutex
+	users map[string][]submission
+}
+
+// UserUsage is what a user sent within the current window
+type UserUsage struct {
+	Messages   int `json:"messages"`
+	Recipients int `json:"recipients"`
+}
+
+type submission struct {
+	at    time.Time
+	rcpts int
+}
+
+func (l *UserLimits) window() time.Duration {
+	if l.Window <= 0 {
+		return time.Hour
+	}
+
+	return l.Window
+}
+
+// usage drops submissions that left the window and sums up the rest, l.mu must be held
+func (l *UserLimits) usage(user string, now time.Time) UserUsage {
+	subs := l.users[user]
+
+	i := 0
+	for i < len(subs) && now.Sub(subs[i].at) >= l.window() {
+		i++
+	}
+	subs = subs[i:]
+
+	if len(subs) == 0 {
+		delete(l.users, user)
+	} else {
+		l.users[user] = subs
+	}
+
+	u := UserUsage{Messages: len(subs)}
+	for _, s := range subs {
+		u.Recipients += s.rcpts
+	}
+
+	return u
+}
+
+// allowMessage reports whether user may start another transaction
+func (l *UserLimits) allowMessage(user string) bool {
+	if l == nil || l.Messages <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.usage(user, time.Now()).Messages < l.Messages
+}
+
+// allowRecipients reports whether user may send a message to n recipients
+func (l *UserLimits) allowRecipients(user string, n int) bool {
+	if l == nil || l.Recipients <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.usage(user, time.Now()).Recipients+n <= l.Recipients
+}
+
+// record counts an accepted message
+func (l *UserLimits) record(user string, rcpts int) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.users == nil {
+		l.users = make(map[string][]submission)
+	}
+
+	// drop what left the window first, without limits nothing else would
+	now := time.Now()
+	l.usage(user, now)
+	l.users[user] = append(l.users[user], submission{now, rcpts})
+}
+
+// Usage returns what each user who sent mail within the window sent, for publishing
+// with expvar.Func
+func (l *UserLimits) Usage() interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	usage := make(map[string]UserUsage)
+	for user := range l.users {
+		if u := l.usage(user, now); u.Messages > 0 {
+			usage[user] = u
+		}
+	}
+
+	return usage
+}
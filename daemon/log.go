@@ -0,0 +1,45 @@
+package daemon
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+)
+
+// phases of a session in log entries
+const (
+	phaseConnect = "connect"
+	phaseHelo    = "helo"
+	phaseMail    = "mail"
+	phaseRcpt    = "rcpt"
+	phaseData    = "data"
+	phaseTLS     = "tls"
+	phaseAuth    = "auth"
+)
+
+// newSessionID returns a random ID tying together the log entries of one session
+func newSessionID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// logf writes a log entry with the session ID, client IP and phase, args are key value pairs
+func (s *session) logf(phase, msg string, args ...interface{}) {
+	slog.Info(msg, append([]interface{}{"session", s.id, "ip", s.ip, "phase", phase}, args...)...)
+}
+
+// phase of the conversation by transaction state
+func (s *session) phase() string {
+	switch s.state {
+	case stateGreeted:
+		return phaseHelo
+	case stateMail:
+		return phaseMail
+	case stateRcpt:
+		return phaseRcpt
+	}
+
+	return phaseConnect
+}
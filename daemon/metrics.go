@@ -0,0 +1,24 @@
+package daemon
+
+// Metrics collects counters and gauges of inbound mail, *expvar.Map satisfies it. Names are
+//
+//	connections        accepted connections
+//	sessions           sessions currently open
+//	messages           accepted messages
+//	bytes              data of accepted messages
+//	rejects.<reason>   refused connections, recipients and messages, e.g. rejects.relay
+type Metrics interface {
+	Add(name string, delta int64)
+}
+
+func (srv *Server) metric(name string, delta int64) {
+	if srv.Metrics != nil {
+		srv.Metrics.Add(name, delta)
+	}
+}
+
+// reject sends a refusal counted under reason
+func (s *session) reject(reason, reply string) {
+	s.srv.metric("rejects."+reason, 1)
+	s.reply(reply)
+}
@@ -0,0 +1,254 @@
+package daemon
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	errPathSyntax   = errors.New("Syntax error in mailbox address")
+	errParamSyntax  = errors.New("Syntax error in parameters")
+	errNullPath     = errors.New("Null path not allowed here")
+	errPathTooLong  = errors.New("Path too long")
+	errPathPrefix   = errors.New("Syntax: MAIL FROM:<address> or RCPT TO:<address>")
+	errUnterminated = errors.New("Unterminated quoted string in address")
+)
+
+// longest path allowed by RFC 5321 section 4.5.3.1.3, including the angle brackets
+const maxPathLength = 256
+
+// parsePath parses the arguments of MAIL or RCPT (RFC 5321 section 4.1.2): prefix ("FROM:" or
+// "TO:"), the path in angle brackets and optional ESMTP parameters. Quoted local parts are
+// returned as sent, source routes are dropped. The null path <> gives an empty address.
+func parsePath(args, prefix string) (addr string, params map[string]string, err error) {
+	if !hasPrefixFold(args, prefix) {
+		return "", nil, errPathPrefix
+	}
+
+	// a space after the colon isn't allowed but plenty of clients send one
+	rest := strings.TrimLeft(args[len(prefix):], " ")
+
+	if !strings.HasPrefix(rest, "<") {
+		return "", nil, errPathSyntax
+	}
+
+	end, err := pathEnd(rest)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if end+1 > maxPathLength {
+		return "", nil, errPathTooLong
+	}
+
+	path := rest[1:end]
+
+	// source route, e.g. <@relay.example,@other.example:user@example.com>
+	if strings.HasPrefix(path, "@") {
+		i := strings.Index(path, ":")
+		if i < 0 || !validRoute(path[:i]) {
+			return "", nil, errPathSyntax
+		}
+		path = path[i+1:]
+	}
+
+	if path != "" && !validMailbox(path) {
+		return "", nil, errPathSyntax
+	}
+
+	params, err = parseParams(rest[end+1:])
+	if err != nil {
+		return "", nil, err
+	}
+
+	return path, params, nil
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// pathEnd finds the closing angle bracket of the path starting at s[0], skipping
+// brackets inside quoted strings
+func pathEnd(s string) (int, error) {
+	quoted := false
+
+	for i := 1; i < len(s); i++ {
+		switch {
+		case quoted && s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == '>':
+			return i, nil
+		case !quoted && s[i] == '<':
+			return 0, errPathSyntax
+		}
+	}
+
+	if quoted {
+		return 0, errUnterminated
+	}
+
+	return 0, errPathSyntax
+}
+
+// validRoute checks the "@domain,@domain" part of a source route
+func validRoute(route string) bool {
+	for _, hop := range strings.Split(route, ",") {
+		if !strings.HasPrefix(hop, "@") || !validDomain(hop[1:]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validMailbox checks local-part "@" domain, where local-part is a dot-string or a quoted
+// string. Postmaster without a domain is accepted as required by RFC 5321 section 4.1.1.3.
+func validMailbox(mailbox string) bool {
+	if strings.EqualFold(mailbox, "postmaster") {
+		return true
+	}
+
+	i := strings.LastIndex(mailbox, "@")
+	if i < 0 {
+		return false
+	}
+
+	local, domain := mailbox[:i], mailbox[i+1:]
+	if strings.HasPrefix(local, "\"") {
+		if !validQuoted(local) {
+			return false
+		}
+	} else if !validDotString(local) {
+		return false
+	}
+
+	if strings.HasPrefix(domain, "[") {
+		return strings.HasSuffix(domain, "]") && len(domain) > 2 && !strings.ContainsAny(domain[1:len(domain)-1], "[]\\ ")
+	}
+
+	return validDomain(domain)
+}
+
+func validDotString(s string) bool {
+	if s == "" || s[0] == '.' || s[len(s)-1] == '.' {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '.' && !isAtext(s[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validQuoted checks a quoted string, where backslash escapes any printable character
+func validQuoted(s string) bool {
+	if len(s) < 2 || s[len(s)-1] != '"' {
+		return false
+	}
+
+	for i := 1; i < len(s)-1; i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			if i++; i == len(s)-1 || s[i] < ' ' || s[i] == 0x7f {
+				return false
+			}
+		case c == '"' || c < ' ' || c == 0x7f:
+			return false
+		}
+	}
+
+	return true
+}
+
+// validDomain checks dot separated labels of letters, digits and hyphens. Bytes above
+// 0x7f are allowed for internationalized domains, those need SMTPUTF8 which is checked separately.
+func validDomain(domain string) bool {
+	if domain == "" {
+		return false
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !isAlnum(c) && c != '-' && c < 0x80 {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// isFQDN reports whether a HELO name is a domain with at least two labels, bare words and
+// address literals are not
+func isFQDN(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	i := strings.LastIndexByte(name, '.')
+	if i < 0 || !validDomain(name) {
+		return false
+	}
+
+	// a numeric top label is a dotted IP address
+	for _, c := range name[i+1:] {
+		if c < '0' || c > '9' {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isAtext reports whether c may appear in an atom (RFC 5322 section 3.2.3), UTF-8 included
+func isAtext(c byte) bool {
+	return isAlnum(c) || c >= 0x80 || strings.IndexByte("!#$%&'*+-/=?^_`{|}~", c) >= 0
+}
+
+func isAlnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// parseParams parses the space separated ESMTP parameters following a path, keys are upper case
+func parseParams(s string) (map[string]string, error) {
+	params := make(map[string]string)
+
+	for _, p := range strings.Fields(s) {
+		kv := strings.SplitN(p, "=", 2)
+		if !validKeyword(kv[0]) {
+			return nil, errParamSyntax
+		}
+
+		if len(kv) == 1 {
+			kv = append(kv, "")
+		} else if kv[1] == "" || strings.ContainsAny(kv[1], "=") {
+			return nil, errParamSyntax
+		}
+
+		params[strings.ToUpper(kv[0])] = kv[1]
+	}
+
+	return params, nil
+}
+
+func validKeyword(s string) bool {
+	if s == "" || !isAlnum(s[0]) {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if !isAlnum(s[i]) && s[i] != '-' {
+			return false
+		}
+	}
+
+	return true
+}
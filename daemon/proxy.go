@@ -0,0 +1,102 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol v2 signature
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errProxyHeader = errors.New("Invalid PROXY protocol header")
+
+// readProxyHeader parses a PROXY protocol (v1 text or v2 binary) header and returns the
+// original client address. A nil address means the proxy sent no usable address
+// (UNKNOWN or LOCAL, e.g. health checks) and the connection's own address applies.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Sig))
+	if err == nil && bytes.Equal(sig, proxyV2Sig) {
+		return readProxyV2(r)
+	}
+
+	return readProxyV1(r)
+}
+
+// readProxyV1 parses "PROXY TCP4 <src> <dst> <srcport> <dstport>\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := readLine(r, 107) // longest valid v1 header
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errProxyHeader
+	}
+
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, errProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	verCmd, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+
+	if verCmd>>4 != 2 {
+		return nil, errProxyHeader
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	// LOCAL command, the proxy talks on its own behalf
+	if verCmd&0xF == 0 {
+		return nil, nil
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if length < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if length < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+
+	// other families carry nothing useful for us
+	return nil, nil
+}
@@ -0,0 +1,83 @@
+package daemon
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// PTR modes of Server.PTR
+const (
+	PTRCheck  = "check"  // the verified name goes into the Received header
+	PTRReject = "reject" // MAIL from clients without one is also refused
+)
+
+// how long the reverse and forward lookups of a client may take together
+const ptrTimeout = 10 * time.Second
+
+// PTR records beyond this many aren't forward checked
+const maxPTRNames = 10
+
+// lookupAddr resolves PTR records, replaced in tests
+var lookupAddr = net.DefaultResolver.LookupAddr
+
+// reverseName returns the client's forward-confirmed reverse DNS name: a PTR name that
+// resolves back to the client IP. It is "unknown" when there is none, with temporary set if
+// a lookup failed. The answer is cached for the rest of the session.
+func (s *session) reverseName() (name string, temporary bool) {
+	if s.ptr != "" {
+		return s.ptr, s.ptrTemporary
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ptrTimeout)
+	defer cancel()
+
+	s.ptr, s.ptrTemporary = "unknown", false
+
+	names, err := lookupAddr(ctx, s.ip)
+	if err != nil {
+		s.ptrTemporary = !isNotFound(err)
+		return s.ptr, s.ptrTemporary
+	}
+
+	ip := net.ParseIP(s.ip)
+	for i, n := range names {
+		if i == maxPTRNames {
+			break
+		}
+
+		n = strings.ToLower(strings.TrimSuffix(n, "."))
+		addrs, err := lookupHost(ctx, n)
+		if err != nil {
+			s.ptrTemporary = s.ptrTemporary || !isNotFound(err)
+			continue
+		}
+
+		for _, a := range addrs {
+			if ip.Equal(net.ParseIP(a)) {
+				s.ptr, s.ptrTemporary = n, false
+				return s.ptr, false
+			}
+		}
+	}
+
+	return s.ptr, s.ptrTemporary
+}
+
+// ptrReject returns the reply refusing a client without a verified name in PTRReject mode
+func (s *session) ptrReject() string {
+	if s.srv.PTR != PTRReject || s.trusted() {
+		return ""
+	}
+
+	name, temporary := s.reverseName()
+	switch {
+	case name != "unknown":
+		return ""
+	case temporary:
+		return "450 4.7.25 Client host rejected: cannot find your hostname, [" + s.ip + "]"
+	}
+
+	return "550 5.7.25 Client host rejected: cannot find your hostname, [" + s.ip + "]"
+}
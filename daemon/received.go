@@ -0,0 +1,139 @@
+package daemon
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// received builds the trace header (RFC 5321 section 4.4) stamped on accepted messages
+func (s *session) received(now time.Time) string {
+	var b strings.Builder
+
+	helo := s.helo
+	if helo == "" {
+		helo = "unknown"
+	}
+
+	tcpInfo := addressLiteral(s.ip)
+	if s.srv.PTR != "" {
+		name, _ := s.reverseName()
+		tcpInfo = name + " " + tcpInfo
+	}
+
+	fmt.Fprintf(&b, "Received: from %s (%s)\r\n\tby %s with %s", helo, tcpInfo, s.srv.hostname(), s.protocol())
+
+	if cs, ok := s.conn.(*tls.Conn); ok {
+		state := cs.ConnectionState()
+		fmt.Fprintf(&b, "\r\n\t(using %s with cipher %s)", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	}
+
+	// naming the recipient of a multi-recipient message would leak the others
+	if len(s.msg.To) == 1 {
+		fmt.Fprintf(&b, "\r\n\tfor <%s>", s.msg.To[0])
+	}
+
+	fmt.Fprintf(&b, "; %s\r\n", now.Format(time.RFC1123Z))
+
+	return b.String()
+}
+
+// protocol names the transmission type as registered for the "with" clause (RFC 3848)
+func (s *session) protocol() string {
+	if !s.esmtp {
+		return "SMTP"
+	}
+
+	p := "ESMTP"
+	if s.msg.UTF8 {
+		p = "UTF8SMTP"
+	}
+	if s.tls {
+		p += "S"
+	}
+	if s.user != "" {
+		p += "A"
+	}
+
+	return p
+}
+
+// addressLiteral formats ip as in RFC 5321 section 4.1.3, e.g. [192.0.2.1] or [IPv6:2001:db8::1]
+func addressLiteral(ip string) string {
+	if addr := net.ParseIP(ip); addr != nil && addr.To4() == nil {
+		return "[IPv6:" + ip + "]"
+	}
+
+	return "[" + ip + "]"
+}
+
+// authResults formats the Authentication-Results header (RFC 8601) for the checks run on msg
+func authResults(hostname string, msg *Msg, helo string) string {
+	var b strings.Builder
+	b.WriteString("Authentication-Results: " + hostname)
+
+	if msg.SPF != "" {
+		if msg.From != "" {
+			fmt.Fprintf(&b, ";\r\n\tspf=%s smtp.mailfrom=%s", msg.SPF, domainOf(msg.From))
+		} else if validDomain(helo) {
+			fmt.Fprintf(&b, ";\r\n\tspf=%s smtp.helo=%s", msg.SPF, helo)
+		} else {
+			fmt.Fprintf(&b, ";\r\n\tspf=%s", msg.SPF)
+		}
+	}
+
+	if len(msg.DKIM) == 0 {
+		b.WriteString(";\r\n\tdkim=none")
+	}
+
+	for _, r := range msg.DKIM {
+		fmt.Fprintf(&b, ";\r\n\tdkim=%s", r.Result)
+		if r.Reason != "" {
+			fmt.Fprintf(&b, " reason=%q", r.Reason)
+		}
+		// both come from the message, only well-formed names make it into the header
+		if validDomain(r.Domain) {
+			fmt.Fprintf(&b, " header.d=%s", r.Domain)
+		}
+		if validDomain(r.Selector) {
+			fmt.Fprintf(&b, " header.s=%s", r.Selector)
+		}
+	}
+
+	if d := msg.DMARC; d != nil {
+		fmt.Fprintf(&b, ";\r\n\tdmarc=%s", d.Result)
+		if d.Policy != "" {
+			fmt.Fprintf(&b, " (p=%s)", d.Policy)
+		}
+		if validDomain(d.Domain) {
+			fmt.Fprintf(&b, " header.from=%s", d.Domain)
+		}
+	}
+
+	return b.String() + "\r\n"
+}
+
+// greeting is the 220 reply opening a session
+func (srv *Server) greeting() string {
+	banner := srv.Banner
+	if banner == "" {
+		banner = "ESMTP ready"
+	}
+
+	return "220 " + srv.hostname() + " " + banner
+}
+
+func (srv *Server) hostname() string {
+	if srv.Hostname != "" {
+		return srv.Hostname
+	}
+
+	if name, err := os.Hostname(); err == nil {
+		return name
+	}
+
+	return "localhost"
+}
@@ -0,0 +1,298 @@
+package daemon
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Rule actions
+const (
+	RuleReject = "reject" // permanent rejection, 5xx
+	RuleDefer  = "defer"  // temporary rejection, 4xx
+	RuleTag    = "tag"    // accept, adding a header to the message
+
+	// accept and hold for review, see Msg.Quarantine
+	RuleQuarantine = "quarantine"
+)
+
+var errNotCondition = errors.New("Not a condition")
+
+// stages of the transaction a rule is checked at, the latest stage any of its conditions needs
+const (
+	stageMail = iota
+	stageRcpt
+	stageData
+)
+
+// Rule rejects, defers or tags mail when all of its conditions match. Unset conditions match anything.
+type Rule struct {
+	Sender    *regexp.Regexp // MAIL FROM address
+	Recipient *regexp.Regexp // RCPT TO address, at DATA any of the recipients
+	HELO      *regexp.Regexp
+	PTR       *regexp.Regexp // verified reverse DNS name of the client, "unknown" without one
+	Network   *net.IPNet     // client IP
+	Header    string         // header field name, lower case
+	Value     *regexp.Regexp // value of the Header field
+
+	Action string // one of the Rule* actions
+	Text   string // reply for reject and defer, header line for tag, reason for quarantine
+}
+
+// Rules is a set of rules that can be replaced while the server runs
+type Rules struct {
+	mu    sync.RWMutex
+	rules []*Rule
+}
+
+// Set replaces the rules
+func (r *Rules) Set(rules []*Rule) {
+	r.mu.Lock()
+	r.rules = rules
+	r.mu.Unlock()
+}
+
+func (r *Rules) get() []*Rule {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.rules
+}
+
+// ParseRules reads rules, one per line:
+//
+//	reject sender=@spam\.example$ 550 5.7.1 No thanks
+//	defer ip=192.0.2.0/24 helo=^unknown$ 451 Try again later
+//	reject ptr=\.dynamic\.example\.net$ 550 5.7.1 Use your provider's relay
+//	tag header=subject:^\[ad\] X-Advert: yes
+//	quarantine header=x-spam-flag:yes Flagged as spam
+//
+// Conditions are sender=, rcpt=, helo=, ptr= and header=name: with a case insensitive regexp, and
+// ip= with a network. The rest of the line is the reply, the header line or the quarantine reason.
+// Blank lines and # comments are skipped.
+func ParseRules(r io.Reader) ([]*Rule, error) {
+	var rules []*Rule
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", n, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, s.Err()
+}
+
+func parseRule(line string) (*Rule, error) {
+	fields := strings.Fields(line)
+	rule := &Rule{Action: strings.ToLower(fields[0])}
+
+	i := 1
+	for ; i < len(fields); i++ {
+		kv := strings.SplitN(fields[i], "=", 2)
+		if len(kv) != 2 {
+			break
+		}
+
+		var err error
+		switch strings.ToLower(kv[0]) {
+		case "sender":
+			rule.Sender, err = regexp.Compile("(?i)" + kv[1])
+		case "rcpt":
+			rule.Recipient, err = regexp.Compile("(?i)" + kv[1])
+		case "helo":
+			rule.HELO, err = regexp.Compile("(?i)" + kv[1])
+		case "ptr":
+			rule.PTR, err = regexp.Compile("(?i)" + kv[1])
+		case "ip":
+			network := kv[1]
+			if !strings.Contains(network, "/") {
+				network += "/32"
+				if strings.Contains(kv[1], ":") {
+					network = kv[1] + "/128"
+				}
+			}
+			_, rule.Network, err = net.ParseCIDR(network)
+		case "header":
+			nv := strings.SplitN(kv[1], ":", 2)
+			if len(nv) != 2 || nv[0] == "" {
+				return nil, fmt.Errorf("Expected header=name:regexp, got %q", fields[i])
+			}
+			rule.Header = strings.ToLower(nv[0])
+			rule.Value, err = regexp.Compile("(?i)" + nv[1])
+		default:
+			// not a condition, the text starts here
+			err = errNotCondition
+		}
+
+		if err == errNotCondition {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rule.Text = strings.Join(fields[i:], " ")
+
+	switch rule.Action {
+	case RuleReject:
+		if rule.Text == "" {
+			rule.Text = "550 Rejected by policy"
+		}
+	case RuleDefer:
+		if rule.Text == "" {
+			rule.Text = "451 Try again later"
+		}
+	case RuleTag:
+		if !strings.Contains(rule.Text, ":") {
+			return nil, fmt.Errorf("Expected a header line to tag with, got %q", rule.Text)
+		}
+	case RuleQuarantine:
+		if rule.Text == "" {
+			rule.Text = "Quarantined by policy"
+		}
+	default:
+		return nil, fmt.Errorf("Unknown action %q", rule.Action)
+	}
+
+	if (rule.Action == RuleReject || rule.Action == RuleDefer) && !validReply(rule.Text, rule.Action) {
+		return nil, fmt.Errorf("Invalid reply %q for %s", rule.Text, rule.Action)
+	}
+
+	return rule, nil
+}
+
+// validReply checks for a reply code of the right class, 5xx for reject and 4xx for defer
+func validReply(text, action string) bool {
+	class := byte('5')
+	if action == RuleDefer {
+		class = '4'
+	}
+
+	return len(text) >= 3 && text[0] == class && text[1] >= '0' && text[1] <= '9' && text[2] >= '0' && text[2] <= '9' &&
+		(len(text) == 3 || text[3] == ' ')
+}
+
+func (r *Rule) stage() int {
+	switch {
+	case r.Header != "":
+		return stageData
+	case r.Recipient != nil:
+		return stageRcpt
+	}
+
+	return stageMail
+}
+
+// match checks the conditions against the session, rcpt is the recipient at RCPT, header
+// fields are known at DATA
+func (r *Rule) match(s *session, rcpt string, fields []headerField) bool {
+	if r.Sender != nil && !r.Sender.MatchString(s.msg.From) {
+		return false
+	}
+
+	if r.HELO != nil && !r.HELO.MatchString(s.helo) {
+		return false
+	}
+
+	if r.PTR != nil {
+		if name, _ := s.reverseName(); !r.PTR.MatchString(name) {
+			return false
+		}
+	}
+
+	if r.Network != nil && !r.Network.Contains(net.ParseIP(s.ip)) {
+		return false
+	}
+
+	if r.Recipient != nil {
+		rcpts := s.msg.To
+		if rcpt != "" {
+			rcpts = []string{rcpt}
+		}
+
+		found := false
+		for _, to := range rcpts {
+			found = found || r.Recipient.MatchString(to)
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if r.Header != "" {
+		found := false
+		for _, f := range fields {
+			if f.name == r.Header {
+				value := strings.TrimSpace(f.raw[strings.IndexByte(f.raw, ':')+1:])
+				found = found || r.Value.MatchString(strings.NewReplacer("\r\n", "", "\n", "").Replace(value))
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// applyRules runs the rules of a stage, returning the reply of the first reject or defer that
+// matches. Matching tags are collected for the message, the first matching quarantine holds it.
+func (s *session) applyRules(stage int, rcpt string, data []byte) string {
+	var fields []headerField
+	if stage == stageData {
+		fields, _ = splitMessage(data)
+	}
+
+	for _, r := range s.srv.Rules.get() {
+		if r.stage() != stage || !r.match(s, rcpt, fields) {
+			continue
+		}
+
+		if r.Action == RuleTag {
+			if !contains(s.tags, r.Text) {
+				s.tags = append(s.tags, r.Text)
+			}
+			continue
+		}
+
+		if r.Action == RuleQuarantine {
+			if s.quarantine == "" {
+				s.quarantine = r.Text
+			}
+			continue
+		}
+
+		s.trace.line("*", "Rule matched: "+r.Action+" "+r.Text)
+		return r.Text
+	}
+
+	return ""
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
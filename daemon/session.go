@@ -0,0 +1,965 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	errBareLineEnding = errors.New("Bare CR or LF in message data")
+	errTooBig         = errors.New("Message exceeds maximum size")
+	errLineTooLong    = errors.New("Line too long")
+)
+
+// longest command line with its CRLF (RFC 5321 section 4.5.3.1.4), AUTH responses may be
+// longer (RFC 4954 section 4)
+const (
+	maxLineLength     = 512
+	maxAuthLineLength = 12288
+)
+
+// how long the last reply of a dropped session may take to write
+const goodbyeTimeout = 10 * time.Second
+
+// session states, the transaction moves forward through MAIL, RCPT and DATA
+const (
+	stateConnected = iota // waiting for HELO/EHLO
+	stateGreeted          // ready for MAIL
+	stateMail             // MAIL accepted, waiting for RCPT
+	stateRcpt             // at least one recipient, DATA or BDAT allowed
+)
+
+// session is the state of a single client connection
+type session struct {
+	srv       *Server
+	id        string // in log entries and Msg.Session
+	started   time.Time
+	rawConn   net.Conn // as accepted, conn is replaced by STARTTLS
+	conn      net.Conn
+	text      *textproto.Conn
+	remote    net.Addr // client address, from the PROXY header when enabled
+	ip        string   // client IP
+	relay     bool     // client is in a network allowed to relay
+	xclientOK bool     // connected from XClientNetworks
+	user      string   // authenticated user
+	helo      string   // name the client gave in HELO/EHLO
+	esmtp     bool     // client greeted with EHLO
+	trace     *transcript
+
+	errors      int       // rejected commands
+	lastCommand time.Time // for Server.CommandRate
+
+	dnsbl        string // blocklist zone listing the client
+	dnsblChecked bool
+	ptr          string // verified reverse DNS name, "unknown" once checked
+	ptrTemporary bool   // the check failed on a DNS error
+	tls          bool
+	state        int
+	busy         bool // receiving message data, guarded by srv.mu
+
+	// current transaction
+	msg    Msg
+	chunks bytes.Buffer // BDAT chunks received so far
+	tooBig bool         // BDAT chunks exceeded the size limit
+	tags   []string     // header lines added by rules
+
+	quarantine string // reason of the first matching quarantine rule
+}
+
+// reset aborts the current transaction
+func (s *session) reset() {
+	s.msg = Msg{}
+	s.chunks.Reset()
+	s.tooBig = false
+	s.tags = nil
+	s.quarantine = ""
+
+	if s.state > stateGreeted {
+		s.state = stateGreeted
+	}
+}
+
+// begin marks the session busy receiving message data, a server that is shutting down
+// lets busy sessions finish. Returns false when the server is already shutting down.
+func (s *session) begin() bool {
+	s.srv.mu.Lock()
+	defer s.srv.mu.Unlock()
+
+	if s.srv.closed {
+		return false
+	}
+
+	s.busy = true
+	return true
+}
+
+func (s *session) end() {
+	s.srv.mu.Lock()
+	s.busy = false
+	s.srv.mu.Unlock()
+}
+
+// deliver checks the finished transaction and hands it over to the handler, returning the final reply
+func (s *session) deliver(data []byte) string {
+	if reply := s.applyRules(stageData, "", data); reply != "" {
+		s.logf(phaseData, "Rule rejected message", "reply", reply)
+		s.srv.metric("rejects.rule", 1)
+		return reply
+	}
+
+	msg := s.msg
+	if s.quarantine != "" {
+		msg.Quarantine, msg.QuarantineReason = true, s.quarantine
+	}
+
+	header := s.received(time.Now())
+	if s.dnsbl != "" && s.srv.dnsblAction() == DNSBLTag {
+		header += fmt.Sprintf("X-DNSBL: [%s] listed on %s\r\n", s.ip, s.dnsbl)
+	}
+	for _, tag := range s.tags {
+		header += tag + "\r\n"
+	}
+
+	if s.srv.VerifyDKIM || s.srv.DMARC != "" {
+		msg.DKIM = verifyDKIM(data)
+	}
+
+	if s.srv.DMARC != "" && !s.trusted() {
+		ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+		spfDomain := s.helo
+		if msg.From != "" {
+			spfDomain = domainOf(msg.From)
+		}
+
+		msg.SPF = checkSPF(ctx, net.ParseIP(s.ip), s.helo, msg.From)
+		msg.DMARC = checkDMARC(ctx, data, msg.SPF, spfDomain, msg.DKIM)
+		cancel()
+
+		if d := msg.DMARC; d.Result == DMARCFail && s.srv.DMARC == DMARCEnforce {
+			switch d.Policy {
+			case "reject":
+				s.logf(phaseData, "Rejecting message failing DMARC", "domain", d.Domain)
+				s.srv.metric("rejects.dmarc", 1)
+				return "550 Rejected by DMARC policy of " + d.Domain
+			case "quarantine":
+				msg.Quarantine, msg.QuarantineReason = true, "DMARC policy of "+d.Domain
+			}
+		}
+	}
+
+	if s.srv.VerifyDKIM || s.srv.DMARC != "" {
+		header += authResults(s.srv.hostname(), &msg, s.helo)
+	}
+
+	msg.Data = append([]byte(header), data...)
+
+	msg.User = s.user
+	msg.IP = s.ip
+	msg.Session = s.id
+
+	if s.srv.Filter != nil {
+		if reply := s.srv.Filter(&msg); reply != "" {
+			s.logf(phaseData, "Content filter rejected message", "reply", reply)
+			s.srv.metric("rejects.filter", 1)
+			return reply
+		}
+	}
+
+	if s.srv.Submit != nil {
+		if reply := s.srv.Submit(&msg); reply != "" {
+			s.logf(phaseData, "Message not taken", "reply", reply)
+			s.srv.metric("rejects.submit", 1)
+			return reply
+		}
+	} else {
+		s.srv.Handler(&msg)
+	}
+	if msg.User != "" {
+		s.srv.UserLimits.record(msg.User, len(msg.To))
+	}
+	s.srv.metric("messages", 1)
+	s.srv.metric("bytes", int64(len(data)))
+	s.logf(phaseData, "Accepted message", "from", msg.From, "rcpts", len(msg.To), "size", len(msg.Data))
+	return "250 We move"
+}
+
+// startTLS upgrades the session, anything the client sent ahead of the handshake is
+// discarded together with the old reader so plaintext can't be injected into the TLS session
+func (s *session) startTLS() error {
+	conn := tls.Server(s.conn, s.srv.TLSConfig)
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+
+	s.conn = conn
+	s.text = textproto.NewConn(conn)
+	s.tls = true
+
+	state := conn.ConnectionState()
+	s.trace.line("*", fmt.Sprintf("TLS established, %s with %s", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite)))
+	s.traceReplies()
+
+	return nil
+}
+
+func converse(sess *session) {
+	c := sess.text
+	tlsConfig := sess.srv.TLSConfig
+	maxSize := sess.srv.maxSize()
+
+	if !sess.greetingPause() {
+		return
+	}
+
+	sess.reply(sess.srv.greeting())
+
+	for {
+		if max := sess.srv.MaxErrors; max > 0 && sess.errors >= max {
+			sess.logf(sess.phase(), "Dropping session over error budget", "errors", sess.errors)
+			sess.srv.metric("rejects.errors", 1)
+			sess.bye("421 Too many errors, closing connection")
+			return
+		}
+
+		sess.throttle()
+
+		s, err := sess.read(maxLineLength)
+		if err == io.EOF {
+			return
+		}
+
+		if err == errLineTooLong {
+			sess.reply("500 5.5.2 Line too long")
+			continue
+		}
+
+		if err != nil && sess.srv.isClosed() {
+			sess.bye("421 Service shutting down")
+			return
+		}
+
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			sess.bye("421 Timeout, closing connection")
+			return
+		}
+
+		if err != nil {
+			panic(err)
+		}
+
+		sess.trace.line("C", redact(s))
+
+		cmd, args := parseCommand(s)
+		if reply := checkSyntax(cmd, args); reply != "" {
+			sess.reply(reply)
+			continue
+		}
+
+		if sess.srv.RequireTLS && !sess.tls && !allowedBeforeTLS(cmd) {
+			sess.reject("tls", "530 5.7.0 Must issue a STARTTLS command first")
+			continue
+		}
+
+		// the name the client greets with, checkSyntax made sure there is one
+		var helo string
+		if cmd == "EHLO" || cmd == "HELO" {
+			helo = strings.Fields(args)[0]
+		}
+
+		if helo != "" && sess.srv.RequireFQDNHelo && !sess.trusted() && !isFQDN(helo) {
+			sess.reject("helo", "504 5.5.2 Need fully-qualified hostname")
+			continue
+		}
+
+		switch cmd {
+		case "EHLO":
+			lines := []string{sess.srv.hostname() + " Hello " + helo, "8BITMIME", "PIPELINING", "SMTPUTF8", "CHUNKING", "DSN", fmt.Sprintf("SIZE %d", maxSize)}
+			if tlsConfig != nil && !sess.tls {
+				lines = append(lines, "STARTTLS")
+			}
+			if sess.authOffered() {
+				lines = append(lines, "AUTH PLAIN LOGIN")
+			}
+			if sess.srv.MaxHold > 0 {
+				lines = append(lines, sess.srv.futureRelease(time.Now()))
+			}
+			if sess.xclientOK {
+				lines = append(lines, "XCLIENT NAME ADDR PORT PROTO HELO LOGIN")
+			}
+			sess.reset()
+			sess.state = stateGreeted
+			sess.helo, sess.esmtp = helo, true
+			writeMulti(c, 250, lines)
+		case "HELO":
+			sess.reset()
+			sess.state = stateGreeted
+			sess.helo, sess.esmtp = helo, false
+			sess.reply("250 " + sess.srv.hostname())
+		case "MAIL":
+			if sess.state == stateConnected {
+				sess.reply("503 Send HELO/EHLO first")
+				continue
+			}
+
+			if sess.state != stateGreeted {
+				sess.reply("503 Nested MAIL command")
+				continue
+			}
+
+			if sess.srv.RequireAuth && sess.user == "" {
+				sess.reject("auth", "530 5.7.0 Authentication required")
+				continue
+			}
+
+			if sess.user != "" && !sess.srv.UserLimits.allowMessage(sess.user) {
+				sess.logf(phaseMail, "User over message limit", "user", sess.user)
+				sess.srv.metric("rejects.user-limit", 1)
+				sess.bye("421 4.7.0 Message limit reached, try again later")
+				return
+			}
+
+			from, params, err := parsePath(args, "FROM:")
+			if err != nil {
+				sess.reply("501 " + err.Error())
+				continue
+			}
+
+			if zone := sess.blocklisted(); zone != "" && sess.srv.dnsblAction() == DNSBLReject {
+				sess.reject("dnsbl", fmt.Sprintf("554 Service unavailable, client [%s] blocked using %s", sess.ip, zone))
+				continue
+			}
+
+			if reply := sess.ptrReject(); reply != "" {
+				sess.logf(phaseMail, "Client has no verified hostname")
+				sess.reject("ptr", reply)
+				continue
+			}
+
+			if v, ok := params["SIZE"]; ok {
+				if size, err := strconv.Atoi(v); err != nil || size > maxSize {
+					sess.reject("size", "552 Message size exceeds fixed maximum message size")
+					continue
+				}
+			}
+
+			_, smtputf8 := params["SMTPUTF8"]
+			if !smtputf8 && !isASCII(from) {
+				sess.reply("553 Non-ASCII address requires SMTPUTF8")
+				continue
+			}
+
+			ret := strings.ToUpper(params["RET"])
+			if ret != "" && ret != "FULL" && ret != "HDRS" {
+				sess.reply("501 Invalid RET parameter")
+				continue
+			}
+
+			envID, hasEnvID := params["ENVID"]
+			envID = decodeXtext(envID)
+			if hasEnvID && (!printable(envID) || len(envID) > maxEnvIDLength) {
+				sess.reply("501 5.5.4 Invalid ENVID parameter")
+				continue
+			}
+
+			body := strings.ToUpper(params["BODY"])
+			if body != "" && body != "7BIT" && body != "8BITMIME" {
+				sess.reply("501 Invalid BODY parameter")
+				continue
+			}
+
+			hold, reply := sess.srv.holdUntil(params, time.Now())
+			if reply != "" {
+				sess.reply(reply)
+				continue
+			}
+
+			sess.msg.From = from
+			if reply := sess.applyRules(stageMail, "", nil); reply != "" {
+				sess.reset()
+				sess.reject("rule", reply)
+				continue
+			}
+
+			sess.msg.UTF8 = smtputf8
+			sess.msg.Ret = ret
+			sess.msg.Body = body
+			sess.msg.EnvID = envID
+			sess.msg.HoldUntil = hold
+			sess.state = stateMail
+			sess.reply("250 In your name")
+		case "RCPT":
+			if sess.state != stateMail && sess.state != stateRcpt {
+				sess.reply("503 Need MAIL before RCPT")
+				continue
+			}
+
+			// temporary, the client sends the rest in another transaction
+			if len(sess.msg.To) >= sess.srv.maxRcpts() {
+				sess.reject("recipients", "452 Too many recipients")
+				continue
+			}
+
+			addr, params, err := parsePath(args, "TO:")
+			if err == nil && addr == "" {
+				err = errNullPath
+			}
+			if err != nil {
+				sess.reply("501 " + err.Error())
+				continue
+			}
+
+			if !sess.relay && sess.user == "" && !sess.srv.isLocal(addr) {
+				sess.reject("relay", "550 Relaying denied")
+				continue
+			}
+
+			if sess.user != "" && !sess.srv.UserLimits.allowRecipients(sess.user, len(sess.msg.To)+1) {
+				sess.reject("user-limit", "452 4.5.3 Recipient limit reached, try again later")
+				continue
+			}
+
+			if sess.srv.RcptValidator != nil && sess.srv.isLocal(addr) {
+				if reply := sess.srv.RcptValidator(addr); reply != "" {
+					sess.reject("recipient", reply)
+					continue
+				}
+			}
+
+			if !sess.msg.UTF8 && !isASCII(addr) {
+				sess.reply("553 Non-ASCII address requires SMTPUTF8")
+				continue
+			}
+
+			notify := strings.ToUpper(params["NOTIFY"])
+			if notify != "" && !validNotify(notify) {
+				sess.reply("501 Invalid NOTIFY parameter")
+				continue
+			}
+
+			if reply := sess.applyRules(stageRcpt, addr, nil); reply != "" {
+				sess.reject("rule", reply)
+				continue
+			}
+
+			if sess.srv.Greylist != nil && !sess.trusted() && !sess.srv.Greylist(sess.ip, sess.msg.From, addr) {
+				sess.reject("greylist", "451 4.7.1 Greylisted, please try again later")
+				continue
+			}
+
+			orcpt, hasORcpt := params["ORCPT"]
+			orcpt = decodeXtext(orcpt)
+			if hasORcpt && !printable(orcpt) {
+				sess.reply("501 5.5.4 Invalid ORCPT parameter")
+				continue
+			}
+
+			msg := &sess.msg
+			if notify != "" {
+				if msg.Notify == nil {
+					msg.Notify = make(map[string]string)
+				}
+				msg.Notify[addr] = notify
+			}
+
+			if hasORcpt {
+				if msg.ORcpt == nil {
+					msg.ORcpt = make(map[string]string)
+				}
+				msg.ORcpt[addr] = orcpt
+			}
+
+			msg.To = append(msg.To, addr)
+			sess.state = stateRcpt
+			sess.reply("250 Defending your honour")
+		case "DATA":
+			if sess.state != stateRcpt {
+				sess.reply("503 Need RCPT before DATA")
+				continue
+			}
+
+			if sess.chunks.Len() > 0 || sess.tooBig {
+				sess.reply("503 DATA not allowed after BDAT")
+				continue
+			}
+
+			if !sess.begin() {
+				sess.bye("421 Service shutting down")
+				return
+			}
+
+			sess.rawConn.SetDeadline(time.Now().Add(sess.srv.dataTimeout()))
+			sess.reply("354 Give me a quest!")
+			flush(c)
+			data, err := readData(c.R, maxSize)
+			if err != nil && err != errBareLineEnding && err != errTooBig {
+				panic(err)
+			}
+			sess.trace.line("C", fmt.Sprintf("<%d bytes of message data>", len(data)))
+
+			switch err {
+			case errBareLineEnding:
+				sess.reject("bare-line-ending", "550 Bare CR or LF not permitted in message data")
+			case errTooBig:
+				sess.reject("size", "552 Message size exceeds fixed maximum message size")
+			default:
+				sess.reply(sess.deliver(data))
+			}
+
+			sess.end()
+			sess.reset()
+		case "BDAT":
+			fields := strings.Fields(args)
+			last := len(fields) == 2 && strings.ToUpper(fields[1]) == "LAST"
+			if len(fields) < 1 || len(fields) > 2 || len(fields) == 2 && !last {
+				sess.reply("501 Syntax: BDAT <size> [LAST]")
+				continue
+			}
+
+			size, err := strconv.ParseInt(fields[0], 10, 64)
+			if err != nil || size < 0 {
+				// the chunk can't be skipped without its size, so the session is lost
+				sess.bye("501 Invalid chunk size")
+				return
+			}
+
+			if !sess.begin() {
+				sess.bye("421 Service shutting down")
+				return
+			}
+
+			sess.rawConn.SetDeadline(time.Now().Add(sess.srv.dataTimeout()))
+
+			// chunk data is consumed either way, over the limit or out of sequence it is thrown away
+			var dst io.Writer = &sess.chunks
+			if sess.state != stateRcpt || sess.tooBig || int64(sess.chunks.Len())+size > int64(maxSize) {
+				sess.tooBig = sess.state == stateRcpt
+				sess.chunks.Reset()
+				dst = ioutil.Discard
+			}
+
+			if _, err = io.CopyN(dst, c.R, size); err != nil {
+				panic(err)
+			}
+			sess.trace.line("C", fmt.Sprintf("<%d bytes of chunk data>", size))
+
+			sess.end()
+
+			if sess.state != stateRcpt {
+				sess.reply("503 Need RCPT before BDAT")
+				continue
+			}
+
+			if !last {
+				sess.reply(fmt.Sprintf("250 %d octets received", size))
+				continue
+			}
+
+			if sess.tooBig {
+				sess.reject("size", "552 Message size exceeds fixed maximum message size")
+			} else {
+				sess.reply(sess.deliver(append([]byte(nil), sess.chunks.Bytes()...)))
+			}
+
+			sess.reset()
+		case "AUTH":
+			if sess.srv.Auth == nil {
+				sess.reply("502 Command not implemented")
+				continue
+			}
+
+			if sess.state == stateConnected {
+				sess.reply("503 Send EHLO first")
+				continue
+			}
+
+			// the credentials would cross the network in the clear
+			if !sess.authOffered() {
+				sess.reject("tls", "538 5.7.11 Encryption required for requested authentication mechanism")
+				continue
+			}
+
+			if sess.user != "" {
+				sess.reply("503 Already authenticated")
+				continue
+			}
+
+			if sess.state != stateGreeted {
+				sess.reply("503 AUTH not permitted during a mail transaction")
+				continue
+			}
+
+			sess.reply(sess.auth(strings.Fields(args)))
+		case "STARTTLS":
+			if tlsConfig == nil {
+				sess.reply("502 Command not implemented")
+				continue
+			}
+
+			if sess.tls {
+				sess.reply("503 Already running TLS")
+				continue
+			}
+
+			sess.reply("220 Ready to start TLS")
+			flush(c)
+			if err := sess.startTLS(); err != nil {
+				sess.logf(phaseTLS, "TLS handshake failed", "err", err)
+				return
+			}
+
+			// client starts over with EHLO
+			c = sess.text
+			sess.user = sess.certUser()
+			sess.reset()
+			sess.state = stateConnected
+		case "VRFY", "EXPN":
+			sess.reply(sess.verify(cmd, args))
+		case "XCLIENT":
+			sess.reply(sess.xclient(args))
+		case "NOOP":
+			sess.reply("250 OK")
+		case "HELP":
+			writeMulti(c, 214, sess.help())
+		case "TURN", "ETRN", "ATRN", "SEND", "SOML", "SAML", "BURL":
+			// known verbs we don't do
+			sess.reply("502 Command not implemented")
+		case "RSET":
+			sess.reset()
+			sess.reply("250 OK")
+		case "QUIT":
+			sess.bye("221 For the king")
+			return
+		default:
+			sess.logf(sess.phase(), "Unknown command", "command", s)
+			sess.reply("500 Command not recognized")
+		}
+	}
+}
+
+// reply answers a command, rejections count against the session's error budget
+func (s *session) reply(msg string) {
+	if strings.HasPrefix(msg, "5") {
+		s.errors++
+	}
+
+	write(s.text, msg)
+}
+
+// throttle keeps the session under Server.CommandRate by delaying the next read
+func (s *session) throttle() {
+	if s.srv.CommandRate <= 0 {
+		return
+	}
+
+	interval := time.Second / time.Duration(s.srv.CommandRate)
+	if wait := interval - time.Since(s.lastCommand); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	s.lastCommand = time.Now()
+}
+
+func write(c *textproto.Conn, msg string) {
+	if _, err := fmt.Fprintf(c.W, "%s\r\n", msg); err != nil {
+		panic(err)
+	}
+}
+
+func flush(c *textproto.Conn) {
+	if err := c.W.Flush(); err != nil {
+		panic(err)
+	}
+}
+
+// parseCommand splits a command line into its upper-cased verb and the arguments
+// following it, tolerating any amount of surrounding whitespace
+func parseCommand(line string) (cmd, args string) {
+	line = strings.Trim(line, " \t")
+
+	i := strings.IndexAny(line, " \t")
+	if i < 0 {
+		return strings.ToUpper(line), ""
+	}
+
+	return strings.ToUpper(line[:i]), strings.TrimLeft(line[i:], " \t")
+}
+
+// checkSyntax validates the arguments of commands with a fixed shape, returning the
+// 500/501 reply for a malformed command
+func checkSyntax(cmd, args string) string {
+	switch cmd {
+	case "":
+		return "500 Syntax error, command unrecognized"
+	case "EHLO", "HELO":
+		// other whitespace than " \t" is left in args by parseCommand
+		if len(strings.Fields(args)) == 0 {
+			return "501 Syntax: " + cmd + " hostname"
+		}
+	case "VRFY", "EXPN":
+		if args == "" {
+			return "501 Syntax: " + cmd + " address"
+		}
+	case "DATA", "RSET", "QUIT", "STARTTLS":
+		if args != "" {
+			return "501 Syntax: " + cmd + " takes no parameters"
+		}
+	}
+
+	return ""
+}
+
+func allowedBeforeTLS(cmd string) bool {
+	switch cmd {
+	case "EHLO", "HELO", "STARTTLS", "NOOP", "RSET", "QUIT":
+		return true
+	}
+
+	return false
+}
+
+// validNotify checks a DSN NOTIFY value: NEVER, or a list of SUCCESS, FAILURE and DELAY
+func validNotify(notify string) bool {
+	if notify == "NEVER" {
+		return true
+	}
+
+	for _, n := range strings.Split(notify, ",") {
+		if n != "SUCCESS" && n != "FAILURE" && n != "DELAY" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// decodeXtext undoes the xtext encoding (RFC 3461) where "+XX" stands for a hex encoded byte
+func decodeXtext(s string) string {
+	var buf bytes.Buffer
+
+	for i := 0; i < len(s); i++ {
+		if s[i] == '+' && i+2 < len(s) {
+			if b, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				buf.WriteByte(byte(b))
+				i += 2
+				continue
+			}
+		}
+		buf.WriteByte(s[i])
+	}
+
+	return buf.String()
+}
+
+// maxEnvIDLength is the longest ENVID once decoded (RFC 3461 section 4.4)
+const maxEnvIDLength = 100
+
+// printable reports whether the decoded xtext s is all printable US-ASCII, as ENVID and ORCPT
+// must be. Both end up in the notices the server sends, a CR or LF would inject lines.
+func printable(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x21 || s[i] > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// readLine reads through the next LF. A line longer than limit is consumed but returned
+// truncated, so a single endless line can't exhaust memory.
+func readLine(r *bufio.Reader, limit int) (line []byte, err error) {
+	for {
+		frag, err := r.ReadSlice('\n')
+		if len(line) <= limit {
+			line = append(line, frag...)
+		}
+
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// writeMulti writes a multiline reply, all lines but the last use the "code-" continuation
+func writeMulti(c *textproto.Conn, code int, lines []string) {
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		write(c, fmt.Sprintf("%d%s%s", code, sep, line))
+	}
+}
+
+// read waits for the next command, for no longer than the command timeout. A server that
+// is shutting down doesn't wait at all. Lines longer than max are errLineTooLong.
+func (s *session) read(max int) (string, error) {
+	c := s.text
+
+	// nothing more pipelined, client waits for replies
+	s.rawConn.SetWriteDeadline(time.Now().Add(s.srv.commandTimeout()))
+	if c.R.Buffered() == 0 {
+		flush(c)
+	}
+
+	// under lock, so Shutdown either sees the deadline set here or overrides it
+	s.srv.mu.Lock()
+	deadline := time.Now().Add(s.srv.commandTimeout())
+	if s.srv.closed {
+		deadline = time.Now()
+	}
+	s.rawConn.SetReadDeadline(deadline)
+	s.srv.mu.Unlock()
+
+	line, err := readLine(c.R, max)
+	if err != nil {
+		return "", err
+	}
+	// the limit counts the CRLF
+	if len(line) > max {
+		return "", errLineTooLong
+	}
+
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return string(bytes.TrimSuffix(line, []byte("\r"))), nil
+}
+
+// help lists the commands available in the session
+func (s *session) help() []string {
+	cmds := "HELO EHLO MAIL RCPT DATA BDAT RSET NOOP QUIT HELP VRFY EXPN"
+	if s.srv.TLSConfig != nil && !s.tls {
+		cmds += " STARTTLS"
+	}
+	if s.authOffered() {
+		cmds += " AUTH"
+	}
+
+	return []string{"Commands supported:", cmds, "End of HELP info"}
+}
+
+// certUser names the client authenticated by a certificate verified against
+// TLSConfig.ClientCAs, empty if there is none
+func (s *session) certUser() string {
+	conn, ok := s.conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	chains := conn.ConnectionState().VerifiedChains
+	if len(chains) == 0 {
+		return ""
+	}
+
+	cert := chains[0][0]
+	user := cert.Subject.CommonName
+	if user == "" {
+		user = cert.Subject.String()
+	}
+
+	s.logf(phaseTLS, "Client authenticated by certificate", "user", user)
+	return user
+}
+
+// greetingPause waits GreetingDelay before the banner. Clients must wait for it, spam bots
+// often don't: anything sent early gets the session dropped.
+func (s *session) greetingPause() bool {
+	if s.srv.GreetingDelay <= 0 {
+		return true
+	}
+
+	s.rawConn.SetReadDeadline(time.Now().Add(s.srv.GreetingDelay))
+	_, err := s.text.R.Peek(1)
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+
+	if err == nil {
+		s.logf(phaseConnect, "Dropping early talker")
+		s.srv.metric("rejects.early-talker", 1)
+		s.bye("554 Protocol violation, talking before the greeting")
+	}
+
+	return false
+}
+
+// bye sends the final reply before the session is dropped
+func (s *session) bye(reply string) {
+	s.rawConn.SetWriteDeadline(time.Now().Add(goodbyeTimeout))
+	write(s.text, reply)
+	flush(s.text)
+}
+
+// readData reads message data up to the terminating CRLF.CRLF and undoes dot-stuffing.
+// Only a strict CRLF.CRLF ends the data. A bare CR or LF anywhere in the message taints it,
+// the data is still consumed up to the real terminator and then rejected, so a smuggled
+// "\n.\n" can never be mistaken for the end of one message and the start of another.
+// Data past limit bytes is consumed and discarded, the message is then rejected as too big.
+func readData(r *bufio.Reader, limit int) ([]byte, error) {
+	var buf bytes.Buffer
+	tainted, tooBig := false, false
+
+	for {
+		line, err := readLine(r, limit)
+		if err != nil {
+			return nil, err
+		}
+
+		n := len(line)
+		if n < 2 || line[n-2] != '\r' || bytes.IndexByte(line[:n-2], '\r') >= 0 {
+			tainted = true
+		} else if n == 3 && line[0] == '.' {
+			break
+		}
+
+		// dot-stuffing
+		if line[0] == '.' {
+			line = line[1:]
+		}
+
+		if buf.Len()+len(line) > limit {
+			tooBig = true
+			buf.Reset()
+		}
+
+		if !tooBig {
+			buf.Write(line)
+		}
+	}
+
+	if tooBig {
+		return nil, errTooBig
+	}
+
+	if tainted {
+		return nil, errBareLineEnding
+	}
+
+	return buf.Bytes(), nil
+}
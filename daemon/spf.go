@@ -0,0 +1,405 @@
+package daemon
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SPF results (RFC 7208 section 2.6)
+const (
+	SPFNone      = "none"
+	SPFNeutral   = "neutral"
+	SPFPass      = "pass"
+	SPFFail      = "fail"
+	SPFSoftFail  = "softfail"
+	SPFTempError = "temperror"
+	SPFPermError = "permerror"
+)
+
+// RFC 7208 section 4.6.4, DNS querying terms per check
+const maxSPFLookups = 10
+
+// lookupMX resolves the mx mechanism, replaced in tests
+var lookupMX = net.DefaultResolver.LookupMX
+
+// spfCheck is one evaluation of check_host(), shared by nested include and redirect
+type spfCheck struct {
+	ctx     context.Context
+	ip      net.IP
+	sender  string // MAIL FROM, postmaster@helo for the null sender
+	helo    string
+	lookups int
+}
+
+// checkSPF evaluates the SPF policy of the sender's domain, or of the HELO name for the null
+// sender, for a client connecting from ip
+func checkSPF(ctx context.Context, ip net.IP, helo, sender string) string {
+	if !strings.Contains(sender, "@") {
+		sender = "postmaster@" + helo
+	}
+
+	c := &spfCheck{ctx: ctx, ip: ip, sender: sender, helo: helo}
+	return c.check(domainOf(sender))
+}
+
+func (c *spfCheck) check(domain string) string {
+	// underscores are common in names of included records, e.g. _spf.example.com
+	if !validDomain(strings.Replace(domain, "_", "x", -1)) {
+		return SPFNone
+	}
+
+	record, result := c.record(domain)
+	if record == "" {
+		return result
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		if name, value, ok := spfModifier(term); ok {
+			if strings.EqualFold(name, "redirect") {
+				redirect = value
+			}
+			continue
+		}
+
+		qualifier := byte('+')
+		if strings.IndexByte("+-~?", term[0]) >= 0 {
+			qualifier, term = term[0], term[1:]
+		}
+
+		match, errResult := c.mechanism(term, domain)
+		if errResult != "" {
+			return errResult
+		}
+
+		if match {
+			switch qualifier {
+			case '-':
+				return SPFFail
+			case '~':
+				return SPFSoftFail
+			case '?':
+				return SPFNeutral
+			}
+			return SPFPass
+		}
+	}
+
+	if redirect != "" {
+		if c.lookups++; c.lookups > maxSPFLookups {
+			return SPFPermError
+		}
+
+		result := c.check(c.expand(redirect, domain))
+		if result == SPFNone {
+			return SPFPermError
+		}
+		return result
+	}
+
+	return SPFNeutral
+}
+
+// record fetches the single SPF record of domain, empty with the result to return if there is none
+func (c *spfCheck) record(domain string) (string, string) {
+	txts, err := lookupTXT(c.ctx, domain)
+	if isNotFound(err) {
+		return "", SPFNone
+	}
+	if err != nil {
+		return "", SPFTempError
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || len(txt) > 7 && strings.EqualFold(txt[:7], "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+
+	switch len(records) {
+	case 0:
+		return "", SPFNone
+	case 1:
+		return records[0], ""
+	}
+
+	return "", SPFPermError
+}
+
+// mechanism reports whether term matches the client, or the error result that ends the check
+func (c *spfCheck) mechanism(term, domain string) (bool, string) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, arg = term[:i], term[i:]
+	}
+	name = strings.ToLower(name)
+
+	switch name {
+	case "all":
+		return arg == "", errIf(arg != "")
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return false, SPFPermError
+		}
+
+		network := arg[1:]
+		if !strings.Contains(network, "/") {
+			network += map[string]string{"ip4": "/32", "ip6": "/128"}[name]
+		}
+
+		_, n, err := net.ParseCIDR(network)
+		if err != nil {
+			return false, SPFPermError
+		}
+		return n.Contains(c.ip), ""
+	}
+
+	// the rest cost a DNS lookup each
+	if c.lookups++; c.lookups > maxSPFLookups {
+		return false, SPFPermError
+	}
+
+	target, v4, v6, ok := c.domainSpec(arg, domain)
+	if !ok {
+		return false, SPFPermError
+	}
+
+	if (name == "include" || name == "exists") && !strings.HasPrefix(arg, ":") {
+		return false, SPFPermError
+	}
+
+	switch name {
+	case "include":
+		switch c.check(target) {
+		case SPFPass:
+			return true, ""
+		case SPFTempError:
+			return false, SPFTempError
+		case SPFPermError, SPFNone:
+			return false, SPFPermError
+		}
+		return false, ""
+	case "a":
+		return c.matchHost(target, v4, v6)
+	case "mx":
+		mxs, err := lookupMX(c.ctx, target)
+		if isNotFound(err) {
+			return false, ""
+		}
+		if err != nil {
+			return false, SPFTempError
+		}
+
+		for i, mx := range mxs {
+			if i == maxSPFLookups {
+				return false, SPFPermError
+			}
+
+			if match, errResult := c.matchHost(strings.TrimSuffix(mx.Host, "."), v4, v6); match || errResult != "" {
+				return match, errResult
+			}
+		}
+		return false, ""
+	case "exists":
+		addrs, err := lookupHost(c.ctx, target)
+		if isNotFound(err) {
+			return false, ""
+		}
+		if err != nil {
+			return false, SPFTempError
+		}
+		return len(addrs) > 0, ""
+	case "ptr":
+		// deprecated by RFC 7208 and expensive, treated as never matching
+		return false, ""
+	}
+
+	return false, SPFPermError
+}
+
+// domainSpec splits ":domain/v4cidr//v6cidr", the domain defaults to the current one
+func (c *spfCheck) domainSpec(arg, domain string) (target string, v4, v6 int, ok bool) {
+	v4, v6 = 32, 128
+
+	if i := strings.Index(arg, "//"); i >= 0 {
+		n, err := strconv.Atoi(arg[i+2:])
+		if err != nil || n < 0 || n > 128 {
+			return "", 0, 0, false
+		}
+		v6, arg = n, arg[:i]
+	}
+
+	if i := strings.LastIndex(arg, "/"); i >= 0 {
+		n, err := strconv.Atoi(arg[i+1:])
+		if err != nil || n < 0 || n > 32 {
+			return "", 0, 0, false
+		}
+		v4, arg = n, arg[:i]
+	}
+
+	target = domain
+	if strings.HasPrefix(arg, ":") {
+		target = c.expand(arg[1:], domain)
+	} else if arg != "" {
+		return "", 0, 0, false
+	}
+
+	return target, v4, v6, true
+}
+
+// matchHost reports whether an address of host is in the client's network
+func (c *spfCheck) matchHost(host string, v4, v6 int) (bool, string) {
+	addrs, err := lookupHost(c.ctx, host)
+	if isNotFound(err) {
+		return false, ""
+	}
+	if err != nil {
+		return false, SPFTempError
+	}
+
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip == nil || (ip.To4() == nil) != (c.ip.To4() == nil) {
+			continue
+		}
+
+		bits, size := v6, 128
+		if ip.To4() != nil {
+			ip, bits, size = ip.To4(), v4, 32
+		}
+
+		n := net.IPNet{IP: ip.Mask(net.CIDRMask(bits, size)), Mask: net.CIDRMask(bits, size)}
+		if n.Contains(c.ip) {
+			return true, ""
+		}
+	}
+
+	return false, ""
+}
+
+// expand replaces macros (RFC 7208 section 7) in a domain spec
+func (c *spfCheck) expand(s, domain string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		switch s[i] {
+		case '%':
+			b.WriteByte('%')
+		case '_':
+			b.WriteByte(' ')
+		case '-':
+			b.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 2 {
+				return b.String()
+			}
+			b.WriteString(c.macro(s[i+1:i+end], domain))
+			i += end
+		}
+	}
+
+	return b.String()
+}
+
+// macro expands a single macro such as "ir" or "d2"
+func (c *spfCheck) macro(m, domain string) string {
+	var value string
+	switch m[0] | 0x20 {
+	case 's':
+		value = c.sender
+	case 'l':
+		value = c.sender[:strings.LastIndex(c.sender, "@")]
+	case 'o':
+		value = domainOf(c.sender)
+	case 'd':
+		value = domain
+	case 'h':
+		value = c.helo
+	case 'i':
+		value = c.ip.String()
+		if c.ip.To4() == nil {
+			nibbles := strings.Split(reverseIP(c.ip), ".")
+			for i, j := 0, len(nibbles)-1; i < j; i, j = i+1, j-1 {
+				nibbles[i], nibbles[j] = nibbles[j], nibbles[i]
+			}
+			value = strings.Join(nibbles, ".")
+		}
+	case 'v':
+		value = "in-addr"
+		if c.ip.To4() == nil {
+			value = "ip6"
+		}
+	default:
+		return ""
+	}
+
+	// transformers: keep the rightmost n parts, r reverses, other characters are delimiters
+	m = m[1:]
+	digits := 0
+	for digits < len(m) && m[digits] >= '0' && m[digits] <= '9' {
+		digits++
+	}
+	keep, _ := strconv.Atoi(m[:digits])
+	m = m[digits:]
+
+	reverse := strings.HasPrefix(m, "r") || strings.HasPrefix(m, "R")
+	if reverse {
+		m = m[1:]
+	}
+
+	delims := m
+	if delims == "" {
+		delims = "."
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delims, r) })
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// spfModifier splits name=value terms, mechanisms have ':' or '/' before any '='
+func spfModifier(term string) (name, value string, ok bool) {
+	i := strings.IndexByte(term, '=')
+	if i <= 0 || strings.ContainsAny(term[:i], ":/") {
+		return "", "", false
+	}
+
+	return term[:i], term[i+1:], true
+}
+
+func errIf(cond bool) string {
+	if cond {
+		return SPFPermError
+	}
+
+	return ""
+}
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+// domainOf returns the lower case domain of addr
+func domainOf(addr string) string {
+	return strings.ToLower(addr[strings.LastIndex(addr, "@")+1:])
+}
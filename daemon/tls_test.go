@@ -0,0 +1,194 @@
+package daemon
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/smtp"
+	"testing"
+	"time"
+)
+
+// issue creates a certificate for name signed by parent, self-signed if parent is nil
+func issue(t *testing.T, name string, parent *tls.Certificate, ca bool) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := tmpl, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	ca := issue(t, "Test CA", nil, true)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	msgs := make(chan *Msg, 1)
+	c := serve(t, &Server{
+		Handler: func(msg *Msg) { msgs <- msg },
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{issue(t, "localhost", &ca, false)},
+			ClientCAs:    pool,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		},
+		RelayNetworks: []*net.IPNet{n},
+	})
+
+	submit := func(certs []tls.Certificate) error {
+		client, err := smtp.Dial(c.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		if err = client.StartTLS(&tls.Config{ServerName: "localhost", RootCAs: pool, Certificates: certs}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = client.Mail("a@example.com"); err != nil {
+			return err
+		}
+		return client.Rcpt("b@example.org")
+	}
+
+	if err := submit(nil); err == nil {
+		t.Fatal("Relayed without a client certificate")
+	}
+
+	if err := submit([]tls.Certificate{issue(t, "billing", nil, false)}); err == nil {
+		t.Fatal("Relayed with an untrusted client certificate")
+	}
+
+	if err := submit([]tls.Certificate{issue(t, "billing", &ca, false)}); err != nil {
+		t.Fatal("Trusted client certificate refused:", err)
+	}
+}
+
+func TestListenerPolicy(t *testing.T) {
+	cert := issue(t, "localhost", nil, false)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	clientConfig := &tls.Config{ServerName: "localhost", RootCAs: pool}
+
+	srv := &Server{
+		Handler:     func(msg *Msg) {},
+		TLSConfig:   &tls.Config{Certificates: []tls.Certificate{cert}},
+		RequireTLS:  true,
+		RequireAuth: true,
+		Auth:        AuthFunc(func(user, pass string) bool { return user == "u" && pass == "p" }),
+	}
+
+	c := serve(t, srv)
+	c.PrintfLine("EHLO client\r\nMAIL FROM:<a@example.com>\r\nAUTH PLAIN AHUAcA==")
+	c.expect(t, 220, 250, 530, 530)
+
+	client, err := smtp.Dial(c.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err = client.StartTLS(clientConfig); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Mail("a@example.com"); err == nil {
+		t.Fatal("MAIL accepted without AUTH")
+	}
+	if err = client.Auth(smtp.PlainAuth("", "u", "p", "127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Mail("a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// port 465 style, TLS from the first byte
+	srv = &Server{Handler: func(msg *Msg) {}, TLSConfig: srv.TLSConfig, ImplicitTLS: true, RequireTLS: true}
+	c = serve(t, srv)
+
+	conn, err := tls.Dial("tcp", c.addr, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err = smtp.NewClient(conn, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		t.Fatal("STARTTLS offered over TLS")
+	}
+	if err = client.Mail("a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthRequiresTLS(t *testing.T) {
+	cert := issue(t, "localhost", nil, false)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+
+	c := serve(t, &Server{
+		Handler:         func(msg *Msg) {},
+		TLSConfig:       &tls.Config{Certificates: []tls.Certificate{cert}},
+		Auth:            AuthFunc(func(user, pass string) bool { return user == "u" && pass == "p" }),
+		AuthRequiresTLS: true,
+	})
+
+	c.PrintfLine("EHLO client\r\nAUTH PLAIN AHUAcA==")
+	c.expect(t, 220, 250, 538)
+
+	client, err := smtp.Dial(c.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err = client.Hello("client"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := client.Extension("AUTH"); ok {
+		t.Fatal("AUTH offered before TLS")
+	}
+
+	if err = client.StartTLS(&tls.Config{ServerName: "localhost", RootCAs: pool}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := client.Extension("AUTH"); !ok {
+		t.Fatal("AUTH not offered after TLS")
+	}
+	if err = client.Auth(smtp.PlainAuth("", "u", "p", "127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+}
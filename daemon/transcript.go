@@ -0,0 +1,89 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// transcript records the commands and replies of one session, see Server.TranscriptDir.
+// Message data and credentials are never written. A nil transcript records nothing.
+type transcript struct {
+	f       *os.File
+	w       *bufio.Writer
+	partial []byte // reply bytes not yet terminated by a line ending
+}
+
+// openTranscript creates the transcript file of a session, on error the session runs untraced
+func openTranscript(dir, ip string) (*transcript, error) {
+	name := fmt.Sprintf("%s-%s.log", time.Now().UTC().Format("20060102T150405.000000000"), strings.Replace(ip, ":", "_", -1))
+
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &transcript{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// line records one line, who is "C" for the client, "S" for the server or "*" for events
+func (t *transcript) line(who, text string) {
+	if t == nil {
+		return
+	}
+
+	fmt.Fprintf(t.w, "%s %s: %s\n", time.Now().Format("15:04:05.000"), who, text)
+}
+
+// Write records replies as they are sent to the client
+func (t *transcript) Write(p []byte) (int, error) {
+	t.partial = append(t.partial, p...)
+
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			break
+		}
+
+		t.line("S", string(bytes.TrimRight(t.partial[:i], "\r")))
+		t.partial = t.partial[i+1:]
+	}
+
+	return len(p), nil
+}
+
+func (t *transcript) close() {
+	if t == nil {
+		return
+	}
+
+	t.line("*", "Connection closed")
+	t.w.Flush()
+	t.f.Close()
+}
+
+// traceReplies tees everything written to the client into the transcript
+func (s *session) traceReplies() {
+	if s.trace != nil {
+		s.text.W = bufio.NewWriter(io.MultiWriter(s.conn, s.trace))
+	}
+}
+
+// redact hides credentials sent along with AUTH
+func redact(line string) string {
+	cmd, args := parseCommand(line)
+	if cmd != "AUTH" {
+		return line
+	}
+
+	if fields := strings.Fields(args); len(fields) > 1 {
+		return "AUTH " + fields[0] + " ***"
+	}
+
+	return line
+}
@@ -0,0 +1,38 @@
+package daemon
+
+import "strings"
+
+// VRFY and EXPN policies
+const (
+	VRFYCannot   = "cannot"   // 252, neither confirm nor deny, the default
+	VRFYDisabled = "disabled" // 502, commands not implemented
+	VRFYLookup   = "lookup"   // answer from Server.Mailbox
+)
+
+// verify answers VRFY and EXPN. Lookups of unknown addresses count against the error budget,
+// which limits address harvesting.
+func (s *session) verify(cmd, args string) string {
+	switch s.srv.VRFY {
+	case VRFYDisabled:
+		return "502 Command not implemented"
+	case VRFYLookup:
+		if s.srv.Mailbox == nil {
+			break
+		}
+
+		addr := strings.TrimSuffix(strings.TrimPrefix(args, "<"), ">")
+		if s.srv.Mailbox(addr) {
+			return "250 <" + addr + ">"
+		}
+
+		if cmd == "EXPN" {
+			return "550 No such mailing list"
+		}
+		return "550 No such user"
+	}
+
+	if cmd == "EXPN" {
+		return "252 Cannot expand, but will accept message and attempt delivery"
+	}
+	return "252 Cannot VRFY user, but will accept message and attempt delivery"
+}
@@ -0,0 +1,81 @@
+package daemon
+
+import (
+	"net"
+	"strings"
+)
+
+// xclient applies the XCLIENT command (Postfix extension) of a trusted frontend, replacing the
+// client attributes used for Received headers and policy checks. The session restarts as if
+// the real client had just connected.
+func (s *session) xclient(args string) string {
+	if !s.xclientOK {
+		return "550 Insufficient authorization"
+	}
+
+	if s.state == stateMail || s.state == stateRcpt {
+		return "503 XCLIENT not permitted during a mail transaction"
+	}
+
+	if args == "" {
+		return "501 Syntax: XCLIENT attribute=value ..."
+	}
+
+	attrs := make(map[string]string)
+	for _, a := range strings.Fields(args) {
+		kv := strings.SplitN(a, "=", 2)
+		if len(kv) != 2 {
+			return "501 Syntax: XCLIENT attribute=value ..."
+		}
+
+		value := decodeXtext(kv[1])
+		if value == "[UNAVAILABLE]" || value == "[TEMPUNAVAIL]" {
+			value = ""
+		}
+		attrs[strings.ToUpper(kv[0])] = value
+	}
+
+	if addr, ok := attrs["ADDR"]; ok && addr != "" {
+		ip := net.ParseIP(strings.TrimPrefix(strings.ToUpper(addr), "IPV6:"))
+		if ip == nil {
+			return "501 Invalid ADDR"
+		}
+
+		s.logf(phaseConnect, "Client address from XCLIENT", "addr", ip.String())
+		s.srv.rekey(s, ip.String())
+		s.remote = &net.TCPAddr{IP: ip}
+		s.relay = s.srv.mayRelay(s.ip)
+		s.dnsbl, s.dnsblChecked = "", false
+		s.ptr, s.ptrTemporary = "", false
+	}
+
+	if helo, ok := attrs["HELO"]; ok {
+		s.helo = helo
+	}
+
+	if proto, ok := attrs["PROTO"]; ok {
+		s.esmtp = strings.EqualFold(proto, "ESMTP")
+	}
+
+	if login, ok := attrs["LOGIN"]; ok {
+		s.user = login
+	}
+
+	s.reset()
+	s.state = stateConnected
+
+	return s.srv.greeting()
+}
+
+// rekey moves s to another client IP in the per-IP connection count
+func (srv *Server) rekey(s *session, ip string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.perIP[s.ip]--; srv.perIP[s.ip] <= 0 {
+		delete(srv.perIP, s.ip)
+	}
+	srv.perIP[ip]++
+
+	s.ip = ip
+}
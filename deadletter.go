@@ -0,0 +1,29 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"time"
+)
+
+// purger drops old dead letters so they don't pile up in the queue forever
+type purger interface {
+	PurgeDead(retention time.Duration, keep int) (int, error)
+}
+
+var deadPurged = expvar.NewInt("dead_purged")
+
+// purgeLoop enforces the dead letter retention every hour
+func purgeLoop(p purger, retention time.Duration, keep int) {
+	for {
+		n, err := p.PurgeDead(retention, keep)
+		if err != nil {
+			log.Println("Error purging dead letters:", err)
+		} else if n > 0 {
+			deadPurged.Add(int64(n))
+			log.Println("Purged", n, "dead letters")
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,228 @@
+package emailq
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	bolt "go.etcd.io/bbolt"
+)
+
+var archiveBucket = []byte("archive")
+
+// Archive is what RemoveDelivered keeps of a delivered message
+type Archive int
+
+const (
+	ArchiveOff     Archive = iota // nothing, delivered messages are deleted
+	ArchiveHeaders                // envelope and headers, the body is dropped
+	ArchiveFull                   // the whole message
+)
+
+// headers cuts data after the blank line ending the header
+func headers(data []byte) []byte {
+	for _, sep := range [][]byte{[]byte("\r\n\r\n"), []byte("\n\n")} {
+		if i := bytes.Index(data, sep); i >= 0 {
+			return data[:i+len(sep)]
+		}
+	}
+
+	return data
+}
+
+// archive turns the stored value of a delivered message into what mode keeps of it
+func (c codec) archive(key, v []byte, mode Archive, now time.Time) ([]byte, error) {
+	msg, err := decodeMsg(v)
+	if err != nil {
+		return nil, err
+	}
+	msg.Delivered = now.UTC()
+
+	if mode == ArchiveFull {
+		return encode(msg), nil
+	}
+
+	// the body may be sealed or in a blob, open it to store the headers anew
+	if err = c.open([]Delivery{{Key: key, Msg: msg}}); err != nil {
+		return nil, err
+	}
+	msg.Data = headers(msg.Data)
+
+	return c.encode(msg)
+}
+
+// remove drops a delivered message q popped, keeping what q.archive says in the archive.
+// A message no longer out for delivery is left alone.
+func (q *EmailQ) remove(tx *bolt.Tx, key []byte) error {
+	v, err := q.held(tx, key)
+	if err == errNotLeased {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if q.archive != ArchiveOff {
+		a, err := q.codec.archive(key, v, q.archive, q.now())
+		if err != nil {
+			return err
+		}
+		if err = tx.Bucket(archiveBucket).Put(key, a); err != nil {
+			return err
+		}
+	}
+
+	return deleteIncoming(tx, key, hostOf(v))
+}
+
+// ListArchived pages through delivered messages kept in the archive in key order
+func (q *EmailQ) ListArchived(ctx context.Context, f Filter) ([]Delivery, error) {
+	return q.list(ctx, archiveBucket, f)
+}
+
+// PurgeArchive drops archived messages delivered longer than retention ago, zero keeps them
+// all. Returns how many were dropped.
+func (q *EmailQ) PurgeArchive(retention time.Duration) (int, error) {
+	if retention <= 0 {
+		return 0, nil
+	}
+
+	return q.purge(archiveBucket, retention, 0)
+}
+
+// ListArchived pages through the archives of all shards
+func (s *Sharded) ListArchived(ctx context.Context, f Filter) ([]Delivery, error) {
+	return s.list(ctx, (*EmailQ).ListArchived, f)
+}
+
+// PurgeArchive drops old archived messages of all shards
+func (s *Sharded) PurgeArchive(retention time.Duration) (purged int, err error) {
+	for _, q := range s.shards {
+		n, err := q.PurgeArchive(retention)
+		purged += n
+		if err != nil {
+			return purged, err
+		}
+	}
+
+	return purged, nil
+}
+
+// ListArchived pages through delivered messages kept in the archive in key order
+func (m *Memory) ListArchived(ctx context.Context, f Filter) ([]Delivery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	page := listEntries(m.archive, f)
+	return page, m.codec().open(page)
+}
+
+// PurgeArchive drops archived messages delivered longer than retention ago
+func (m *Memory) PurgeArchive(retention time.Duration) (purged int, err error) {
+	if retention <= 0 {
+		return 0, nil
+	}
+	cutoff := m.now().Add(-retention)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for k, e := range m.archive {
+		if e.due.Before(cutoff) {
+			delete(m.archive, k)
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+// ListArchived pages through delivered messages kept in the archive in key order
+func (r *Redis) ListArchived(ctx context.Context, f Filter) ([]Delivery, error) {
+	return r.list(ctx, r.archive, f)
+}
+
+// PurgeArchive drops archived messages delivered longer than retention ago
+func (r *Redis) PurgeArchive(retention time.Duration) (int, error) {
+	if retention <= 0 {
+		return 0, nil
+	}
+	cutoff := score(r.now().Add(-retention))
+	return purgeScript.Run(context.Background(), r.client, []string{r.archive, r.msgs, r.hosts, r.retried}, cutoff, 0).Int()
+}
+
+// ListArchived pages through delivered messages kept in the archive in key order
+func (s *SQL) ListArchived(ctx context.Context, f Filter) ([]Delivery, error) {
+	return s.list(ctx, stateArchived, f)
+}
+
+// PurgeArchive drops archived messages delivered longer than retention ago
+func (s *SQL) PurgeArchive(retention time.Duration) (int, error) {
+	if retention <= 0 {
+		return 0, nil
+	}
+	res, err := s.db.Exec(s.query(`DELETE FROM scalemail_queue WHERE state = ? AND due < ?`), stateArchived, s.now().Add(-retention).UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+// archiveRow moves a delivered message to the archive state
+func (s *SQL) archiveRow(key []byte) error {
+	return s.tx(func(tx *sql.Tx) error {
+		var v []byte
+		err := tx.QueryRow(s.query(`SELECT msg FROM scalemail_queue WHERE id = ? AND state = ?`+s.dialect.forUpdate()), string(key), stateOutgoing).Scan(&v)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		now := s.now()
+		a, err := s.codec().archive(key, v, s.Archive, now)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(s.query(`UPDATE scalemail_queue SET state = ?, due = ?, msg = ? WHERE id = ?`), stateArchived, now.UnixMilli(), a, string(key))
+		return err
+	})
+}
+
+// archiveMsg moves a delivered message to the archive set
+func (r *Redis) archiveMsg(ctx context.Context, key []byte) error {
+	v, err := r.client.HGet(ctx, r.msgs, string(key)).Bytes()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	now := r.now()
+	a, err := r.codec().archive(key, v, r.Archive, now)
+	if err != nil {
+		return err
+	}
+
+	if _, err = r.transfer(ctx, r.outgoing, r.archive, key, now, a); err != nil {
+		return err
+	}
+
+	_, err = r.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.HDel(ctx, r.hosts, string(key))
+		p.HDel(ctx, r.retried, string(key))
+		return nil
+	})
+	return err
+}
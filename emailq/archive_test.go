@@ -0,0 +1,91 @@
+package emailq
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+// keep sets the archive mode of a queue from backends
+func keep(queue Queue, mode Archive) {
+	switch b := queue.(type) {
+	case *EmailQ:
+		b.archive = mode
+	case *Sharded:
+		for _, shard := range b.shards {
+			shard.archive = mode
+		}
+	case *Memory:
+		b.Archive = mode
+	case *Redis:
+		b.Archive = mode
+	case *SQL:
+		b.Archive = mode
+	}
+}
+
+type archiver interface {
+	Queue
+	ListArchived(ctx context.Context, f Filter) ([]Delivery, error)
+	PurgeArchive(retention time.Duration) (int, error)
+}
+
+func TestArchive(t *testing.T) {
+	s, _ := NewSealer(bytes.Repeat([]byte{7}, 32))
+
+	for name, queue := range backends(t) {
+		seal(queue, s)
+		a := queue.(archiver)
+
+		for _, mode := range []Archive{ArchiveOff, ArchiveHeaders, ArchiveFull} {
+			keep(queue, mode)
+
+			msg := createMsg()
+			msg.Data = []byte("Subject: hi\r\n\r\nbody")
+			queue.Push(ctx, msg)
+
+			key, _, err := queue.Pop(ctx)
+			if err != nil || key == nil {
+				t.Fatal(name, "error popping:", err)
+			}
+			if err = queue.RemoveDelivered(key); err != nil {
+				t.Fatal(name, "error removing delivered:", err)
+			}
+
+			page, err := a.ListArchived(ctx, Filter{})
+			if err != nil {
+				t.Fatal(name, "error listing archive:", err)
+			}
+
+			want := map[Archive]string{ArchiveHeaders: "Subject: hi\r\n\r\n", ArchiveFull: "Subject: hi\r\n\r\nbody"}[mode]
+			switch {
+			case mode == ArchiveOff && len(page) != 0:
+				t.Fatal(name, "delivered message archived while off")
+			case mode != ArchiveOff && (len(page) != 1 || string(page[0].Msg.Data) != want || page[0].Msg.Delivered.IsZero()):
+				t.Fatal(name, "unexpected archive of mode", mode, page)
+			}
+
+			if n, err := a.PurgeArchive(time.Hour); err != nil || n != 0 {
+				t.Fatal(name, "purged within retention:", n, err)
+			}
+
+			time.Sleep(5 * time.Millisecond)
+			if n, _ := a.PurgeArchive(time.Millisecond); n != len(page) {
+				t.Fatal(name, "archive not purged:", n)
+			}
+		}
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	for data, want := range map[string]string{
+		"Subject: a\r\n\r\nbody": "Subject: a\r\n\r\n",
+		"Subject: a\n\nbody":     "Subject: a\n\n",
+		"Subject: a\r\n":         "Subject: a\r\n",
+	} {
+		if got := string(headers([]byte(data))); got != want {
+			t.Errorf("headers(%q) = %q", data, got)
+		}
+	}
+}
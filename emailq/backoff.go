@@ -0,0 +1,63 @@
+package emailq
+
+import (
+	"math/rand"
+	"time"
+)
+
+// BackoffFunc is how long a message waits before delivery attempt number retry + 1, retry
+// counts failed attempts from 1
+type BackoffFunc func(retry int) time.Duration
+
+// Quadratic waits retry² minutes, the default schedule
+func Quadratic(retry int) time.Duration {
+	return time.Duration(retry*retry) * time.Minute
+}
+
+// Exponential doubles base with every retry up to max
+func Exponential(base, max time.Duration) BackoffFunc {
+	return func(retry int) time.Duration {
+		d := base
+		for i := 1; i < retry && d < max; i++ {
+			d *= 2
+		}
+
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
+
+// Delays follows a fixed schedule, e.g. a provider's recommended one, repeating the last
+// delay once it runs out
+func Delays(delays ...time.Duration) BackoffFunc {
+	return func(retry int) time.Duration {
+		if len(delays) == 0 {
+			return Quadratic(retry)
+		}
+
+		if retry > len(delays) {
+			retry = len(delays)
+		}
+		return delays[retry-1]
+	}
+}
+
+// Jitter spreads the delays of b randomly by up to fraction either way, so messages that
+// failed together don't all come back at once
+func Jitter(b BackoffFunc, fraction float64) BackoffFunc {
+	return func(retry int) time.Duration {
+		d := b.delay(retry)
+		return d + time.Duration((rand.Float64()*2-1)*fraction*float64(d))
+	}
+}
+
+// delay is the wait before the next attempt, nil follows Quadratic
+func (b BackoffFunc) delay(retry int) time.Duration {
+	if b == nil {
+		return Quadratic(retry)
+	}
+
+	return b(retry)
+}
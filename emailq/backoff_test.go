@@ -0,0 +1,71 @@
+package emailq
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBackoff(t *testing.T) {
+	exp := Exponential(time.Minute, time.Hour)
+	for retry, expected := range map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 4: 8 * time.Minute, 10: time.Hour} {
+		if d := exp(retry); d != expected {
+			t.Fatalf("Exponential retry %d: %v, expected %v", retry, d, expected)
+		}
+	}
+
+	delays := Delays(5*time.Minute, 30*time.Minute)
+	if delays(1) != 5*time.Minute || delays(2) != 30*time.Minute || delays(9) != 30*time.Minute {
+		t.Fatal("Unexpected delays:", delays(1), delays(2), delays(9))
+	}
+
+	jitter := Jitter(delays, 0.1)
+	for i := 0; i < 100; i++ {
+		if d := jitter(1); d < 270*time.Second || d > 330*time.Second {
+			t.Fatal("Jitter out of range:", d)
+		}
+	}
+
+	var none BackoffFunc
+	if none.delay(3) != 9*time.Minute {
+		t.Fatal("Nil backoff should be quadratic")
+	}
+}
+
+func TestBackoffOption(t *testing.T) {
+	dir, err := os.MkdirTemp("", "emailq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fixed, err := New(filepath.Join(dir, "backoff.db"), &Options{Backoff: Delays(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fixed.Close()
+
+	fixed.Push(ctx, createMsg())
+	key, _, _ := fixed.Pop(ctx)
+	popped, _ := keyTime(key)
+
+	if err = fixed.Retry(key, nil); err != nil {
+		t.Fatal("Error retrying:", err)
+	}
+
+	held, _ := fixed.PopBatch(ctx, 10)
+	if len(held) != 0 {
+		t.Fatal("Retried message due too early")
+	}
+
+	fixed.db.View(func(tx *bolt.Tx) error {
+		k, _ := tx.Bucket(incomingBucket).Cursor().First()
+		if due, _ := keyTime(k); due.Sub(popped) != time.Hour {
+			t.Fatal("Unexpected retry time:", due.Sub(popped))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,50 @@
+package emailq
+
+import (
+	"archive/tar"
+	"io"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Backup writes a consistent copy of the bolt file to w while the queue keeps running.
+// Returns the number of bytes written.
+func (q *EmailQ) Backup(w io.Writer) (n int64, err error) {
+	err = q.view(func(tx *bolt.Tx) error {
+		n, err = tx.WriteTo(w)
+		return err
+	})
+
+	return n, err
+}
+
+// Backup writes a tar archive of all shards to w, named like the files but without the
+// directory. Each shard is consistent on its own, they are copied one after another.
+func (s *Sharded) Backup(w io.Writer) (n int64, err error) {
+	tw := tar.NewWriter(w)
+
+	for _, q := range s.shards {
+		err = q.view(func(tx *bolt.Tx) error {
+			hdr := &tar.Header{
+				Name:    filepath.Base(tx.DB().Path()),
+				Mode:    0600,
+				Size:    tx.Size(),
+				ModTime: time.Now(),
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+
+			written, err := tx.WriteTo(tw)
+			n += written
+			return err
+		})
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, tw.Close()
+}
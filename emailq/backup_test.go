@@ -0,0 +1,82 @@
+package emailq
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackup(t *testing.T) {
+	dir, err := os.MkdirTemp("", "emailq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	queue, err := New(filepath.Join(dir, "queue.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	queue.Push(ctx, createMsg())
+
+	var buf bytes.Buffer
+	n, err := queue.Backup(&buf)
+	if err != nil || n != int64(buf.Len()) {
+		t.Fatal("Error backing up:", n, err)
+	}
+
+	// the snapshot doesn't change with the queue
+	queue.Push(ctx, createMsg())
+
+	file := filepath.Join(dir, "copy.db")
+	os.WriteFile(file, buf.Bytes(), 0600)
+	restored, err := New(file, nil)
+	if err != nil {
+		t.Fatal("Error opening backup:", err)
+	}
+	defer restored.Close()
+
+	if restored.Length() != 1 {
+		t.Fatal("Expected 1 message in the backup, got", restored.Length())
+	}
+}
+
+func TestShardedBackup(t *testing.T) {
+	dir, err := os.MkdirTemp("", "emailq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sharded, err := NewSharded(filepath.Join(dir, "queue.db"), 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sharded.Close()
+
+	var buf bytes.Buffer
+	if _, err = sharded.Backup(&buf); err != nil {
+		t.Fatal("Error backing up:", err)
+	}
+
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal("Bad archive:", err)
+		}
+		names = append(names, hdr.Name)
+	}
+
+	if len(names) != 3 || names[0] != "queue.db.0" || names[2] != "queue.db.2" {
+		t.Fatal("Unexpected archive entries:", names)
+	}
+}
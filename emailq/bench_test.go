@@ -0,0 +1,201 @@
+package emailq
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// benchSizes are the message sizes benchmarks run with
+var benchSizes = []int{1 << 10, 64 << 10, 1 << 20}
+
+// backlog is how many messages benchmarks keep queued at most, more of the large ones would
+// fill memory
+const backlog = 100
+
+// benchmark runs fn against an empty queue of every kind for each of sizes, as
+// <backend>/<size>
+func benchmark(b *testing.B, sizes []int, fn func(b *testing.B, queue Queue, size int)) {
+	var names []string
+	for name := range backends(b) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, size := range sizes {
+			b.Run(fmt.Sprintf("%s/%dKB", name, size>>10), func(b *testing.B) {
+				queue := backends(b)[name]
+				b.ReportAllocs()
+				b.SetBytes(int64(size))
+				fn(b, queue, size)
+			})
+		}
+	}
+}
+
+func benchMsg(size int) *Msg {
+	msg := createMsg()
+	msg.Data = bytes.Repeat([]byte("x"), size)
+	return msg
+}
+
+// fill pushes backlog messages of size outside the timer
+func fill(b *testing.B, queue Queue, size int) {
+	b.StopTimer()
+	defer b.StartTimer()
+
+	msgs := make([]*Msg, backlog)
+	for i := range msgs {
+		msgs[i] = benchMsg(size)
+	}
+	if err := queue.PushAll(ctx, msgs); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// drain delivers what's due outside the timer
+func drain(b *testing.B, queue Queue) {
+	b.StopTimer()
+	defer b.StartTimer()
+
+	for {
+		batch, err := queue.PopBatch(ctx, backlog)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(batch) == 0 {
+			return
+		}
+
+		for _, d := range batch {
+			queue.RemoveDelivered(d.Key)
+		}
+	}
+}
+
+func BenchmarkPush(b *testing.B) {
+	benchmark(b, benchSizes, func(b *testing.B, queue Queue, size int) {
+		msg := benchMsg(size)
+		for i := 0; i < b.N; i++ {
+			if i%backlog == 0 {
+				drain(b, queue)
+			}
+
+			if err := queue.Push(ctx, msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkPop(b *testing.B) {
+	benchmark(b, benchSizes, func(b *testing.B, queue Queue, size int) {
+		for i := 0; i < b.N; i++ {
+			if i%backlog == 0 {
+				fill(b, queue, size)
+			}
+
+			key, _, err := queue.Pop(ctx)
+			if err != nil || key == nil {
+				b.Fatal("Error popping:", err)
+			}
+			if err = queue.RemoveDelivered(key); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkPopBatch(b *testing.B) {
+	benchmark(b, benchSizes, func(b *testing.B, queue Queue, size int) {
+		for popped := 0; popped < b.N; {
+			fill(b, queue, size)
+
+			batch, err := queue.PopBatch(ctx, backlog)
+			if err != nil || len(batch) != backlog {
+				b.Fatal("Error popping:", len(batch), err)
+			}
+			for _, d := range batch {
+				if err = queue.RemoveDelivered(d.Key); err != nil {
+					b.Fatal(err)
+				}
+			}
+			popped += len(batch)
+		}
+	})
+}
+
+// BenchmarkMixed pushes and pops as a busy server does, every fourth delivery fails and is
+// retried at once. The queue holds a backlog throughout.
+func BenchmarkMixed(b *testing.B) {
+	benchmark(b, benchSizes, func(b *testing.B, queue Queue, size int) {
+		retryNow(queue)
+		fill(b, queue, size)
+		msg := benchMsg(size)
+
+		for i := 0; i < b.N; i++ {
+
+			if err := queue.Push(ctx, msg); err != nil {
+				b.Fatal(err)
+			}
+
+			key, _, err := queue.Pop(ctx)
+			if err != nil || key == nil {
+				b.Fatal("Error popping:", err)
+			}
+
+			if i%4 == 0 {
+				err = queue.Retry(key, nil)
+			} else {
+				err = queue.RemoveDelivered(key)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkConcurrent pushes and delivers from many goroutines, as connections and
+// deliveries run side by side
+func BenchmarkConcurrent(b *testing.B) {
+	benchmark(b, benchSizes[:1], func(b *testing.B, queue Queue, size int) {
+		b.RunParallel(func(pb *testing.PB) {
+			msg := benchMsg(size)
+			for pb.Next() {
+				if err := queue.Push(ctx, msg); err != nil {
+					b.Error(err)
+					return
+				}
+
+				// another goroutine may have taken it
+				if key, _, err := queue.Pop(ctx); err != nil {
+					b.Error(err)
+					return
+				} else if key != nil {
+					queue.RemoveDelivered(key)
+				}
+			}
+		})
+	})
+}
+
+// retryNow makes retries due at once so they don't pile up
+func retryNow(queue Queue) {
+	switch b := queue.(type) {
+	case *EmailQ:
+		b.backoff = Delays(0)
+	case *Sharded:
+		for _, s := range b.shards {
+			s.backoff = Delays(0)
+		}
+	case *Memory:
+		b.Backoff = Delays(0)
+	case *Redis:
+		b.Backoff = Delays(0)
+	case *SQL:
+		b.Backoff = Delays(0)
+	}
+}
@@ -0,0 +1,187 @@
+package emailq
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultBlobSize is the body size from which Data goes to the BlobStore, if one is set
+const DefaultBlobSize = 256 << 10
+
+// BlobStore keeps message bodies too large to copy around with every pop and retry. The
+// queue only stores the reference. Blobs are shared by messages with the same body and
+// dropped by CollectBlobs once nothing refers to them.
+type BlobStore interface {
+	Put(data []byte) (ref string, err error)
+	Get(ref string) ([]byte, error)
+	Delete(ref string) error
+	List(before time.Time) (refs []string, err error) // blobs last stored before
+}
+
+// DirStore is a BlobStore keeping blobs as files named by their SHA-256 in a directory
+type DirStore struct {
+	dir string
+}
+
+// NewDirStore uses dir for blobs, creating it if needed
+func NewDirStore(dir string) (*DirStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &DirStore{dir: dir}, nil
+}
+
+// Put writes data unless the same blob is stored already
+func (d *DirStore) Put(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	ref := hex.EncodeToString(sum[:])
+	path := filepath.Join(d.dir, ref)
+
+	// CollectBlobs goes by the time, the blob is in use again
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err == nil {
+		return ref, nil
+	}
+
+	f, err := os.CreateTemp(d.dir, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return ref, os.Rename(f.Name(), path)
+}
+
+// Get reads the blob ref
+func (d *DirStore) Get(ref string) ([]byte, error) {
+	if _, err := hex.DecodeString(ref); err != nil {
+		return nil, fmt.Errorf("Invalid blob reference: %s", ref)
+	}
+
+	return os.ReadFile(filepath.Join(d.dir, ref))
+}
+
+// Delete removes the blob ref, a missing one is fine
+func (d *DirStore) Delete(ref string) error {
+	err := os.Remove(filepath.Join(d.dir, ref))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// List finds the blobs last stored before the given time
+func (d *DirStore) List(before time.Time) (refs []string, err error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		if _, err := hex.DecodeString(e.Name()); err != nil || e.IsDir() {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			continue // removed meanwhile
+		}
+
+		if info.ModTime().Before(before) {
+			refs = append(refs, e.Name())
+		}
+	}
+
+	return refs, nil
+}
+
+// collect deletes blobs stored more than grace ago that no message refers to. grace covers
+// pushes that stored the blob but haven't committed the message yet.
+func collect(blobs BlobStore, grace time.Duration, refs map[string]bool) (deleted int, err error) {
+	if blobs == nil {
+		return 0, nil
+	}
+
+	old, err := blobs.List(time.Now().Add(-grace))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, ref := range old {
+		if refs[ref] {
+			continue
+		}
+
+		if err = blobs.Delete(ref); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// addRef notes the blob the stored value v refers to
+func addRef(refs map[string]bool, v []byte) {
+	if m, err := decodeMsg(v); err == nil && m.BlobRef != "" {
+		refs[m.BlobRef] = true
+	}
+}
+
+// CollectBlobs deletes blobs of delivered and purged messages, see collect
+func (q *EmailQ) CollectBlobs(grace time.Duration) (int, error) {
+	refs := make(map[string]bool)
+
+	// refs go first, a blob stored while they're gathered is newer than grace
+	if err := q.blobRefs(refs); err != nil {
+		return 0, err
+	}
+
+	return collect(q.codec.blobs, grace, refs)
+}
+
+func (q *EmailQ) blobRefs(refs map[string]bool) error {
+	return q.view(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{incomingBucket, deadBucket, quarantineBucket, archiveBucket} {
+			err := tx.Bucket(b).ForEach(func(k, v []byte) error {
+				addRef(refs, v)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// CollectBlobs deletes blobs no shard refers to, the shards share the BlobStore
+func (s *Sharded) CollectBlobs(grace time.Duration) (int, error) {
+	refs := make(map[string]bool)
+	for _, q := range s.shards {
+		if err := q.blobRefs(refs); err != nil {
+			return 0, err
+		}
+	}
+
+	return collect(s.shards[0].codec.blobs, grace, refs)
+}
@@ -0,0 +1,116 @@
+package emailq
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+// spill sets the blob store of a queue from backends
+func spill(queue Queue, blobs BlobStore, size int) {
+	switch b := queue.(type) {
+	case *EmailQ:
+		b.codec.blobs, b.codec.blobSize = blobs, size
+	case *Sharded:
+		for _, shard := range b.shards {
+			shard.codec.blobs, shard.codec.blobSize = blobs, size
+		}
+	case *Memory:
+		b.Blobs, b.BlobSize = blobs, size
+	case *Redis:
+		b.Blobs, b.BlobSize = blobs, size
+	case *SQL:
+		b.Blobs, b.BlobSize = blobs, size
+	}
+}
+
+type collector interface {
+	Queue
+	CollectBlobs(grace time.Duration) (int, error)
+}
+
+func TestBlobs(t *testing.T) {
+	body := bytes.Repeat([]byte("attachment "), 100)
+
+	for name, queue := range backends(t) {
+		dir, err := os.MkdirTemp("", "blobs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		store, _ := NewDirStore(dir)
+		spill(queue, store, 512)
+
+		// split by host, both share the body
+		large, other, small := createMsg(), createMsg(), createMsg()
+		large.Data, other.Data, small.Data = body, body, []byte("short")
+		other.Host = "other"
+		if err = queue.PushAll(ctx, []*Msg{large, other, small}); err != nil {
+			t.Fatal(name, "error pushing:", err)
+		}
+		if refs, _ := store.List(time.Now().Add(time.Hour)); len(refs) != 1 {
+			t.Fatal(name, "expected a single blob, got", len(refs))
+		}
+
+		batch, err := queue.PopBatch(ctx, 10)
+		if err != nil || len(batch) != 3 {
+			t.Fatal(name, "error popping:", len(batch), err)
+		}
+		for _, d := range batch {
+			if d.Msg.BlobRef != "" || !bytes.Equal(d.Msg.Data, body) && string(d.Msg.Data) != "short" {
+				t.Fatal(name, "body not restored:", len(d.Msg.Data))
+			}
+		}
+
+		c := queue.(collector)
+		if n, err := c.CollectBlobs(0); err != nil || n != 0 {
+			t.Fatal(name, "blob in use collected:", n, err)
+		}
+
+		for _, d := range batch {
+			queue.RemoveDelivered(d.Key)
+		}
+		if n, err := c.CollectBlobs(time.Hour); err != nil || n != 0 {
+			t.Fatal(name, "blob collected within grace:", n, err)
+		}
+		if n, err := c.CollectBlobs(0); err != nil || n != 1 {
+			t.Fatal(name, "blob of delivered messages not collected:", n, err)
+		}
+	}
+}
+
+func TestMissingBlob(t *testing.T) {
+	for name, queue := range backends(t) {
+		dir, err := os.MkdirTemp("", "blobs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		store, _ := NewDirStore(dir)
+		spill(queue, store, 512)
+
+		large, small := createMsg(), createMsg()
+		large.Data, small.Data = bytes.Repeat([]byte("attachment "), 100), []byte("short")
+		queue.PushAll(ctx, []*Msg{large, small})
+
+		refs, _ := store.List(time.Now().Add(time.Hour))
+		store.Delete(refs[0])
+
+		// the rest of the batch is delivered, the unreadable message set aside
+		batch, err := queue.PopBatch(ctx, 10)
+		if err != nil || len(batch) != 1 || string(batch[0].Msg.Data) != "short" {
+			t.Fatal(name, "unexpected batch with a blob missing:", len(batch), err)
+		}
+		if list, err := queue.(corrupter).Corrupted(); err != nil || len(list) != 1 || list[0].Error == "" {
+			t.Fatal(name, "message without its blob not set aside:", list, err)
+		}
+
+		queue.RemoveDelivered(batch[0].Key)
+		if n, _ := queue.(lister).ListPending(ctx, Filter{}); len(n) != 0 || queue.Length() != 0 {
+			t.Fatal(name, "message without its blob left in the queue:", n)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package emailq
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ReasonKilled is the DeadReason of pending messages killed by KillPending
+const ReasonKilled = "killed"
+
+// bulkChunk is how many messages a bulk operation changes per transaction
+const bulkChunk = 500
+
+// bulk pages through the messages list finds, handing fn the keys of a chunk at a time.
+// fn returns how many it changed, messages gone meanwhile don't count. Once ctx is done no
+// more chunks are changed, those that were stay.
+func bulk(ctx context.Context, list func(context.Context, Filter) ([]Delivery, error), f Filter, fn func(keys [][]byte) (int, error)) (changed int, err error) {
+	f.Limit = bulkChunk
+
+	for {
+		page, err := list(ctx, f)
+		if err != nil || len(page) == 0 {
+			return changed, err
+		}
+
+		keys := make([][]byte, len(page))
+		for i, d := range page {
+			keys[i] = d.Key
+		}
+
+		n, err := fn(keys)
+		changed += n
+		if err != nil {
+			return changed, err
+		}
+
+		f.After = keys[len(keys)-1]
+	}
+}
+
+// revive readies a dead letter for another round of delivery attempts, keeping its history
+func (msg *Msg) revive() {
+	msg.Retry = 0
+	msg.DeadReason, msg.DeadCode = "", 0
+	msg.Expires = time.Time{}
+}
+
+// RetryDead queues the dead letters f selects for delivery again with their retries reset,
+// f.After and f.Limit are ignored. Returns how many were queued.
+func (q *EmailQ) RetryDead(ctx context.Context, f Filter) (int, error) {
+	defer q.hooks.w.wake()
+
+	return bulk(ctx, q.ListDead, f, func(keys [][]byte) (n int, err error) {
+		err = q.update(func(tx *bolt.Tx) error {
+			n = 0
+			dead := tx.Bucket(deadBucket)
+			now := q.now()
+
+			for _, k := range keys {
+				v := dead.Get(k)
+				if v == nil {
+					continue
+				}
+
+				m := decode(v)
+				m.revive()
+
+				if err := putIncoming(tx, newKey(now), encode(m), m.Host, false); err != nil {
+					return err
+				}
+				if err := dead.Delete(k); err != nil {
+					return err
+				}
+				n++
+			}
+
+			return nil
+		})
+
+		return n, err
+	})
+}
+
+// KillPending moves the pending messages f selects to the dead letter queue
+func (q *EmailQ) KillPending(ctx context.Context, f Filter) (int, error) {
+	return bulk(ctx, q.ListPending, f, func(keys [][]byte) (n int, err error) {
+		err = q.update(func(tx *bolt.Tx) error {
+			n = 0
+			dead := tx.Bucket(deadBucket)
+			now := q.now()
+
+			for _, k := range keys {
+				v := pending(tx, k, now)
+				if v == nil {
+					continue
+				}
+
+				m := decode(v)
+				m.DeadReason = ReasonKilled
+
+				if err := dead.Put(k, encode(m)); err != nil {
+					return err
+				}
+				if err := deleteIncoming(tx, k, m.Host); err != nil {
+					return err
+				}
+				n++
+			}
+
+			return nil
+		})
+
+		return n, err
+	})
+}
+
+// DeletePending drops the pending messages f selects
+func (q *EmailQ) DeletePending(ctx context.Context, f Filter) (int, error) {
+	return bulk(ctx, q.ListPending, f, q.deleter(incomingBucket))
+}
+
+// DeleteDead drops the dead letters f selects
+func (q *EmailQ) DeleteDead(ctx context.Context, f Filter) (int, error) {
+	return bulk(ctx, q.ListDead, f, q.deleter(deadBucket))
+}
+
+func (q *EmailQ) deleter(bucket []byte) func(keys [][]byte) (int, error) {
+	return func(keys [][]byte) (n int, err error) {
+		err = q.update(func(tx *bolt.Tx) error {
+			n = 0
+			b := tx.Bucket(bucket)
+			incoming := bytes.Equal(bucket, incomingBucket)
+			now := q.now()
+
+			for _, k := range keys {
+				v := b.Get(k)
+				if incoming {
+					v = pending(tx, k, now)
+				}
+				if v == nil {
+					continue
+				}
+
+				var err error
+				if incoming {
+					err = deleteIncoming(tx, k, hostOf(v))
+				} else {
+					err = b.Delete(k)
+				}
+				if err != nil {
+					return err
+				}
+				n++
+			}
+
+			return nil
+		})
+
+		return n, err
+	}
+}
+
+// RetryDead queues dead letters of all shards for delivery again
+func (s *Sharded) RetryDead(ctx context.Context, f Filter) (int, error) {
+	return s.bulk(ctx, (*EmailQ).RetryDead, f)
+}
+
+// KillPending moves pending messages of all shards to the dead letter queue
+func (s *Sharded) KillPending(ctx context.Context, f Filter) (int, error) {
+	return s.bulk(ctx, (*EmailQ).KillPending, f)
+}
+
+// DeletePending drops pending messages of all shards
+func (s *Sharded) DeletePending(ctx context.Context, f Filter) (int, error) {
+	return s.bulk(ctx, (*EmailQ).DeletePending, f)
+}
+
+// DeleteDead drops dead letters of all shards
+func (s *Sharded) DeleteDead(ctx context.Context, f Filter) (int, error) {
+	return s.bulk(ctx, (*EmailQ).DeleteDead, f)
+}
+
+func (s *Sharded) bulk(ctx context.Context, fn func(*EmailQ, context.Context, Filter) (int, error), f Filter) (changed int, err error) {
+	for _, q := range s.shards {
+		n, err := fn(q, ctx, f)
+		changed += n
+		if err != nil {
+			return changed, err
+		}
+	}
+
+	return changed, nil
+}
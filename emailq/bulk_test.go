@@ -0,0 +1,57 @@
+package emailq
+
+import (
+	"context"
+	"testing"
+)
+
+type bulker interface {
+	lister
+	RetryDead(ctx context.Context, f Filter) (int, error)
+	KillPending(ctx context.Context, f Filter) (int, error)
+	DeletePending(ctx context.Context, f Filter) (int, error)
+	DeleteDead(ctx context.Context, f Filter) (int, error)
+}
+
+func TestBulk(t *testing.T) {
+	for name, backend := range backends(t) {
+		queue := backend.(bulker)
+
+		for i := 0; i < 4; i++ {
+			msg := createMsg()
+			if i%2 == 0 {
+				msg.Host = "gmail.com"
+			}
+			queue.Push(ctx, msg)
+		}
+
+		if n, err := queue.KillPending(ctx, Filter{Host: "gmail.com"}); err != nil || n != 2 || queue.Length() != 2 {
+			t.Fatal(name, "killed", n, "leaving", queue.Length(), err)
+		}
+
+		dead, _ := queue.ListDead(ctx, Filter{})
+		if len(dead) != 2 || dead[0].Msg.DeadReason != ReasonKilled {
+			t.Fatal(name, "unexpected dead letters:", len(dead))
+		}
+
+		if n, err := queue.RetryDead(ctx, Filter{}); err != nil || n != 2 || queue.Length() != 4 {
+			t.Fatal(name, "retried", n, "leaving", queue.Length(), err)
+		}
+
+		if n, err := queue.DeletePending(ctx, Filter{Host: "host"}); err != nil || n != 2 || queue.Length() != 2 {
+			t.Fatal(name, "deleted", n, "leaving", queue.Length(), err)
+		}
+
+		batch, _ := queue.PopBatch(ctx, 2)
+		for _, d := range batch {
+			if d.Msg.Host != "gmail.com" || d.Msg.DeadReason != "" {
+				t.Fatal(name, "unexpected retried message:", d.Msg.Host, d.Msg.DeadReason)
+			}
+			queue.Kill(d.Key, nil)
+		}
+
+		if n, err := queue.DeleteDead(ctx, Filter{}); err != nil || n != 2 {
+			t.Fatal(name, "deleted", n, "dead letters:", err)
+		}
+	}
+}
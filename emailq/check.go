@@ -0,0 +1,132 @@
+package emailq
+
+import (
+	"bytes"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Report summarizes queue health as found by Check
+type Report struct {
+	Incoming    int
+	Outgoing    int
+	Dead        int
+	Corrupt     []string // keys whose value does not decode
+	BadKeys     []string // keys that are not timestamps
+	Stale       []string // leased keys older than the stale threshold
+	Repaired    int      // stale leases released
+	Size        int64    // database size in bytes
+	FreePages   int
+	PendingFree int
+}
+
+// Healthy reports whether Check found nothing to complain about
+func (r *Report) Healthy() bool {
+	return len(r.Corrupt) == 0 && len(r.BadKeys) == 0 && len(r.Stale) == r.Repaired
+}
+
+// Check verifies that every record decodes and every key parses. Leased messages whose key
+// is older than staleAfter are reported, and with repair set their leases released.
+// Offline (nothing is sending) staleAfter of 0 treats every lease as stale.
+func (q *EmailQ) Check(staleAfter time.Duration, repair bool) (*Report, error) {
+	r := &Report{}
+	now := q.now().UTC()
+
+	fn := q.view
+	if repair {
+		fn = q.update
+	}
+
+	err := fn(func(tx *bolt.Tx) error {
+		r.Size = tx.Size()
+
+		buckets := []struct {
+			name  []byte
+			count *int
+		}{
+			{incomingBucket, &r.Incoming},
+			{deadBucket, &r.Dead},
+		}
+
+		var stale [][]byte
+		for _, b := range buckets {
+			err := tx.Bucket(b.name).ForEach(func(k, v []byte) error {
+				out := bytes.Equal(b.name, incomingBucket) && leased(tx, k, now)
+				if out {
+					r.Outgoing++
+				} else {
+					*b.count++
+				}
+
+				if _, err := decodeMsg(v); err != nil {
+					r.Corrupt = append(r.Corrupt, string(k))
+				}
+
+				t, err := keyTime(k)
+				if err != nil {
+					r.BadKeys = append(r.BadKeys, string(k))
+					return nil
+				}
+
+				if out && now.Sub(t) >= staleAfter {
+					r.Stale = append(r.Stale, string(k))
+					stale = append(stale, append([]byte(nil), k...))
+				}
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if !repair {
+			return nil
+		}
+
+		leases := tx.Bucket(leasesBucket)
+		for _, k := range stale {
+			if err := leases.Delete(k); err != nil {
+				return err
+			}
+			r.Repaired++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats := q.stats()
+	r.FreePages = stats.FreePageN
+	r.PendingFree = stats.PendingPageN
+
+	return r, nil
+}
+
+// Check runs Check on every shard and adds up the reports
+func (s *Sharded) Check(staleAfter time.Duration, repair bool) (*Report, error) {
+	total := &Report{}
+
+	for _, q := range s.shards {
+		r, err := q.Check(staleAfter, repair)
+		if err != nil {
+			return nil, err
+		}
+
+		total.Incoming += r.Incoming
+		total.Outgoing += r.Outgoing
+		total.Dead += r.Dead
+		total.Corrupt = append(total.Corrupt, r.Corrupt...)
+		total.BadKeys = append(total.BadKeys, r.BadKeys...)
+		total.Stale = append(total.Stale, r.Stale...)
+		total.Repaired += r.Repaired
+		total.Size += r.Size
+		total.FreePages += r.FreePages
+		total.PendingFree += r.PendingFree
+	}
+
+	return total, nil
+}
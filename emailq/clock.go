@@ -0,0 +1,34 @@
+package emailq
+
+import "time"
+
+// Clock tells the queue the time, keys, due times, backoff, expiry, leases and retention
+// all go by it. Tests set their own to step through retries without sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+// clockNow is c.Now(), the system time if c is nil
+func clockNow(c Clock) time.Time {
+	if c == nil {
+		return time.Now()
+	}
+
+	return c.Now()
+}
+
+func (q *EmailQ) now() time.Time {
+	return clockNow(q.clock)
+}
+
+func (m *Memory) now() time.Time {
+	return clockNow(m.Clock)
+}
+
+func (r *Redis) now() time.Time {
+	return clockNow(r.Clock)
+}
+
+func (s *SQL) now() time.Time {
+	return clockNow(s.Clock)
+}
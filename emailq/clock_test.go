@@ -0,0 +1,80 @@
+package emailq
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock stands still until it's moved on
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func setClock(queue Queue, c Clock) {
+	switch b := queue.(type) {
+	case *EmailQ:
+		b.clock = c
+	case *Sharded:
+		for _, s := range b.shards {
+			s.clock = c
+		}
+	case *Memory:
+		b.Clock = c
+	case *Redis:
+		b.Clock = c
+	case *SQL:
+		b.Clock = c
+	}
+}
+
+func TestClock(t *testing.T) {
+	for name, queue := range backends(t) {
+		clock := &fakeClock{now: time.Now()}
+		setClock(queue, clock)
+
+		msg := createMsg()
+		msg.Expires = clock.Now().Add(time.Hour)
+		queue.Push(ctx, msg)
+
+		key, _, err := queue.Pop(ctx)
+		if err != nil || key == nil {
+			t.Fatal(name, "error popping:", err)
+		}
+		queue.Retry(key, nil)
+
+		if key, _, _ = queue.Pop(ctx); key != nil {
+			t.Fatal(name, "retry popped before its backoff passed")
+		}
+
+		clock.advance(Quadratic(1))
+		if key, _, err = queue.Pop(ctx); err != nil || key == nil {
+			t.Fatal(name, "retry not popped once its backoff passed:", err)
+		}
+		queue.Retry(key, nil)
+
+		// past the deadline the message goes to the dead letter queue
+		clock.advance(2 * time.Hour)
+		if key, _, _ = queue.Pop(ctx); key != nil {
+			t.Fatal(name, "expired message popped")
+		}
+		if m := queue.(interface{ Metrics() Metrics }).Metrics(); m.Expired != 1 {
+			t.Fatal(name, "expired message not dead-lettered:", m.Expired)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package emailq
+
+import (
+	"fmt"
+	"time"
+)
+
+// codec turns pushed messages into stored values, sealing Data and moving large bodies out
+// to blobs, and undoes that for messages handed out
+type codec struct {
+	sealer   *Sealer
+	blobs    BlobStore
+	blobSize int
+}
+
+// encode stores msg, msg itself is left as it is
+func (c codec) encode(msg *Msg) ([]byte, error) {
+	stored := *msg
+
+	if c.sealer != nil && !msg.Sealed {
+		data, err := c.sealer.seal(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		stored.Data, stored.Sealed = data, true
+	}
+
+	if c.blobs != nil && msg.BlobRef == "" && len(stored.Data) > c.threshold() {
+		ref, err := c.blobs.Put(stored.Data)
+		if err != nil {
+			return nil, err
+		}
+		stored.Data, stored.BlobRef = nil, ref
+	}
+
+	return encode(&stored), nil
+}
+
+// encodeAll prepares msgs for the queue and encodes them
+func (c codec) encodeAll(msgs []*Msg, now time.Time, maxRetries int, ttl time.Duration) ([][]byte, error) {
+	values := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		msg.prepare(now, maxRetries, ttl)
+
+		v, err := c.encode(msg)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+
+	return values, nil
+}
+
+func (c codec) threshold() int {
+	if c.blobSize <= 0 {
+		return DefaultBlobSize
+	}
+
+	return c.blobSize
+}
+
+// open restores Data of the messages in batch in place
+func (c codec) open(batch []Delivery) error {
+	for _, d := range batch {
+		if err := c.openMsg(d.Key, d.Msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// openPopped restores Data of the messages popped in t, one that can't be restored is taken
+// out of the batch and added to t.corrupt. Those are returned for the queue to set aside,
+// still leased to it.
+func (c codec) openPopped(t *taken) (failed []Corrupt) {
+	batch := t.batch[:0]
+	for _, d := range t.batch {
+		if err := c.openMsg(d.Key, d.Msg); err != nil {
+			failed = append(failed, newCorrupt(d.Key, encode(d.Msg), err))
+			continue
+		}
+		batch = append(batch, d)
+	}
+
+	t.batch = batch
+	t.corrupt = append(t.corrupt, failed...)
+	return failed
+}
+
+// openMsg restores Data of msg in place, msg is left as stored if it fails
+func (c codec) openMsg(key []byte, msg *Msg) error {
+	data := msg.Data
+	if msg.BlobRef != "" {
+		if c.blobs == nil {
+			return fmt.Errorf("Message %s is kept in a blob and no blob store is set", key)
+		}
+
+		var err error
+		if data, err = c.blobs.Get(msg.BlobRef); err != nil {
+			return fmt.Errorf("Can't load message %s: %v", key, err)
+		}
+	}
+
+	if msg.Sealed {
+		var err error
+		if data, err = c.sealer.open(key, data); err != nil {
+			return err
+		}
+	}
+
+	msg.Data, msg.BlobRef, msg.Sealed = data, "", false
+	return nil
+}
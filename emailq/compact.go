@@ -0,0 +1,161 @@
+package emailq
+
+import (
+	"context"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// compactTxSize is how much Compact copies per transaction
+const compactTxSize = 64 << 20
+
+// FileStats describes the bolt file, which never shrinks on its own. Free pages are reused
+// by later writes but only Compact gives them back to the file system.
+type FileStats struct {
+	Size      int64 // bytes
+	FreeBytes int64 // in free and pending pages
+	FreePages int
+}
+
+// update and view run fn in a bolt transaction, Compact waits for them to swap the file
+func (q *EmailQ) update(fn func(*bolt.Tx) error) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	defer q.hooks.commit(time.Now())
+
+	return q.db.Update(fn)
+}
+
+// cancellable wraps fn of a transaction to fail with the error of ctx, before fn runs and
+// after it's done so the transaction is rolled back
+func cancellable(ctx context.Context, fn func(*bolt.Tx) error) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(tx); err != nil {
+			return err
+		}
+
+		return ctx.Err()
+	}
+}
+
+func (q *EmailQ) view(fn func(*bolt.Tx) error) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	return q.db.View(fn)
+}
+
+func (q *EmailQ) stats() bolt.Stats {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	return q.db.Stats()
+}
+
+// FileStats reports the size of the bolt file and how much of it is free
+func (q *EmailQ) FileStats() (s FileStats, err error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	info, err := os.Stat(q.db.Path())
+	if err != nil {
+		return s, err
+	}
+
+	stats := q.db.Stats()
+	s.Size = info.Size()
+	s.FreePages = stats.FreePageN + stats.PendingPageN
+	s.FreeBytes = int64(stats.FreeAlloc)
+
+	return s, nil
+}
+
+// Compact copies the queue to a new file leaving the free pages behind and swaps it in.
+// Every queue operation waits until it's done, run it when the queue is quiet. Returns
+// how many bytes were given back.
+func (q *EmailQ) Compact() (saved int64, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	path := q.db.Path()
+	tmp := path + ".compact"
+	os.Remove(tmp)
+
+	dst, err := bolt.Open(tmp, 0600, q.boltOpts)
+	if err != nil {
+		return 0, err
+	}
+
+	err = bolt.Compact(dst, q.db, compactTxSize)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+
+	before, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	after, err := os.Stat(tmp)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = q.db.Close(); err != nil {
+		return 0, err
+	}
+
+	// the old file is still there if the rename fails, reopen whichever is in place
+	err = os.Rename(tmp, path)
+
+	db, oerr := bolt.Open(path, 0600, q.boltOpts)
+	if oerr != nil {
+		return 0, oerr
+	}
+	q.tune(db)
+	q.db = db
+
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+
+	return before.Size() - after.Size(), nil
+}
+
+// FileStats adds up the stats of all shards
+func (s *Sharded) FileStats() (total FileStats, err error) {
+	for _, q := range s.shards {
+		fs, err := q.FileStats()
+		if err != nil {
+			return total, err
+		}
+
+		total.Size += fs.Size
+		total.FreeBytes += fs.FreeBytes
+		total.FreePages += fs.FreePages
+	}
+
+	return total, nil
+}
+
+// Compact compacts the shards one after another
+func (s *Sharded) Compact() (saved int64, err error) {
+	for _, q := range s.shards {
+		n, err := q.Compact()
+		saved += n
+		if err != nil {
+			return saved, err
+		}
+	}
+
+	return saved, nil
+}
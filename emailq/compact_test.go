@@ -0,0 +1,58 @@
+package emailq
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompact(t *testing.T) {
+	dir, err := os.MkdirTemp("", "emailq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	queue, err := New(filepath.Join(dir, "queue.db"), &Options{NoSync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+
+	var msgs []*Msg
+	for i := 0; i < 500; i++ {
+		msg := createMsg()
+		msg.Data = bytes.Repeat([]byte("x"), 4096)
+		msgs = append(msgs, msg)
+	}
+	queue.PushAll(ctx, msgs)
+
+	batch, _ := queue.PopBatch(ctx, len(msgs))
+	for _, d := range batch {
+		queue.RemoveDelivered(d.Key)
+	}
+	queue.Push(ctx, createMsg())
+
+	before, err := queue.FileStats()
+	if err != nil || before.FreeBytes == 0 {
+		t.Fatal("Expected free pages after deleting:", before, err)
+	}
+
+	saved, err := queue.Compact()
+	if err != nil || saved <= 0 {
+		t.Fatal("Error compacting:", saved, err)
+	}
+
+	after, _ := queue.FileStats()
+	if after.Size != before.Size-saved {
+		t.Fatal("Unexpected size after compacting:", before, after, saved)
+	}
+
+	if key, _, err := queue.Pop(ctx); err != nil || key == nil {
+		t.Fatal("Message lost compacting:", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "queue.db.compact")); !os.IsNotExist(err) {
+		t.Fatal("Temporary file left behind")
+	}
+}
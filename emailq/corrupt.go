@@ -0,0 +1,96 @@
+package emailq
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var corruptBucket = []byte("corrupt")
+
+// Corrupt is a stored value that failed to decode when it was popped. It's set aside
+// instead of being delivered as an empty message.
+type Corrupt struct {
+	Key   []byte
+	Error string
+	Time  time.Time
+	Raw   []byte
+}
+
+// ErrCorrupt is wrapped by the errors of stored values that can't be read, the Error of
+// Corrupt values included
+var ErrCorrupt = errors.New("Corrupt message")
+
+// decodeMsg is decode that reports values it can't read
+func decodeMsg(b []byte) (*Msg, error) {
+	var result Msg
+	if err := unmarshal(b, &result); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+
+	return &result, nil
+}
+
+func newCorrupt(key, raw []byte, err error) Corrupt {
+	return Corrupt{
+		Key:   append([]byte(nil), key...),
+		Error: err.Error(),
+		Time:  time.Now().UTC(),
+		Raw:   append([]byte(nil), raw...),
+	}
+}
+
+func encodeCorrupt(c Corrupt) []byte {
+	return marshal(c)
+}
+
+func decodeCorrupt(b []byte) (c Corrupt) {
+	unmarshal(b, &c)
+	return c
+}
+
+// Corrupted lists the values set aside because they didn't decode, oldest first
+func (q *EmailQ) Corrupted() (list []Corrupt, err error) {
+	err = q.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(corruptBucket).ForEach(func(k, v []byte) error {
+			list = append(list, decodeCorrupt(v))
+			return nil
+		})
+	})
+
+	return list, err
+}
+
+// DeleteCorrupt drops a value set aside
+func (q *EmailQ) DeleteCorrupt(key []byte) error {
+	return q.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(corruptBucket).Delete(key)
+	})
+}
+
+// Corrupted lists the values set aside in all shards
+func (s *Sharded) Corrupted() ([]Corrupt, error) {
+	var list []Corrupt
+	for _, q := range s.shards {
+		c, err := q.Corrupted()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, c...)
+	}
+
+	return list, nil
+}
+
+// DeleteCorrupt drops a value set aside from whichever shard has it
+func (s *Sharded) DeleteCorrupt(key []byte) error {
+	for _, q := range s.shards {
+		if err := q.DeleteCorrupt(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
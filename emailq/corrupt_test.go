@@ -0,0 +1,74 @@
+package emailq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	bolt "go.etcd.io/bbolt"
+)
+
+// inject stores raw as a message due now, bypassing Push
+func inject(t *testing.T, queue Queue, key string, raw []byte) {
+	var err error
+	switch b := queue.(type) {
+	case *EmailQ:
+		err = b.db.Update(func(tx *bolt.Tx) error { return putIncoming(tx, []byte(key), raw, hostOf(raw), false) })
+	case *Sharded:
+		inject(t, b.shards[0], key, raw)
+	case *Memory:
+		b.incoming[key] = memEntry{time.Now(), raw}
+	case *Redis:
+		ctx := context.Background()
+		b.client.HSet(ctx, b.msgs, key, raw)
+		err = b.client.ZAdd(ctx, b.incoming, redis.Z{Score: score(time.Now()), Member: key}).Err()
+	case *SQL:
+		_, err = b.db.Exec(`INSERT INTO scalemail_queue (id, state, due, host, sender, rcpts, retry, msg) VALUES (?, ?, ?, '', '', '', 0, ?)`,
+			key, stateIncoming, time.Now().UnixMilli(), raw)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type corrupter interface {
+	Queue
+	Corrupted() ([]Corrupt, error)
+	DeleteCorrupt(key []byte) error
+}
+
+func TestCorrupt(t *testing.T) {
+	for name, queue := range backends(t) {
+		obs := &recorder{}
+		observe(queue, obs)
+
+		key := newKey(time.Now().Add(-time.Minute))
+		inject(t, queue, string(key), []byte("not a gob"))
+		queue.Push(ctx, createMsg())
+
+		batch, err := queue.PopBatch(ctx, 10)
+		if err != nil || len(batch) != 1 || batch[0].Msg.Host != "host" {
+			t.Fatal(name, "corrupt value popped:", batch, err)
+		}
+
+		c := queue.(corrupter)
+		list, err := c.Corrupted()
+		if err != nil || len(list) != 1 {
+			t.Fatal(name, "corrupt value not set aside:", list, err)
+		}
+		if string(list[0].Key) != string(key) || string(list[0].Raw) != "not a gob" || list[0].Error == "" {
+			t.Fatal(name, "unexpected corrupt record:", list[0])
+		}
+		if obs.corrupt != 1 {
+			t.Fatal(name, "observer not told:", obs.corrupt)
+		}
+
+		if err = c.DeleteCorrupt(key); err != nil {
+			t.Fatal(name, "error deleting:", err)
+		}
+		if list, _ = c.Corrupted(); len(list) != 0 {
+			t.Fatal(name, "corrupt value not deleted")
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package emailq
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// PurgeDead drops dead letters older than retention and all but the newest keep, zero
+// retention or keep doesn't limit by that. Returns how many were dropped.
+func (q *EmailQ) PurgeDead(retention time.Duration, keep int) (int, error) {
+	return q.purge(deadBucket, retention, keep)
+}
+
+// purge drops entries of bucket as PurgeDead does dead letters
+func (q *EmailQ) purge(bucket []byte, retention time.Duration, keep int) (purged int, err error) {
+	cutoff := q.now().Add(-retention)
+
+	err = q.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		excess := b.Stats().KeyN - keep
+
+		// keys sort by time, oldest first. Deleting while iterating skips entries, collect first.
+		var old [][]byte
+		b.ForEach(func(k, v []byte) error {
+			if keep > 0 && len(old) < excess {
+				old = append(old, append([]byte(nil), k...))
+				return nil
+			}
+
+			if t, err := keyTime(k); retention > 0 && (err != nil || t.Before(cutoff)) {
+				old = append(old, append([]byte(nil), k...))
+			}
+			return nil
+		})
+
+		for _, k := range old {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		purged = len(old)
+		return nil
+	})
+
+	return purged, err
+}
+
+// PurgeDead drops old dead letters of all shards, keep counts across shards
+func (s *Sharded) PurgeDead(retention time.Duration, keep int) (purged int, err error) {
+	type deadKey struct {
+		key   []byte
+		shard *EmailQ
+	}
+
+	var all []deadKey
+	for _, q := range s.shards {
+		n, err := q.PurgeDead(retention, 0)
+		purged += n
+		if err != nil {
+			return purged, err
+		}
+
+		if keep > 0 {
+			q.view(func(tx *bolt.Tx) error {
+				return tx.Bucket(deadBucket).ForEach(func(k, v []byte) error {
+					all = append(all, deadKey{append([]byte(nil), k...), q})
+					return nil
+				})
+			})
+		}
+	}
+
+	if keep <= 0 || len(all) <= keep {
+		return purged, nil
+	}
+
+	sort.Slice(all, func(i, j int) bool { return bytes.Compare(all[i].key, all[j].key) < 0 })
+
+	for _, d := range all[:len(all)-keep] {
+		err = d.shard.update(func(tx *bolt.Tx) error {
+			return tx.Bucket(deadBucket).Delete(d.key)
+		})
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+
+	return purged, nil
+}
@@ -0,0 +1,41 @@
+package emailq
+
+import (
+	"testing"
+	"time"
+)
+
+type purger interface {
+	Queue
+	PurgeDead(retention time.Duration, keep int) (int, error)
+}
+
+func TestPurgeDead(t *testing.T) {
+	for name, backend := range backends(t) {
+		queue := backend.(purger)
+
+		for i := 0; i < 4; i++ {
+			queue.Push(ctx, createMsg())
+		}
+
+		batch, _ := queue.PopBatch(ctx, 4)
+		for _, d := range batch {
+			if err := queue.Kill(d.Key, nil); err != nil {
+				t.Fatal(name, "error killing:", err)
+			}
+		}
+
+		if n, err := queue.PurgeDead(0, 2); err != nil || n != 2 {
+			t.Fatal(name, "purged", n, "of 4 keeping 2:", err)
+		}
+
+		if n, err := queue.PurgeDead(time.Hour, 0); err != nil || n != 0 {
+			t.Fatal(name, "purged", n, "recent dead letters:", err)
+		}
+
+		time.Sleep(2 * time.Millisecond)
+		if n, err := queue.PurgeDead(time.Millisecond, 0); err != nil || n != 2 {
+			t.Fatal(name, "purged", n, "of 2 old dead letters:", err)
+		}
+	}
+}
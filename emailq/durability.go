@@ -0,0 +1,46 @@
+package emailq
+
+import (
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// batch is update in a transaction shared with concurrent callers, see Options.GroupCommit.
+// fn may run more than once.
+func (q *EmailQ) batch(fn func(*bolt.Tx) error) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	defer q.hooks.commit(time.Now())
+
+	return q.db.Batch(fn)
+}
+
+// tune applies the batch settings to db, after New and Compact open it
+func (q *EmailQ) tune(db *bolt.DB) {
+	if q.batchDelay > 0 {
+		db.MaxBatchDelay = q.batchDelay
+	}
+}
+
+// syncLoop flushes the file every interval until done is closed, see Options.SyncEvery
+func (q *EmailQ) syncLoop(done chan struct{}, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			// a failing disk fails the commits too, they report it
+			q.mu.RLock()
+			select {
+			case <-done: // closed meanwhile
+			default:
+				q.db.Sync()
+			}
+			q.mu.RUnlock()
+		}
+	}
+}
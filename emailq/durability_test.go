@@ -0,0 +1,74 @@
+package emailq
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGroupCommit(t *testing.T) {
+	dir, err := os.MkdirTemp("", "emailq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	queue, err := New(filepath.Join(dir, "queue.db"), &Options{
+		GroupCommit: true,
+		BatchDelay:  time.Millisecond,
+		SyncEvery:   time.Millisecond,
+		Quota:       Quota{MaxMessages: 30},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !queue.db.NoSync || queue.db.MaxBatchDelay != time.Millisecond {
+		t.Fatal("Durability options not applied")
+	}
+
+	// pushes over the quota fail alone without taking their batch down
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var accepted, full int
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := queue.Push(ctx, createMsg())
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				accepted++
+			case errors.Is(err, ErrQueueFull):
+				full++
+			default:
+				t.Error("Error pushing:", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if accepted != 30 || full != 20 || queue.Length() != 30 {
+		t.Fatal("Unexpected pushes:", accepted, full, queue.Length())
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if err = queue.Close(); err != nil {
+		t.Fatal("Error closing:", err)
+	}
+
+	if queue, err = New(filepath.Join(dir, "queue.db"), nil); err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+
+	if queue.Length() != 30 {
+		t.Fatal("Messages lost reopening:", queue.Length())
+	}
+}
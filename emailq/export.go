@@ -0,0 +1,148 @@
+package emailq
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// states of messages as exported and walked by Iterate
+const (
+	StatePending  = "pending"
+	StateDead     = "dead"
+	StateArchived = "archived"
+)
+
+// Record is a message as ExportJSON writes it, one JSON object per line
+type Record struct {
+	Key   string `json:"key"`
+	State string `json:"state"`
+	Msg   *Msg   `json:"msg"`
+}
+
+// Lister pages through the messages of a queue, all queues in this package are one
+type Lister interface {
+	ListPending(ctx context.Context, f Filter) ([]Delivery, error)
+	ListDead(ctx context.Context, f Filter) ([]Delivery, error)
+	ListArchived(ctx context.Context, f Filter) ([]Delivery, error)
+}
+
+// each calls fn for every message list returns, page by page
+func each(ctx context.Context, list func(context.Context, Filter) ([]Delivery, error), fn func(d Delivery) error) error {
+	f := Filter{Limit: bulkChunk}
+
+	for {
+		page, err := list(ctx, f)
+		if err != nil || len(page) == 0 {
+			return err
+		}
+
+		for _, d := range page {
+			if err = fn(d); err != nil {
+				return err
+			}
+		}
+
+		f.After = page[len(page)-1].Key
+	}
+}
+
+// stateList is where the messages of an exported state come from
+type stateList struct {
+	state string
+	list  func(context.Context, Filter) ([]Delivery, error)
+}
+
+func states(l Lister) []stateList {
+	return []stateList{{StatePending, l.ListPending}, {StateDead, l.ListDead}}
+}
+
+// ExportJSON writes the pending messages and dead letters of l to w. Messages out for
+// delivery aren't pending, Recover them first when exporting a stopped queue.
+func ExportJSON(ctx context.Context, l Lister, w io.Writer) (n int, err error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	for _, s := range states(l) {
+		err = each(ctx, s.list, func(d Delivery) error {
+			n++
+			return enc.Encode(Record{Key: string(d.Key), State: s.state, Msg: d.Msg})
+		})
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, bw.Flush()
+}
+
+// ImportJSON pushes the pending messages ExportJSON wrote to q, due right away unless they
+// have NotBefore. Dead letters are skipped. Returns how many messages were pushed.
+func ImportJSON(ctx context.Context, q Queue, r io.Reader) (n int, err error) {
+	dec := json.NewDecoder(r)
+
+	var batch []*Msg
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := q.PushAll(ctx, batch); err != nil {
+			return err
+		}
+		n += len(batch)
+		batch = batch[:0]
+
+		return nil
+	}
+
+	for {
+		var rec Record
+		if err = dec.Decode(&rec); err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+
+		if rec.State != StatePending || rec.Msg == nil {
+			continue
+		}
+
+		batch = append(batch, rec.Msg)
+		if len(batch) == bulkChunk {
+			if err = flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, flush()
+}
+
+// ExportEML writes the body of every message of l to dir/pending/<key>.eml or
+// dir/dead/<key>.eml
+func ExportEML(ctx context.Context, l Lister, dir string) (n int, err error) {
+	for _, s := range states(l) {
+		sub := filepath.Join(dir, s.state)
+		if err = os.MkdirAll(sub, 0700); err != nil {
+			return n, err
+		}
+
+		err = each(ctx, s.list, func(d Delivery) error {
+			// colons of the timestamp keys don't go well in file names everywhere
+			name := strings.ReplaceAll(string(d.Key), ":", "-") + ".eml"
+			n++
+			return os.WriteFile(filepath.Join(sub, name), d.Msg.Data, 0600)
+		})
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,58 @@
+package emailq
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	for name, queue := range backends(t) {
+		msg := createMsg()
+		msg.Data = []byte("Subject: pending")
+		dead := createMsg()
+		dead.Data = []byte("Subject: dead")
+
+		queue.Push(ctx, dead)
+		key, _, _ := queue.Pop(ctx)
+		queue.Kill(key, nil)
+		queue.Push(ctx, msg)
+
+		var buf bytes.Buffer
+		n, err := ExportJSON(ctx, queue.(Lister), &buf)
+		if err != nil || n != 2 {
+			t.Fatal(name, "error exporting:", n, err)
+		}
+		if !strings.Contains(buf.String(), `"state":"dead"`) {
+			t.Fatal(name, "dead letter not exported:", buf.String())
+		}
+
+		seeded := NewMemory()
+		if n, err = ImportJSON(ctx, seeded, &buf); err != nil || n != 1 {
+			t.Fatal(name, "error importing:", n, err)
+		}
+		_, got, _ := seeded.Pop(ctx)
+		if string(got.Data) != "Subject: pending" || got.Host != "host" || len(got.To) != 2 {
+			t.Fatal(name, "message changed on the way:", got)
+		}
+
+		dir, err := os.MkdirTemp("", "eml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		if n, err = ExportEML(ctx, queue.(Lister), dir); err != nil || n != 2 {
+			t.Fatal(name, "error exporting .eml:", n, err)
+		}
+		files, _ := filepath.Glob(filepath.Join(dir, "dead", "*.eml"))
+		if len(files) != 1 || strings.Contains(filepath.Base(files[0]), ":") {
+			t.Fatal(name, "unexpected .eml files:", files)
+		}
+		if body, _ := os.ReadFile(files[0]); string(body) != "Subject: dead" {
+			t.Fatal(name, "unexpected .eml body:", string(body))
+		}
+	}
+}
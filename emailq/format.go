@@ -0,0 +1,27 @@
+package emailq
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// Messages and corrupt values are stored as JSON objects with the fields of Msg and Corrupt,
+// byte slices in base64, so tools in any language can read the queue. Values written before
+// are gob. They still decode and turn into JSON whenever they're stored again.
+
+// marshal encodes v for storage
+func marshal(v any) []byte {
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// unmarshal decodes a stored value of either format. A gob value starts with the length of
+// its type's description, never '{' for Msg or Corrupt.
+func unmarshal(b []byte, v any) error {
+	if len(b) > 0 && b[0] == '{' {
+		return json.Unmarshal(b, v)
+	}
+
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
@@ -0,0 +1,67 @@
+package emailq
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestJSONValues(t *testing.T) {
+	dir, err := os.MkdirTemp("", "emailq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	queue, err := New(filepath.Join(dir, "queue.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+
+	queue.Push(ctx, createMsg())
+
+	queue.db.View(func(tx *bolt.Tx) error {
+		_, v := tx.Bucket(incomingBucket).Cursor().First()
+
+		var stored map[string]any
+		if err := json.Unmarshal(v, &stored); err != nil || stored["From"] != "from" {
+			t.Fatal("Message not stored as JSON:", string(v), err)
+		}
+		return nil
+	})
+}
+
+func TestGobValues(t *testing.T) {
+	for name, queue := range backends(t) {
+		// as written before values were JSON
+		var buf bytes.Buffer
+		old := createMsg()
+		old.Created = time.Now().UTC().Truncate(time.Second)
+		gob.NewEncoder(&buf).Encode(old)
+		inject(t, queue, string(newKey(time.Now().Add(-time.Second))), buf.Bytes())
+
+		key, msg, err := queue.Pop(ctx)
+		if err != nil || key == nil {
+			t.Fatal(name, "error popping:", err)
+		}
+		if msg.From != old.From || !msg.Created.Equal(old.Created) || string(msg.Data) != string(old.Data) {
+			t.Fatal(name, "gob value decoded wrong:", msg)
+		}
+
+		// stored again as JSON
+		if err = queue.Retry(key, nil); err != nil {
+			t.Fatal(name, "error retrying:", err)
+		}
+		page, _ := queue.(Lister).ListPending(ctx, Filter{})
+		if len(page) != 1 || page[0].Msg.From != old.From {
+			t.Fatal(name, "retried gob value lost:", page)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package emailq
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var greylistBucket = []byte("greylist")
+
+// greylist entry, first and last attempt as unix seconds followed by 1 once the tuple passed
+const greylistEntrySize = 17
+
+// Greylist records a delivery attempt of the (client IP, sender, recipient) tuple and reports
+// whether it may pass. A tuple is turned away until it retries at least delay after it was first
+// seen, then it passes until it isn't seen for expire.
+func (q *EmailQ) Greylist(ip, from, to string, delay, expire time.Duration) (pass bool, err error) {
+	return q.greylist(ip, from, to, q.now(), delay, expire)
+}
+
+func (q *EmailQ) greylist(ip, from, to string, now time.Time, delay, expire time.Duration) (pass bool, err error) {
+	key := []byte(ip + "\x00" + strings.ToLower(from) + "\x00" + strings.ToLower(to))
+
+	err = q.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(greylistBucket)
+
+		first, last, passed := now, now, false
+		if v := b.Get(key); len(v) == greylistEntrySize {
+			first = time.Unix(int64(binary.BigEndian.Uint64(v)), 0)
+			last = time.Unix(int64(binary.BigEndian.Uint64(v[8:])), 0)
+			passed = v[16] == 1
+		}
+
+		if now.Sub(last) > expire {
+			first, passed = now, false
+		}
+
+		pass = passed || now.Sub(first) >= delay
+		if pass {
+			passed = true
+		}
+
+		v := make([]byte, greylistEntrySize)
+		binary.BigEndian.PutUint64(v, uint64(first.Unix()))
+		binary.BigEndian.PutUint64(v[8:], uint64(now.Unix()))
+		if passed {
+			v[16] = 1
+		}
+
+		return b.Put(key, v)
+	})
+
+	return pass, err
+}
+
+// PruneGreylist removes greylist entries not seen for expire
+func (q *EmailQ) PruneGreylist(expire time.Duration) (removed int, err error) {
+	return q.pruneGreylist(q.now().Add(-expire))
+}
+
+func (q *EmailQ) pruneGreylist(before time.Time) (removed int, err error) {
+	cutoff := before.Unix()
+
+	err = q.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(greylistBucket)
+
+		// deleting while iterating with a cursor skips entries, collect first
+		var expired [][]byte
+		b.ForEach(func(k, v []byte) error {
+			if len(v) != greylistEntrySize || int64(binary.BigEndian.Uint64(v[8:])) < cutoff {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		removed = len(expired)
+		return nil
+	})
+
+	return removed, err
+}
+
+// Greylist keeps greylist entries in the first shard
+func (s *Sharded) Greylist(ip, from, to string, delay, expire time.Duration) (bool, error) {
+	return s.shards[0].Greylist(ip, from, to, delay, expire)
+}
+
+// PruneGreylist removes greylist entries not seen for expire
+func (s *Sharded) PruneGreylist(expire time.Duration) (int, error) {
+	return s.shards[0].PruneGreylist(expire)
+}
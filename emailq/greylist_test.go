@@ -0,0 +1,39 @@
+package emailq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGreylist(t *testing.T) {
+	start := time.Now()
+	delay, expire := 5*time.Minute, 24*time.Hour
+
+	attempt := func(to string, after time.Duration, expected bool) {
+		t.Helper()
+
+		pass, err := q.greylist("192.0.2.1", "a@example.com", to, start.Add(after), delay, expire)
+		if err != nil {
+			t.Fatal("Error greylisting:", err)
+		}
+		if pass != expected {
+			t.Fatalf("Expected pass %v for %s after %v", expected, to, after)
+		}
+	}
+
+	attempt("b@example.org", 0, false)
+	attempt("b@example.org", time.Minute, false)
+	attempt("B@example.org", 6*time.Minute, true)
+	attempt("b@example.org", 20*time.Hour, true)
+
+	// another recipient starts over
+	attempt("c@example.org", 20*time.Hour, false)
+
+	// forgotten after it wasn't seen for expire
+	attempt("b@example.org", 45*time.Hour, false)
+
+	removed, err := q.pruneGreylist(start.Add(46 * time.Hour))
+	if err != nil || removed != 2 {
+		t.Fatal("Unexpected prune result:", removed, err)
+	}
+}
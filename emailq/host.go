@@ -0,0 +1,409 @@
+package emailq
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// hostsBucket indexes incoming keys by destination host, a nested bucket per host. Each host
+// is a queue of its own in key order, popped in turn with the others.
+var hostsBucket = []byte("hosts")
+
+// retriesBucket is hostsBucket for the keys of retried messages, those of each host take
+// turns with its fresh ones
+var retriesBucket = []byte("retries")
+
+// lanes are the indexes keys are filed in, fresh first
+var lanes = [][]byte{hostsBucket, retriesBucket}
+
+// lane is the index of a message, retried or not
+func lane(retried bool) []byte {
+	if retried {
+		return retriesBucket
+	}
+
+	return hostsBucket
+}
+
+// hostKeys are the due keys of one host, fresh and retried ones in lanes of their own
+type hostKeys struct {
+	host           string
+	fresh, retried []string // oldest first
+	retriedFirst   bool     // the oldest of them all is retried
+	keys           []string // both lanes taking turns, see turns.order
+}
+
+// keyed sets retriedFirst for queues whose keys sort in due order
+func (h *hostKeys) keyed() {
+	h.retriedFirst = len(h.fresh) == 0 || len(h.retried) > 0 && h.retried[0] < h.fresh[0]
+}
+
+// oldest is the oldest key of both lanes
+func (h *hostKeys) oldest() string {
+	if len(h.fresh) == 0 || h.retriedFirst {
+		return h.retried[0]
+	}
+
+	return h.fresh[0]
+}
+
+// turns remembers the lane each host was popped from last, the other goes first next time.
+// That way pops of one message take turns as well as the messages of a batch do.
+type turns struct {
+	mu      sync.Mutex
+	retried map[string]bool // host -> its last popped message was retried
+}
+
+// order interleaves the lanes of hosts into their keys, up to n each. A host starts with the
+// lane it wasn't popped from last, or else the one holding its oldest key. However many
+// retries come due at once, a fresh message waits behind no more of them than of other fresh
+// ones, and the other way round.
+func (t *turns) order(hosts []hostKeys, n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i := range hosts {
+		h := &hosts[i]
+
+		retriedFirst := h.retriedFirst
+		if last, ok := t.retried[h.host]; ok {
+			retriedFirst = !last
+		}
+
+		first, second := h.fresh, h.retried
+		if retriedFirst {
+			first, second = second, first
+		}
+
+		h.keys = make([]string, 0, min(n, len(first)+len(second)))
+		for len(h.keys) < n && len(first)+len(second) > 0 {
+			if len(first) > 0 {
+				h.keys, first = append(h.keys, first[0]), first[1:]
+			}
+			if len(second) > 0 && len(h.keys) < n {
+				h.keys, second = append(h.keys, second[0]), second[1:]
+			}
+		}
+	}
+}
+
+// took notes the lane of the last of keys each host had popped. Hosts popped of all the keys
+// they had due are forgotten, they start with their oldest one again.
+func (t *turns) took(hosts []hostKeys, keys []string) {
+	popped := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		popped[k] = true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.retried == nil {
+		t.retried = make(map[string]bool)
+	}
+
+	for _, h := range hosts {
+		last := -1
+		for i, k := range h.keys {
+			if popped[k] {
+				last = i
+			}
+		}
+
+		switch {
+		case last < 0:
+		case last == len(h.fresh)+len(h.retried)-1:
+			delete(t.retried, h.host)
+		default:
+			t.retried[h.host] = slices.Contains(h.retried, h.keys[last])
+		}
+	}
+}
+
+// schedule takes up to n keys from hosts one per host and round, so a host with a large
+// backlog doesn't hold back the others. Hosts go in the order given. With limit, a host gets
+// no more keys than limit minus what busy says it has out for delivery already.
+func schedule(hosts []hostKeys, n, limit int, busy map[string]int) (keys []string) {
+	next := make([]int, len(hosts))
+
+	for len(keys) < n {
+		added := false
+		for i, h := range hosts {
+			if len(keys) == n {
+				break
+			}
+			if next[i] == len(h.keys) || limit > 0 && busy[h.host]+next[i] >= limit {
+				continue
+			}
+
+			keys = append(keys, h.keys[next[i]])
+			next[i]++
+			added = true
+		}
+
+		if !added {
+			break
+		}
+	}
+
+	return keys
+}
+
+// byOldest orders hosts by their oldest due key
+func byOldest(hosts []hostKeys) {
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].oldest() < hosts[j].oldest() })
+}
+
+// groupHosts collects up to n due keys per lane and host from keys in due order. hostOf
+// returns "" for keys to skip and whether a message was retried.
+func groupHosts(keys []string, n int, hostOf func(i int) (host string, retried bool)) []hostKeys {
+	var hosts []hostKeys
+	index := make(map[string]int)
+
+	for i, k := range keys {
+		host, retried := hostOf(i)
+		if host == "" {
+			continue
+		}
+
+		j, ok := index[host]
+		if !ok {
+			j = len(hosts)
+			index[host] = j
+			hosts = append(hosts, hostKeys{host: host, retriedFirst: retried})
+		}
+
+		h := &hosts[j]
+		if retried && len(h.retried) < n {
+			h.retried = append(h.retried, k)
+		} else if !retried && len(h.fresh) < n {
+			h.fresh = append(h.fresh, k)
+		}
+	}
+
+	return hosts
+}
+
+// hostName is the index bucket of host. Values that don't decode have no host, they're filed
+// under "?" to still be popped and set aside.
+func hostName(host string) []byte {
+	if host == "" {
+		return []byte("?")
+	}
+
+	return []byte(strings.ToLower(host))
+}
+
+// putIncoming stores v under key in incoming and indexes it for host, in the lane of
+// retried messages if it was
+func putIncoming(tx *bolt.Tx, key, v []byte, host string, retried bool) error {
+	if err := tx.Bucket(incomingBucket).Put(key, v); err != nil {
+		return err
+	}
+
+	b, err := tx.Bucket(lane(retried)).CreateBucketIfNotExists(hostName(host))
+	if err != nil {
+		return err
+	}
+
+	return b.Put(key, []byte{})
+}
+
+// deleteIncoming drops key from incoming, its lease and the index of host in either lane. A
+// key not filed under host, e.g. a value that stopped decoding, is looked for under every host.
+func deleteIncoming(tx *bolt.Tx, key []byte, host string) error {
+	if err := tx.Bucket(incomingBucket).Delete(key); err != nil {
+		return err
+	}
+
+	if err := tx.Bucket(leasesBucket).Delete(key); err != nil {
+		return err
+	}
+
+	for _, l := range lanes {
+		hosts := tx.Bucket(l)
+		if b := hosts.Bucket(hostName(host)); b != nil && b.Get(key) != nil {
+			return unindex(hosts, hostName(host), key)
+		}
+	}
+
+	for _, l := range lanes {
+		hosts := tx.Bucket(l)
+
+		var found []byte
+		hosts.ForEachBucket(func(name []byte) error {
+			if found == nil && hosts.Bucket(name).Get(key) != nil {
+				found = append([]byte(nil), name...)
+			}
+			return nil
+		})
+		if found != nil {
+			return unindex(hosts, found, key)
+		}
+	}
+
+	return nil
+}
+
+// unindex drops key from the bucket of host, and the bucket once it's empty
+func unindex(hosts *bolt.Bucket, name, key []byte) error {
+	b := hosts.Bucket(name)
+	if err := b.Delete(key); err != nil {
+		return err
+	}
+
+	if k, _ := b.Cursor().First(); k == nil {
+		return hosts.DeleteBucket(name)
+	}
+
+	return nil
+}
+
+// hostOf reads the host of a stored value, "" if it doesn't decode
+func hostOf(v []byte) string {
+	return decode(v).Host
+}
+
+// indexHosts builds the index of files written before there was one, or before retried
+// messages had a lane of their own
+func indexHosts(tx *bolt.Tx) error {
+	for _, l := range lanes {
+		if err := tx.DeleteBucket(l); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		if _, err := tx.CreateBucket(l); err != nil {
+			return err
+		}
+	}
+
+	// collect first, the bucket can't change under ForEach
+	type entry struct{ key, host, lane []byte }
+	var entries []entry
+	tx.Bucket(incomingBucket).ForEach(func(k, v []byte) error {
+		m := decode(v)
+		entries = append(entries, entry{append([]byte(nil), k...), hostName(m.Host), lane(m.Retry > 0)})
+		return nil
+	})
+
+	for _, e := range entries {
+		b, err := tx.Bucket(e.lane).CreateBucketIfNotExists(e.host)
+		if err != nil {
+			return err
+		}
+		if err = b.Put(e.key, []byte{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dueHosts finds up to n due keys in each lane of each host that isn't paused, hosts with
+// the oldest first. Leased keys are skipped.
+func dueHosts(tx *bolt.Tx, n int, now time.Time) (hosts []hostKeys, err error) {
+	now = now.UTC()
+	paused := pausedHosts(tx)
+
+	// hosts either lane has, in the order found
+	var names []string
+	seen := make(map[string]bool)
+	for _, l := range lanes {
+		tx.Bucket(l).ForEachBucket(func(name []byte) error {
+			if !seen[string(name)] && !paused[string(name)] {
+				seen[string(name)] = true
+				names = append(names, string(name))
+			}
+			return nil
+		})
+	}
+
+	for _, name := range names {
+		h := hostKeys{host: name}
+		if h.fresh, err = dueKeysOf(tx, hostsBucket, name, n, now); err != nil {
+			return nil, err
+		}
+		if h.retried, err = dueKeysOf(tx, retriesBucket, name, n, now); err != nil {
+			return nil, err
+		}
+
+		if len(h.fresh)+len(h.retried) > 0 {
+			h.keyed()
+			hosts = append(hosts, h)
+		}
+	}
+	byOldest(hosts)
+
+	return hosts, nil
+}
+
+// dueKeysOf finds up to n due keys host has in the index l, leased ones are skipped
+func dueKeysOf(tx *bolt.Tx, l []byte, host string, n int, now time.Time) (keys []string, err error) {
+	b := tx.Bucket(l).Bucket([]byte(host))
+	if b == nil {
+		return nil, nil
+	}
+
+	incoming := tx.Bucket(incomingBucket)
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && len(keys) < n; k, _ = c.Next() {
+		t, err := keyTime(k)
+		if err != nil {
+			return nil, err
+		}
+		if t.After(now) {
+			break
+		}
+
+		if incoming.Get(k) != nil && !leased(tx, k, now) {
+			keys = append(keys, string(k))
+		}
+	}
+
+	return keys, nil
+}
+
+// dueKeys picks up to n keys due for delivery, taking turns between hosts and between the
+// fresh and retried messages of each
+func (q *EmailQ) dueKeys(tx *bolt.Tx, n int) ([][]byte, error) {
+	now := q.now()
+	hosts, err := dueHosts(tx, n, now)
+	if err != nil {
+		return nil, err
+	}
+	q.turns.order(hosts, n)
+
+	var busy map[string]int
+	if q.hostLimit > 0 {
+		busy = leasedHosts(tx, now)
+	}
+
+	chosen := schedule(hosts, n, q.hostLimit, busy)
+	q.turns.took(hosts, chosen)
+
+	var keys [][]byte
+	for _, k := range chosen {
+		keys = append(keys, []byte(k))
+	}
+
+	return keys, nil
+}
+
+// candidates returns what dueHosts and leasedHosts find, the latter only with busy
+func (q *EmailQ) candidates(ctx context.Context, n int, busy bool) (hosts []hostKeys, out map[string]int, err error) {
+	err = q.view(cancellable(ctx, func(tx *bolt.Tx) error {
+		now := q.now()
+		hosts, err = dueHosts(tx, n, now)
+		if busy {
+			out = leasedHosts(tx, now)
+		}
+		return err
+	}))
+
+	return hosts, out, err
+}
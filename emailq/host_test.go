@@ -0,0 +1,177 @@
+package emailq
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// limitHosts sets the host limit of a queue from backends
+func limitHosts(queue Queue, limit int) {
+	switch b := queue.(type) {
+	case *EmailQ:
+		b.hostLimit = limit
+	case *Sharded:
+		b.hostLimit = limit
+	case *Memory:
+		b.HostLimit = limit
+	case *Redis:
+		b.HostLimit = limit
+	case *SQL:
+		b.HostLimit = limit
+	}
+}
+
+func pushTo(t *testing.T, queue Queue, host string, n int) {
+	for i := 0; i < n; i++ {
+		msg := createMsg()
+		msg.Host = host
+		if err := queue.Push(ctx, msg); err != nil {
+			t.Fatal("Error pushing:", err)
+		}
+	}
+}
+
+func countHosts(batch []Delivery) map[string]int {
+	hosts := make(map[string]int)
+	for _, d := range batch {
+		hosts[d.Msg.Host]++
+	}
+
+	return hosts
+}
+
+func TestHostTurns(t *testing.T) {
+	for name, queue := range backends(t) {
+		pushTo(t, queue, "gmail.com", 10)
+		pushTo(t, queue, "Example.org", 2)
+
+		// the burst for gmail.com came first but doesn't keep example.org waiting
+		batch, err := queue.PopBatch(ctx, 4)
+		if err != nil {
+			t.Fatal(name, "error popping:", err)
+		}
+		if hosts := countHosts(batch); hosts["gmail.com"] != 2 || hosts["Example.org"] != 2 {
+			t.Fatal(name, "hosts didn't take turns:", hosts)
+		}
+
+		batch, _ = queue.PopBatch(ctx, 20)
+		if hosts := countHosts(batch); hosts["gmail.com"] != 8 || len(hosts) != 1 {
+			t.Fatal(name, "rest of the burst not popped:", hosts)
+		}
+	}
+}
+
+func TestHostLimit(t *testing.T) {
+	for name, queue := range backends(t) {
+		limitHosts(queue, 2)
+		pushTo(t, queue, "gmail.com", 5)
+		pushTo(t, queue, "example.org", 1)
+
+		batch, err := queue.PopBatch(ctx, 10)
+		if err != nil {
+			t.Fatal(name, "error popping:", err)
+		}
+		if hosts := countHosts(batch); hosts["gmail.com"] != 2 || hosts["example.org"] != 1 {
+			t.Fatal(name, "host limit not kept:", hosts)
+		}
+
+		if more, _ := queue.PopBatch(ctx, 10); len(more) != 0 {
+			t.Fatal(name, "popped over the host limit:", countHosts(more))
+		}
+
+		// a delivery makes room for the next one
+		for _, d := range batch {
+			if d.Msg.Host == "gmail.com" {
+				queue.RemoveDelivered(d.Key)
+				break
+			}
+		}
+		if more, _ := queue.PopBatch(ctx, 10); len(more) != 1 || more[0].Msg.Host != "gmail.com" {
+			t.Fatal(name, "expected one more for gmail.com, got", countHosts(more))
+		}
+	}
+}
+
+func TestHostIndexUpgrade(t *testing.T) {
+	dir, err := os.MkdirTemp("", "emailq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queue.db")
+	queue, err := New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushTo(t, queue, "example.org", 3)
+
+	// as written before the index
+	queue.db.Update(func(tx *bolt.Tx) error { return tx.DeleteBucket(hostsBucket) })
+	queue.Close()
+
+	if queue, err = New(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+
+	if batch, err := queue.PopBatch(ctx, 10); err != nil || len(batch) != 3 {
+		t.Fatal("Messages lost upgrading:", len(batch), err)
+	}
+}
+
+func TestRetryTurns(t *testing.T) {
+	for name, queue := range backends(t) {
+		clock := &fakeClock{now: time.Now()}
+		setClock(queue, clock)
+
+		pushTo(t, queue, "example.org", 10)
+		batch, _ := queue.PopBatch(ctx, 10)
+		for _, d := range batch {
+			queue.Retry(d.Key, nil)
+		}
+		clock.advance(Quadratic(1))
+
+		// a burst of retries came due first, fresh mail still gets every other turn
+		pushTo(t, queue, "example.org", 1)
+		if !popsWithin(queue, 2, 0) {
+			t.Fatal(name, "fresh message waited behind the retries")
+		}
+
+		batch, _ = queue.PopBatch(ctx, 20)
+		for _, d := range batch {
+			queue.RemoveDelivered(d.Key)
+		}
+
+		// and the other way round
+		pushTo(t, queue, "example.org", 1)
+		key, _, _ := queue.Pop(ctx)
+		queue.Retry(key, nil)
+		pushTo(t, queue, "example.org", 10)
+		clock.advance(Quadratic(1))
+
+		if !popsWithin(queue, 2, 1) {
+			t.Fatal(name, "retry waited behind the fresh messages")
+		}
+	}
+}
+
+// popsWithin delivers n messages popped one at a time, it tells if one of them was retried
+// retry times
+func popsWithin(queue Queue, n, retry int) bool {
+	found := false
+	for i := 0; i < n; i++ {
+		key, msg, _ := queue.Pop(ctx)
+		if key == nil {
+			break
+		}
+		found = found || msg.Retry == retry
+		queue.RemoveDelivered(key)
+	}
+
+	return found
+}
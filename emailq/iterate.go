@@ -0,0 +1,85 @@
+package emailq
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// Stop is returned by the fn of Iterate to end the walk early without an error
+var Stop = errors.New("Stop iterating")
+
+// Cursor is where Iterate picks up, after the message it names. It stays valid however the
+// queue changes meanwhile, keys don't change and sort by time. A retried message gets a new
+// key though and may come up again. The empty Cursor starts from the first message.
+type Cursor string
+
+func cursorOf(key []byte) Cursor {
+	return Cursor(base64.RawURLEncoding.EncodeToString(key))
+}
+
+func (c Cursor) key() ([]byte, error) {
+	if c == "" {
+		return nil, nil
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(string(c))
+	if err != nil || len(key) == 0 {
+		return nil, fmt.Errorf("Invalid cursor: %s", c)
+	}
+
+	return key, nil
+}
+
+// listOf picks the List method of l for state
+func listOf(l Lister, state string) (func(context.Context, Filter) ([]Delivery, error), error) {
+	switch state {
+	case StatePending:
+		return l.ListPending, nil
+	case StateDead:
+		return l.ListDead, nil
+	case StateArchived:
+		return l.ListArchived, nil
+	}
+
+	return nil, fmt.Errorf("Unknown state: %s", state)
+}
+
+// Iterate calls fn for every message of state f selects in key order, starting after from.
+// Messages are fetched f.Limit at a time, only a page is held in memory however large the
+// queue. f.After is ignored, from takes its place. Returns the cursor to resume after the
+// last message fn took, empty once state was walked to the end. fn returning Stop ends the
+// walk with a nil error, ctx being done with its error.
+func Iterate(ctx context.Context, l Lister, state string, from Cursor, f Filter, fn func(d Delivery) error) (next Cursor, err error) {
+	list, err := listOf(l, state)
+	if err != nil {
+		return from, err
+	}
+
+	if f.After, err = from.key(); err != nil {
+		return from, err
+	}
+
+	for {
+		page, err := list(ctx, f)
+		if err != nil {
+			return from, err
+		}
+		if len(page) == 0 {
+			return "", nil
+		}
+
+		for _, d := range page {
+			if err = fn(d); err == Stop {
+				return cursorOf(d.Key), nil
+			}
+			if err != nil {
+				return from, err
+			}
+			from = cursorOf(d.Key)
+		}
+
+		f.After = page[len(page)-1].Key
+	}
+}
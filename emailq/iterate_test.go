@@ -0,0 +1,48 @@
+package emailq
+
+import (
+	"testing"
+)
+
+func TestIterate(t *testing.T) {
+	for name, queue := range backends(t) {
+		for i := 0; i < 5; i++ {
+			queue.Push(ctx, createMsg())
+		}
+		l := queue.(Lister)
+
+		// a page of two at a time, stopping after the third
+		var seen []string
+		next, err := Iterate(ctx, l, StatePending, "", Filter{Limit: 2}, func(d Delivery) error {
+			seen = append(seen, string(d.Key))
+			if len(seen) == 3 {
+				return Stop
+			}
+			return nil
+		})
+		if err != nil || len(seen) != 3 || next == "" {
+			t.Fatal(name, "error iterating:", len(seen), next, err)
+		}
+
+		// a new message doesn't upset the cursor
+		queue.Push(ctx, createMsg())
+
+		next, err = Iterate(ctx, l, StatePending, next, Filter{Limit: 2}, func(d Delivery) error {
+			if string(d.Key) <= seen[len(seen)-1] {
+				t.Fatal(name, "message seen twice:", string(d.Key))
+			}
+			seen = append(seen, string(d.Key))
+			return nil
+		})
+		if err != nil || len(seen) != 6 || next != "" {
+			t.Fatal(name, "error resuming:", len(seen), next, err)
+		}
+
+		if _, err = Iterate(ctx, l, StatePending, "not base64!", Filter{}, func(Delivery) error { return nil }); err == nil {
+			t.Fatal(name, "invalid cursor accepted")
+		}
+		if _, err = Iterate(ctx, l, "outgoing", "", Filter{}, func(Delivery) error { return nil }); err == nil {
+			t.Fatal(name, "unknown state accepted")
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package emailq
+
+import (
+	"bytes"
+	"context"
+	"net/mail"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var journalBucket = []byte("journal")
+
+// Results of delivery attempts in the journal
+const (
+	ResultDelivered = "delivered"
+	ResultDeferred  = "deferred" // to be retried
+	ResultBounced   = "bounced"  // refused permanently or out of retries
+)
+
+// Entry is a delivery attempt as the journal keeps it, stored as JSON like messages. The
+// journal is only ever appended to, PurgeJournal drops the oldest entries.
+type Entry struct {
+	ID        string // journal key, sorts by Time
+	Time      time.Time
+	Key       string // of the message when attempted, retries get a new one
+	MessageID string
+	From      string
+	To        []string
+	Host      string
+	MX        string // server tried, empty if none was reached
+	Code      int    // SMTP reply code, zero without one
+	Result    string
+	Error     string
+	Duration  time.Duration
+}
+
+// EntryFor fills in what the journal keeps of message key, the attempt is up to the caller
+func EntryFor(key []byte, msg *Msg) Entry {
+	e := Entry{Key: string(key), From: msg.From, To: msg.To, Host: msg.Host}
+	if m, err := mail.ReadMessage(bytes.NewReader(msg.Data)); err == nil {
+		e.MessageID = m.Header.Get("Message-Id")
+	}
+
+	return e
+}
+
+// JournalFilter selects journal entries, zero fields match everything
+type JournalFilter struct {
+	Key       string // message key
+	MessageID string
+	Host      string
+	Since     time.Time // attempted at or after
+	Until     time.Time // attempted before
+
+	After string // ID of the last entry on the previous page
+	Limit int    // page size, 100 if zero
+}
+
+func (f *JournalFilter) match(e *Entry) bool {
+	switch {
+	case f.Key != "" && e.Key != f.Key:
+		return false
+	case f.MessageID != "" && e.MessageID != f.MessageID:
+		return false
+	case f.Host != "" && !strings.EqualFold(e.Host, f.Host):
+		return false
+	}
+
+	return true
+}
+
+// Journal appends an attempt to the journal, e.ID is set and e.Time if it's zero
+func (q *EmailQ) Journal(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = q.now()
+	}
+	e.Time = e.Time.UTC()
+	key := newKey(e.Time)
+	e.ID = string(key)
+
+	return q.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(journalBucket).Put(key, marshal(e))
+	})
+}
+
+// ListJournal pages through the journal oldest first, seeking to f.Since
+func (q *EmailQ) ListJournal(ctx context.Context, f JournalFilter) (page []Entry, err error) {
+	limit := f.Limit
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+
+	err = q.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(journalBucket).Cursor()
+
+		start := []byte(f.After)
+		if f.After == "" && !f.Since.IsZero() {
+			start = []byte(f.Since.UTC().Format(keyLayout))
+		}
+
+		k, v := c.Seek(start)
+		if f.After != "" && bytes.Equal(k, start) {
+			k, v = c.Next()
+		}
+
+		until := []byte(f.Until.UTC().Format(keyLayout))
+		for ; k != nil && len(page) < limit; k, v = c.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !f.Until.IsZero() && bytes.Compare(k, until) >= 0 {
+				break
+			}
+
+			var e Entry
+			if err := unmarshal(v, &e); err != nil {
+				continue
+			}
+			if f.match(&e) {
+				page = append(page, e)
+			}
+		}
+
+		return nil
+	})
+
+	return page, err
+}
+
+// PurgeJournal drops entries older than retention and all but the newest keep, like
+// PurgeDead does dead letters. Returns how many were dropped.
+func (q *EmailQ) PurgeJournal(retention time.Duration, keep int) (int, error) {
+	return q.purge(journalBucket, retention, keep)
+}
+
+// Journal keeps the journal in the first shard
+func (s *Sharded) Journal(e Entry) error {
+	return s.shards[0].Journal(e)
+}
+
+// ListJournal pages through the journal in the first shard
+func (s *Sharded) ListJournal(ctx context.Context, f JournalFilter) ([]Entry, error) {
+	return s.shards[0].ListJournal(ctx, f)
+}
+
+// PurgeJournal drops old entries of the journal in the first shard
+func (s *Sharded) PurgeJournal(retention time.Duration, keep int) (int, error) {
+	return s.shards[0].PurgeJournal(retention, keep)
+}
@@ -0,0 +1,61 @@
+package emailq
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type journaler interface {
+	Journal(e Entry) error
+	ListJournal(ctx context.Context, f JournalFilter) ([]Entry, error)
+	PurgeJournal(retention time.Duration, keep int) (int, error)
+}
+
+func TestJournal(t *testing.T) {
+	for name, queue := range backends(t) {
+		j, ok := queue.(journaler)
+		if !ok {
+			continue
+		}
+
+		msg := createMsg()
+		msg.Data = []byte("Message-Id: <1@example.com>\r\n\r\nHello")
+		start := time.Now().Add(-time.Hour)
+
+		for i, result := range []string{ResultDeferred, ResultDeferred, ResultDelivered} {
+			e := EntryFor([]byte("key"), msg)
+			e.Time, e.Result, e.MX = start.Add(time.Duration(i)*time.Minute), result, "mx.example.com"
+			if err := j.Journal(e); err != nil {
+				t.Fatal(name, "error journaling:", err)
+			}
+		}
+		other := EntryFor([]byte("other"), createMsg())
+		other.Result = ResultBounced
+		j.Journal(other)
+
+		all, err := j.ListJournal(ctx, JournalFilter{MessageID: "<1@example.com>"})
+		if err != nil || len(all) != 3 || all[2].Result != ResultDelivered || all[0].MX != "mx.example.com" {
+			t.Fatal(name, "unexpected journal of the message:", all, err)
+		}
+
+		page, _ := j.ListJournal(ctx, JournalFilter{Key: "key", Limit: 2})
+		next, _ := j.ListJournal(ctx, JournalFilter{Key: "key", After: page[1].ID})
+		if len(page) != 2 || len(next) != 1 || next[0].ID != all[2].ID {
+			t.Fatal(name, "unexpected pages:", page, next)
+		}
+
+		window, _ := j.ListJournal(ctx, JournalFilter{Since: start.Add(30 * time.Second), Until: start.Add(90 * time.Second)})
+		if len(window) != 1 || window[0].ID != all[1].ID {
+			t.Fatal(name, "unexpected entries between since and until:", window)
+		}
+
+		// the bounce is recent, the attempts an hour old
+		if n, err := j.PurgeJournal(30*time.Minute, 0); err != nil || n != 3 {
+			t.Fatal(name, "unexpected purge:", n, err)
+		}
+		if left, _ := j.ListJournal(ctx, JournalFilter{}); len(left) != 1 || left[0].Result != ResultBounced {
+			t.Fatal(name, "unexpected journal after purging:", left)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package emailq
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// keyLayout is a fixed width UTC timestamp, keys sort by time byte by byte
+const keyLayout = "2006-01-02T15:04:05.000000000Z"
+
+var keySeq uint32
+
+// newKey makes a key sorting by t, the sequence number keeps messages pushed or retried at
+// the same instant from overwriting each other
+func newKey(t time.Time) []byte {
+	return []byte(fmt.Sprintf("%s-%08x", t.UTC().Format(keyLayout), atomic.AddUint32(&keySeq, 1)))
+}
+
+// uniqueKey is newKey with a random suffix, for queues shared by instances whose sequence
+// numbers may coincide
+func uniqueKey(t time.Time) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+
+	return string(newKey(t)) + hex.EncodeToString(suffix)
+}
+
+// keyTime returns the time key sorts by. Keys written before sequence numbers are plain
+// RFC 3339 timestamps.
+func keyTime(key []byte) (time.Time, error) {
+	if len(key) > len(keyLayout) && key[len(keyLayout)] == '-' {
+		return time.Parse(keyLayout, string(key[:len(keyLayout)]))
+	}
+
+	return time.Parse(time.RFC3339Nano, string(key))
+}
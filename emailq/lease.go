@@ -0,0 +1,146 @@
+package emailq
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// leasesBucket holds the leases of popped messages. A popped message stays in incoming under
+// its key, the lease says who took it and until when. Once the lease runs out the message is
+// due again, so nothing is lost to a crash while it was out for delivery.
+var leasesBucket = []byte("leases")
+
+// outgoingBucket held popped messages before leases, New moves them back to incoming
+var outgoingBucket = []byte("outgoing")
+
+// DefaultLease is how long a popped message is held if Options.Lease is zero
+const DefaultLease = 30 * time.Minute
+
+// ErrLeased is returned for a message whose lease is held by another owner
+var ErrLeased = errors.New("Message is leased by another owner")
+
+// errNotLeased is returned for a key that isn't out for delivery
+var errNotLeased = notFound("outgoing")
+
+// lease value, the expiry as unix nanoseconds followed by the owner
+type lease struct {
+	owner string
+	until time.Time
+}
+
+func (l lease) encode() []byte {
+	v := make([]byte, 8+len(l.owner))
+	binary.BigEndian.PutUint64(v, uint64(l.until.UnixNano()))
+	copy(v[8:], l.owner)
+
+	return v
+}
+
+func decodeLease(v []byte) (l lease, ok bool) {
+	if len(v) < 8 {
+		return l, false
+	}
+
+	return lease{string(v[8:]), time.Unix(0, int64(binary.BigEndian.Uint64(v)))}, true
+}
+
+// newOwner makes the random owner ID a queue leases messages under
+func newOwner() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// leased reports whether key has a lease that hasn't run out
+func leased(tx *bolt.Tx, key []byte, now time.Time) bool {
+	l, ok := decodeLease(tx.Bucket(leasesBucket).Get(key))
+	return ok && l.until.After(now)
+}
+
+// pending returns the value of key in incoming, nil if it's missing or leased
+func pending(tx *bolt.Tx, key []byte, now time.Time) []byte {
+	if leased(tx, key, now) {
+		return nil
+	}
+
+	return tx.Bucket(incomingBucket).Get(key)
+}
+
+// held returns the value of a message q popped. A lease that ran out still counts as long as
+// no one else took the message since.
+func (q *EmailQ) held(tx *bolt.Tx, key []byte) ([]byte, error) {
+	v := tx.Bucket(incomingBucket).Get(key)
+	l, ok := decodeLease(tx.Bucket(leasesBucket).Get(key))
+	if v == nil || !ok {
+		return nil, errNotLeased
+	}
+
+	if l.owner != q.owner && l.until.After(q.now()) {
+		return nil, ErrLeased
+	}
+
+	return v, nil
+}
+
+// eachLeased calls fn with the key and value of every message out for delivery
+func eachLeased(tx *bolt.Tx, now time.Time, fn func(k, v []byte)) {
+	incoming := tx.Bucket(incomingBucket)
+
+	tx.Bucket(leasesBucket).ForEach(func(k, l []byte) error {
+		if v := incoming.Get(k); v != nil && leased(tx, k, now) {
+			fn(k, v)
+		}
+		return nil
+	})
+}
+
+// leasedUsage is what the messages out for delivery take of incoming
+func leasedUsage(tx *bolt.Tx, now time.Time) (u usage) {
+	eachLeased(tx, now, func(k, v []byte) {
+		u = u.add(usage{1, int64(len(v))})
+	})
+
+	return u
+}
+
+// leasedHosts counts the messages out for delivery by host
+func leasedHosts(tx *bolt.Tx, now time.Time) map[string]int {
+	busy := make(map[string]int)
+	eachLeased(tx, now, func(k, v []byte) {
+		busy[string(hostName(hostOf(v)))]++
+	})
+
+	return busy
+}
+
+// isLeased checks whether key is out for delivery
+func (q *EmailQ) isLeased(key []byte) (found bool) {
+	q.view(func(tx *bolt.Tx) error {
+		found = leased(tx, key, q.now())
+		return nil
+	})
+
+	return
+}
+
+// migrateOutgoing moves what files written before leases have out for delivery back to
+// incoming, due now
+func migrateOutgoing(tx *bolt.Tx) error {
+	outgoing := tx.Bucket(outgoingBucket)
+
+	err := outgoing.ForEach(func(k, v []byte) error {
+		m := decode(v)
+		return putIncoming(tx, newKey(time.Now()), append([]byte(nil), v...), m.Host, m.Retry > 0)
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.DeleteBucket(outgoingBucket)
+}
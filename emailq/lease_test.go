@@ -0,0 +1,137 @@
+package emailq
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestLease(t *testing.T) {
+	dir, err := os.MkdirTemp("", "emailq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	queue, err := New(filepath.Join(dir, "queue.db"), &Options{Lease: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+
+	queue.Push(ctx, createMsg())
+	key, _, err := queue.Pop(ctx)
+	if err != nil || key == nil {
+		t.Fatal("Error popping:", err)
+	}
+
+	if k, _, _ := queue.Pop(ctx); k != nil || queue.Length() != 0 {
+		t.Fatal("Leased message popped again")
+	}
+	if page, _ := queue.ListPending(ctx, Filter{}); len(page) != 0 {
+		t.Fatal("Leased message listed as pending")
+	}
+
+	// the lease runs out as if the process holding it crashed
+	time.Sleep(100 * time.Millisecond)
+
+	owner := queue.owner
+	queue.owner = "other"
+	again, _, err := queue.Pop(ctx)
+	if err != nil || string(again) != string(key) {
+		t.Fatal("Message not due again after its lease ran out:", string(again), err)
+	}
+
+	queue.owner = owner
+	if err = queue.Retry(key, nil); !errors.Is(err, ErrLeased) {
+		t.Fatal("Retried a message leased by another owner:", err)
+	}
+
+	queue.owner = "other"
+	if err = queue.RemoveDelivered(key); err != nil {
+		t.Fatal("Error removing delivered:", err)
+	}
+	if err = queue.Kill(key, nil); err == nil {
+		t.Fatal("Killed a delivered message")
+	}
+}
+
+func TestOutgoingUpgrade(t *testing.T) {
+	dir, err := os.MkdirTemp("", "emailq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queue.db")
+	queue, err := New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// as written before leases, a message out for delivery when the process died
+	queue.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(outgoingBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(newKey(time.Now()), encode(createMsg()))
+	})
+	queue.Close()
+
+	if queue, err = New(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+
+	if batch, err := queue.PopBatch(ctx, 10); err != nil || len(batch) != 1 {
+		t.Fatal("Outgoing message lost upgrading:", len(batch), err)
+	}
+}
+
+func TestInterrupted(t *testing.T) {
+	dir, err := os.MkdirTemp("", "emailq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	queue, err := New(filepath.Join(dir, "queue.db"), &Options{Lease: time.Millisecond, Backoff: Delays(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+
+	msg := createMsg()
+	msg.MaxRetries = 2
+	queue.Push(ctx, msg)
+
+	// a crash loop, every delivery is cut short, the third one for good
+	for retry := 0; retry <= 3; retry++ {
+		if retry%2 == 0 {
+			queue.Recover()
+		} else {
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		key, m, err := queue.Pop(ctx)
+		if retry == 3 {
+			if key != nil || err != nil {
+				t.Fatal("Message interrupted too often popped again:", m, err)
+			}
+			break
+		}
+		if err != nil || key == nil || m.Retry != retry || len(m.Attempts) != retry {
+			t.Fatal("Interruption not recorded:", retry, m, err)
+		}
+	}
+
+	dead, _ := queue.ListDead(ctx, Filter{})
+	if len(dead) != 1 || dead[0].Msg.DeadReason != ReasonInterrupted {
+		t.Fatal("Expected the message dead-lettered as interrupted:", dead)
+	}
+}
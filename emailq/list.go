@@ -0,0 +1,134 @@
+package emailq
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Filter selects messages listed by ListPending and ListDead, zero fields match everything
+type Filter struct {
+	Host     string    // destination domain
+	From     string    // sender
+	Since    time.Time // created at or after
+	Until    time.Time // created before
+	MinRetry int       // failed at least this many times
+	Reason   string    // dead-lettered for this DeadReason
+
+	Metadata map[string]string // has all of these in its Metadata
+
+	After []byte // key of the last message on the previous page
+	Limit int    // page size, 100 if zero
+}
+
+const defaultLimit = 100
+
+func (f *Filter) match(key []byte, msg *Msg) bool {
+	switch {
+	case f.After != nil && bytes.Compare(key, f.After) <= 0:
+		return false
+	case f.Host != "" && !strings.EqualFold(msg.Host, f.Host):
+		return false
+	case f.From != "" && !strings.EqualFold(msg.From, f.From):
+		return false
+	case !f.Since.IsZero() && msg.Created.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !msg.Created.Before(f.Until):
+		return false
+	case f.Reason != "" && msg.DeadReason != f.Reason:
+		return false
+	}
+
+	for k, v := range f.Metadata {
+		if mv, ok := msg.Metadata[k]; !ok || mv != v {
+			return false
+		}
+	}
+
+	return msg.Retry >= f.MinRetry
+}
+
+func (f *Filter) limit() int {
+	if f.Limit <= 0 {
+		return defaultLimit
+	}
+
+	return f.Limit
+}
+
+// ListPending pages through messages waiting for delivery in key order, leased ones are out
+// for delivery and skipped
+func (q *EmailQ) ListPending(ctx context.Context, f Filter) ([]Delivery, error) {
+	return q.list(ctx, incomingBucket, f)
+}
+
+// ListDead pages through dead letters in key order
+func (q *EmailQ) ListDead(ctx context.Context, f Filter) ([]Delivery, error) {
+	return q.list(ctx, deadBucket, f)
+}
+
+// list scans bucket for a page, checking ctx as it goes through messages f doesn't match
+func (q *EmailQ) list(ctx context.Context, bucket []byte, f Filter) (page []Delivery, err error) {
+	err = q.view(func(tx *bolt.Tx) error {
+		now := q.now()
+		skipLeased := bytes.Equal(bucket, incomingBucket)
+		c := tx.Bucket(bucket).Cursor()
+
+		k, v := c.First()
+		if f.After != nil {
+			k, v = c.Seek(f.After)
+		}
+
+		for ; k != nil && len(page) < f.limit(); k, v = c.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if skipLeased && leased(tx, k, now) {
+				continue
+			}
+			if msg := decode(v); f.match(k, msg) {
+				page = append(page, Delivery{Key: append([]byte(nil), k...), Msg: msg})
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return page, q.codec.open(page)
+}
+
+// ListPending pages through messages waiting for delivery in all shards
+func (s *Sharded) ListPending(ctx context.Context, f Filter) ([]Delivery, error) {
+	return s.list(ctx, (*EmailQ).ListPending, f)
+}
+
+// ListDead pages through dead letters in all shards
+func (s *Sharded) ListDead(ctx context.Context, f Filter) ([]Delivery, error) {
+	return s.list(ctx, (*EmailQ).ListDead, f)
+}
+
+// list merges a page of each shard, enough to fill the page in key order
+func (s *Sharded) list(ctx context.Context, fn func(*EmailQ, context.Context, Filter) ([]Delivery, error), f Filter) ([]Delivery, error) {
+	var page []Delivery
+	for _, q := range s.shards {
+		p, err := fn(q, ctx, f)
+		if err != nil {
+			return nil, err
+		}
+		page = append(page, p...)
+	}
+
+	sort.Slice(page, func(i, j int) bool { return bytes.Compare(page[i].Key, page[j].Key) < 0 })
+
+	if len(page) > f.limit() {
+		page = page[:f.limit()]
+	}
+	return page, nil
+}
@@ -0,0 +1,96 @@
+package emailq
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type lister interface {
+	Queue
+	ListPending(ctx context.Context, f Filter) ([]Delivery, error)
+	ListDead(ctx context.Context, f Filter) ([]Delivery, error)
+}
+
+func TestList(t *testing.T) {
+	for name, backend := range backends(t) {
+		queue := backend.(lister)
+
+		for i := 0; i < 5; i++ {
+			msg := createMsg()
+			if i >= 3 {
+				msg.Host = "gmail.com"
+			}
+			queue.Push(ctx, msg)
+		}
+
+		if page, err := queue.ListPending(ctx, Filter{Host: "Gmail.com"}); err != nil || len(page) != 2 {
+			t.Fatal(name, "unexpected messages for gmail.com:", len(page), err)
+		}
+
+		var pages []int
+		f := Filter{Limit: 2}
+		for {
+			page, err := queue.ListPending(ctx, f)
+			if err != nil {
+				t.Fatal(name, "error listing:", err)
+			}
+			if len(page) == 0 {
+				break
+			}
+
+			pages = append(pages, len(page))
+			f.After = page[len(page)-1].Key
+		}
+		if len(pages) != 3 || pages[2] != 1 {
+			t.Fatal(name, "unexpected pages:", pages)
+		}
+
+		if page, _ := queue.ListPending(ctx, Filter{MinRetry: 1}); len(page) != 0 {
+			t.Fatal(name, "listed messages that never failed")
+		}
+		if page, _ := queue.ListPending(ctx, Filter{Since: time.Now().Add(time.Hour)}); len(page) != 0 {
+			t.Fatal(name, "listed messages created before Since")
+		}
+
+		key, _, _ := queue.Pop(ctx)
+		queue.Kill(key, nil)
+
+		if page, err := queue.ListDead(ctx, Filter{From: "from"}); err != nil || len(page) != 1 || string(page[0].Key) != string(key) {
+			t.Fatal(name, "unexpected dead letters:", len(page), err)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	for name, backend := range backends(t) {
+		queue := backend.(lister)
+		setClock(queue, &fakeClock{now: time.Now().Add(-time.Hour)})
+
+		msg := createMsg()
+		msg.Metadata = map[string]string{"tenant": "acme", "campaign": "spring"}
+		queue.Push(ctx, msg)
+		queue.Push(ctx, createMsg())
+
+		key, _, _ := queue.Pop(ctx)
+		queue.Retry(key, nil)
+		setClock(queue, nil)
+
+		page, err := queue.ListPending(ctx, Filter{Metadata: map[string]string{"campaign": "spring"}})
+		if err != nil || len(page) != 1 || page[0].Msg.Metadata["tenant"] != "acme" {
+			t.Fatal(name, "metadata lost retrying:", len(page), err)
+		}
+		if page, _ := queue.ListPending(ctx, Filter{Metadata: map[string]string{"campaign": "autumn"}}); len(page) != 0 {
+			t.Fatal(name, "listed messages of another campaign")
+		}
+
+		batch, _ := queue.PopBatch(ctx, 2)
+		for _, d := range batch {
+			queue.Kill(d.Key, nil)
+		}
+
+		if page, _ := queue.ListDead(ctx, Filter{Metadata: map[string]string{"tenant": "acme"}}); len(page) != 1 || page[0].Msg.Retry != 1 {
+			t.Fatal(name, "metadata lost dead-lettering:", page)
+		}
+	}
+}
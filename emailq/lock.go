@@ -0,0 +1,90 @@
+package emailq
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrLocked is returned by New when another process holds the file past Options.Timeout
+var ErrLocked = errors.New("Queue file is locked by another process")
+
+// LockedError is ErrLocked naming the file and the process holding it
+type LockedError struct {
+	Path string
+	PID  int // zero if unknown, e.g. the file is open read-only
+}
+
+func (e *LockedError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("Queue file %s is locked by another process", e.Path)
+	}
+
+	return fmt.Sprintf("Queue file %s is locked by process %d", e.Path, e.PID)
+}
+
+func (e *LockedError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// pidPath is where the process that has path open for writing leaves its PID
+func pidPath(path string) string {
+	return path + ".pid"
+}
+
+// writePID records the PID for lockedError of other processes, it's only a diagnostic so
+// failing to write it doesn't fail New
+func writePID(pidFile string) {
+	os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// lockedError reads the PID of the process holding path
+func lockedError(path string) error {
+	e := &LockedError{Path: path}
+	if b, err := os.ReadFile(pidPath(path)); err == nil {
+		e.PID, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+	}
+
+	return e
+}
+
+// createBuckets creates what's missing of buckets and upgrades files written by earlier
+// versions
+func createBuckets(tx *bolt.Tx) error {
+	for _, name := range buckets {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+
+	if tx.Bucket(hostsBucket) == nil || tx.Bucket(retriesBucket) == nil {
+		if err := indexHosts(tx); err != nil {
+			return err
+		}
+	}
+
+	if tx.Bucket(outgoingBucket) != nil {
+		return migrateOutgoing(tx)
+	}
+
+	return nil
+}
+
+// checkBuckets makes sure a file opened read-only needs no createBuckets
+func checkBuckets(tx *bolt.Tx) error {
+	for _, name := range append(append([][]byte{}, lanes...), buckets...) {
+		if tx.Bucket(name) == nil {
+			return fmt.Errorf("Queue file needs upgrading, open it for writing once: no %s bucket", name)
+		}
+	}
+
+	if tx.Bucket(outgoingBucket) != nil {
+		return fmt.Errorf("Queue file needs upgrading, open it for writing once: outgoing bucket")
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package emailq
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocked(t *testing.T) {
+	dir, err := os.MkdirTemp("", "emailq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queue.db")
+	queue, err := New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.Push(ctx, createMsg())
+
+	_, err = New(path, &Options{Timeout: 50 * time.Millisecond})
+	var locked *LockedError
+	if !errors.Is(err, ErrLocked) || !errors.As(err, &locked) || locked.PID != os.Getpid() {
+		t.Fatal("Expected the lock reported with our PID:", err)
+	}
+
+	// read-only waits for the writer too
+	if _, err = New(path, &Options{Timeout: 50 * time.Millisecond, ReadOnly: true}); !errors.Is(err, ErrLocked) {
+		t.Fatal("Opened read-only while locked for writing:", err)
+	}
+
+	queue.Close()
+	if _, err = os.Stat(pidPath(path)); !os.IsNotExist(err) {
+		t.Fatal("PID file left behind:", err)
+	}
+
+	// readers share the file
+	r1, err := New(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal("Error opening read-only:", err)
+	}
+	defer r1.Close()
+
+	r2, err := New(path, &Options{Timeout: 50 * time.Millisecond, ReadOnly: true})
+	if err != nil {
+		t.Fatal("Error opening read-only twice:", err)
+	}
+	defer r2.Close()
+
+	if page, err := r2.ListPending(ctx, Filter{}); err != nil || len(page) != 1 {
+		t.Fatal("Error listing read-only:", len(page), err)
+	}
+	if err = r1.Push(ctx, createMsg()); err == nil {
+		t.Fatal("Pushed to a read-only queue")
+	}
+}
@@ -0,0 +1,576 @@
+package emailq
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is a queue that lives only as long as the process, for tests and deployments that
+// would rather lose queued mail on restart than keep emails.db around. Messages are stored
+// encoded so callers can't change them behind the queue's back.
+type Memory struct {
+	mu       sync.Mutex
+	incoming map[string]memEntry
+	outgoing map[string][]byte
+	dead     map[string]memEntry // due is when the message was killed
+	paused   map[string]bool
+	corrupt  map[string]Corrupt
+	archive  map[string]memEntry // due is when the message was delivered
+	meter    meter
+	turns    turns
+	waker    waker
+
+	// These work as in Options, hooks run unlocked
+	Backoff    BackoffFunc
+	MaxRetries int
+	TTL        time.Duration
+	Observer   Observer
+	Sealer     *Sealer
+	Blobs      BlobStore
+	BlobSize   int
+	Quota      Quota
+	HostLimit  int
+	Archive    Archive
+	Clock      Clock
+}
+
+type memEntry struct {
+	due time.Time
+	msg []byte
+}
+
+// NewMemory creates an empty in-memory queue
+func NewMemory() *Memory {
+	return &Memory{
+		incoming: make(map[string]memEntry),
+		outgoing: make(map[string][]byte),
+		dead:     make(map[string]memEntry),
+		paused:   make(map[string]bool),
+		corrupt:  make(map[string]Corrupt),
+		archive:  make(map[string]memEntry),
+	}
+}
+
+// Close drops the queued messages
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.incoming = make(map[string]memEntry)
+	m.outgoing = make(map[string][]byte)
+	m.dead = make(map[string]memEntry)
+	m.corrupt = make(map[string]Corrupt)
+	m.archive = make(map[string]memEntry)
+
+	return nil
+}
+
+// Length returns Incoming queue length
+func (m *Memory) Length() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.incoming)
+}
+
+// Push messages to the queue, due now or at msg.NotBefore
+func (m *Memory) Push(ctx context.Context, msg *Msg) error {
+	return m.PushAll(ctx, []*Msg{msg})
+}
+
+// PushAll pushes msgs at once, ErrQueueFull if they don't fit the Quota. Memory doesn't
+// block, ctx is only checked before.
+func (m *Memory) PushAll(ctx context.Context, msgs []*Msg) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	now := m.now().UTC()
+	keys := make([][]byte, len(msgs))
+
+	values, err := m.codec().encodeAll(msgs, now, m.MaxRetries, m.TTL)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	if m.Quota.enabled() {
+		u := usage{count: len(m.incoming)}
+		for _, e := range m.incoming {
+			u.bytes += int64(len(e.msg))
+		}
+
+		if err = m.Quota.admit(u, values); err != nil {
+			m.mu.Unlock()
+			return err
+		}
+	}
+
+	for i, msg := range msgs {
+		keys[i] = newKey(now)
+		m.incoming[string(keys[i])] = memEntry{msg.due(now), values[i]}
+	}
+	m.mu.Unlock()
+
+	for i, msg := range msgs {
+		m.hooks().push(keys[i], msg)
+	}
+	return nil
+}
+
+// Pop get next email from the queue
+func (m *Memory) Pop(ctx context.Context) (key []byte, msg *Msg, err error) {
+	batch, err := m.PopBatch(ctx, 1)
+	if err != nil || len(batch) == 0 {
+		return nil, nil, err
+	}
+
+	return batch[0].Key, batch[0].Msg, nil
+}
+
+// PopBatch gets up to n emails that are due for delivery, taking turns between hosts and
+// skipping paused ones. Expired ones are dead-lettered instead.
+func (m *Memory) PopBatch(ctx context.Context, n int) ([]Delivery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	t := m.popBatch(n)
+	if failed := m.codec().openPopped(&t); len(failed) > 0 {
+		m.mu.Lock()
+		for _, c := range failed {
+			delete(m.outgoing, string(c.Key))
+			m.corrupt[string(c.Key)] = c
+		}
+		m.mu.Unlock()
+	}
+
+	m.hooks().popped(t)
+
+	return t.batch, nil
+}
+
+func (m *Memory) popBatch(n int) (t taken) {
+	now := m.now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var due []string
+	for k, e := range m.incoming {
+		if !e.due.After(now) {
+			due = append(due, k)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		a, b := m.incoming[due[i]], m.incoming[due[j]]
+		if !a.due.Equal(b.due) {
+			return a.due.Before(b.due)
+		}
+		return due[i] < due[j]
+	})
+
+	hosts := groupHosts(due, n, func(i int) (string, bool) {
+		msg := decode(m.incoming[due[i]].msg)
+		host := string(hostName(msg.Host))
+		if m.paused[host] {
+			return "", false
+		}
+		return host, msg.Retry > 0
+	})
+
+	var busy map[string]int
+	if m.HostLimit > 0 {
+		busy = make(map[string]int)
+		for _, v := range m.outgoing {
+			busy[string(hostName(hostOf(v)))]++
+		}
+	}
+
+	m.turns.order(hosts, n)
+	keys := schedule(hosts, n, m.HostLimit, busy)
+	m.turns.took(hosts, keys)
+
+	t.batch = make([]Delivery, 0, len(keys))
+	for _, k := range keys {
+		v := m.incoming[k].msg
+		delete(m.incoming, k)
+
+		msg, err := decodeMsg(v)
+		if err != nil {
+			c := newCorrupt([]byte(k), v, err)
+			m.corrupt[k] = c
+			t.corrupt = append(t.corrupt, c)
+			continue
+		}
+
+		if msg.expired(now) {
+			msg.DeadReason = ReasonExpired
+			m.dead[k] = memEntry{now, encode(msg)}
+			t.dead = append(t.dead, Delivery{Key: []byte(k), Msg: msg})
+			continue
+		}
+		m.outgoing[k] = v
+
+		t.batch = append(t.batch, Delivery{Key: []byte(k), Msg: msg})
+	}
+
+	return t
+}
+
+// Retry takes msg from outgoing queue and schedules it again after the Backoff delay
+func (m *Memory) Retry(key []byte, cause error) error {
+	m.mu.Lock()
+	v, ok := m.outgoing[string(key)]
+	if !ok {
+		m.mu.Unlock()
+		return notFound("outgoing")
+	}
+	delete(m.outgoing, string(key))
+
+	now := m.now()
+	msg := decode(v)
+	msg.fail(now, cause)
+	msg.Retry++
+	due := now.Add(m.Backoff.delay(msg.Retry))
+
+	m.incoming[string(key)] = memEntry{due, encode(msg)}
+	m.mu.Unlock()
+
+	m.hooks().retry(key, msg, cause)
+	return nil
+}
+
+// MarkWarned records that the sender of msg in outgoing queue was notified about the delay
+func (m *Memory) MarkWarned(key []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, ok := m.outgoing[string(key)]
+	if !ok {
+		return notFound("outgoing")
+	}
+
+	msg := decode(v)
+	msg.Warned = true
+	m.outgoing[string(key)] = encode(msg)
+
+	return nil
+}
+
+// Kill takes msg out of outgoing and pushed that to Dead Letter queue, recording cause as
+// its last attempt
+func (m *Memory) Kill(key []byte, cause error) error {
+	m.mu.Lock()
+	v, ok := m.outgoing[string(key)]
+	if !ok {
+		m.mu.Unlock()
+		return notFound("outgoing")
+	}
+	delete(m.outgoing, string(key))
+
+	now := m.now()
+	msg := decode(v)
+	msg.kill(now, cause)
+	m.dead[string(key)] = memEntry{now, encode(msg)}
+	m.mu.Unlock()
+
+	m.hooks().kill(key, msg, cause)
+	return nil
+}
+
+// RemoveDelivered removes successfully delivered message
+func (m *Memory) RemoveDelivered(key []byte) error {
+	m.mu.Lock()
+	if v, ok := m.outgoing[string(key)]; ok && m.Archive != ArchiveOff {
+		now := m.now()
+		a, err := m.codec().archive(key, v, m.Archive, now)
+		if err != nil {
+			m.mu.Unlock()
+			return err
+		}
+		m.archive[string(key)] = memEntry{now, a}
+	}
+	delete(m.outgoing, string(key))
+	m.mu.Unlock()
+
+	m.hooks().delivered(key)
+	return nil
+}
+
+// Recover requeues outgoing emails that were interrupted, see EmailQ.Recover
+func (m *Memory) Recover() error {
+	var r recovered
+	now := m.now()
+
+	m.mu.Lock()
+	for k, v := range m.outgoing {
+		delete(m.outgoing, k)
+
+		msg := decode(v)
+		retry := msg.interrupt(now)
+		r.add([]byte(k), msg, retry)
+		if retry {
+			m.incoming[k] = memEntry{now.Add(m.Backoff.delay(msg.Retry)), encode(msg)}
+		} else {
+			m.dead[k] = memEntry{now, encode(msg)}
+		}
+	}
+	m.mu.Unlock()
+
+	r.report(m.hooks())
+	return nil
+}
+
+// PurgeDead drops dead letters older than retention and all but the newest keep, zero
+// retention or keep doesn't limit by that. Returns how many were dropped.
+func (m *Memory) PurgeDead(retention time.Duration, keep int) (purged int, err error) {
+	cutoff := m.now().Add(-retention)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]string, 0, len(m.dead))
+	for k := range m.dead {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return m.dead[keys[i]].due.Before(m.dead[keys[j]].due) })
+
+	for i, k := range keys {
+		if keep > 0 && i < len(keys)-keep || retention > 0 && m.dead[k].due.Before(cutoff) {
+			delete(m.dead, k)
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+// ListPending pages through messages waiting for delivery in key order
+func (m *Memory) ListPending(ctx context.Context, f Filter) ([]Delivery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	page := listEntries(m.incoming, f)
+	return page, m.codec().open(page)
+}
+
+// ListDead pages through dead letters in key order
+func (m *Memory) ListDead(ctx context.Context, f Filter) ([]Delivery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	page := listEntries(m.dead, f)
+	return page, m.codec().open(page)
+}
+
+// nextDue is when the first message in incoming is due, popped ones are in outgoing
+func (m *Memory) nextDue() (next time.Time, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, e := range m.incoming {
+		if next.IsZero() || e.due.Before(next) {
+			next = e.due
+		}
+	}
+
+	return next, nil
+}
+
+func listEntries(entries map[string]memEntry, f Filter) (page []Delivery) {
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if len(page) == f.limit() {
+			break
+		}
+
+		if msg := decode(entries[k].msg); f.match([]byte(k), msg) {
+			page = append(page, Delivery{Key: []byte(k), Msg: msg})
+		}
+	}
+
+	return page
+}
+
+// PauseHost holds back delivery of all messages for host until ResumeHost
+func (m *Memory) PauseHost(host string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.paused[strings.ToLower(host)] = true
+	return nil
+}
+
+// ResumeHost lets messages for host be popped again
+func (m *Memory) ResumeHost(host string) error {
+	defer m.waker.wake()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.paused, strings.ToLower(host))
+	return nil
+}
+
+// PausedHosts lists the hosts delivery is paused for
+func (m *Memory) PausedHosts() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hosts := make([]string, 0, len(m.paused))
+	for h := range m.paused {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+
+	return hosts, nil
+}
+
+// RetryDead queues the dead letters f selects for delivery again with their retries reset
+func (m *Memory) RetryDead(ctx context.Context, f Filter) (int, error) {
+	defer m.waker.wake()
+
+	return bulk(ctx, m.ListDead, f, func(keys [][]byte) (n int, err error) {
+		now := m.now()
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		for _, k := range keys {
+			e, ok := m.dead[string(k)]
+			if !ok {
+				continue
+			}
+
+			msg := decode(e.msg)
+			msg.revive()
+
+			delete(m.dead, string(k))
+			m.incoming[string(newKey(now))] = memEntry{now, encode(msg)}
+			n++
+		}
+
+		return n, nil
+	})
+}
+
+// KillPending moves the pending messages f selects to the dead letter queue
+func (m *Memory) KillPending(ctx context.Context, f Filter) (int, error) {
+	return bulk(ctx, m.ListPending, f, func(keys [][]byte) (n int, err error) {
+		now := m.now()
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		for _, k := range keys {
+			e, ok := m.incoming[string(k)]
+			if !ok {
+				continue
+			}
+
+			msg := decode(e.msg)
+			msg.DeadReason = ReasonKilled
+
+			delete(m.incoming, string(k))
+			m.dead[string(k)] = memEntry{now, encode(msg)}
+			n++
+		}
+
+		return n, nil
+	})
+}
+
+// DeletePending drops the pending messages f selects
+func (m *Memory) DeletePending(ctx context.Context, f Filter) (int, error) {
+	return bulk(ctx, m.ListPending, f, m.deleter(func() map[string]memEntry { return m.incoming }))
+}
+
+// DeleteDead drops the dead letters f selects
+func (m *Memory) DeleteDead(ctx context.Context, f Filter) (int, error) {
+	return bulk(ctx, m.ListDead, f, m.deleter(func() map[string]memEntry { return m.dead }))
+}
+
+// deleter drops keys from the map entries returns, Close replaces the maps
+func (m *Memory) deleter(entries func() map[string]memEntry) func(keys [][]byte) (int, error) {
+	return func(keys [][]byte) (n int, err error) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		set := entries()
+		for _, k := range keys {
+			if _, ok := set[string(k)]; ok {
+				delete(set, string(k))
+				n++
+			}
+		}
+
+		return n, nil
+	}
+}
+
+// Corrupted lists the values set aside because they didn't decode, oldest first
+func (m *Memory) Corrupted() ([]Corrupt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := make([]Corrupt, 0, len(m.corrupt))
+	for _, c := range m.corrupt {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return string(list[i].Key) < string(list[j].Key) })
+
+	return list, nil
+}
+
+// DeleteCorrupt drops a value set aside
+func (m *Memory) DeleteCorrupt(key []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.corrupt, string(key))
+	return nil
+}
+
+func (m *Memory) codec() codec {
+	return codec{m.Sealer, m.Blobs, m.BlobSize}
+}
+
+func (m *Memory) hooks() hooks {
+	return hooks{m.Observer, &m.meter, &m.waker}
+}
+
+// CollectBlobs deletes blobs of delivered and purged messages, see EmailQ.CollectBlobs
+func (m *Memory) CollectBlobs(grace time.Duration) (int, error) {
+	refs := make(map[string]bool)
+
+	m.mu.Lock()
+	for _, entries := range []map[string]memEntry{m.incoming, m.dead, m.archive} {
+		for _, e := range entries {
+			addRef(refs, e.msg)
+		}
+	}
+	for _, v := range m.outgoing {
+		addRef(refs, v)
+	}
+	m.mu.Unlock()
+
+	return collect(m.Blobs, grace, refs)
+}
@@ -0,0 +1,66 @@
+package emailq
+
+import "testing"
+
+func TestMemoryFlow(t *testing.T) {
+	var queue Queue = NewMemory()
+	defer queue.Close()
+
+	for i := 0; i < 3; i++ {
+		msg := createMsg()
+		msg.Retry = i
+		if err := queue.Push(ctx, msg); err != nil {
+			t.Fatal("Error pushing:", err)
+		}
+	}
+
+	batch, err := queue.PopBatch(ctx, 2)
+	if err != nil || len(batch) != 2 {
+		t.Fatal("Error popping batch:", len(batch), err)
+	}
+	if batch[0].Msg.Retry != 0 || batch[1].Msg.Retry != 1 {
+		t.Fatal("Messages not popped in order")
+	}
+
+	// changing a popped message doesn't change the queued one
+	batch[0].Msg.From = "changed"
+
+	if err = queue.MarkWarned(batch[0].Key); err != nil {
+		t.Fatal("Error marking warned:", err)
+	}
+	if err = queue.Retry(batch[0].Key, nil); err != nil {
+		t.Fatal("Error retrying:", err)
+	}
+	if err = queue.Retry(batch[0].Key, nil); err == nil {
+		t.Fatal("Retried a message that isn't out for delivery")
+	}
+	if err = queue.Kill(batch[1].Key, nil); err != nil {
+		t.Fatal("Error killing:", err)
+	}
+
+	key, msg, err := queue.Pop(ctx)
+	if err != nil || key == nil || msg.Retry != 2 {
+		t.Fatal("Error popping:", msg, err)
+	}
+
+	// the retried message waits
+	if key, _, _ := queue.Pop(ctx); key != nil {
+		t.Fatal("Retry popped before its time")
+	}
+
+	if err = queue.Recover(); err != nil {
+		t.Fatal("Error recovering:", err)
+	}
+	if queue.Length() != 2 {
+		t.Fatal("Expected 2 messages after recover, got", queue.Length())
+	}
+
+	m := queue.(*Memory)
+	retried := decode(m.incoming[string(batch[0].Key)].msg)
+	if retried.From != "from" || !retried.Warned || retried.Retry != 1 {
+		t.Fatal("Unexpected retried message:", retried)
+	}
+	if len(m.dead) != 1 {
+		t.Fatal("Expected 1 dead letter, got", len(m.dead))
+	}
+}
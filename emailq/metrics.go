@@ -0,0 +1,147 @@
+package emailq
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are what a queue counted since it was opened, see the Metrics method of each queue
+type Metrics struct {
+	Pushed    int64
+	Popped    int64
+	Retried   int64
+	Killed    int64 // expired ones aside
+	Expired   int64
+	Delivered int64
+	Corrupt   int64
+
+	// Commits times write transactions. Only the bolt and SQL queues have them, it stays
+	// empty for Memory and Redis.
+	Commits Histogram
+}
+
+// Histogram counts durations up to each of Bounds, Counts has one more for longer ones
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []int64
+	Count  int64
+	Sum    time.Duration
+}
+
+// TxBuckets are the bounds Commits are counted by
+var TxBuckets = [...]time.Duration{
+	100 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 500 * time.Millisecond, time.Second,
+}
+
+// CommitObserver is an Observer also told how long each write transaction took
+type CommitObserver interface {
+	Observer
+	OnCommit(d time.Duration)
+}
+
+// meter keeps the Metrics of a queue, the zero value is ready
+type meter struct {
+	pushed, popped, retried, killed, expired, delivered, corrupt atomic.Int64
+
+	counts [len(TxBuckets) + 1]atomic.Int64
+	count  atomic.Int64
+	sum    atomic.Int64
+}
+
+// dead counts msg going to the dead letter queue by its DeadReason
+func (m *meter) dead(msg *Msg) {
+	if msg.DeadReason == ReasonExpired {
+		m.expired.Add(1)
+	} else {
+		m.killed.Add(1)
+	}
+}
+
+func (m *meter) commit(d time.Duration) {
+	i := 0
+	for i < len(TxBuckets) && d > TxBuckets[i] {
+		i++
+	}
+
+	m.counts[i].Add(1)
+	m.count.Add(1)
+	m.sum.Add(int64(d))
+}
+
+func (m *meter) metrics() Metrics {
+	h := Histogram{
+		Bounds: TxBuckets[:],
+		Counts: make([]int64, len(m.counts)),
+		Count:  m.count.Load(),
+		Sum:    time.Duration(m.sum.Load()),
+	}
+	for i := range m.counts {
+		h.Counts[i] = m.counts[i].Load()
+	}
+
+	return Metrics{
+		Pushed:    m.pushed.Load(),
+		Popped:    m.popped.Load(),
+		Retried:   m.retried.Load(),
+		Killed:    m.killed.Load(),
+		Expired:   m.expired.Load(),
+		Delivered: m.delivered.Load(),
+		Corrupt:   m.corrupt.Load(),
+		Commits:   h,
+	}
+}
+
+// add sums the Metrics of shards
+func (mt Metrics) add(o Metrics) Metrics {
+	mt.Pushed += o.Pushed
+	mt.Popped += o.Popped
+	mt.Retried += o.Retried
+	mt.Killed += o.Killed
+	mt.Expired += o.Expired
+	mt.Delivered += o.Delivered
+	mt.Corrupt += o.Corrupt
+
+	if mt.Commits.Counts == nil {
+		mt.Commits = Histogram{Bounds: o.Commits.Bounds, Counts: make([]int64, len(o.Commits.Counts))}
+	}
+	for i, c := range o.Commits.Counts {
+		mt.Commits.Counts[i] += c
+	}
+	mt.Commits.Count += o.Commits.Count
+	mt.Commits.Sum += o.Commits.Sum
+
+	return mt
+}
+
+// Metrics returns what the queue counted since it was opened
+func (q *EmailQ) Metrics() Metrics {
+	return q.meter.metrics()
+}
+
+// Metrics adds up the Metrics of all shards
+func (s *Sharded) Metrics() (total Metrics) {
+	for _, q := range s.shards {
+		total = total.add(q.Metrics())
+	}
+
+	return total
+}
+
+// Metrics returns what the queue counted since it was created
+func (m *Memory) Metrics() Metrics {
+	return m.meter.metrics()
+}
+
+// Metrics returns what this instance counted since it was opened, other instances sharing
+// the queue count their own
+func (r *Redis) Metrics() Metrics {
+	return r.meter.metrics()
+}
+
+// Metrics returns what this instance counted since it was opened, other instances sharing
+// the queue count their own
+func (s *SQL) Metrics() Metrics {
+	return s.meter.metrics()
+}
@@ -0,0 +1,46 @@
+package emailq
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	for name, queue := range backends(t) {
+		stale := createMsg()
+		stale.Expires = time.Now().Add(-time.Minute)
+		queue.PushAll(ctx, []*Msg{stale, createMsg(), createMsg()})
+
+		batch, err := queue.PopBatch(ctx, 10)
+		if err != nil || len(batch) != 2 {
+			t.Fatal(name, "error popping:", len(batch), err)
+		}
+		queue.RemoveDelivered(batch[0].Key)
+		queue.Kill(batch[1].Key, errors.New("550 no"))
+
+		m := queue.(interface{ Metrics() Metrics }).Metrics()
+		if m.Pushed != 3 || m.Popped != 2 || m.Expired != 1 || m.Delivered != 1 || m.Killed != 1 || m.Retried != 0 {
+			t.Fatal(name, "unexpected metrics:", m)
+		}
+
+		h := m.Commits
+		if len(h.Counts) != len(TxBuckets)+1 {
+			t.Fatal(name, "unexpected histogram:", h)
+		}
+
+		var sum int64
+		for _, c := range h.Counts {
+			sum += c
+		}
+		if sum != h.Count {
+			t.Fatal(name, "histogram doesn't add up:", h)
+		}
+
+		_, memory := queue.(*Memory)
+		_, shared := queue.(*Redis)
+		if !memory && !shared && h.Count == 0 {
+			t.Fatal(name, "commits not timed")
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package emailq
+
+import "time"
+
+// Observer is told about messages moving through the queue, for metrics, webhooks or audit
+// logs. Hooks run after the change is stored, on the goroutine that made it, so they should
+// be quick. Messages must not be modified. With a Sealer or Blobs only pushed and popped
+// ones carry their Data as it was pushed.
+type Observer interface {
+	OnPush(key []byte, msg *Msg)
+	OnPop(key []byte, msg *Msg)
+	OnRetry(key []byte, msg *Msg, cause error)
+	OnKill(key []byte, msg *Msg, cause error) // msg.DeadReason tells expired messages apart
+	OnDelivered(key []byte)
+	OnCorrupt(c Corrupt) // a popped value didn't decode and was set aside
+}
+
+// NopObserver ignores everything, embed it to implement only some of the hooks
+type NopObserver struct{}
+
+func (NopObserver) OnPush(key []byte, msg *Msg)               {}
+func (NopObserver) OnPop(key []byte, msg *Msg)                {}
+func (NopObserver) OnRetry(key []byte, msg *Msg, cause error) {}
+func (NopObserver) OnKill(key []byte, msg *Msg, cause error)  {}
+func (NopObserver) OnDelivered(key []byte)                    {}
+func (NopObserver) OnCorrupt(c Corrupt)                       {}
+
+// hooks counts in the meter of the queue, calls the Observer if there is one and wakes
+// subscriptions when there may be more to pop
+type hooks struct {
+	Observer
+	m *meter
+	w *waker
+}
+
+func (h hooks) push(key []byte, msg *Msg) {
+	h.m.pushed.Add(1)
+	h.w.wake()
+	if h.Observer != nil {
+		h.OnPush(key, msg)
+	}
+}
+
+// popped reports a batch taken for delivery and the messages set aside instead
+func (h hooks) popped(t taken) {
+	h.m.popped.Add(int64(len(t.batch)))
+	for _, d := range t.dead {
+		h.m.dead(d.Msg)
+	}
+	h.m.corrupt.Add(int64(len(t.corrupt)))
+	if h.Observer == nil {
+		return
+	}
+
+	for _, d := range t.batch {
+		h.OnPop(d.Key, d.Msg)
+	}
+	for _, d := range t.dead {
+		h.OnKill(d.Key, d.Msg, nil)
+	}
+	for _, c := range t.corrupt {
+		h.OnCorrupt(c)
+	}
+}
+
+func (h hooks) retry(key []byte, msg *Msg, cause error) {
+	h.m.retried.Add(1)
+	h.w.wake()
+	if h.Observer != nil {
+		h.OnRetry(key, msg, cause)
+	}
+}
+
+func (h hooks) kill(key []byte, msg *Msg, cause error) {
+	h.m.dead(msg)
+	h.w.wake()
+	if h.Observer != nil {
+		h.OnKill(key, msg, cause)
+	}
+}
+
+func (h hooks) delivered(key []byte) {
+	h.m.delivered.Add(1)
+	h.w.wake()
+	if h.Observer != nil {
+		h.OnDelivered(key)
+	}
+}
+
+// commit times a write transaction that started at start
+func (h hooks) commit(start time.Time) {
+	d := time.Since(start)
+	h.m.commit(d)
+
+	if c, ok := h.Observer.(CommitObserver); ok {
+		c.OnCommit(d)
+	}
+}
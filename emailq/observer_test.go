@@ -0,0 +1,99 @@
+package emailq
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	NopObserver
+
+	mu      sync.Mutex
+	events  []string
+	corrupt int
+}
+
+func (r *recorder) record(event string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, event)
+}
+
+func (r *recorder) OnPush(key []byte, msg *Msg)               { r.record("push") }
+func (r *recorder) OnPop(key []byte, msg *Msg)                { r.record("pop") }
+func (r *recorder) OnRetry(key []byte, msg *Msg, cause error) { r.record("retry " + cause.Error()) }
+func (r *recorder) OnDelivered(key []byte)                    { r.record("delivered") }
+
+func (r *recorder) OnCorrupt(c Corrupt) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.corrupt++
+}
+
+func (r *recorder) OnKill(key []byte, msg *Msg, cause error) {
+	if cause == nil {
+		r.record("kill " + msg.DeadReason)
+		return
+	}
+	r.record("kill " + cause.Error())
+}
+
+// observe attaches obs to a queue from backends
+func observe(queue Queue, obs Observer) {
+	switch b := queue.(type) {
+	case *EmailQ:
+		b.hooks.Observer = obs
+	case *Sharded:
+		for _, s := range b.shards {
+			s.hooks.Observer = obs
+		}
+	case *Memory:
+		b.Observer = obs
+	case *Redis:
+		b.Observer = obs
+	case *SQL:
+		b.Observer = obs
+	}
+}
+
+func TestObserver(t *testing.T) {
+	for name, queue := range backends(t) {
+		obs := &recorder{}
+		observe(queue, obs)
+
+		stale := createMsg()
+		stale.Expires = time.Now().Add(-time.Minute)
+		queue.Push(ctx, stale)
+
+		for _, cause := range []error{fmt.Errorf("451 later"), fmt.Errorf("550 no"), nil} {
+			queue.Push(ctx, createMsg())
+
+			batch, err := queue.PopBatch(ctx, 10)
+			if err != nil || len(batch) != 1 {
+				t.Fatal(name, "error popping:", len(batch), err)
+			}
+
+			switch key := batch[0].Key; {
+			case cause == nil:
+				queue.RemoveDelivered(key)
+			case cause.Error() == "451 later":
+				queue.Retry(key, cause)
+			default:
+				queue.Kill(key, cause)
+			}
+		}
+
+		// shards report their part of a batch separately
+		sort.Strings(obs.events)
+
+		want := []string{"delivered", "kill 550 no", "kill expired", "pop", "pop", "pop", "push", "push", "push", "push", "retry 451 later"}
+		if fmt.Sprint(obs.events) != fmt.Sprint(want) {
+			t.Fatal(name, "unexpected events:", obs.events)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package emailq
+
+import (
+	"sort"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var pausedBucket = []byte("paused")
+
+// PauseHost holds back delivery of all messages for host, e.g. while the provider is
+// blocking us. They stay queued and are popped again after ResumeHost.
+func (q *EmailQ) PauseHost(host string) error {
+	return q.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(pausedBucket).Put([]byte(strings.ToLower(host)), []byte{})
+	})
+}
+
+// ResumeHost lets messages for host be popped again
+func (q *EmailQ) ResumeHost(host string) error {
+	defer q.hooks.w.wake()
+
+	return q.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(pausedBucket).Delete([]byte(strings.ToLower(host)))
+	})
+}
+
+// PausedHosts lists the hosts delivery is paused for
+func (q *EmailQ) PausedHosts() (hosts []string, err error) {
+	err = q.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(pausedBucket).ForEach(func(k, v []byte) error {
+			hosts = append(hosts, string(k))
+			return nil
+		})
+	})
+
+	return hosts, err
+}
+
+// pausedHosts is the set of paused hosts, nil when there are none
+func pausedHosts(tx *bolt.Tx) (paused map[string]bool) {
+	tx.Bucket(pausedBucket).ForEach(func(k, v []byte) error {
+		if paused == nil {
+			paused = make(map[string]bool)
+		}
+		paused[string(k)] = true
+		return nil
+	})
+
+	return paused
+}
+
+// PauseHost holds back delivery for host in all shards
+func (s *Sharded) PauseHost(host string) error {
+	for _, q := range s.shards {
+		if err := q.PauseHost(host); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ResumeHost lets messages for host be popped again from all shards
+func (s *Sharded) ResumeHost(host string) error {
+	for _, q := range s.shards {
+		if err := q.ResumeHost(host); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PausedHosts lists the hosts delivery is paused for in any shard
+func (s *Sharded) PausedHosts() ([]string, error) {
+	seen := make(map[string]bool)
+	for _, q := range s.shards {
+		hosts, err := q.PausedHosts()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, h := range hosts {
+			seen[h] = true
+		}
+	}
+
+	hosts := make([]string, 0, len(seen))
+	for h := range seen {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+
+	return hosts, nil
+}
@@ -0,0 +1,48 @@
+package emailq
+
+import "testing"
+
+type pauser interface {
+	Queue
+	PauseHost(host string) error
+	ResumeHost(host string) error
+	PausedHosts() ([]string, error)
+}
+
+func TestPauseHost(t *testing.T) {
+	for name, backend := range backends(t) {
+		queue := backend.(pauser)
+
+		blocked := createMsg()
+		blocked.Host = "gmail.com"
+		queue.Push(ctx, blocked)
+		queue.Push(ctx, createMsg())
+
+		if err := queue.PauseHost("Gmail.com"); err != nil {
+			t.Fatal(name, "error pausing:", err)
+		}
+		queue.PauseHost("gmail.com")
+
+		if hosts, err := queue.PausedHosts(); err != nil || len(hosts) != 1 || hosts[0] != "gmail.com" {
+			t.Fatal(name, "unexpected paused hosts:", hosts, err)
+		}
+
+		batch, err := queue.PopBatch(ctx, 10)
+		if err != nil || len(batch) != 1 || batch[0].Msg.Host != "host" {
+			t.Fatal(name, "paused host popped:", len(batch), err)
+		}
+
+		if err = queue.ResumeHost("gmail.com"); err != nil {
+			t.Fatal(name, "error resuming:", err)
+		}
+
+		batch, err = queue.PopBatch(ctx, 10)
+		if err != nil || len(batch) != 1 || batch[0].Msg.Host != "gmail.com" {
+			t.Fatal(name, "resumed host not popped:", len(batch), err)
+		}
+
+		if hosts, _ := queue.PausedHosts(); len(hosts) != 0 {
+			t.Fatal(name, "host still paused:", hosts)
+		}
+	}
+}
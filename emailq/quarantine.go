@@ -0,0 +1,128 @@
+package emailq
+
+import (
+	"sort"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var quarantineBucket = []byte("quarantine")
+
+// Quarantine holds msg aside instead of queueing it for delivery until it's released or deleted
+func (q *EmailQ) Quarantine(msg *Msg, reason string) error {
+	now := q.now().UTC()
+	msg.prepare(now, q.maxRetries, q.ttl)
+	msg.QuarantineReason = reason
+
+	v, err := q.codec.encode(msg)
+	if err != nil {
+		return err
+	}
+
+	return q.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(quarantineBucket).Put(newKey(now), v)
+	})
+}
+
+// Quarantined lists the held messages, oldest first
+func (q *EmailQ) Quarantined() (held []Delivery, err error) {
+	err = q.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(quarantineBucket).ForEach(func(k, v []byte) error {
+			held = append(held, Delivery{Key: append([]byte(nil), k...), Msg: decode(v)})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return held, q.codec.open(held)
+}
+
+// Release moves a held message to the incoming queue, due for delivery right away
+func (q *EmailQ) Release(key []byte) error {
+	defer q.hooks.w.wake()
+
+	return q.update(func(tx *bolt.Tx) error {
+		quarantine := tx.Bucket(quarantineBucket)
+
+		msg := quarantine.Get(key)
+		if msg == nil {
+			return notFound("quarantine")
+		}
+
+		m := decode(msg)
+		m.QuarantineReason = ""
+
+		if err := quarantine.Delete(key); err != nil {
+			return err
+		}
+
+		key := newKey(q.now())
+		return putIncoming(tx, key, encode(m), m.Host, m.Retry > 0)
+	})
+}
+
+// DeleteQuarantined drops a held message
+func (q *EmailQ) DeleteQuarantined(key []byte) error {
+	return q.update(func(tx *bolt.Tx) error {
+		quarantine := tx.Bucket(quarantineBucket)
+		if quarantine.Get(key) == nil {
+			return notFound("quarantine")
+		}
+
+		return quarantine.Delete(key)
+	})
+}
+
+// isQuarantined checks whether key is currently in quarantine bucket
+func (q *EmailQ) isQuarantined(key []byte) (found bool) {
+	q.view(func(tx *bolt.Tx) error {
+		found = tx.Bucket(quarantineBucket).Get(key) != nil
+		return nil
+	})
+
+	return
+}
+
+// Quarantine holds msg aside in the shard picked by hashing the Message-ID
+func (s *Sharded) Quarantine(msg *Msg, reason string) error {
+	return s.shards[s.shardFor(msg)].Quarantine(msg, reason)
+}
+
+// Quarantined lists the held messages of all shards, oldest first
+func (s *Sharded) Quarantined() ([]Delivery, error) {
+	var held []Delivery
+	for _, q := range s.shards {
+		h, err := q.Quarantined()
+		if err != nil {
+			return nil, err
+		}
+		held = append(held, h...)
+	}
+
+	sort.Slice(held, func(i, j int) bool { return string(held[i].Key) < string(held[j].Key) })
+	return held, nil
+}
+
+// Release moves a held message to the incoming queue of its shard
+func (s *Sharded) Release(key []byte) error {
+	for _, q := range s.shards {
+		if q.isQuarantined(key) {
+			return q.Release(key)
+		}
+	}
+
+	return notFound("quarantine")
+}
+
+// DeleteQuarantined drops a held message from its shard
+func (s *Sharded) DeleteQuarantined(key []byte) error {
+	for _, q := range s.shards {
+		if q.isQuarantined(key) {
+			return q.DeleteQuarantined(key)
+		}
+	}
+
+	return notFound("quarantine")
+}
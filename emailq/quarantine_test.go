@@ -0,0 +1,88 @@
+package emailq
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQuarantine(t *testing.T) {
+	before := q.Length()
+
+	if err := q.Quarantine(createMsg(), "DMARC policy of example.com"); err != nil {
+		t.Fatal("Error quarantining:", err)
+	}
+	if err := q.Quarantine(createMsg(), "rule"); err != nil {
+		t.Fatal("Error quarantining:", err)
+	}
+
+	if q.Length() != before {
+		t.Fatal("Quarantined message queued for delivery")
+	}
+
+	held, err := q.Quarantined()
+	if err != nil || len(held) != 2 {
+		t.Fatal("Expected 2 held messages:", len(held), err)
+	}
+	if held[0].Msg.QuarantineReason != "DMARC policy of example.com" {
+		t.Fatal("Reason not kept:", held[0].Msg.QuarantineReason)
+	}
+
+	if err = q.Release(held[0].Key); err != nil {
+		t.Fatal("Error releasing:", err)
+	}
+	if q.Length() != before+1 {
+		t.Fatal("Released message not queued")
+	}
+
+	if err = q.DeleteQuarantined(held[1].Key); err != nil {
+		t.Fatal("Error deleting:", err)
+	}
+	if err = q.DeleteQuarantined(held[1].Key); err == nil {
+		t.Fatal("Deleted message still held")
+	}
+
+	if held, _ = q.Quarantined(); len(held) != 0 {
+		t.Fatal("Quarantine not empty:", len(held))
+	}
+
+	// don't leave the released message to the other tests
+	key, msg, err := q.Pop(ctx)
+	if err != nil || key == nil {
+		t.Fatal("Error popping:", err)
+	}
+	if msg.QuarantineReason != "" {
+		t.Fatal("Released message still has a reason:", msg.QuarantineReason)
+	}
+	q.RemoveDelivered(key)
+}
+
+func TestShardedQuarantine(t *testing.T) {
+	dir, err := os.MkdirTemp("", "emailq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewSharded(filepath.Join(dir, "test.db"), 3, nil)
+	if err != nil {
+		t.Fatal("Error creating sharded queue:", err)
+	}
+	defer s.Close()
+
+	if err = s.Quarantine(createMsg(), "rule"); err != nil {
+		t.Fatal("Error quarantining:", err)
+	}
+
+	held, err := s.Quarantined()
+	if err != nil || len(held) != 1 {
+		t.Fatal("Expected 1 held message:", len(held), err)
+	}
+
+	if err = s.Release(held[0].Key); err != nil {
+		t.Fatal("Error releasing:", err)
+	}
+	if s.Length() != 1 {
+		t.Fatal("Released message not queued")
+	}
+}
@@ -1,229 +1,814 @@
 package emailq
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
+	"errors"
 	"fmt"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/boltdb/bolt"
+	bolt "go.etcd.io/bbolt"
 )
 
 var (
 	incomingBucket = []byte("incoming")
-	outgoingBucket = []byte("outgoing")
 	deadBucket     = []byte("deadletter")
 )
 
+// Queue is the set of operations the sender needs, implemented by EmailQ, Sharded, Redis,
+// SQL and Memory. Operations taking a context give up with its error once it's done, a
+// transaction cut short is rolled back.
+//
+// Subscribe pops messages as they come due, in batches like PopBatch, and hands them over
+// on the returned channel. It's closed once ctx is done, messages popped by then can still
+// be received and are out for delivery. Pushes, finished deliveries and other changes that
+// may let more be popped wake it, otherwise it looks again within a minute.
+type Queue interface {
+	Push(ctx context.Context, msg *Msg) error
+	PushAll(ctx context.Context, msgs []*Msg) error
+	Pop(ctx context.Context) (key []byte, msg *Msg, err error)
+	PopBatch(ctx context.Context, n int) ([]Delivery, error)
+	Subscribe(ctx context.Context) <-chan Delivery
+	Retry(key []byte, cause error) error
+	MarkWarned(key []byte) error
+	Kill(key []byte, cause error) error
+	RemoveDelivered(key []byte) error
+	Recover() error
+	Length() int
+	Close() error
+}
+
 // EmailQ is a persistent queue that holds the mail messages
 type EmailQ struct {
-	db *bolt.DB
+	mu         sync.RWMutex // held for writing while Compact swaps db
+	db         *bolt.DB
+	boltOpts   *bolt.Options
+	backoff    BackoffFunc
+	maxRetries int
+	ttl        time.Duration
+	hooks      hooks
+	meter      meter
+	codec      codec
+	quota      Quota
+	hostLimit  int
+	archive    Archive
+	owner      string        // leases of messages this queue popped are held under it
+	lease      time.Duration // how long they're held
+	clock      Clock
+	turns      turns // of fresh and retried messages, see dueKeys
+	waker      waker
+
+	groupCommit bool
+	batchDelay  time.Duration
+	done        chan struct{} // closed by Close to stop the sync loop
+	shared      shared
+	pidFile     string // removed by Close, empty when read-only
 }
 
+// DefaultMaxRetries is used for messages pushed without MaxRetries to a queue without one
+const DefaultMaxRetries = 6
+
 // Msg represents email message
 type Msg struct {
-	Host  string
-	From  string
-	To    []string
-	Data  []byte
-	Retry int
+	Host    string
+	From    string // empty for the null reverse-path of bounces and DSNs
+	To      []string
+	Data    []byte
+	Retry   int       // failed delivery attempts so far
+	Created time.Time // when the message was first pushed
+	Warned  bool      // sender was already told the delivery is delayed
+	UTF8    bool      // needs SMTPUTF8, addresses or headers contain UTF-8
+	Body    string    // BODY= the client declared, 7BIT, 8BITMIME or empty
+
+	NotBefore time.Time // scheduled delivery, the message isn't popped before then
+
+	// MaxRetries is how many failed attempts are retried before the message is
+	// dead-lettered, set to the queue's default on Push when zero
+	MaxRetries int
+
+	Expires    time.Time // deadline, a message popped later is dead-lettered instead of delivered
+	DeadReason string    // why the message ended up in the dead letter queue, one of the Reasons
+	DeadCode   int       // SMTP reply code of ReasonPermanent and ReasonPolicy
+
+	LastError   string    // error of the latest failed attempt
+	LastAttempt time.Time // when the latest attempt failed
+	Attempts    []Attempt // failed attempts, oldest first, at most maxAttempts of the latest
+
+	QuarantineReason string // why the message is held, while it's in quarantine
+
+	Delivered time.Time // when the message was delivered, once it's in the archive
+
+	Sealed  bool   // Data is encrypted, only ever true while stored, see Sealer
+	BlobRef string // Data is in the BlobStore, only ever set while stored
+
+	// DSN options requested on submission (RFC 3461)
+	Ret    string            // FULL or HDRS
+	EnvID  string            // envelope identifier
+	Notify map[string]string // recipient -> NOTIFY, e.g. "FAILURE,DELAY" or "NEVER"
+	ORcpt  map[string]string // recipient -> original recipient
+
+	// Metadata is free-form, e.g. tenant, campaign or tracking IDs and the submitting client.
+	// The queue keeps it as pushed through retries and in the dead letter queue.
+	Metadata map[string]string
+}
+
+// Attempt is a failed delivery attempt
+type Attempt struct {
+	Time  time.Time
+	Error string
+}
+
+// maxAttempts bounds the history kept on a message retried for days
+const maxAttempts = 20
+
+// ReasonExpired is the DeadReason of messages dead-lettered past their Expires deadline
+const ReasonExpired = "expired"
+
+// ReasonInterrupted is the DeadReason of messages whose deliveries were cut short, e.g. by a
+// crash, more often than they may be retried
+const ReasonInterrupted = "interrupted"
+
+// DeadReasons of messages Kill dead-letters, told apart by the cause it's given
+const (
+	ReasonMaxRetries = "max-retries" // failed temporarily as many times as they may be retried
+	ReasonPermanent  = "permanent"   // refused with a 5xx reply, not retried
+	ReasonPolicy     = "policy"      // refused with a 5.7.x security or policy status
+)
+
+// ErrNotFound is returned for a key that isn't where an operation looks for it, e.g. a
+// message retried once it's no longer out for delivery. The errors wrapping it name where.
+var ErrNotFound = errors.New("Message not found")
+
+// notFound is ErrNotFound for messages in bucket
+func notFound(bucket string) error {
+	return fmt.Errorf("%w in %s bucket", ErrNotFound, bucket)
+}
+
+// errInterrupted is the failed attempt recorded for a delivery cut short
+var errInterrupted = errors.New("Delivery interrupted")
+
+// Options tune the bolt file and retries, the zero value keeps the defaults
+type Options struct {
+	Timeout time.Duration // how long to wait for another process to release the file, forever if zero
+
+	// ReadOnly opens the file for inspection, several processes may read it at once but
+	// not while one has it open for writing. Anything that changes the queue fails.
+	ReadOnly bool
+
+	// NoSync skips the fsync after each commit. Pushes get much faster but a crash or power
+	// loss can lose the latest messages even though the client was told they were accepted.
+	NoSync bool
+
+	// SyncEvery is NoSync with an fsync at this interval, so a crash loses at most the
+	// messages accepted during the last interval. Zero syncs every commit unless NoSync.
+	SyncEvery time.Duration
+
+	// GroupCommit lets concurrent pushes share a transaction and its fsync, each waits up to
+	// BatchDelay (10ms if zero) for others to join. Nothing is lost on a crash, pushes just
+	// take a little longer each while many more of them complete per second.
+	GroupCommit bool
+	BatchDelay  time.Duration
+
+	// FreelistType is "array" or "map", map is faster on large files with many free pages
+	FreelistType string
+
+	// Backoff schedules retries of failed deliveries, Quadratic if nil
+	Backoff BackoffFunc
+
+	// MaxRetries is the default of Msg.MaxRetries, DefaultMaxRetries if zero
+	MaxRetries int
+
+	// TTL sets Msg.Expires of pushed messages that have none, zero keeps them until
+	// they run out of retries
+	TTL time.Duration
+
+	// Observer is told about every push, pop, retry, kill and delivery
+	Observer Observer
+
+	// Sealer encrypts message bodies before they are stored, nil keeps them in the clear
+	Sealer *Sealer
+
+	// Blobs keeps bodies larger than BlobSize out of the queue, DefaultBlobSize if zero
+	Blobs    BlobStore
+	BlobSize int
+
+	// Quota refuses pushes once the incoming queue holds that much, shards share it
+	Quota Quota
+
+	// HostLimit is how many messages for one host may be out for delivery at once, others
+	// wait in the queue. Zero is unlimited.
+	HostLimit int
+
+	// Archive keeps delivered messages in the archive bucket instead of deleting them, see
+	// PurgeArchive
+	Archive Archive
+
+	// Lease is how long a popped message is held for delivery before it's due again, as
+	// after a crash, DefaultLease if zero. Keep it above the longest delivery.
+	Lease time.Duration
+
+	// Clock is what the queue takes the time from, the system clock if nil
+	Clock Clock
+}
+
+// Delivery is a message taken off the queue together with its key
+type Delivery struct {
+	Key []byte
+	Msg *Msg
+}
+
+// buckets New creates, besides the lanes indexing hosts
+var buckets = [][]byte{
+	incomingBucket, leasesBucket, deadBucket, quarantineBucket, pausedBucket, corruptBucket,
+	archiveBucket, greylistBucket, journalBucket,
 }
 
-// New creates new instance of EmailQ
-func New(filepath string) (*EmailQ, error) {
-	db, err := bolt.Open(filepath, 0600, nil)
+// New creates new instance of EmailQ, opts may be nil. ErrLocked if another process holds
+// the file for longer than opts.Timeout.
+func New(filepath string, opts *Options) (*EmailQ, error) {
+	boltOpts, err := opts.bolt()
 	if err != nil {
 		return nil, err
 	}
 
-	// create buckets
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(incomingBucket)
-		if err != nil {
-			return err
-		}
+	db, err := bolt.Open(filepath, 0600, boltOpts)
+	if err == bolt.ErrTimeout {
+		return nil, lockedError(filepath)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		_, err = tx.CreateBucketIfNotExists(outgoingBucket)
-		if err != nil {
-			return err
+	if db.IsReadOnly() {
+		err = db.View(checkBuckets)
+	} else {
+		err = db.Update(createBuckets)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	q := &EmailQ{
+		db:       db,
+		boltOpts: boltOpts,
+		owner:    newOwner(),
+		lease:    DefaultLease,
+	}
+	q.hooks.m, q.hooks.w = &q.meter, &q.waker
+	if opts != nil {
+		q.backoff, q.maxRetries, q.ttl = opts.Backoff, opts.MaxRetries, opts.TTL
+		q.hooks.Observer = opts.Observer
+		q.codec = codec{opts.Sealer, opts.Blobs, opts.BlobSize}
+		q.quota, q.hostLimit = opts.Quota, opts.HostLimit
+		q.archive, q.clock = opts.Archive, opts.Clock
+		q.groupCommit, q.batchDelay = opts.GroupCommit, opts.BatchDelay
+		if opts.Lease > 0 {
+			q.lease = opts.Lease
 		}
+	}
+	q.tune(db)
 
-		_, err = tx.CreateBucketIfNotExists(deadBucket)
-		return err
-	})
+	if !db.IsReadOnly() {
+		q.pidFile = pidPath(filepath)
+		writePID(q.pidFile)
+	}
 
-	if err != nil {
-		return nil, err
+	if opts != nil && opts.SyncEvery > 0 && !opts.ReadOnly {
+		q.done = make(chan struct{})
+		go q.syncLoop(q.done, opts.SyncEvery)
+	}
+
+	return q, nil
+}
+
+func (o *Options) bolt() (*bolt.Options, error) {
+	if o == nil {
+		return nil, nil
+	}
+
+	opts := &bolt.Options{Timeout: o.Timeout, NoSync: o.NoSync || o.SyncEvery > 0, ReadOnly: o.ReadOnly}
+
+	switch o.FreelistType {
+	case "":
+	case "array":
+		opts.FreelistType = bolt.FreelistArrayType
+	case "map":
+		opts.FreelistType = bolt.FreelistMapType
+	default:
+		return nil, fmt.Errorf("Unknown freelist type: %s", o.FreelistType)
 	}
 
-	return &EmailQ{
-		db: db,
-	}, nil
+	return opts, nil
 }
 
 // Close closes the queue
 func (q *EmailQ) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.done != nil {
+		close(q.done)
+		q.done = nil
+		q.db.Sync()
+	}
+
+	if q.pidFile != "" {
+		os.Remove(q.pidFile)
+	}
+
 	return q.db.Close()
 }
 
-// Length returns Incoming queue length
+// Length returns Incoming queue length, messages out for delivery don't count
 func (q *EmailQ) Length() (count int) {
-	q.db.View(func(tx *bolt.Tx) error {
+	q.view(func(tx *bolt.Tx) error {
 		b := tx.Bucket(incomingBucket)
-		count = b.Stats().KeyN
+		count = b.Stats().KeyN - leasedUsage(tx, q.now()).count
 		return nil
 	})
 
 	return
 }
 
-// Push messages to the queue
-func (q *EmailQ) Push(msg *Msg) error {
-	key := []byte(time.Now().UTC().Format(time.RFC3339Nano))
-	value := encode(msg)
-
-	err := q.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(incomingBucket)
-		return b.Put(key, value)
-	})
+// Push messages to the queue, due now or at msg.NotBefore
+func (q *EmailQ) Push(ctx context.Context, msg *Msg) error {
+	return q.PushAll(ctx, []*Msg{msg})
+}
 
-	return err
+// PushAll pushes msgs in a single transaction, either all of them are queued or none.
+// ErrQueueFull if they don't fit the Quota.
+func (q *EmailQ) PushAll(ctx context.Context, msgs []*Msg) error {
+	return q.pushAll(ctx, msgs, q.quota, usage{})
 }
 
-// Retry takes msg from outgoing queue and places that in the Retry queue
-func (q *EmailQ) Retry(key []byte) error {
-	return q.db.Update(func(tx *bolt.Tx) error {
-		outgoing := tx.Bucket(outgoingBucket)
+// pushAll checks quota against the incoming bucket plus what other shards hold
+func (q *EmailQ) pushAll(ctx context.Context, msgs []*Msg, quota Quota, other usage) error {
+	now := q.now().UTC()
+	keys := make([][]byte, len(msgs))
 
-		msg := outgoing.Get(key)
-		if msg == nil {
-			return fmt.Errorf("Message not found in outgoing bucket")
+	values, err := q.codec.encodeAll(msgs, now, q.maxRetries, q.ttl)
+	if err != nil {
+		return err
+	}
+
+	commit := q.update
+	if q.groupCommit {
+		commit = q.batch
+	}
+
+	err = commit(cancellable(ctx, func(tx *bolt.Tx) error {
+		if quota.enabled() {
+			if q.shared.tx != tx {
+				q.shared = shared{tx: tx}
+			}
+
+			u := pendingUsage(tx, now).add(other).add(q.shared.u)
+			if err := quota.admit(u, values); err != nil {
+				return err
+			}
+			q.shared.u = q.shared.u.add(usage{len(values), sizeOf(values)})
 		}
 
-		err := outgoing.Delete(key)
+		for i, msg := range msgs {
+			keys[i] = newKey(msg.due(now))
+			if err := putIncoming(tx, keys[i], values[i], msg.Host, msg.Retry > 0); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}))
+	if err != nil {
+		return err
+	}
+
+	for i, msg := range msgs {
+		q.hooks.push(keys[i], msg)
+	}
+	return nil
+}
+
+// Retry requeues a popped msg under a new key, due after the backoff delay. cause is
+// recorded in the attempt history.
+func (q *EmailQ) Retry(key []byte, cause error) error {
+	var m *Msg
+	err := q.update(func(tx *bolt.Tx) error {
+		msg, err := q.held(tx, key)
 		if err != nil {
 			return err
 		}
 
-		incoming := tx.Bucket(incomingBucket)
+		m = decode(msg)
+		if err = deleteIncoming(tx, key, m.Host); err != nil {
+			return err
+		}
 
-		t, err := time.Parse(time.RFC3339Nano, string(key))
+		t, err := keyTime(key)
 		if err != nil {
 			return err
 		}
 
-		m := decode(msg)
+		m.fail(q.now(), cause)
 		m.Retry++
-		t = t.Add(time.Duration(m.Retry*m.Retry) * time.Minute)
-
-		key = []byte(t.Format(time.RFC3339Nano))
-		msg = encode(m)
+		t = t.Add(q.backoff.delay(m.Retry))
 
-		return incoming.Put(key, msg)
+		return putIncoming(tx, newKey(t), encode(m), m.Host, true)
 	})
-}
+	if err != nil {
+		return err
+	}
 
-// Kill takes msg out of outgoing and pushed that to Dead Letter queue
-func (q *EmailQ) Kill(key []byte) error {
-	return q.db.Update(func(tx *bolt.Tx) error {
-		outgoing := tx.Bucket(outgoingBucket)
+	q.hooks.retry(key, m, cause)
+	return nil
+}
 
-		msg := outgoing.Get(key)
-		if msg == nil {
-			return fmt.Errorf("Message not found in outgoing bucket")
+// MarkWarned records that the sender of popped msg was notified about the delay
+func (q *EmailQ) MarkWarned(key []byte) error {
+	return q.update(func(tx *bolt.Tx) error {
+		msg, err := q.held(tx, key)
+		if err != nil {
+			return err
 		}
 
-		err := outgoing.Delete(key)
+		m := decode(msg)
+		m.Warned = true
+
+		return tx.Bucket(incomingBucket).Put(key, encode(m))
+	})
+}
+
+// Kill takes popped msg out of incoming and pushed that to Dead Letter queue, recording
+// cause as its last attempt and classifying it as the DeadReason
+func (q *EmailQ) Kill(key []byte, cause error) error {
+	var m *Msg
+	err := q.update(func(tx *bolt.Tx) error {
+		msg, err := q.held(tx, key)
 		if err != nil {
 			return err
 		}
 
-		retry := tx.Bucket(deadBucket)
+		m = decode(msg)
+		if err = deleteIncoming(tx, key, m.Host); err != nil {
+			return err
+		}
 
-		return retry.Put(key, msg)
+		m.kill(q.now(), cause)
+
+		return tx.Bucket(deadBucket).Put(key, encode(m))
 	})
+	if err != nil {
+		return err
+	}
+
+	q.hooks.kill(key, m, cause)
+	return nil
 }
 
 // Pop get next email from the queue
-func (q *EmailQ) Pop() (key []byte, msg *Msg, err error) {
-	err = q.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(incomingBucket)
+func (q *EmailQ) Pop(ctx context.Context) (key []byte, msg *Msg, err error) {
+	batch, err := q.PopBatch(ctx, 1)
+	if err != nil || len(batch) == 0 {
+		return nil, nil, err
+	}
 
-		k, v := b.Cursor().First()
-		if k == nil {
-			return nil
-		}
+	return batch[0].Key, batch[0].Msg, nil
+}
 
-		t, err := time.Parse(time.RFC3339Nano, string(k))
+// PopBatch gets up to n emails that are due for delivery in a single transaction, expired
+// ones are dead-lettered
+func (q *EmailQ) PopBatch(ctx context.Context, n int) (batch []Delivery, err error) {
+	var t taken
+	err = q.update(cancellable(ctx, func(tx *bolt.Tx) error {
+		keys, err := q.dueKeys(tx, n)
 		if err != nil {
 			return err
 		}
 
-		if t.After(time.Now().UTC()) {
-			return nil
+		t, err = q.take(tx, keys)
+		return err
+	}))
+	if err == nil {
+		err = q.setAside(q.codec.openPopped(&t))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	q.hooks.popped(t)
+	return t.batch, nil
+}
+
+// takeKeys leases given keys, keys no longer pending are skipped
+func (q *EmailQ) takeKeys(ctx context.Context, keys [][]byte) (batch []Delivery, err error) {
+	var t taken
+	err = q.update(cancellable(ctx, func(tx *bolt.Tx) error {
+		t, err = q.take(tx, keys)
+		return err
+	}))
+	if err == nil {
+		err = q.setAside(q.codec.openPopped(&t))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	q.hooks.popped(t)
+	return t.batch, nil
+}
+
+// setAside moves popped messages whose bodies can't be read from incoming to the corrupt
+// bucket, like values that don't decode
+func (q *EmailQ) setAside(corrupt []Corrupt) error {
+	if len(corrupt) == 0 {
+		return nil
+	}
+
+	return q.update(func(tx *bolt.Tx) error {
+		for _, c := range corrupt {
+			if err := tx.Bucket(corruptBucket).Put(c.Key, encodeCorrupt(c)); err != nil {
+				return err
+			}
+			if err := deleteIncoming(tx, c.Key, ""); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// taken is what a pop did with the messages it took off incoming
+type taken struct {
+	batch   []Delivery // out for delivery
+	dead    []Delivery // dead-lettered past their deadline or interrupted too often
+	corrupt []Corrupt  // set aside, they didn't decode
+}
+
+// take leases keys to q, expired messages go to the dead letter queue and values that
+// don't decode to the corrupt bucket instead. A key whose lease ran out is a delivery that
+// was cut short, it's recorded as an attempt.
+func (q *EmailQ) take(tx *bolt.Tx, keys [][]byte) (t taken, err error) {
+	now := q.now()
+	leases := tx.Bucket(leasesBucket)
+	l := lease{q.owner, now.Add(q.lease)}.encode()
+
+	for _, k := range keys {
+		v := pending(tx, k, now)
+		if v == nil {
+			continue
 		}
 
-		msg = decode(v)
-		err = b.Delete(k)
+		m, err := decodeMsg(v)
 		if err != nil {
-			return err
+			c := newCorrupt(k, v, err)
+			if err = tx.Bucket(corruptBucket).Put(k, encodeCorrupt(c)); err != nil {
+				return t, err
+			}
+			if err = deleteIncoming(tx, k, ""); err != nil {
+				return t, err
+			}
+			t.corrupt = append(t.corrupt, c)
+			continue
 		}
 
-		// key needs to be cloned, k is not valid outside of the transaction
-		key = append(key, k...)
+		dead := m.expired(now)
+		if dead {
+			m.DeadReason = ReasonExpired
+		} else if leases.Get(k) != nil {
+			// the lease ran out, the delivery was cut short
+			if dead = !m.interrupt(now); !dead {
+				if err = tx.Bucket(incomingBucket).Put(k, encode(m)); err != nil {
+					return t, err
+				}
+			}
+		}
 
-		// stick things into outgoing bucket
-		b = tx.Bucket(outgoingBucket)
-		return b.Put(k, v)
-	})
+		if dead {
+			if err = tx.Bucket(deadBucket).Put(k, encode(m)); err != nil {
+				return t, err
+			}
+			if err = deleteIncoming(tx, k, m.Host); err != nil {
+				return t, err
+			}
+			t.dead = append(t.dead, Delivery{Key: k, Msg: m})
+			continue
+		}
 
-	return key, msg, err
+		if err = leases.Put(k, l); err != nil {
+			return t, err
+		}
+
+		t.batch = append(t.batch, Delivery{Key: k, Msg: m})
+	}
+
+	return t, nil
 }
 
-// Recover re-queues outgoing emails that were interrupted
+// Recover requeues interrupted emails, recording the interruption as a failed attempt. They
+// wait the backoff delay like a retry, exhausted ones go to the dead letter queue. Leases
+// run out on their own, Recover saves waiting for that when the process that held them is
+// known to be gone, as at startup. Only one process opens a bolt file.
 func (q *EmailQ) Recover() error {
-	return q.db.Update(func(tx *bolt.Tx) error {
-		outgoing := tx.Bucket(outgoingBucket)
-		incoming := tx.Bucket(incomingBucket)
-
-		c := outgoing.Cursor()
+	var r recovered
+	err := q.update(func(tx *bolt.Tx) error {
+		r = recovered{}
+		now := q.now()
+		incoming, dead := tx.Bucket(incomingBucket), tx.Bucket(deadBucket)
+
+		var keys [][]byte
+		tx.Bucket(leasesBucket).ForEach(func(k, v []byte) error {
+			keys = append(keys, append([]byte(nil), k...))
+			return nil
+		})
 
-		for k, v := c.First(); k != nil; k, v = c.First() {
-			err := c.Delete() // delete from outgoing
+		for _, k := range keys {
+			// values that don't decode are set aside once they're popped again
+			m, err := decodeMsg(incoming.Get(k))
 			if err != nil {
-				return nil
+				continue
+			}
+
+			if err = deleteIncoming(tx, k, m.Host); err != nil {
+				return err
 			}
 
-			// reinsert into incoming
-			key := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+			retry := m.interrupt(now)
+			r.add(k, m, retry)
+			if !retry {
+				err = dead.Put(k, encode(m))
+			} else {
+				err = putIncoming(tx, newKey(now.Add(q.backoff.delay(m.Retry))), encode(m), m.Host, true)
+			}
+			if err != nil {
+				return err
+			}
+		}
 
-			incoming.Put(key, v)
+		// drop the leases left, of values that didn't decode or are gone
+		if err := tx.DeleteBucket(leasesBucket); err != nil {
+			return err
 		}
 
-		return nil
+		_, err := tx.CreateBucket(leasesBucket)
+		return err
 	})
+	if err != nil {
+		return err
+	}
+
+	r.report(q.hooks)
+	return nil
 }
 
 // RemoveDelivered removes successfully delivered message
 func (q *EmailQ) RemoveDelivered(key []byte) error {
-	return q.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(outgoingBucket)
-		return b.Delete(key)
+	err := q.update(func(tx *bolt.Tx) error {
+		return q.remove(tx, key)
 	})
+	if err != nil {
+		return err
+	}
+
+	q.hooks.delivered(key)
+	return nil
+}
+
+// due is when a pushed message may first be popped
+func (msg *Msg) due(now time.Time) time.Time {
+	if msg.NotBefore.After(now) {
+		return msg.NotBefore
+	}
+
+	return now
+}
+
+// prepare fills in what the queue tracks about a newly pushed msg
+func (msg *Msg) prepare(now time.Time, maxRetries int, ttl time.Duration) {
+	if msg.Created.IsZero() {
+		msg.Created = now
+	}
+
+	if msg.Expires.IsZero() && ttl > 0 {
+		msg.Expires = msg.Created.Add(ttl)
+	}
+
+	if msg.MaxRetries == 0 {
+		msg.MaxRetries = maxRetries
+	}
+	if msg.MaxRetries == 0 {
+		msg.MaxRetries = DefaultMaxRetries
+	}
+}
+
+// Exhausted reports whether msg failed as many times as it may be retried, messages queued
+// before MaxRetries existed get DefaultMaxRetries
+func (msg *Msg) Exhausted() bool {
+	max := msg.MaxRetries
+	if max == 0 {
+		max = DefaultMaxRetries
+	}
+
+	return msg.Retry >= max
+}
+
+// fail records a failed delivery attempt, a nil cause isn't one
+func (msg *Msg) fail(now time.Time, cause error) {
+	if cause == nil {
+		return
+	}
+
+	msg.LastError, msg.LastAttempt = cause.Error(), now.UTC()
+	msg.Attempts = append(msg.Attempts, Attempt{msg.LastAttempt, msg.LastError})
+	if len(msg.Attempts) > maxAttempts {
+		msg.Attempts = msg.Attempts[len(msg.Attempts)-maxAttempts:]
+	}
+}
+
+// kill records cause as the failed attempt that dead-letters msg and why, see deadReason
+func (msg *Msg) kill(now time.Time, cause error) {
+	msg.fail(now, cause)
+	msg.DeadReason, msg.DeadCode = deadReason(msg, cause)
+}
+
+// Permanent reports whether cause is a 5xx SMTP reply, a failure retrying won't fix
+func Permanent(cause error) bool {
+	var reply *textproto.Error
+	return errors.As(cause, &reply) && reply.Code >= 500
+}
+
+// deadReason classifies the cause of a Kill by its SMTP reply, one that isn't permanent is
+// running out of retries if msg did, otherwise the caller's decision
+func deadReason(msg *Msg, cause error) (reason string, code int) {
+	var reply *textproto.Error
+	switch {
+	case Permanent(cause) && errors.As(cause, &reply):
+		if strings.HasPrefix(reply.Msg, "5.7.") {
+			return ReasonPolicy, reply.Code
+		}
+		return ReasonPermanent, reply.Code
+	case cause != nil && msg.Exhausted():
+		return ReasonMaxRetries, 0
+	}
+
+	return ReasonKilled, 0
+}
+
+// interrupt records a delivery cut short as a failed attempt, counting toward MaxRetries.
+// Reports whether msg gets another try, an exhausted one is marked for the dead letter queue.
+func (msg *Msg) interrupt(now time.Time) (retry bool) {
+	msg.fail(now, errInterrupted)
+
+	if msg.Exhausted() {
+		msg.DeadReason = ReasonInterrupted
+		return false
+	}
+
+	msg.Retry++
+	return true
 }
 
+// recovered is what Recover did with the interrupted messages
+type recovered struct {
+	retried []Delivery
+	dead    []Delivery
+}
+
+func (r *recovered) add(key []byte, msg *Msg, retry bool) {
+	d := Delivery{Key: append([]byte(nil), key...), Msg: msg}
+	if retry {
+		r.retried = append(r.retried, d)
+	} else {
+		r.dead = append(r.dead, d)
+	}
+}
+
+func (r recovered) report(h hooks) {
+	for _, d := range r.retried {
+		h.retry(d.Key, d.Msg, errInterrupted)
+	}
+	for _, d := range r.dead {
+		h.kill(d.Key, d.Msg, errInterrupted)
+	}
+}
+
+// expired reports whether msg is past its Expires deadline
+func (msg *Msg) expired(now time.Time) bool {
+	return !msg.Expires.IsZero() && now.After(msg.Expires)
+}
+
+// decode returns an empty Msg for values that don't decode, see decodeMsg
 func decode(b []byte) *Msg {
-	var result Msg
-	buf := bytes.NewBuffer(b)
-	decoder := gob.NewDecoder(buf)
-	decoder.Decode(&result)
-	return &result
+	if msg, err := decodeMsg(b); err == nil {
+		return msg
+	}
+
+	return &Msg{}
 }
 
 func encode(msg *Msg) []byte {
-	var buf bytes.Buffer
-	encoder := gob.NewEncoder(&buf)
-	encoder.Encode(msg)
-
-	return buf.Bytes()
+	return marshal(msg)
 }
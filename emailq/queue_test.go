@@ -2,8 +2,18 @@ package emailq
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/textproto"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	bolt "go.etcd.io/bbolt"
 )
 
 const (
@@ -12,10 +22,13 @@ const (
 
 var (
 	q *EmailQ
+
+	// ctx is what tests that don't cancel pass to queue operations
+	ctx = context.Background()
 )
 
 func TestMain(m *testing.M) {
-	queue, err := New(testDb)
+	queue, err := New(testDb, nil)
 	if err != nil {
 		panic(err)
 	}
@@ -33,12 +46,12 @@ func TestMain(m *testing.M) {
 }
 
 func TestNormalFlow(t *testing.T) {
-	err := q.Push(createMsg())
+	err := q.Push(ctx, createMsg())
 	if err != nil {
 		t.Fatal("Error pushing:", err)
 	}
 
-	key, _, err := q.Pop()
+	key, _, err := q.Pop(ctx)
 	if err != nil || key == nil {
 		t.Fatal("Error popping:", err)
 	}
@@ -50,42 +63,107 @@ func TestNormalFlow(t *testing.T) {
 }
 
 func TestRetryFlow(t *testing.T) {
-	err := q.Push(createMsg())
+	err := q.Push(ctx, createMsg())
 
-	key, _, err := q.Pop()
+	key, _, err := q.Pop(ctx)
 	if err != nil || key == nil {
 		t.Fatal("Error popping:", err)
 	}
 
-	err = q.Retry(key)
+	err = q.Retry(key, nil)
 	if err != nil {
 		t.Fatal("Error pushing retry:", err)
 	}
 
-	key, _, err = q.Pop()
+	key, _, err = q.Pop(ctx)
 	if key != nil {
 		t.Fatal("Retry needs to wait")
 	}
 }
 
+func TestWarnedFlow(t *testing.T) {
+	err := q.Push(ctx, createMsg())
+
+	key, msg, err := q.Pop(ctx)
+	if err != nil || key == nil {
+		t.Fatal("Error popping:", err)
+	}
+
+	if msg.Created.IsZero() || msg.Warned {
+		t.Fatal("Fresh message should have creation time and no warning")
+	}
+
+	err = q.MarkWarned(key)
+	if err != nil {
+		t.Fatal("Error marking warned:", err)
+	}
+
+	q.view(func(tx *bolt.Tx) error {
+		if !decode(tx.Bucket(incomingBucket).Get(key)).Warned {
+			t.Fatal("Warning flag was not persisted")
+		}
+		return nil
+	})
+
+	err = q.RemoveDelivered(key)
+	if err != nil {
+		t.Fatal("Error removing delivered:", err)
+	}
+}
+
 func TestDeadFlow(t *testing.T) {
-	err := q.Push(createMsg())
+	err := q.Push(ctx, createMsg())
 
-	key, _, err := q.Pop()
+	key, _, err := q.Pop(ctx)
 	if err != nil || key == nil {
 		t.Fatal("Error popping:", err)
 	}
 
-	err = q.Kill(key)
+	err = q.Kill(key, nil)
 	if err != nil {
 		t.Fatal("Error pushing dead letter:", err)
 	}
 }
 
+func TestDeadReasons(t *testing.T) {
+	causes := []struct {
+		cause  error
+		retry  int
+		reason string
+		code   int
+	}{
+		{errors.New("dial tcp: i/o timeout"), DefaultMaxRetries, ReasonMaxRetries, 0},
+		{&textproto.Error{Code: 451, Msg: "4.3.0 Try again later"}, DefaultMaxRetries, ReasonMaxRetries, 0},
+		{&textproto.Error{Code: 451, Msg: "4.3.0 Try again later"}, 0, ReasonKilled, 0},
+		{&textproto.Error{Code: 550, Msg: "5.1.1 No such user"}, 0, ReasonPermanent, 550},
+		{fmt.Errorf("Sending: %w", &textproto.Error{Code: 554, Msg: "5.7.1 Rejected by policy"}), 0, ReasonPolicy, 554},
+		{nil, DefaultMaxRetries, ReasonKilled, 0},
+	}
+
+	for name, backend := range backends(t) {
+		queue := backend.(bulker)
+		for _, c := range causes {
+			msg := createMsg()
+			msg.Retry = c.retry
+			queue.Push(ctx, msg)
+			key, _, _ := queue.Pop(ctx)
+			if err := queue.Kill(key, c.cause); err != nil {
+				t.Fatal(name, "error killing:", err)
+			}
+
+			dead, err := queue.ListDead(ctx, Filter{Reason: c.reason})
+			if err != nil || len(dead) != 1 || dead[0].Msg.DeadCode != c.code {
+				t.Fatal(name, "unexpected dead letters for", c.cause, dead, err)
+			}
+			queue.DeleteDead(ctx, Filter{Reason: c.reason})
+		}
+	}
+}
+
 func TestCrashFlow(t *testing.T) {
-	err := q.Push(createMsg())
+	err := q.Push(ctx, createMsg())
 
-	k1, msg1, err := q.Pop()
+	k1, msg1, err := q.Pop(ctx)
 	if err != nil || k1 == nil {
 		t.Fatal("Error popping:", err)
 	}
@@ -95,20 +173,53 @@ func TestCrashFlow(t *testing.T) {
 		t.Fatal("Error recovering:", err)
 	}
 
-	k2, msg2, err := q.Pop()
+	// the interruption counts as a failed attempt, the message waits like a retry
+	if k2, _, _ := q.Pop(ctx); k2 != nil {
+		t.Fatal("Recovered message popped before its time")
+	}
+
+	page, err := q.ListPending(ctx, Filter{})
 	if err != nil {
+		t.Fatal("Error listing:", err)
+	}
+
+	var recovered *Msg
+	for _, d := range page {
+		if d.Msg.LastError == errInterrupted.Error() {
+			recovered = d.Msg
+			if bytes.Equal(k1, d.Key) {
+				t.Fatal("Recovered message should get a new key", string(k1))
+			}
+		}
+	}
+	if recovered == nil || recovered.Retry != 1 || recovered.From != msg1.From {
+		t.Fatal("Interruption not recorded:", recovered)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	err := q.Push(ctx, createMsg())
+
+	key, _, err := q.Pop(ctx)
+	if err != nil || key == nil {
 		t.Fatal("Error popping:", err)
 	}
 
-	if bytes.Equal(k1, k2) {
-		t.Fatal("Message should get a new key", string(k1), string(k2))
+	r, err := q.Check(0, true)
+	if err != nil {
+		t.Fatal("Error checking:", err)
+	}
+
+	if !r.Healthy() || len(r.Stale) != 1 || r.Repaired != 1 {
+		t.Fatalf("Unexpected report: %+v", r)
 	}
 
-	if msg1.From != msg2.From {
-		t.Fatal("Outgoing message does not match", string(k1), string(k2))
+	key, _, err = q.Pop(ctx)
+	if err != nil || key == nil {
+		t.Fatal("Repaired message should be back in incoming:", err)
 	}
 
-	err = q.RemoveDelivered(k2)
+	err = q.RemoveDelivered(key)
 	if err != nil {
 		t.Fatal("Error removing delivered:", err)
 	}
@@ -122,3 +233,258 @@ func createMsg() *Msg {
 		Data: nil,
 	}
 }
+
+func TestOptions(t *testing.T) {
+	dir, err := os.MkdirTemp("", "emailq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err = New(filepath.Join(dir, "bad.db"), &Options{FreelistType: "list"}); err == nil {
+		t.Fatal("Expected error for unknown freelist type")
+	}
+
+	tuned, err := New(filepath.Join(dir, "tuned.db"), &Options{Timeout: time.Second, NoSync: true, FreelistType: "map"})
+	if err != nil {
+		t.Fatal("Error opening with options:", err)
+	}
+	defer tuned.Close()
+
+	if !tuned.db.NoSync {
+		t.Fatal("NoSync not applied")
+	}
+
+	// the file is locked by the open queue
+	if _, err = New(filepath.Join(dir, "tuned.db"), &Options{Timeout: 50 * time.Millisecond}); err == nil {
+		t.Fatal("Expected timeout opening a locked file")
+	}
+}
+
+func TestKeys(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 5, 0, time.UTC)
+
+	// same instant, and a whole second which RFC3339Nano would shorten
+	a, b, c := newKey(now), newKey(now), newKey(now.Add(500*time.Millisecond))
+	if bytes.Equal(a, b) || bytes.Compare(a, b) > 0 || bytes.Compare(b, c) > 0 {
+		t.Fatal("Keys not unique and ordered:", string(a), string(b), string(c))
+	}
+
+	if k, err := keyTime(a); err != nil || !k.Equal(now) {
+		t.Fatal("Unexpected key time:", k, err)
+	}
+	if k, err := keyTime([]byte("2024-05-01T10:00:05.5Z")); err != nil || !k.Equal(now.Add(500*time.Millisecond)) {
+		t.Fatal("Unexpected time of an old key:", k, err)
+	}
+
+	before := q.Length()
+	for i := 0; i < 100; i++ {
+		if err := q.Push(ctx, createMsg()); err != nil {
+			t.Fatal("Error pushing:", err)
+		}
+	}
+	if q.Length() != before+100 {
+		t.Fatal("Messages pushed at the same instant overwrote each other:", q.Length()-before)
+	}
+
+	batch, err := q.PopBatch(ctx, 200)
+	if err != nil {
+		t.Fatal("Error popping:", err)
+	}
+	for _, d := range batch {
+		q.RemoveDelivered(d.Key)
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	m := NewMemory()
+	m.MaxRetries = 2
+
+	transactional := createMsg()
+	transactional.MaxRetries = 10
+	m.Push(ctx, transactional)
+	m.Push(ctx, createMsg())
+
+	batch, _ := m.PopBatch(ctx, 2)
+	if len(batch) != 2 || batch[0].Msg.MaxRetries != 10 || batch[1].Msg.MaxRetries != 2 {
+		t.Fatal("Unexpected MaxRetries:", batch)
+	}
+
+	msg := batch[1].Msg
+	if msg.Retry = 1; msg.Exhausted() {
+		t.Fatal("Message exhausted after 1 of 2 retries")
+	}
+	if msg.Retry = 2; !msg.Exhausted() {
+		t.Fatal("Message not exhausted after 2 of 2 retries")
+	}
+
+	// queued before MaxRetries was tracked
+	legacy := &Msg{Retry: DefaultMaxRetries}
+	if !legacy.Exhausted() {
+		t.Fatal("Legacy message should fall back to DefaultMaxRetries")
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	m := NewMemory()
+	m.TTL = time.Hour
+
+	fresh := createMsg()
+	m.Push(ctx, fresh)
+	if d := fresh.Expires.Sub(fresh.Created); d != time.Hour {
+		t.Fatal("TTL not applied:", d)
+	}
+
+	for _, queue := range []Queue{q, m} {
+		stale := createMsg()
+		stale.Expires = time.Now().Add(-time.Minute)
+		queue.Push(ctx, stale)
+
+		batch, err := queue.PopBatch(ctx, 10)
+		if err != nil {
+			t.Fatal("Error popping:", err)
+		}
+		for _, d := range batch {
+			if !d.Msg.Expires.IsZero() && d.Msg.Expires.Before(time.Now()) {
+				t.Fatal("Expired message popped")
+			}
+			queue.RemoveDelivered(d.Key)
+		}
+	}
+
+	q.db.View(func(tx *bolt.Tx) error {
+		_, v := tx.Bucket(deadBucket).Cursor().Last()
+		if v == nil || decode(v).DeadReason != ReasonExpired {
+			t.Fatal("Expired message not dead-lettered")
+		}
+		return nil
+	})
+
+	if len(m.dead) != 1 {
+		t.Fatal("Expired message not dead-lettered in memory")
+	}
+}
+
+func TestAttempts(t *testing.T) {
+	m := NewMemory()
+	m.Backoff = func(retry int) time.Duration { return 0 }
+	m.Push(ctx, createMsg())
+
+	for i := 0; i < maxAttempts+5; i++ {
+		key, _, _ := m.Pop(ctx)
+		if err := m.Retry(key, fmt.Errorf("451 Try again later (%d)", i)); err != nil {
+			t.Fatal("Error retrying:", err)
+		}
+	}
+
+	key, msg, _ := m.Pop(ctx)
+	if len(msg.Attempts) != maxAttempts || msg.LastAttempt.IsZero() {
+		t.Fatal("Unexpected attempt history:", len(msg.Attempts), msg.LastAttempt)
+	}
+	if msg.LastError != "451 Try again later (24)" || msg.Attempts[0].Error != "451 Try again later (5)" {
+		t.Fatal("Oldest attempts should be dropped:", msg.Attempts[0], msg.LastError)
+	}
+
+	m.Kill(key, fmt.Errorf("550 No such user"))
+	if dead := decode(m.dead[string(key)].msg); dead.LastError != "550 No such user" || len(dead.Attempts) != maxAttempts {
+		t.Fatal("Dead letter doesn't explain the failure:", dead.LastError)
+	}
+}
+
+// backends opens an empty queue of every kind, closed when the test or benchmark ends
+func backends(t testing.TB) map[string]Queue {
+	dir, err := os.MkdirTemp("", "emailq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	bolt, err := New(filepath.Join(dir, "queue.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bolt.Close() })
+
+	sharded, err := NewSharded(filepath.Join(dir, "sharded.db"), 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sharded.Close() })
+
+	sqlite, err := OpenSQL("sqlite3", filepath.Join(dir, "queue.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlite.Close() })
+
+	mr := miniredis.RunT(t)
+	rds := NewRedis(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "test")
+	t.Cleanup(func() { rds.Close() })
+
+	return map[string]Queue{"bolt": bolt, "sharded": sharded, "sqlite": sqlite, "redis": rds, "memory": NewMemory()}
+}
+
+func TestPushAll(t *testing.T) {
+	for name, queue := range backends(t) {
+		var msgs []*Msg
+		for _, host := range []string{"a.example", "b.example", "c.example"} {
+			msg := createMsg()
+			msg.Host = host
+			msgs = append(msgs, msg)
+		}
+
+		if err := queue.PushAll(ctx, msgs); err != nil {
+			t.Fatal(name, "error pushing:", err)
+		}
+		if queue.Length() != 3 {
+			t.Fatal(name, "expected 3 messages, got", queue.Length())
+		}
+
+		if batch, err := queue.PopBatch(ctx, 10); err != nil || len(batch) != 3 {
+			t.Fatal(name, "error popping:", len(batch), err)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for name, queue := range backends(t) {
+		unknown := []byte("2024-05-01T10:00:05Z-unknown")
+		if err := queue.Retry(unknown, nil); !errors.Is(err, ErrNotFound) {
+			t.Fatal(name, "expected ErrNotFound retrying an unknown key, got", err)
+		}
+		if err := queue.Kill(unknown, nil); !errors.Is(err, ErrNotFound) {
+			t.Fatal(name, "expected ErrNotFound killing an unknown key, got", err)
+		}
+	}
+
+	if _, err := decodeMsg([]byte("{not json")); !errors.Is(err, ErrCorrupt) {
+		t.Fatal("Expected ErrCorrupt decoding garbage, got", err)
+	}
+}
+
+func TestContext(t *testing.T) {
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	for name, queue := range backends(t) {
+		if err := queue.Push(cancelled, createMsg()); !errors.Is(err, context.Canceled) || queue.Length() != 0 {
+			t.Fatal(name, "push with a cancelled context:", err, queue.Length())
+		}
+
+		queue.Push(ctx, createMsg())
+		if batch, err := queue.PopBatch(cancelled, 10); !errors.Is(err, context.Canceled) || len(batch) != 0 {
+			t.Fatal(name, "pop with a cancelled context:", len(batch), err)
+		}
+		if _, err := queue.(lister).ListPending(cancelled, Filter{}); !errors.Is(err, context.Canceled) {
+			t.Fatal(name, "list with a cancelled context:", err)
+		}
+		if n, err := queue.(bulker).DeletePending(cancelled, Filter{}); !errors.Is(err, context.Canceled) || n != 0 {
+			t.Fatal(name, "bulk delete with a cancelled context:", n, err)
+		}
+
+		// nothing was left out for delivery
+		if batch, err := queue.PopBatch(ctx, 10); err != nil || len(batch) != 1 {
+			t.Fatal(name, "message not poppable after the cancelled pop:", len(batch), err)
+		}
+	}
+}
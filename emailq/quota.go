@@ -0,0 +1,111 @@
+package emailq
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrQueueFull is returned by Push when the messages would take the queue over its Quota
+var ErrQueueFull = errors.New("Queue is full")
+
+// Quota limits the messages waiting for delivery, so submissions are refused instead of
+// accepted into a queue that can't hold them. Zero fields don't limit.
+type Quota struct {
+	MaxMessages int
+	MaxBytes    int64 // as stored, bodies kept in Blobs don't count
+}
+
+// usage is what the incoming queue holds
+type usage struct {
+	count int
+	bytes int64
+}
+
+func (u usage) add(o usage) usage {
+	return usage{u.count + o.count, u.bytes + o.bytes}
+}
+
+func (u usage) sub(o usage) usage {
+	return usage{u.count - o.count, u.bytes - o.bytes}
+}
+
+func sizeOf(values [][]byte) (size int64) {
+	for _, v := range values {
+		size += int64(len(v))
+	}
+
+	return size
+}
+
+// shared is what earlier pushes of a transaction shared by GroupCommit added, bolt's stats
+// don't see it before the commit. Only the writer holding tx touches it.
+type shared struct {
+	tx *bolt.Tx
+	u  usage
+}
+
+func (qt Quota) enabled() bool {
+	return qt.MaxMessages > 0 || qt.MaxBytes > 0
+}
+
+// admit checks whether values fit on top of u
+func (qt Quota) admit(u usage, values [][]byte) error {
+	if qt.MaxMessages > 0 && u.count+len(values) > qt.MaxMessages {
+		return ErrQueueFull
+	}
+
+	if qt.MaxBytes > 0 && u.bytes+sizeOf(values) > qt.MaxBytes {
+		return ErrQueueFull
+	}
+
+	return nil
+}
+
+// bucketUsage counts leaf pages rather than decoding values, bytes include bolt's own
+// page headers. Buckets small enough are kept inline in their parent instead of pages.
+func bucketUsage(b *bolt.Bucket) usage {
+	stats := b.Stats()
+	return usage{stats.KeyN, int64(stats.LeafInuse + stats.InlineBucketInuse)}
+}
+
+// pendingUsage is bucketUsage less the messages out for delivery
+func pendingUsage(tx *bolt.Tx, now time.Time) usage {
+	return bucketUsage(tx.Bucket(incomingBucket)).sub(leasedUsage(tx, now))
+}
+
+func (q *EmailQ) usage() (u usage) {
+	q.view(func(tx *bolt.Tx) error {
+		u = pendingUsage(tx, q.now())
+		return nil
+	})
+
+	return u
+}
+
+// usageScript adds up the size of the messages in a sorted set
+var usageScript = redis.NewScript(`
+local keys = redis.call('ZRANGE', KEYS[1], 0, -1)
+local bytes = 0
+for _, k in ipairs(keys) do
+	bytes = bytes + redis.call('HSTRLEN', KEYS[2], k)
+end
+return {#keys, bytes}
+`)
+
+func (r *Redis) usage(ctx context.Context) (u usage, err error) {
+	if r.Quota.MaxBytes == 0 {
+		n, err := r.client.ZCard(ctx, r.incoming).Result()
+		return usage{count: int(n)}, err
+	}
+
+	res, err := usageScript.Run(ctx, r.client, []string{r.incoming, r.msgs}).Int64Slice()
+	if err != nil {
+		return u, err
+	}
+
+	return usage{int(res[0]), res[1]}, nil
+}
@@ -0,0 +1,60 @@
+package emailq
+
+import (
+	"errors"
+	"testing"
+)
+
+// limit sets the quota of a queue from backends
+func limit(queue Queue, qt Quota) {
+	switch b := queue.(type) {
+	case *EmailQ:
+		b.quota = qt
+	case *Sharded:
+		b.quota = qt
+	case *Memory:
+		b.Quota = qt
+	case *Redis:
+		b.Quota = qt
+	case *SQL:
+		b.Quota = qt
+	}
+}
+
+func TestQuota(t *testing.T) {
+	for name, queue := range backends(t) {
+		limit(queue, Quota{MaxMessages: 2})
+
+		if err := queue.PushAll(ctx, []*Msg{createMsg(), createMsg(), createMsg()}); !errors.Is(err, ErrQueueFull) {
+			t.Fatal(name, "batch over the quota accepted:", err)
+		}
+		if queue.Length() != 0 {
+			t.Fatal(name, "refused batch partly queued:", queue.Length())
+		}
+
+		other := createMsg()
+		other.Host = "other"
+		if err := queue.PushAll(ctx, []*Msg{createMsg(), other}); err != nil {
+			t.Fatal(name, "error pushing:", err)
+		}
+		if err := queue.Push(ctx, createMsg()); !errors.Is(err, ErrQueueFull) {
+			t.Fatal(name, "message over the quota accepted:", err)
+		}
+
+		// popped messages are out for delivery and no longer count
+		if key, _, err := queue.Pop(ctx); err != nil || key == nil {
+			t.Fatal(name, "error popping:", err)
+		}
+		if err := queue.Push(ctx, createMsg()); err != nil {
+			t.Fatal(name, "error pushing after pop:", err)
+		}
+	}
+
+	for name, queue := range backends(t) {
+		limit(queue, Quota{MaxBytes: 1})
+
+		if err := queue.Push(ctx, createMsg()); !errors.Is(err, ErrQueueFull) {
+			t.Fatal(name, "message over the byte quota accepted:", err)
+		}
+	}
+}
@@ -0,0 +1,812 @@
+package emailq
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis keeps the queue in Redis so several instances can share it. Incoming, outgoing and
+// dead letters are sorted sets of message keys scored by due, pop and kill time in
+// milliseconds, the messages themselves live in a hash, their hosts in another and a third
+// marks those retried. Keys share a hash tag so the scripts moving messages between sets also
+// work on Redis Cluster.
+type Redis struct {
+	client redis.UniversalClient
+
+	incoming, outgoing, dead, archive, msgs, hosts, retried, paused, corrupt string
+
+	meter meter
+	turns turns
+	waker waker
+
+	// Stale is how long a message must have been out for delivery before Recover puts it
+	// back, zero recovers all of them. Instances sharing a queue need it to keep from
+	// taking over each other's deliveries.
+	Stale time.Duration
+
+	// These work as in Options
+	Backoff    BackoffFunc
+	MaxRetries int
+	TTL        time.Duration
+	Observer   Observer
+	Sealer     *Sealer
+	Blobs      BlobStore
+	BlobSize   int
+	Quota      Quota
+	HostLimit  int
+	Archive    Archive
+	Clock      Clock
+}
+
+// takeScript moves the keys ARGV[2...] still in incoming to outgoing scored ARGV[1], returns
+// the keys moved
+var takeScript = redis.NewScript(`
+local moved = {}
+for i = 2, #ARGV do
+	if redis.call('ZREM', KEYS[1], ARGV[i]) == 1 then
+		redis.call('ZADD', KEYS[2], ARGV[1], ARGV[i])
+		table.insert(moved, ARGV[i])
+	end
+end
+return moved
+`)
+
+// dueWindow is how many of the oldest due messages PopBatch looks at to take turns between
+// their hosts, and between fresh and retried ones
+const dueWindow = 10000
+
+// dueScript returns up to ARGV[2] of the oldest keys in incoming scored up to ARGV[1] whose
+// hosts aren't among ARGV[3...], walking past excluded ones in steps small enough to unpack
+var dueScript = redis.NewScript(`
+local skip = {}
+for i = 3, #ARGV do
+	skip[ARGV[i]] = true
+end
+local due, offset, window = {}, 0, tonumber(ARGV[2])
+while #due < window do
+	local keys = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', offset, 1000)
+	if #keys == 0 then
+		break
+	end
+	offset = offset + #keys
+	local hosts = redis.call('HMGET', KEYS[2], unpack(keys))
+	for i, k in ipairs(keys) do
+		if not (hosts[i] and skip[hosts[i]]) then
+			table.insert(due, k)
+			if #due == window then
+				break
+			end
+		end
+	end
+end
+return due
+`)
+
+// moveScript moves key ARGV[1] between sets scoring it ARGV[2], storing the message ARGV[3]
+// when given. Returns 0 when the key isn't in the source set.
+var moveScript = redis.NewScript(`
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+if ARGV[3] ~= '' then
+	redis.call('HSET', KEYS[3], ARGV[1], ARGV[3])
+end
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[1])
+return 1
+`)
+
+// updateScript stores message ARGV[2] under key ARGV[1] if the key is in the set
+var updateScript = redis.NewScript(`
+if not redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	return 0
+end
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+return 1
+`)
+
+// purgeScript drops dead letters scored before ARGV[1] unless it's 0, then all but the newest
+// ARGV[2] unless it's 0, with their messages, hosts and retried marks. Returns how many were
+// dropped.
+var purgeScript = redis.NewScript(`
+local purged = 0
+if tonumber(ARGV[1]) > 0 then
+	local keys = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[1])
+	for _, k in ipairs(keys) do
+		redis.call('HDEL', KEYS[2], k)
+		redis.call('HDEL', KEYS[3], k)
+		redis.call('HDEL', KEYS[4], k)
+	end
+	purged = purged + redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[1])
+end
+local excess = redis.call('ZCARD', KEYS[1]) - tonumber(ARGV[2])
+if tonumber(ARGV[2]) > 0 and excess > 0 then
+	local keys = redis.call('ZRANGE', KEYS[1], 0, excess - 1)
+	for _, k in ipairs(keys) do
+		redis.call('HDEL', KEYS[2], k)
+		redis.call('HDEL', KEYS[3], k)
+		redis.call('HDEL', KEYS[4], k)
+	end
+	purged = purged + redis.call('ZREMRANGEBYRANK', KEYS[1], 0, excess - 1)
+end
+return purged
+`)
+
+// NewRedis creates a queue in the Redis client connects to, keys start with prefix
+func NewRedis(client redis.UniversalClient, prefix string) *Redis {
+	tag := "{" + prefix + "}:"
+
+	return &Redis{
+		client:   client,
+		incoming: tag + "incoming",
+		outgoing: tag + "outgoing",
+		dead:     tag + "deadletter",
+		archive:  tag + "archive",
+		msgs:     tag + "msgs",
+		hosts:    tag + "hosts",
+		retried:  tag + "retried",
+		paused:   tag + "paused",
+		corrupt:  tag + "corrupt",
+	}
+}
+
+// OpenRedis connects to a redis:// or rediss:// URL, e.g. redis://localhost:6379/0
+func OpenRedis(url, prefix string) (*Redis, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	client := redis.NewClient(opts)
+	if err = client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return NewRedis(client, prefix), nil
+}
+
+// Close closes the client
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
+
+// Length returns Incoming queue length
+func (r *Redis) Length() int {
+	n, _ := r.client.ZCard(context.Background(), r.incoming).Result()
+	return int(n)
+}
+
+// Push messages to the queue, due now or at msg.NotBefore
+func (r *Redis) Push(ctx context.Context, msg *Msg) error {
+	return r.PushAll(ctx, []*Msg{msg})
+}
+
+// PushAll pushes msgs in a single MULTI/EXEC transaction, ErrQueueFull if they don't fit
+// the Quota. Instances pushing at the same time may go over it a little.
+func (r *Redis) PushAll(ctx context.Context, msgs []*Msg) error {
+	now := r.now().UTC()
+
+	keys := make([]string, len(msgs))
+	values, err := r.codec().encodeAll(msgs, now, r.MaxRetries, r.TTL)
+	if err != nil {
+		return err
+	}
+
+	if r.Quota.enabled() {
+		u, err := r.usage(ctx)
+		if err != nil {
+			return err
+		}
+		if err = r.Quota.admit(u, values); err != nil {
+			return err
+		}
+	}
+
+	_, err = r.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		for i, msg := range msgs {
+			keys[i] = uniqueKey(now)
+			p.HSet(ctx, r.msgs, keys[i], values[i])
+			p.HSet(ctx, r.hosts, keys[i], string(hostName(msg.Host)))
+			if msg.Retry > 0 {
+				p.HSet(ctx, r.retried, keys[i], 1)
+			}
+			p.ZAdd(ctx, r.incoming, redis.Z{Score: score(msg.due(now)), Member: keys[i]})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, msg := range msgs {
+		r.hooks().push([]byte(keys[i]), msg)
+	}
+	return nil
+}
+
+// Pop get next email from the queue
+func (r *Redis) Pop(ctx context.Context) (key []byte, msg *Msg, err error) {
+	batch, err := r.PopBatch(ctx, 1)
+	if err != nil || len(batch) == 0 {
+		return nil, nil, err
+	}
+
+	return batch[0].Key, batch[0].Msg, nil
+}
+
+// PopBatch gets up to n emails that are due for delivery taking turns between hosts and
+// skipping paused ones, expired ones are dead-lettered and values that don't decode set aside
+func (r *Redis) PopBatch(ctx context.Context, n int) ([]Delivery, error) {
+	keys, err := r.popFair(ctx, n)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+
+	// keys are out for delivery now, cancelling would leave them there until Recover
+	ctx = context.WithoutCancel(ctx)
+
+	values, err := r.client.HMGet(ctx, r.msgs, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	now := r.now()
+	t := taken{batch: make([]Delivery, 0, len(keys))}
+	for i, k := range keys {
+		v, _ := values[i].(string)
+
+		msg, err := decodeMsg([]byte(v))
+		if err != nil {
+			c := newCorrupt([]byte(k), []byte(v), err)
+			if err = r.setAside(ctx, c); err != nil {
+				return nil, err
+			}
+			t.corrupt = append(t.corrupt, c)
+			continue
+		}
+
+		if msg.expired(now) {
+			msg.DeadReason = ReasonExpired
+			if err = r.move(ctx, r.outgoing, r.dead, []byte(k), now, encode(msg)); err != nil {
+				return nil, err
+			}
+			t.dead = append(t.dead, Delivery{Key: []byte(k), Msg: msg})
+			continue
+		}
+
+		t.batch = append(t.batch, Delivery{Key: []byte(k), Msg: msg})
+	}
+
+	for _, c := range r.codec().openPopped(&t) {
+		if err = r.setAside(ctx, c); err != nil {
+			return nil, err
+		}
+	}
+
+	r.hooks().popped(t)
+	return t.batch, nil
+}
+
+// setAside moves a popped value that didn't decode or whose body can't be read out of the
+// queue
+func (r *Redis) setAside(ctx context.Context, c Corrupt) error {
+	_, err := r.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.ZRem(ctx, r.outgoing, string(c.Key))
+		p.HDel(ctx, r.msgs, string(c.Key))
+		p.HDel(ctx, r.hosts, string(c.Key))
+		p.HDel(ctx, r.retried, string(c.Key))
+		p.HSet(ctx, r.corrupt, string(c.Key), encodeCorrupt(c))
+		return nil
+	})
+
+	return err
+}
+
+// Corrupted lists the values set aside because they didn't decode, oldest first
+func (r *Redis) Corrupted() ([]Corrupt, error) {
+	values, err := r.client.HGetAll(context.Background(), r.corrupt).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Corrupt, 0, len(values))
+	for _, v := range values {
+		list = append(list, decodeCorrupt([]byte(v)))
+	}
+	sort.Slice(list, func(i, j int) bool { return string(list[i].Key) < string(list[j].Key) })
+
+	return list, nil
+}
+
+// DeleteCorrupt drops a value set aside
+func (r *Redis) DeleteCorrupt(key []byte) error {
+	return r.client.HDel(context.Background(), r.corrupt, string(key)).Err()
+}
+
+// popFair moves up to n of the dueWindow oldest due keys from incoming to outgoing, taking
+// turns between hosts. Paused hosts and those at HostLimit are left out of the window, a
+// backlog for them would otherwise fill it and keep everyone else waiting.
+func (r *Redis) popFair(ctx context.Context, n int) ([]string, error) {
+	paused, err := r.client.SMembers(ctx, r.paused).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	skip := make(map[string]bool)
+	for _, h := range paused {
+		skip[h] = true
+	}
+
+	var busy map[string]int
+	if r.HostLimit > 0 {
+		out, err := r.client.ZRange(ctx, r.outgoing, 0, -1).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		outHosts, err := r.hostsOf(ctx, out)
+		if err != nil {
+			return nil, err
+		}
+
+		busy = make(map[string]int)
+		for _, h := range outHosts {
+			busy[h]++
+			if busy[h] >= r.HostLimit {
+				skip[h] = true
+			}
+		}
+	}
+
+	now := score(r.now())
+	args := []interface{}{strconv.FormatFloat(now, 'f', -1, 64), dueWindow}
+	for h := range skip {
+		args = append(args, h)
+	}
+
+	due, err := dueScript.Run(ctx, r.client, []string{r.incoming, r.hosts}, args...).StringSlice()
+	if err != nil || len(due) == 0 {
+		return nil, err
+	}
+
+	hosts, err := r.hostsOf(ctx, due)
+	if err != nil {
+		return nil, err
+	}
+
+	retried, err := r.client.HMGet(ctx, r.retried, due...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	lanes := groupHosts(due, n, func(i int) (string, bool) {
+		if skip[hosts[i]] {
+			return "", false
+		}
+		return hosts[i], retried[i] != nil
+	})
+	r.turns.order(lanes, n)
+	keys := schedule(lanes, n, r.HostLimit, busy)
+	r.turns.took(lanes, keys)
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	// another instance may have taken some meanwhile
+	args = []interface{}{now}
+	for _, k := range keys {
+		args = append(args, k)
+	}
+
+	return takeScript.Run(ctx, r.client, []string{r.incoming, r.outgoing}, args...).StringSlice()
+}
+
+// hostsOf looks up the hosts of keys, as hostName has them
+func (r *Redis) hostsOf(ctx context.Context, keys []string) ([]string, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	values, err := r.client.HMGet(ctx, r.hosts, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := make([]string, len(keys))
+	for i, v := range values {
+		if h, ok := v.(string); ok {
+			hosts[i] = h
+			continue
+		}
+
+		// pushed before hosts were recorded
+		raw, err := r.client.HGet(ctx, r.msgs, keys[i]).Bytes()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		hosts[i] = string(hostName(hostOf(raw)))
+	}
+
+	return hosts, nil
+}
+
+// Retry takes msg from outgoing queue and schedules it again after the Backoff delay
+func (r *Redis) Retry(key []byte, cause error) error {
+	ctx := context.Background()
+
+	v, err := r.client.HGet(ctx, r.msgs, string(key)).Bytes()
+	if err == redis.Nil {
+		return notFound("outgoing")
+	}
+	if err != nil {
+		return err
+	}
+
+	now := r.now()
+	m := decode(v)
+	m.fail(now, cause)
+	m.Retry++
+	due := now.Add(r.Backoff.delay(m.Retry))
+
+	if err = r.move(ctx, r.outgoing, r.incoming, key, due, encode(m)); err != nil {
+		return err
+	}
+	if err = r.client.HSet(ctx, r.retried, string(key), 1).Err(); err != nil {
+		return err
+	}
+
+	r.hooks().retry(key, m, cause)
+	return nil
+}
+
+// MarkWarned records that the sender of msg in outgoing queue was notified about the delay
+func (r *Redis) MarkWarned(key []byte) error {
+	ctx := context.Background()
+
+	v, err := r.client.HGet(ctx, r.msgs, string(key)).Bytes()
+	if err == redis.Nil {
+		return notFound("outgoing")
+	}
+	if err != nil {
+		return err
+	}
+
+	m := decode(v)
+	m.Warned = true
+
+	ok, err := updateScript.Run(ctx, r.client, []string{r.outgoing, r.msgs}, string(key), encode(m)).Int()
+	if err == nil && ok == 0 {
+		err = notFound("outgoing")
+	}
+
+	return err
+}
+
+// Kill takes msg out of outgoing and pushed that to Dead Letter queue, recording cause as
+// its last attempt
+func (r *Redis) Kill(key []byte, cause error) error {
+	ctx := context.Background()
+
+	v, err := r.client.HGet(ctx, r.msgs, string(key)).Bytes()
+	if err == redis.Nil {
+		return notFound("outgoing")
+	}
+	if err != nil {
+		return err
+	}
+
+	now := r.now()
+	m := decode(v)
+	m.kill(now, cause)
+
+	if err = r.move(ctx, r.outgoing, r.dead, key, now, encode(m)); err != nil {
+		return err
+	}
+
+	r.hooks().kill(key, m, cause)
+	return nil
+}
+
+// RemoveDelivered removes successfully delivered message
+func (r *Redis) RemoveDelivered(key []byte) error {
+	ctx := context.Background()
+	if r.Archive != ArchiveOff {
+		if err := r.archiveMsg(ctx, key); err != nil {
+			return err
+		}
+
+		r.hooks().delivered(key)
+		return nil
+	}
+
+	_, err := r.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.ZRem(ctx, r.outgoing, string(key))
+		p.HDel(ctx, r.msgs, string(key))
+		p.HDel(ctx, r.hosts, string(key))
+		p.HDel(ctx, r.retried, string(key))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.hooks().delivered(key)
+	return nil
+}
+
+// Recover requeues outgoing emails that were interrupted as EmailQ.Recover does, see Stale
+func (r *Redis) Recover() error {
+	ctx := context.Background()
+	now := r.now()
+
+	keys, err := r.client.ZRangeByScore(ctx, r.outgoing, &redis.ZRangeBy{Min: "-inf", Max: strconv.FormatFloat(score(now.Add(-r.Stale)), 'f', -1, 64)}).Result()
+	if err != nil {
+		return err
+	}
+
+	var rec recovered
+	defer func() { rec.report(r.hooks()) }()
+
+	for _, k := range keys {
+		v, err := r.client.HGet(ctx, r.msgs, k).Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		m := decode(v)
+		retry := m.interrupt(now)
+
+		to, at := r.dead, now
+		if retry {
+			to, at = r.incoming, now.Add(r.Backoff.delay(m.Retry))
+		}
+
+		// another instance may have recovered it meanwhile
+		ok, err := r.transfer(ctx, r.outgoing, to, []byte(k), at, encode(m))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if retry {
+			if err = r.client.HSet(ctx, r.retried, k, 1).Err(); err != nil {
+				return err
+			}
+		}
+		rec.add([]byte(k), m, retry)
+	}
+
+	return nil
+}
+
+// PurgeDead drops dead letters older than retention and all but the newest keep, zero
+// retention or keep doesn't limit by that. Returns how many were dropped.
+func (r *Redis) PurgeDead(retention time.Duration, keep int) (int, error) {
+	var cutoff float64
+	if retention > 0 {
+		cutoff = score(r.now().Add(-retention))
+	}
+
+	return purgeScript.Run(context.Background(), r.client, []string{r.dead, r.msgs, r.hosts, r.retried}, cutoff, keep).Int()
+}
+
+// ListPending pages through messages waiting for delivery in key order
+func (r *Redis) ListPending(ctx context.Context, f Filter) ([]Delivery, error) {
+	return r.list(ctx, r.incoming, f)
+}
+
+// ListDead pages through dead letters in key order
+func (r *Redis) ListDead(ctx context.Context, f Filter) ([]Delivery, error) {
+	return r.list(ctx, r.dead, f)
+}
+
+func (r *Redis) list(ctx context.Context, set string, f Filter) (page []Delivery, err error) {
+	keys, err := r.client.ZRange(ctx, set, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if len(page) == f.limit() {
+			break
+		}
+
+		if f.After != nil && k <= string(f.After) {
+			continue
+		}
+
+		v, err := r.client.HGet(ctx, r.msgs, k).Bytes()
+		if err == redis.Nil {
+			continue // delivered meanwhile
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if msg := decode(v); f.match([]byte(k), msg) {
+			page = append(page, Delivery{Key: []byte(k), Msg: msg})
+		}
+	}
+
+	return page, r.codec().open(page)
+}
+
+// PauseHost holds back delivery of all messages for host until ResumeHost
+func (r *Redis) PauseHost(host string) error {
+	return r.client.SAdd(context.Background(), r.paused, strings.ToLower(host)).Err()
+}
+
+// ResumeHost lets messages for host be popped again
+func (r *Redis) ResumeHost(host string) error {
+	defer r.waker.wake()
+
+	return r.client.SRem(context.Background(), r.paused, strings.ToLower(host)).Err()
+}
+
+// PausedHosts lists the hosts delivery is paused for
+func (r *Redis) PausedHosts() ([]string, error) {
+	hosts, err := r.client.SMembers(context.Background(), r.paused).Result()
+	sort.Strings(hosts)
+	return hosts, err
+}
+
+// RetryDead queues the dead letters f selects for delivery again with their retries reset
+func (r *Redis) RetryDead(ctx context.Context, f Filter) (int, error) {
+	defer r.waker.wake()
+
+	return bulk(ctx, r.ListDead, f, func(keys [][]byte) (int, error) {
+		n, err := r.transferAll(keys, r.dead, r.incoming, (*Msg).revive)
+		if err != nil {
+			return n, err
+		}
+
+		// fresh again with their retries reset
+		fields := make([]string, len(keys))
+		for i, k := range keys {
+			fields[i] = string(k)
+		}
+		return n, r.client.HDel(context.Background(), r.retried, fields...).Err()
+	})
+}
+
+// KillPending moves the pending messages f selects to the dead letter queue
+func (r *Redis) KillPending(ctx context.Context, f Filter) (int, error) {
+	return bulk(ctx, r.ListPending, f, func(keys [][]byte) (int, error) {
+		return r.transferAll(keys, r.incoming, r.dead, func(m *Msg) { m.DeadReason = ReasonKilled })
+	})
+}
+
+// DeletePending drops the pending messages f selects
+func (r *Redis) DeletePending(ctx context.Context, f Filter) (int, error) {
+	return bulk(ctx, r.ListPending, f, r.deleter(r.incoming))
+}
+
+// DeleteDead drops the dead letters f selects
+func (r *Redis) DeleteDead(ctx context.Context, f Filter) (int, error) {
+	return bulk(ctx, r.ListDead, f, r.deleter(r.dead))
+}
+
+// transferAll moves keys between sets, rewriting each message with fn. Keys no longer in
+// the source set are skipped.
+func (r *Redis) transferAll(keys [][]byte, from, to string, fn func(m *Msg)) (n int, err error) {
+	ctx := context.Background()
+	now := r.now()
+
+	for _, k := range keys {
+		v, err := r.client.HGet(ctx, r.msgs, string(k)).Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+
+		m := decode(v)
+		fn(m)
+
+		ok, err := r.transfer(ctx, from, to, k, now, encode(m))
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (r *Redis) deleter(set string) func(keys [][]byte) (int, error) {
+	return func(keys [][]byte) (int, error) {
+		ctx := context.Background()
+
+		members := make([]interface{}, len(keys))
+		fields := make([]string, len(keys))
+		for i, k := range keys {
+			members[i], fields[i] = string(k), string(k)
+		}
+
+		var removed *redis.IntCmd
+		_, err := r.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			removed = p.ZRem(ctx, set, members...)
+			p.HDel(ctx, r.msgs, fields...)
+			p.HDel(ctx, r.hosts, fields...)
+			p.HDel(ctx, r.retried, fields...)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		return int(removed.Val()), nil
+	}
+}
+
+func (r *Redis) move(ctx context.Context, from, to string, key []byte, at time.Time, value []byte) error {
+	ok, err := r.transfer(ctx, from, to, key, at, value)
+	if err == nil && !ok {
+		err = notFound("outgoing")
+	}
+
+	return err
+}
+
+// transfer moves key between sets scored at, storing value if not nil. Reports whether key
+// was in the source set.
+func (r *Redis) transfer(ctx context.Context, from, to string, key []byte, at time.Time, value []byte) (bool, error) {
+	ok, err := moveScript.Run(ctx, r.client, []string{from, to, r.msgs}, string(key), score(at), value).Int()
+	return ok == 1, err
+}
+
+// nextDue is the score of the first message in incoming, popped ones are in outgoing
+func (r *Redis) nextDue() (time.Time, error) {
+	first, err := r.client.ZRangeWithScores(context.Background(), r.incoming, 0, 0).Result()
+	if err != nil || len(first) == 0 {
+		return time.Time{}, err
+	}
+
+	return time.UnixMilli(int64(first[0].Score)), nil
+}
+
+// score is t in milliseconds, float64 holds those exactly
+func score(t time.Time) float64 {
+	return float64(t.UnixMilli())
+}
+
+func (r *Redis) codec() codec {
+	return codec{r.Sealer, r.Blobs, r.BlobSize}
+}
+
+func (r *Redis) hooks() hooks {
+	return hooks{r.Observer, &r.meter, &r.waker}
+}
+
+// CollectBlobs deletes blobs of delivered and purged messages, see EmailQ.CollectBlobs
+func (r *Redis) CollectBlobs(grace time.Duration) (int, error) {
+	ctx := context.Background()
+	refs := make(map[string]bool)
+
+	iter := r.client.HScan(ctx, r.msgs, 0, "", 0).Iterator()
+	for iter.Next(ctx) {
+		// keys and values alternate
+		if !iter.Next(ctx) {
+			break
+		}
+		addRef(refs, []byte(iter.Val()))
+	}
+	if err := iter.Err(); err != nil {
+		return 0, err
+	}
+
+	return collect(r.Blobs, grace, refs)
+}
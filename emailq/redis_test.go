@@ -0,0 +1,101 @@
+package emailq
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisFlow(t *testing.T) {
+	mr := miniredis.RunT(t)
+	r := NewRedis(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "test")
+	defer r.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := r.Push(ctx, createMsg()); err != nil {
+			t.Fatal("Error pushing:", err)
+		}
+	}
+
+	if r.Length() != 3 {
+		t.Fatal("Expected 3 messages, got", r.Length())
+	}
+
+	batch, err := r.PopBatch(ctx, 2)
+	if err != nil || len(batch) != 2 {
+		t.Fatal("Error popping batch:", len(batch), err)
+	}
+	if batch[0].Msg.From != "from" || string(batch[0].Key) >= string(batch[1].Key) {
+		t.Fatal("Unexpected batch:", batch[0].Msg, string(batch[0].Key), string(batch[1].Key))
+	}
+
+	if err = r.MarkWarned(batch[0].Key); err != nil {
+		t.Fatal("Error marking warned:", err)
+	}
+	if err = r.Retry(batch[0].Key, nil); err != nil {
+		t.Fatal("Error retrying:", err)
+	}
+	if err = r.Retry(batch[0].Key, nil); err == nil {
+		t.Fatal("Retried a message that isn't out for delivery")
+	}
+
+	if err = r.Kill(batch[1].Key, nil); err != nil {
+		t.Fatal("Error killing:", err)
+	}
+
+	key, msg, err := r.Pop(ctx)
+	if err != nil || key == nil {
+		t.Fatal("Error popping:", err)
+	}
+	if msg.Retry != 0 {
+		t.Fatal("Retry popped before its time")
+	}
+
+	// interrupted delivery goes back to incoming
+	if err = r.Recover(); err != nil {
+		t.Fatal("Error recovering:", err)
+	}
+	if r.Length() != 2 {
+		t.Fatal("Expected 2 messages after recover, got", r.Length())
+	}
+
+	// the recovered message waits like the retried one, due in a minute
+	if k, _, _ := r.Pop(ctx); k != nil {
+		t.Fatal("Retry popped before its time")
+	}
+
+	v, _ := r.client.HGet(context.Background(), r.msgs, string(key)).Bytes()
+	if m := decode(v); m.Retry != 1 || m.LastError != errInterrupted.Error() {
+		t.Fatal("Interruption not recorded:", m)
+	}
+
+	n, _ := r.client.ZCard(context.Background(), r.dead).Result()
+	if n != 1 {
+		t.Fatal("Expected 1 dead letter, got", n)
+	}
+}
+
+func TestRedisPausedBacklog(t *testing.T) {
+	mr := miniredis.RunT(t)
+	r := NewRedis(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "test")
+	defer r.Close()
+
+	var backlog []*Msg
+	for i := 0; i <= dueWindow; i++ {
+		msg := createMsg()
+		msg.Host = "gmail.com"
+		backlog = append(backlog, msg)
+	}
+	if err := r.PushAll(ctx, backlog); err != nil {
+		t.Fatal("Error pushing:", err)
+	}
+	r.Push(ctx, createMsg())
+	r.PauseHost("gmail.com")
+
+	batch, err := r.PopBatch(ctx, 10)
+	if err != nil || len(batch) != 1 || batch[0].Msg.Host != "host" {
+		t.Fatal("Paused backlog starved other hosts:", len(batch), err)
+	}
+}
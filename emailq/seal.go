@@ -0,0 +1,82 @@
+package emailq
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// Sealer encrypts message bodies at rest with AES-256-GCM. Data is sealed on Push and
+// opened again before messages are handed out, so consumers of the queue never see the
+// ciphertext. Messages queued before the Sealer was set are read as they are.
+type Sealer struct {
+	aead cipher.AEAD
+}
+
+// NewSealer takes a 32 byte key, e.g. a data key unwrapped by a KMS
+func NewSealer(key []byte) (*Sealer, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("Encryption key must be 32 bytes, got %v", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sealer{aead: aead}, nil
+}
+
+// LoadKey creates a Sealer from a file holding 32 raw bytes or 64 hex digits
+func LoadKey(path string) (*Sealer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if text := bytes.TrimSpace(b); len(text) == 64 {
+		if key, err := hex.DecodeString(string(text)); err == nil {
+			b = key
+		}
+	}
+
+	return NewSealer(b)
+}
+
+// seal encrypts data under a fresh nonce it's prefixed with
+func (s *Sealer) seal(data []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return s.aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// open decrypts Data of message key sealed by seal
+func (s *Sealer) open(key, data []byte) ([]byte, error) {
+	if s == nil {
+		return nil, fmt.Errorf("Message %s is encrypted and no key is set", key)
+	}
+
+	n := s.aead.NonceSize()
+	if len(data) < n {
+		return nil, fmt.Errorf("%w %s: too short to decrypt", ErrCorrupt, key)
+	}
+
+	plain, err := s.aead.Open(nil, data[:n], data[n:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("Can't decrypt message %s: %v", key, err)
+	}
+
+	return plain, nil
+}
@@ -0,0 +1,105 @@
+package emailq
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// seal sets the Sealer of a queue from backends
+func seal(queue Queue, s *Sealer) {
+	switch b := queue.(type) {
+	case *EmailQ:
+		b.codec.sealer = s
+	case *Sharded:
+		for _, shard := range b.shards {
+			shard.codec.sealer = s
+		}
+	case *Memory:
+		b.Sealer = s
+	case *Redis:
+		b.Sealer = s
+	case *SQL:
+		b.Sealer = s
+	}
+}
+
+func TestSealer(t *testing.T) {
+	if _, err := NewSealer([]byte("short")); err == nil {
+		t.Fatal("Expected error for a short key")
+	}
+
+	key := bytes.Repeat([]byte{7}, 32)
+	s, _ := NewSealer(key)
+	other, _ := NewSealer(bytes.Repeat([]byte{8}, 32))
+
+	for name, queue := range backends(t) {
+		legacy := createMsg()
+		legacy.Data = []byte("queued in the clear")
+		queue.Push(ctx, legacy)
+
+		seal(queue, s)
+		msg := createMsg()
+		msg.Data = []byte("Subject: secret")
+		if err := queue.Push(ctx, msg); err != nil {
+			t.Fatal(name, "error pushing:", err)
+		}
+		if msg.Sealed || string(msg.Data) != "Subject: secret" {
+			t.Fatal(name, "pushed message was changed")
+		}
+
+		seal(queue, nil)
+		if _, err := queue.(lister).ListPending(ctx, Filter{}); err == nil {
+			t.Fatal(name, "sealed message read without the key")
+		}
+
+		seal(queue, other)
+		if _, err := queue.(lister).ListPending(ctx, Filter{}); err == nil {
+			t.Fatal(name, "sealed message read with the wrong key")
+		}
+
+		seal(queue, s)
+		batch, err := queue.PopBatch(ctx, 10)
+		if err != nil || len(batch) != 2 {
+			t.Fatal(name, "error popping:", len(batch), err)
+		}
+
+		got := map[string]bool{}
+		for _, d := range batch {
+			got[string(d.Msg.Data)] = !d.Msg.Sealed
+		}
+		if !got["queued in the clear"] || !got["Subject: secret"] {
+			t.Fatal(name, "unexpected bodies:", got)
+		}
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	dir, err := os.MkdirTemp("", "emailq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	raw := filepath.Join(dir, "raw.key")
+	os.WriteFile(raw, bytes.Repeat([]byte{1}, 32), 0600)
+
+	text := filepath.Join(dir, "hex.key")
+	os.WriteFile(text, []byte("0101010101010101010101010101010101010101010101010101010101010101\n"), 0600)
+
+	a, err := LoadKey(raw)
+	if err != nil {
+		t.Fatal("Error loading raw key:", err)
+	}
+	b, err := LoadKey(text)
+	if err != nil {
+		t.Fatal("Error loading hex key:", err)
+	}
+
+	v, _ := codec{sealer: a}.encode(&Msg{Data: []byte("hello")})
+	msg := []Delivery{{Key: []byte("k"), Msg: decode(v)}}
+	if err = (codec{sealer: b}).open(msg); err != nil || string(msg[0].Msg.Data) != "hello" {
+		t.Fatal("Keys from raw and hex files differ:", err)
+	}
+}
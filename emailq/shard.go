@@ -0,0 +1,298 @@
+package emailq
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/mail"
+	"sort"
+	"sync"
+)
+
+// Sharded spreads the queue across several bolt files. Bolt serializes writes through
+// a single lock per file, sharding lets concurrent daemon sessions push in parallel.
+type Sharded struct {
+	shards    []*EmailQ
+	quota     Quota // across all shards
+	hostLimit int
+	turns     turns
+	waker     waker
+
+	mu       sync.Mutex
+	inflight map[string]*EmailQ // popped keys and the shard they came from
+}
+
+// NewSharded creates n bolt files named filepath.0 ... filepath.n-1, opts may be nil
+func NewSharded(filepath string, n int, opts *Options) (*Sharded, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("Invalid number of shards: %v", n)
+	}
+
+	s := &Sharded{
+		inflight: make(map[string]*EmailQ),
+	}
+
+	if opts != nil {
+		s.hostLimit = opts.HostLimit
+	}
+
+	// shards leave the quota to PushAll
+	if opts != nil && opts.Quota.enabled() {
+		shardOpts := *opts
+		s.quota, shardOpts.Quota = opts.Quota, Quota{}
+		opts = &shardOpts
+	}
+
+	for i := 0; i < n; i++ {
+		q, err := New(fmt.Sprintf("%s.%d", filepath, i), opts)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		// wake the subscriptions of all shards
+		q.hooks.w = &s.waker
+		s.shards = append(s.shards, q)
+	}
+
+	return s, nil
+}
+
+// Close closes all shards
+func (s *Sharded) Close() (err error) {
+	for _, q := range s.shards {
+		if e := q.Close(); e != nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// Length returns Incoming queue length across all shards
+func (s *Sharded) Length() (count int) {
+	for _, q := range s.shards {
+		count += q.Length()
+	}
+
+	return count
+}
+
+// Push messages to the shard picked by hashing the Message-ID
+func (s *Sharded) Push(ctx context.Context, msg *Msg) error {
+	return s.PushAll(ctx, []*Msg{msg})
+}
+
+// PushAll pushes msgs grouped by shard. Messages split from one submission share the
+// Message-ID and so the shard, making that a single transaction. The quota is checked
+// against the other shards as they are before each transaction.
+func (s *Sharded) PushAll(ctx context.Context, msgs []*Msg) error {
+	byShard := make(map[int][]*Msg)
+	for _, msg := range msgs {
+		i := s.shardFor(msg)
+		byShard[i] = append(byShard[i], msg)
+	}
+
+	for i, m := range byShard {
+		if err := s.shards[i].pushAll(ctx, m, s.quota, s.usage(i)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// usage adds up the incoming queues of all shards but skip, nothing if there's no quota
+func (s *Sharded) usage(skip int) (u usage) {
+	if !s.quota.enabled() {
+		return u
+	}
+
+	for i, q := range s.shards {
+		if i != skip {
+			u = u.add(q.usage())
+		}
+	}
+
+	return u
+}
+
+// shardFor picks the shard of a new message by hashing its Message-ID
+func (s *Sharded) shardFor(msg *Msg) int {
+	h := fnv.New32a()
+	h.Write(messageID(msg))
+
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+// Pop get next email across all shards
+func (s *Sharded) Pop(ctx context.Context) (key []byte, msg *Msg, err error) {
+	batch, err := s.PopBatch(ctx, 1)
+	if err != nil || len(batch) == 0 {
+		return nil, nil, err
+	}
+
+	return batch[0].Key, batch[0].Msg, nil
+}
+
+// PopBatch gets up to n due emails, taking turns between hosts across all shards
+func (s *Sharded) PopBatch(ctx context.Context, n int) ([]Delivery, error) {
+	shardOf := make(map[string]*EmailQ)
+	byHost := make(map[string]*hostKeys)
+	busy := make(map[string]int)
+
+	for _, q := range s.shards {
+		hosts, out, err := q.candidates(ctx, n, s.hostLimit > 0)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, h := range hosts {
+			for _, k := range append(h.fresh, h.retried...) {
+				shardOf[k] = q
+			}
+
+			if m, ok := byHost[h.host]; ok {
+				m.fresh, m.retried = append(m.fresh, h.fresh...), append(m.retried, h.retried...)
+			} else {
+				byHost[h.host] = &hostKeys{host: h.host, fresh: h.fresh, retried: h.retried}
+			}
+		}
+
+		for host, c := range out {
+			busy[host] += c
+		}
+	}
+
+	hosts := make([]hostKeys, 0, len(byHost))
+	for _, h := range byHost {
+		sort.Strings(h.fresh)
+		sort.Strings(h.retried)
+		h.fresh, h.retried = h.fresh[:min(n, len(h.fresh))], h.retried[:min(n, len(h.retried))]
+		h.keyed()
+		hosts = append(hosts, *h)
+	}
+	byOldest(hosts)
+	s.turns.order(hosts, n)
+
+	chosen := schedule(hosts, n, s.hostLimit, busy)
+	s.turns.took(hosts, chosen)
+
+	// group chosen keys by shard preserving order
+	byShard := make(map[*EmailQ][][]byte)
+	for _, k := range chosen {
+		byShard[shardOf[k]] = append(byShard[shardOf[k]], []byte(k))
+	}
+
+	var batch []Delivery
+	for q, keys := range byShard {
+		taken, err := q.takeKeys(ctx, keys)
+		if err != nil {
+			return nil, err
+		}
+
+		s.mu.Lock()
+		for _, d := range taken {
+			s.inflight[string(d.Key)] = q
+		}
+		s.mu.Unlock()
+
+		batch = append(batch, taken...)
+	}
+
+	sort.Slice(batch, func(i, j int) bool {
+		return bytes.Compare(batch[i].Key, batch[j].Key) < 0
+	})
+
+	return batch, nil
+}
+
+// Retry places msg back in the incoming queue of its shard
+func (s *Sharded) Retry(key []byte, cause error) error {
+	return s.done(key, func(q *EmailQ, key []byte) error {
+		return q.Retry(key, cause)
+	})
+}
+
+// MarkWarned records the delay warning on msg in its shard
+func (s *Sharded) MarkWarned(key []byte) error {
+	q, err := s.shardOf(key)
+	if err != nil {
+		return err
+	}
+
+	return q.MarkWarned(key)
+}
+
+// Kill moves msg to the Dead Letter queue of its shard
+func (s *Sharded) Kill(key []byte, cause error) error {
+	return s.done(key, func(q *EmailQ, key []byte) error {
+		return q.Kill(key, cause)
+	})
+}
+
+// RemoveDelivered removes successfully delivered message from its shard
+func (s *Sharded) RemoveDelivered(key []byte) error {
+	return s.done(key, (*EmailQ).RemoveDelivered)
+}
+
+// Recover re-queues interrupted emails in all shards
+func (s *Sharded) Recover() error {
+	for _, q := range s.shards {
+		if err := q.Recover(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// done applies fn to the shard holding key and forgets the key
+func (s *Sharded) done(key []byte, fn func(*EmailQ, []byte) error) error {
+	q, err := s.shardOf(key)
+	if err != nil {
+		return err
+	}
+
+	if err = fn(q, key); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.inflight, string(key))
+	s.mu.Unlock()
+
+	return nil
+}
+
+// shardOf finds the shard holding popped key, falling back to a scan of the leases
+func (s *Sharded) shardOf(key []byte) (*EmailQ, error) {
+	s.mu.Lock()
+	q, ok := s.inflight[string(key)]
+	s.mu.Unlock()
+
+	if ok {
+		return q, nil
+	}
+
+	for _, q := range s.shards {
+		if q.isLeased(key) {
+			return q, nil
+		}
+	}
+
+	return nil, errNotLeased
+}
+
+// messageID returns the Message-ID header, or the whole message when there is none
+func messageID(msg *Msg) []byte {
+	m, err := mail.ReadMessage(bytes.NewReader(msg.Data))
+	if err == nil {
+		if id := m.Header.Get("Message-Id"); id != "" {
+			return []byte(id)
+		}
+	}
+
+	return append([]byte(msg.From), msg.Data...)
+}
@@ -0,0 +1,64 @@
+package emailq
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShardedFlow(t *testing.T) {
+	dir, err := os.MkdirTemp("", "emailq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewSharded(filepath.Join(dir, "test.db"), 4, nil)
+	if err != nil {
+		t.Fatal("Error creating sharded queue:", err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		msg := createMsg()
+		msg.Data = []byte("Message-ID: <" + string(rune('a'+i)) + "@example.com>\r\n\r\nbody\r\n")
+
+		if err = s.Push(ctx, msg); err != nil {
+			t.Fatal("Error pushing:", err)
+		}
+	}
+
+	if s.Length() != 10 {
+		t.Fatal("Expected 10 messages, got", s.Length())
+	}
+
+	batch, err := s.PopBatch(ctx, 6)
+	if err != nil || len(batch) != 6 {
+		t.Fatal("Error popping batch:", len(batch), err)
+	}
+
+	for i := 1; i < len(batch); i++ {
+		if string(batch[i-1].Key) > string(batch[i].Key) {
+			t.Fatal("Batch is not merged in key order")
+		}
+	}
+
+	for _, d := range batch {
+		if err = s.RemoveDelivered(d.Key); err != nil {
+			t.Fatal("Error removing delivered:", err)
+		}
+	}
+
+	key, _, err := s.Pop(ctx)
+	if err != nil || key == nil {
+		t.Fatal("Error popping:", err)
+	}
+
+	if err = s.Kill(key, nil); err != nil {
+		t.Fatal("Error killing:", err)
+	}
+
+	if s.Length() != 3 {
+		t.Fatal("Expected 3 messages, got", s.Length())
+	}
+}
@@ -0,0 +1,168 @@
+package emailq
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Size is how many messages a state of the queue holds and how many bytes they take
+type Size struct {
+	Messages int
+	Bytes    int64
+}
+
+// Sizes break down what a queue holds by state, for alerting on what fills the disk and not
+// just on how many messages there are. Bytes are as stored, encrypted and without bodies
+// kept in Blobs. Bolt counts the pages values take including its own headers, other queues
+// the values.
+type Sizes struct {
+	Pending     Size // waiting for delivery
+	Outgoing    Size // out for delivery
+	Dead        Size
+	Quarantined Size
+	Archived    Size
+	Corrupt     Size
+}
+
+func (u usage) size() Size {
+	return Size{u.count, u.bytes}
+}
+
+func (s Size) add(o Size) Size {
+	return Size{s.Messages + o.Messages, s.Bytes + o.Bytes}
+}
+
+// Total adds up all states
+func (s Sizes) Total() Size {
+	return s.Pending.add(s.Outgoing).add(s.Dead).add(s.Quarantined).add(s.Archived).add(s.Corrupt)
+}
+
+func (s Sizes) add(o Sizes) Sizes {
+	return Sizes{
+		Pending:     s.Pending.add(o.Pending),
+		Outgoing:    s.Outgoing.add(o.Outgoing),
+		Dead:        s.Dead.add(o.Dead),
+		Quarantined: s.Quarantined.add(o.Quarantined),
+		Archived:    s.Archived.add(o.Archived),
+		Corrupt:     s.Corrupt.add(o.Corrupt),
+	}
+}
+
+// Sizes reports what each bucket holds, messages out for delivery are in incoming but
+// counted apart
+func (q *EmailQ) Sizes() (s Sizes, err error) {
+	err = q.view(func(tx *bolt.Tx) error {
+		out := leasedUsage(tx, q.now())
+
+		s.Pending = bucketUsage(tx.Bucket(incomingBucket)).sub(out).size()
+		s.Outgoing = out.size()
+		s.Dead = bucketUsage(tx.Bucket(deadBucket)).size()
+		s.Quarantined = bucketUsage(tx.Bucket(quarantineBucket)).size()
+		s.Archived = bucketUsage(tx.Bucket(archiveBucket)).size()
+		s.Corrupt = bucketUsage(tx.Bucket(corruptBucket)).size()
+		return nil
+	})
+
+	return s, err
+}
+
+// Sizes adds up the Sizes of all shards
+func (s *Sharded) Sizes() (total Sizes, err error) {
+	for _, q := range s.shards {
+		sz, err := q.Sizes()
+		if err != nil {
+			return total, err
+		}
+		total = total.add(sz)
+	}
+
+	return total, nil
+}
+
+// Sizes reports what the queue holds
+func (m *Memory) Sizes() (s Sizes, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries := func(entries map[string]memEntry) (sz Size) {
+		for _, e := range entries {
+			sz = sz.add(Size{1, int64(len(e.msg))})
+		}
+		return sz
+	}
+
+	s.Pending, s.Dead, s.Archived = entries(m.incoming), entries(m.dead), entries(m.archive)
+	for _, v := range m.outgoing {
+		s.Outgoing = s.Outgoing.add(Size{1, int64(len(v))})
+	}
+	for _, c := range m.corrupt {
+		s.Corrupt = s.Corrupt.add(Size{1, int64(len(c.Raw))})
+	}
+
+	return s, nil
+}
+
+// hashUsageScript adds up the size of the values of a hash
+var hashUsageScript = redis.NewScript(`
+local values = redis.call('HVALS', KEYS[1])
+local bytes = 0
+for _, v in ipairs(values) do
+	bytes = bytes + #v
+end
+return {#values, bytes}
+`)
+
+// Sizes reports what each set holds, walking them in scripts that block Redis meanwhile
+func (r *Redis) Sizes() (s Sizes, err error) {
+	ctx := context.Background()
+
+	for _, set := range []struct {
+		key  string
+		size *Size
+	}{{r.incoming, &s.Pending}, {r.outgoing, &s.Outgoing}, {r.dead, &s.Dead}, {r.archive, &s.Archived}} {
+		res, err := usageScript.Run(ctx, r.client, []string{set.key, r.msgs}).Int64Slice()
+		if err != nil {
+			return s, err
+		}
+		*set.size = Size{int(res[0]), res[1]}
+	}
+
+	res, err := hashUsageScript.Run(ctx, r.client, []string{r.corrupt}).Int64Slice()
+	if err != nil {
+		return s, err
+	}
+	s.Corrupt = Size{int(res[0]), res[1]}
+
+	return s, nil
+}
+
+// Sizes reports what each state holds
+func (s *SQL) Sizes() (sz Sizes, err error) {
+	rows, err := s.db.Query(s.query(`SELECT state, COUNT(*), COALESCE(SUM(LENGTH(msg)), 0) FROM scalemail_queue GROUP BY state`))
+	if err != nil {
+		return sz, err
+	}
+	defer rows.Close()
+
+	states := map[string]*Size{
+		stateIncoming: &sz.Pending,
+		stateOutgoing: &sz.Outgoing,
+		stateDead:     &sz.Dead,
+		stateArchived: &sz.Archived,
+		stateCorrupt:  &sz.Corrupt,
+	}
+	for rows.Next() {
+		var state string
+		var n Size
+		if err = rows.Scan(&state, &n.Messages, &n.Bytes); err != nil {
+			return sz, err
+		}
+		if p, ok := states[state]; ok {
+			*p = n
+		}
+	}
+
+	return sz, rows.Err()
+}
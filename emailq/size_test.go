@@ -0,0 +1,45 @@
+package emailq
+
+import (
+	"errors"
+	"testing"
+)
+
+type sizer interface {
+	Sizes() (Sizes, error)
+}
+
+func TestSizes(t *testing.T) {
+	for name, queue := range backends(t) {
+		s, ok := queue.(sizer)
+		if !ok {
+			t.Fatal(name, "doesn't report sizes")
+		}
+
+		for i := 0; i < 3; i++ {
+			queue.Push(ctx, createMsg())
+		}
+		key, _, _ := queue.Pop(ctx)
+		dead, _, _ := queue.Pop(ctx)
+		queue.Kill(dead, errors.New("550 No such user"))
+
+		sz, err := s.Sizes()
+		if err != nil {
+			t.Fatal(name, "error reading sizes:", err)
+		}
+		if sz.Pending.Messages != 1 || sz.Outgoing.Messages != 1 || sz.Dead.Messages != 1 {
+			t.Fatal(name, "unexpected message counts:", sz)
+		}
+		if sz.Pending.Bytes <= 0 || sz.Outgoing.Bytes <= 0 || sz.Dead.Bytes <= 0 {
+			t.Fatal(name, "bytes not counted:", sz)
+		}
+		if total := sz.Total(); total.Messages != 3 || total.Bytes < sz.Pending.Bytes+sz.Outgoing.Bytes {
+			t.Fatal(name, "unexpected total:", total)
+		}
+
+		queue.RemoveDelivered(key)
+		if sz, _ = s.Sizes(); sz.Outgoing != (Size{}) {
+			t.Fatal(name, "delivered message still counted:", sz.Outgoing)
+		}
+	}
+}
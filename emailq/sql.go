@@ -0,0 +1,859 @@
+package emailq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// message states in the queue table
+const (
+	stateIncoming = "incoming"
+	stateOutgoing = "outgoing"
+	stateDead     = "deadletter"
+	stateCorrupt  = "corrupt" // msg holds the Corrupt record
+	stateArchived = "archived"
+)
+
+// dialect covers the differences between the databases SQL runs on
+type dialect struct {
+	blob       string // column type of the encoded message
+	skipLocked string // row locking clause of the pop query
+	numbered   bool   // placeholders are $1, $2... instead of ?
+}
+
+// dialects by driver name, SQLite locks the whole database for writes anyway
+var dialects = map[string]dialect{
+	"postgres": {blob: "BYTEA", skipLocked: " FOR UPDATE SKIP LOCKED", numbered: true},
+	"mysql":    {blob: "LONGBLOB", skipLocked: " FOR UPDATE SKIP LOCKED"},
+	"sqlite3":  {blob: "BLOB"},
+}
+
+// SQL keeps the queue in a database table shared by several instances. Messages move between
+// states within a single row, due holds the delivery, pop or kill time in milliseconds.
+// Instances popping at the same time skip the rows locked by each other. Host, sender,
+// recipients and retry count are copied out of the encoded message for ad-hoc queries, e.g.
+//
+//	SELECT host, COUNT(*) FROM scalemail_queue WHERE state = 'deadletter' GROUP BY host
+type SQL struct {
+	db      *sql.DB
+	dialect dialect
+	meter   meter
+	turns   turns
+	waker   waker
+
+	// Stale is how long a message must have been out for delivery before Recover puts it
+	// back, zero recovers all of them. Instances sharing a queue need it to keep from
+	// taking over each other's deliveries.
+	Stale time.Duration
+
+	// These work as in Options
+	Backoff    BackoffFunc
+	MaxRetries int
+	TTL        time.Duration
+	Observer   Observer
+	Sealer     *Sealer
+	Blobs      BlobStore
+	BlobSize   int
+	Quota      Quota
+	HostLimit  int
+	Archive    Archive
+	Clock      Clock
+}
+
+// OpenSQL connects to the database and creates the queue table, driver is "postgres", "mysql"
+// or "sqlite3" and needs to be registered by importing it
+func OpenSQL(driver, dsn string) (*SQL, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := NewSQL(db, driver)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// NewSQL creates a queue in db, dialect is the name of a supported driver
+func NewSQL(db *sql.DB, dialect string) (*SQL, error) {
+	d, ok := dialects[dialect]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported SQL dialect: %s", dialect)
+	}
+
+	// concurrent SQLite writers would fail with "database is locked" instead of waiting
+	if dialect == "sqlite3" {
+		db.SetMaxOpenConns(1)
+	}
+
+	s := &SQL{db: db, dialect: d}
+
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS scalemail_queue (
+	id VARCHAR(64) NOT NULL PRIMARY KEY,
+	state VARCHAR(16) NOT NULL,
+	due BIGINT NOT NULL,
+	host VARCHAR(255) NOT NULL,
+	sender VARCHAR(255) NOT NULL,
+	rcpts TEXT NOT NULL,
+	retry INTEGER NOT NULL,
+	msg ` + d.blob + ` NOT NULL
+)`)
+	if err != nil {
+		return nil, err
+	}
+
+	// CREATE INDEX IF NOT EXISTS isn't available everywhere, an existing index is fine
+	db.Exec(`CREATE INDEX scalemail_queue_due ON scalemail_queue (state, due)`)
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS scalemail_paused (host VARCHAR(255) NOT NULL PRIMARY KEY)`)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Close closes the database
+func (s *SQL) Close() error {
+	return s.db.Close()
+}
+
+// Length returns Incoming queue length
+func (s *SQL) Length() (count int) {
+	s.db.QueryRow(s.query(`SELECT COUNT(*) FROM scalemail_queue WHERE state = ?`), stateIncoming).Scan(&count)
+	return
+}
+
+// Push messages to the queue, due now or at msg.NotBefore
+func (s *SQL) Push(ctx context.Context, msg *Msg) error {
+	return s.PushAll(ctx, []*Msg{msg})
+}
+
+// PushAll pushes msgs in a single transaction, either all of them are queued or none.
+// ErrQueueFull if they don't fit the Quota.
+func (s *SQL) PushAll(ctx context.Context, msgs []*Msg) error {
+	now := s.now().UTC()
+
+	keys := make([]string, len(msgs))
+	values, err := s.codec().encodeAll(msgs, now, s.MaxRetries, s.TTL)
+	if err != nil {
+		return err
+	}
+
+	err = s.txContext(ctx, func(tx *sql.Tx) error {
+		if s.Quota.enabled() {
+			var u usage
+			err := tx.QueryRow(s.query(`SELECT COUNT(*), COALESCE(SUM(LENGTH(msg)), 0) FROM scalemail_queue WHERE state = ?`), stateIncoming).Scan(&u.count, &u.bytes)
+			if err != nil {
+				return err
+			}
+			if err = s.Quota.admit(u, values); err != nil {
+				return err
+			}
+		}
+
+		for i, msg := range msgs {
+			keys[i] = uniqueKey(now)
+			_, err := tx.Exec(s.query(`INSERT INTO scalemail_queue (id, state, due, host, sender, rcpts, retry, msg) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+				keys[i], stateIncoming, msg.due(now).UnixMilli(), msg.Host, msg.From, strings.Join(msg.To, ","), msg.Retry, values[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, msg := range msgs {
+		s.hooks().push([]byte(keys[i]), msg)
+	}
+	return nil
+}
+
+// Pop get next email from the queue
+func (s *SQL) Pop(ctx context.Context) (key []byte, msg *Msg, err error) {
+	batch, err := s.PopBatch(ctx, 1)
+	if err != nil || len(batch) == 0 {
+		return nil, nil, err
+	}
+
+	return batch[0].Key, batch[0].Msg, nil
+}
+
+// PopBatch gets up to n emails that are due for delivery in a single transaction taking
+// turns between hosts and skipping paused ones, expired ones are dead-lettered and values
+// that don't decode set aside
+func (s *SQL) PopBatch(ctx context.Context, n int) ([]Delivery, error) {
+	now := s.now().UnixMilli()
+	var t taken
+
+	err := s.txContext(ctx, func(tx *sql.Tx) error {
+		keys, err := s.dueKeys(tx, n, now)
+		if err != nil || len(keys) == 0 {
+			return err
+		}
+
+		keys, values, err := s.lock(tx, keys)
+		if err != nil {
+			return err
+		}
+
+		for i, key := range keys {
+			msg, err := decodeMsg(values[i])
+			if err != nil {
+				c := newCorrupt([]byte(key), values[i], err)
+				if _, err = tx.Exec(s.query(`UPDATE scalemail_queue SET state = ?, due = ?, msg = ? WHERE id = ?`), stateCorrupt, now, encodeCorrupt(c), key); err != nil {
+					return err
+				}
+				t.corrupt = append(t.corrupt, c)
+				continue
+			}
+
+			if msg.expired(time.UnixMilli(now)) {
+				msg.DeadReason = ReasonExpired
+				if _, err = tx.Exec(s.query(`UPDATE scalemail_queue SET state = ?, due = ?, msg = ? WHERE id = ?`), stateDead, now, encode(msg), key); err != nil {
+					return err
+				}
+				t.dead = append(t.dead, Delivery{Key: []byte(key), Msg: msg})
+				continue
+			}
+
+			if _, err = tx.Exec(s.query(`UPDATE scalemail_queue SET state = ?, due = ? WHERE id = ?`), stateOutgoing, now, key); err != nil {
+				return err
+			}
+			t.batch = append(t.batch, Delivery{Key: []byte(key), Msg: msg})
+		}
+
+		return nil
+	})
+
+	if err == nil {
+		err = s.setAside(s.codec().openPopped(&t))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.hooks().popped(t)
+	return t.batch, nil
+}
+
+// setAside moves popped messages whose bodies can't be read out of the queue, like values
+// that don't decode
+func (s *SQL) setAside(corrupt []Corrupt) error {
+	if len(corrupt) == 0 {
+		return nil
+	}
+
+	return s.tx(func(tx *sql.Tx) error {
+		for _, c := range corrupt {
+			if _, err := tx.Exec(s.query(`UPDATE scalemail_queue SET state = ?, due = ?, msg = ? WHERE id = ?`), stateCorrupt, s.now().UnixMilli(), encodeCorrupt(c), string(c.Key)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// dueKeys picks up to n ids due by now taking turns between hosts that aren't paused, and
+// between the fresh and retried messages of each
+func (s *SQL) dueKeys(tx *sql.Tx, n int, now int64) ([]string, error) {
+	rows, err := tx.Query(s.query(`SELECT id, host, retried FROM (
+	SELECT id, LOWER(host) AS host, retry > 0 AS retried, due,
+		ROW_NUMBER() OVER (PARTITION BY LOWER(host), retry > 0 ORDER BY due, id) AS position
+	FROM scalemail_queue WHERE state = ? AND due <= ? AND LOWER(host) NOT IN (SELECT host FROM scalemail_paused)
+) ranked WHERE position <= ? ORDER BY due, id`), stateIncoming, now, n)
+	if err != nil {
+		return nil, err
+	}
+
+	var due, hosts []string
+	var retried []bool
+	for rows.Next() {
+		var key, host string
+		var r bool
+		if err = rows.Scan(&key, &host, &r); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		due, hosts, retried = append(due, key), append(hosts, host), append(retried, r)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var busy map[string]int
+	if s.HostLimit > 0 {
+		if busy, err = s.busy(tx); err != nil {
+			return nil, err
+		}
+	}
+
+	lanes := groupHosts(due, n, func(i int) (string, bool) {
+		return string(hostName(hosts[i])), retried[i]
+	})
+	s.turns.order(lanes, n)
+	keys := schedule(lanes, n, s.HostLimit, busy)
+	s.turns.took(lanes, keys)
+
+	return keys, nil
+}
+
+// busy counts the messages out for delivery by host
+func (s *SQL) busy(tx *sql.Tx) (map[string]int, error) {
+	rows, err := tx.Query(s.query(`SELECT LOWER(host), COUNT(*) FROM scalemail_queue WHERE state = ? GROUP BY LOWER(host)`), stateOutgoing)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	busy := make(map[string]int)
+	for rows.Next() {
+		var host string
+		var count int
+		if err = rows.Scan(&host, &count); err != nil {
+			return nil, err
+		}
+		busy[string(hostName(host))] = count
+	}
+
+	return busy, rows.Err()
+}
+
+// lock reads the messages of keys still incoming, skipping rows other instances locked, in
+// the order of keys
+func (s *SQL) lock(tx *sql.Tx, keys []string) ([]string, [][]byte, error) {
+	args := []interface{}{stateIncoming}
+	for _, k := range keys {
+		args = append(args, k)
+	}
+
+	rows, err := tx.Query(s.query(`SELECT id, msg FROM scalemail_queue WHERE state = ? AND id IN (?`+strings.Repeat(", ?", len(keys)-1)+`)`+s.dialect.skipLocked), args...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	found := make(map[string][]byte)
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err = rows.Scan(&key, &value); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		found[key] = value
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var locked []string
+	var values [][]byte
+	for _, k := range keys {
+		if v, ok := found[k]; ok {
+			locked, values = append(locked, k), append(values, v)
+		}
+	}
+
+	return locked, values, nil
+}
+
+// Corrupted lists the values set aside because they didn't decode, oldest first
+func (s *SQL) Corrupted() (list []Corrupt, err error) {
+	rows, err := s.db.Query(s.query(`SELECT msg FROM scalemail_queue WHERE state = ? ORDER BY id`), stateCorrupt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var value []byte
+		if err = rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		list = append(list, decodeCorrupt(value))
+	}
+
+	return list, rows.Err()
+}
+
+// DeleteCorrupt drops a value set aside
+func (s *SQL) DeleteCorrupt(key []byte) error {
+	_, err := s.db.Exec(s.query(`DELETE FROM scalemail_queue WHERE id = ? AND state = ?`), string(key), stateCorrupt)
+	return err
+}
+
+// Retry takes msg from outgoing queue and schedules it again after the Backoff delay
+func (s *SQL) Retry(key []byte, cause error) error {
+	var msg *Msg
+	err := s.update(key, func(m *Msg) (state string, due time.Time) {
+		now := s.now()
+		m.fail(now, cause)
+		m.Retry++
+		msg = m
+		return stateIncoming, now.Add(s.Backoff.delay(m.Retry))
+	})
+	if err != nil {
+		return err
+	}
+
+	s.hooks().retry(key, msg, cause)
+	return nil
+}
+
+// MarkWarned records that the sender of msg in outgoing queue was notified about the delay
+func (s *SQL) MarkWarned(key []byte) error {
+	return s.update(key, func(m *Msg) (state string, due time.Time) {
+		m.Warned = true
+		return stateOutgoing, s.now()
+	})
+}
+
+// Kill takes msg out of outgoing and pushed that to Dead Letter queue, recording cause as
+// its last attempt
+func (s *SQL) Kill(key []byte, cause error) error {
+	var msg *Msg
+	err := s.update(key, func(m *Msg) (state string, due time.Time) {
+		now := s.now()
+		m.kill(now, cause)
+		msg = m
+		return stateDead, now
+	})
+	if err != nil {
+		return err
+	}
+
+	s.hooks().kill(key, msg, cause)
+	return nil
+}
+
+// RemoveDelivered removes successfully delivered message
+func (s *SQL) RemoveDelivered(key []byte) error {
+	var err error
+	if s.Archive != ArchiveOff {
+		err = s.archiveRow(key)
+	} else {
+		_, err = s.db.Exec(s.query(`DELETE FROM scalemail_queue WHERE id = ? AND state = ?`), string(key), stateOutgoing)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.hooks().delivered(key)
+	return nil
+}
+
+// Recover requeues outgoing emails that were interrupted as EmailQ.Recover does, see Stale
+func (s *SQL) Recover() error {
+	var r recovered
+	err := s.tx(func(tx *sql.Tx) error {
+		r = recovered{}
+		now := s.now()
+
+		rows, err := tx.Query(s.query(`SELECT id FROM scalemail_queue WHERE state = ? AND due <= ?`), stateOutgoing, now.Add(-s.Stale).UnixMilli())
+		if err != nil {
+			return err
+		}
+
+		var keys []string
+		for rows.Next() {
+			var key string
+			if err = rows.Scan(&key); err != nil {
+				rows.Close()
+				return err
+			}
+			keys = append(keys, key)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			_, err := s.rewrite(tx, []byte(key), stateOutgoing, func(m *Msg) (string, time.Time) {
+				retry := m.interrupt(now)
+				r.add([]byte(key), m, retry)
+				if !retry {
+					return stateDead, now
+				}
+				return stateIncoming, now.Add(s.Backoff.delay(m.Retry))
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.report(s.hooks())
+	return nil
+}
+
+// PurgeDead drops dead letters older than retention and all but the newest keep, zero
+// retention or keep doesn't limit by that. Returns how many were dropped.
+func (s *SQL) PurgeDead(retention time.Duration, keep int) (purged int, err error) {
+	err = s.tx(func(tx *sql.Tx) error {
+		if retention > 0 {
+			res, err := tx.Exec(s.query(`DELETE FROM scalemail_queue WHERE state = ? AND due < ?`), stateDead, s.now().Add(-retention).UnixMilli())
+			if err != nil {
+				return err
+			}
+
+			n, _ := res.RowsAffected()
+			purged += int(n)
+		}
+
+		if keep <= 0 {
+			return nil
+		}
+
+		var count int
+		if err := tx.QueryRow(s.query(`SELECT COUNT(*) FROM scalemail_queue WHERE state = ?`), stateDead).Scan(&count); err != nil {
+			return err
+		}
+		if count <= keep {
+			return nil
+		}
+
+		rows, err := tx.Query(s.query(`SELECT id FROM scalemail_queue WHERE state = ? ORDER BY due, id LIMIT `+strconv.Itoa(count-keep)), stateDead)
+		if err != nil {
+			return err
+		}
+
+		var ids []string
+		for rows.Next() {
+			var id string
+			if err = rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+
+		for _, id := range ids {
+			if _, err = tx.Exec(s.query(`DELETE FROM scalemail_queue WHERE id = ?`), id); err != nil {
+				return err
+			}
+		}
+
+		purged += len(ids)
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return purged, nil
+}
+
+// PauseHost holds back delivery of all messages for host until ResumeHost
+func (s *SQL) PauseHost(host string) error {
+	return s.tx(func(tx *sql.Tx) error {
+		// no portable INSERT that ignores duplicates
+		if _, err := tx.Exec(s.query(`DELETE FROM scalemail_paused WHERE host = ?`), strings.ToLower(host)); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(s.query(`INSERT INTO scalemail_paused (host) VALUES (?)`), strings.ToLower(host))
+		return err
+	})
+}
+
+// ResumeHost lets messages for host be popped again
+func (s *SQL) ResumeHost(host string) error {
+	defer s.waker.wake()
+
+	_, err := s.db.Exec(s.query(`DELETE FROM scalemail_paused WHERE host = ?`), strings.ToLower(host))
+	return err
+}
+
+// PausedHosts lists the hosts delivery is paused for
+func (s *SQL) PausedHosts() (hosts []string, err error) {
+	rows, err := s.db.Query(`SELECT host FROM scalemail_paused ORDER BY host`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var host string
+		if err = rows.Scan(&host); err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, host)
+	}
+
+	return hosts, rows.Err()
+}
+
+// ListPending pages through messages waiting for delivery in key order
+func (s *SQL) ListPending(ctx context.Context, f Filter) ([]Delivery, error) {
+	return s.list(ctx, stateIncoming, f)
+}
+
+// ListDead pages through dead letters in key order
+func (s *SQL) ListDead(ctx context.Context, f Filter) ([]Delivery, error) {
+	return s.list(ctx, stateDead, f)
+}
+
+// list narrows down by the inspectable columns, the rest of f is matched on the messages
+func (s *SQL) list(ctx context.Context, state string, f Filter) (page []Delivery, err error) {
+	q := `SELECT id, msg FROM scalemail_queue WHERE state = ? AND retry >= ?`
+	args := []interface{}{state, f.MinRetry}
+
+	if f.Host != "" {
+		q += ` AND LOWER(host) = ?`
+		args = append(args, strings.ToLower(f.Host))
+	}
+	if f.From != "" {
+		q += ` AND LOWER(sender) = ?`
+		args = append(args, strings.ToLower(f.From))
+	}
+	if f.After != nil {
+		q += ` AND id > ?`
+		args = append(args, string(f.After))
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.query(q+` ORDER BY id`), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for len(page) < f.limit() && rows.Next() {
+		var key string
+		var value []byte
+		if err = rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+
+		if msg := decode(value); f.match([]byte(key), msg) {
+			page = append(page, Delivery{Key: []byte(key), Msg: msg})
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return page, s.codec().open(page)
+}
+
+// RetryDead queues the dead letters f selects for delivery again with their retries reset
+func (s *SQL) RetryDead(ctx context.Context, f Filter) (int, error) {
+	defer s.waker.wake()
+
+	return bulk(ctx, s.ListDead, f, s.rewriter(stateDead, func(m *Msg) (string, time.Time) {
+		m.revive()
+		return stateIncoming, s.now()
+	}))
+}
+
+// KillPending moves the pending messages f selects to the dead letter queue
+func (s *SQL) KillPending(ctx context.Context, f Filter) (int, error) {
+	return bulk(ctx, s.ListPending, f, s.rewriter(stateIncoming, func(m *Msg) (string, time.Time) {
+		m.DeadReason = ReasonKilled
+		return stateDead, s.now()
+	}))
+}
+
+// DeletePending drops the pending messages f selects
+func (s *SQL) DeletePending(ctx context.Context, f Filter) (int, error) {
+	return bulk(ctx, s.ListPending, f, s.deleter(stateIncoming))
+}
+
+// DeleteDead drops the dead letters f selects
+func (s *SQL) DeleteDead(ctx context.Context, f Filter) (int, error) {
+	return bulk(ctx, s.ListDead, f, s.deleter(stateDead))
+}
+
+// rewriter applies fn to the messages under keys in state from, a transaction per chunk
+func (s *SQL) rewriter(from string, fn func(m *Msg) (state string, due time.Time)) func(keys [][]byte) (int, error) {
+	return func(keys [][]byte) (n int, err error) {
+		err = s.tx(func(tx *sql.Tx) error {
+			n = 0
+			for _, k := range keys {
+				found, err := s.rewrite(tx, k, from, fn)
+				if err != nil {
+					return err
+				}
+				if found {
+					n++
+				}
+			}
+
+			return nil
+		})
+
+		return n, err
+	}
+}
+
+func (s *SQL) deleter(state string) func(keys [][]byte) (int, error) {
+	return func(keys [][]byte) (n int, err error) {
+		err = s.tx(func(tx *sql.Tx) error {
+			n = 0
+			for _, k := range keys {
+				res, err := tx.Exec(s.query(`DELETE FROM scalemail_queue WHERE id = ? AND state = ?`), string(k), state)
+				if err != nil {
+					return err
+				}
+
+				if affected, _ := res.RowsAffected(); affected > 0 {
+					n++
+				}
+			}
+
+			return nil
+		})
+
+		return n, err
+	}
+}
+
+// update rewrites msg in outgoing queue under key and moves it to the state fn returns
+func (s *SQL) update(key []byte, fn func(m *Msg) (state string, due time.Time)) error {
+	return s.tx(func(tx *sql.Tx) error {
+		found, err := s.rewrite(tx, key, stateOutgoing, fn)
+		if err == nil && !found {
+			err = notFound("outgoing")
+		}
+
+		return err
+	})
+}
+
+// rewrite changes msg under key if it's in state from and moves it to the state fn returns,
+// reports whether it was found
+func (s *SQL) rewrite(tx *sql.Tx, key []byte, from string, fn func(m *Msg) (state string, due time.Time)) (bool, error) {
+	var value []byte
+	err := tx.QueryRow(s.query(`SELECT msg FROM scalemail_queue WHERE id = ? AND state = ?`+s.dialect.forUpdate()), string(key), from).Scan(&value)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	m := decode(value)
+	state, due := fn(m)
+
+	_, err = tx.Exec(s.query(`UPDATE scalemail_queue SET state = ?, due = ?, retry = ?, msg = ? WHERE id = ?`), state, due.UnixMilli(), m.Retry, encode(m), string(key))
+	return err == nil, err
+}
+
+// nextDue is the earliest due of the incoming state, popped messages are outgoing
+func (s *SQL) nextDue() (time.Time, error) {
+	var due sql.NullInt64
+	err := s.db.QueryRow(s.query(`SELECT MIN(due) FROM scalemail_queue WHERE state = ?`), stateIncoming).Scan(&due)
+	if err != nil || !due.Valid {
+		return time.Time{}, err
+	}
+
+	return time.UnixMilli(due.Int64), nil
+}
+
+func (s *SQL) tx(fn func(tx *sql.Tx) error) error {
+	return s.txContext(context.Background(), fn)
+}
+
+// txContext is tx rolled back by the driver once ctx is done
+func (s *SQL) txContext(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	defer s.hooks().commit(time.Now())
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// query rewrites ? placeholders for the dialect
+func (s *SQL) query(q string) string {
+	if !s.dialect.numbered {
+		return q
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+// forUpdate locks the selected row where the database supports it
+func (d dialect) forUpdate() string {
+	if d.skipLocked == "" {
+		return ""
+	}
+
+	return " FOR UPDATE"
+}
+
+func (s *SQL) codec() codec {
+	return codec{s.Sealer, s.Blobs, s.BlobSize}
+}
+
+func (s *SQL) hooks() hooks {
+	return hooks{s.Observer, &s.meter, &s.waker}
+}
+
+// CollectBlobs deletes blobs of delivered and purged messages, see EmailQ.CollectBlobs
+func (s *SQL) CollectBlobs(grace time.Duration) (int, error) {
+	refs := make(map[string]bool)
+
+	rows, err := s.db.Query(s.query(`SELECT msg FROM scalemail_queue WHERE state <> ?`), stateCorrupt)
+	if err != nil {
+		return 0, err
+	}
+
+	for rows.Next() {
+		var value []byte
+		if err = rows.Scan(&value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		addRef(refs, value)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	return collect(s.Blobs, grace, refs)
+}
@@ -0,0 +1,159 @@
+package emailq
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestSQLPop(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS scalemail_queue").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE INDEX").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS scalemail_paused").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	s, err := NewSQL(db, "postgres")
+	if err != nil {
+		t.Fatal("Error creating queue:", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("ROW_NUMBER() OVER (PARTITION BY LOWER(host), retry > 0 ORDER BY due, id) AS position FROM scalemail_queue WHERE state = $1 AND due <= $2 AND LOWER(host) NOT IN (SELECT host FROM scalemail_paused) ) ranked WHERE position <= $3")).
+		WithArgs(stateIncoming, sqlmock.AnyArg(), 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "host", "retried"}).AddRow("k1", "host", false).AddRow("k2", "host", false))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, msg FROM scalemail_queue WHERE state = $1 AND id IN ($2, $3) FOR UPDATE SKIP LOCKED")).
+		WithArgs(stateIncoming, "k1", "k2").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "msg"}).AddRow("k1", encode(createMsg())))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE scalemail_queue SET state = $1, due = $2 WHERE id = $3")).
+		WithArgs(stateOutgoing, sqlmock.AnyArg(), "k1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	batch, err := s.PopBatch(ctx, 2)
+	if err != nil || len(batch) != 1 {
+		t.Fatal("Error popping batch:", len(batch), err)
+	}
+	if string(batch[0].Key) != "k1" || batch[0].Msg.From != "from" {
+		t.Fatal("Unexpected delivery:", string(batch[0].Key), batch[0].Msg)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT msg FROM scalemail_queue WHERE id = $1 AND state = $2 FOR UPDATE")).
+		WithArgs("k1", stateOutgoing).
+		WillReturnRows(sqlmock.NewRows([]string{"msg"}).AddRow(encode(createMsg())))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE scalemail_queue SET state = $1, due = $2, retry = $3, msg = $4 WHERE id = $5")).
+		WithArgs(stateIncoming, sqlmock.AnyArg(), int64(1), sqlmock.AnyArg(), "k1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err = s.Retry([]byte("k1"), nil); err != nil {
+		t.Fatal("Error retrying:", err)
+	}
+
+	// nothing out for delivery under that key
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT msg FROM scalemail_queue WHERE id = $1 AND state = $2 FOR UPDATE")).
+		WithArgs("k1", stateOutgoing).
+		WillReturnRows(sqlmock.NewRows([]string{"msg"}))
+	mock.ExpectRollback()
+
+	if err = s.Kill([]byte("k1"), nil); err == nil {
+		t.Fatal("Killed a message that isn't out for delivery")
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLPlaceholders(t *testing.T) {
+	s := &SQL{dialect: dialects["mysql"]}
+	if q := s.query("id = ? AND state = ?"); q != "id = ? AND state = ?" {
+		t.Fatal("Unexpected mysql query:", q)
+	}
+
+	s.dialect = dialects["postgres"]
+	if q := s.query("id = ? AND state = ?"); q != "id = $1 AND state = $2" {
+		t.Fatal("Unexpected postgres query:", q)
+	}
+}
+
+func TestSQLiteFlow(t *testing.T) {
+	dir, err := os.MkdirTemp("", "emailq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenSQL("sqlite3", filepath.Join(dir, "queue.sqlite"))
+	if err != nil {
+		t.Fatal("Error opening queue:", err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 3; i++ {
+		if err = s.Push(ctx, createMsg()); err != nil {
+			t.Fatal("Error pushing:", err)
+		}
+	}
+
+	batch, err := s.PopBatch(ctx, 2)
+	if err != nil || len(batch) != 2 {
+		t.Fatal("Error popping batch:", len(batch), err)
+	}
+	if s.Length() != 1 {
+		t.Fatal("Expected 1 message left, got", s.Length())
+	}
+
+	if err = s.MarkWarned(batch[0].Key); err != nil {
+		t.Fatal("Error marking warned:", err)
+	}
+	if err = s.Retry(batch[0].Key, nil); err != nil {
+		t.Fatal("Error retrying:", err)
+	}
+	if err = s.Kill(batch[1].Key, nil); err != nil {
+		t.Fatal("Error killing:", err)
+	}
+	if err = s.Kill(batch[1].Key, nil); err == nil {
+		t.Fatal("Killed a message that isn't out for delivery")
+	}
+
+	// the retried message waits, the third one is due
+	key, msg, err := s.Pop(ctx)
+	if err != nil || key == nil || msg.Retry != 0 {
+		t.Fatal("Error popping:", msg, err)
+	}
+	if key, _, _ := s.Pop(ctx); key != nil {
+		t.Fatal("Retry popped before its time")
+	}
+
+	if err = s.Recover(); err != nil {
+		t.Fatal("Error recovering:", err)
+	}
+	if s.Length() != 2 {
+		t.Fatal("Expected 2 messages after recover, got", s.Length())
+	}
+
+	// the columns are there for inspection with the sqlite3 shell
+	var retry int
+	var rcpts string
+	err = s.db.QueryRow(`SELECT retry, rcpts FROM scalemail_queue WHERE id = ?`, string(batch[0].Key)).Scan(&retry, &rcpts)
+	if err != nil || retry != 1 || rcpts != "a,b" {
+		t.Fatal("Unexpected columns:", retry, rcpts, err)
+	}
+
+	var dead int
+	s.db.QueryRow(`SELECT COUNT(*) FROM scalemail_queue WHERE state = 'deadletter'`).Scan(&dead)
+	if dead != 1 {
+		t.Fatal("Expected 1 dead letter, got", dead)
+	}
+}
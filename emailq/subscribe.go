@@ -0,0 +1,190 @@
+package emailq
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// subscribeBatch is how many popped messages a subscription holds for the receiver
+	subscribeBatch = 100
+
+	// pollEvery is the longest a subscription waits before looking for due messages again.
+	// Changes made through this instance wake it right away, those of other instances
+	// sharing a Redis or SQL queue don't.
+	pollEvery = time.Minute
+
+	// drainEvery is how often a subscription checks the receiver made room for more
+	drainEvery = 50 * time.Millisecond
+)
+
+// waker wakes the subscriptions of a queue when messages may have come due or a host may
+// take more of them, the zero value is ready. A nil waker does nothing.
+type waker struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// wait returns a channel closed by the next wake
+func (w *waker) wait() <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.ch == nil {
+		w.ch = make(chan struct{})
+	}
+	return w.ch
+}
+
+func (w *waker) wake() {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	if w.ch != nil {
+		close(w.ch)
+		w.ch = nil
+	}
+	w.mu.Unlock()
+}
+
+// source is what a subscription pops from, nextDue is when the first pending message that
+// isn't out for delivery is due, zero if there's none
+type source interface {
+	PopBatch(ctx context.Context, n int) ([]Delivery, error)
+	nextDue() (time.Time, error)
+	now() time.Time
+}
+
+// subscribe pops the messages of src as they come due into the returned channel until ctx
+// is done, then closes it. Messages popped by then can still be received and should be, they
+// are out for delivery. Popping errors are retried after pollEvery.
+func subscribe(ctx context.Context, src source, w *waker) <-chan Delivery {
+	ch := make(chan Delivery, subscribeBatch)
+
+	go func() {
+		defer close(ch)
+
+		for {
+			// taken before popping so a push meanwhile isn't missed
+			woken := w.wait()
+
+			wait := pollEvery
+			if free := cap(ch) - len(ch); free > 0 {
+				popped := src.now()
+				batch, err := src.PopBatch(ctx, free)
+				for _, d := range batch {
+					ch <- d // never blocks, there's room for free
+				}
+				if err != nil && ctx.Err() == nil {
+					log.Println("Error popping from the queue:", err)
+				}
+
+				// there may be more due messages, don't wait
+				if err == nil && len(batch) == free {
+					continue
+				}
+				if err == nil {
+					wait = untilDue(src, popped)
+				}
+			}
+			if len(ch) > 0 {
+				wait = min(wait, drainEvery)
+			}
+
+			t := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-woken:
+			case <-t.C:
+			}
+			t.Stop()
+		}
+	}()
+
+	return ch
+}
+
+// untilDue is how long until the next message of src comes due, at most pollEvery. One that
+// was due when popped is held back by a paused host or the host limit, something else has
+// to change first.
+func untilDue(src source, popped time.Time) time.Duration {
+	next, err := src.nextDue()
+	if err != nil || next.IsZero() || !next.After(popped) {
+		return pollEvery
+	}
+
+	return min(max(next.Sub(src.now()), 0), pollEvery)
+}
+
+// Subscribe yields messages as they come due until ctx is done, see Queue
+func (q *EmailQ) Subscribe(ctx context.Context) <-chan Delivery {
+	return subscribe(ctx, q, &q.waker)
+}
+
+// nextDue skips the keys out for delivery, they sort first
+func (q *EmailQ) nextDue() (next time.Time, err error) {
+	err = q.view(func(tx *bolt.Tx) error {
+		now := q.now()
+		c := tx.Bucket(incomingBucket).Cursor()
+
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if !leased(tx, k, now) {
+				next, err = keyTime(k)
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return next, err
+}
+
+// Subscribe yields messages of all shards as they come due until ctx is done, see Queue
+func (s *Sharded) Subscribe(ctx context.Context) <-chan Delivery {
+	return subscribe(ctx, s, &s.waker)
+}
+
+func (s *Sharded) nextDue() (next time.Time, err error) {
+	for _, q := range s.shards {
+		t, err := q.nextDue()
+		if err != nil {
+			return next, err
+		}
+		if !t.IsZero() && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+
+	return next, nil
+}
+
+// now is the time of the shards, they share the Clock of Options
+func (s *Sharded) now() time.Time {
+	return s.shards[0].now()
+}
+
+// Subscribe yields messages as they come due until ctx is done, see Queue
+func (m *Memory) Subscribe(ctx context.Context) <-chan Delivery {
+	return subscribe(ctx, m, &m.waker)
+}
+
+// Subscribe yields messages as they come due until ctx is done, see Queue. Pushes of other
+// instances are found within pollEvery.
+func (r *Redis) Subscribe(ctx context.Context) <-chan Delivery {
+	return subscribe(ctx, r, &r.waker)
+}
+
+// Subscribe yields messages as they come due until ctx is done, see Queue. Pushes of other
+// instances are found within pollEvery.
+func (s *SQL) Subscribe(ctx context.Context) <-chan Delivery {
+	return subscribe(ctx, s, &s.waker)
+}
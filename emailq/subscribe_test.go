@@ -0,0 +1,95 @@
+package emailq
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// received waits for a message from ch, nil if none comes within d
+func received(ch <-chan Delivery, d time.Duration) *Delivery {
+	select {
+	case m, ok := <-ch:
+		if !ok {
+			return nil
+		}
+		return &m
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	for name, backend := range backends(t) {
+		queue := backend.(pauser)
+		sub, cancel := context.WithCancel(ctx)
+		ch := queue.Subscribe(sub)
+
+		// woken by the push, long before pollEvery
+		queue.Push(ctx, createMsg())
+		d := received(ch, 2*time.Second)
+		if d == nil || d.Msg.Host != "host" {
+			t.Fatal(name, "pushed message not received")
+		}
+		queue.RemoveDelivered(d.Key)
+
+		// comes due while waiting
+		later := createMsg()
+		later.NotBefore = time.Now().Add(300 * time.Millisecond)
+		queue.Push(ctx, later)
+		if d = received(ch, 100*time.Millisecond); d != nil {
+			t.Fatal(name, "message received before it was due")
+		}
+		if d = received(ch, 2*time.Second); d == nil {
+			t.Fatal(name, "message not received once due")
+		}
+		queue.RemoveDelivered(d.Key)
+
+		// held back until the host is resumed
+		queue.PauseHost("host")
+		queue.Push(ctx, createMsg())
+		if d = received(ch, 100*time.Millisecond); d != nil {
+			t.Fatal(name, "paused host received")
+		}
+		queue.ResumeHost("host")
+		if d = received(ch, 2*time.Second); d == nil {
+			t.Fatal(name, "resumed host not received")
+		}
+		queue.RemoveDelivered(d.Key)
+
+		cancel()
+		if _, ok := <-ch; ok {
+			t.Fatal(name, "channel not closed with the context")
+		}
+	}
+}
+
+func TestSubscribeBacklog(t *testing.T) {
+	m := NewMemory()
+	for i := 0; i < 3*subscribeBatch; i++ {
+		m.Push(ctx, createMsg())
+	}
+
+	sub, cancel := context.WithCancel(ctx)
+	ch := m.Subscribe(sub)
+
+	// more than a batch, popped as the receiver makes room
+	for i := 0; i < 3*subscribeBatch; i++ {
+		if received(ch, 2*time.Second) == nil {
+			t.Fatal("Backlog not received, got", i)
+		}
+	}
+
+	// what was popped before the cancel is still handed over
+	m.Push(ctx, createMsg())
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	n := 0
+	for range ch {
+		n++
+	}
+	if n != 1 || m.Length() != 0 {
+		t.Fatal("Popped message lost on cancel:", n, m.Length())
+	}
+}
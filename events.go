@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/oliverjanik/scalemail/emailq"
+)
+
+// delivery event types
+const (
+	eventAccepted  = "accepted"
+	eventDelivered = "delivered"
+	eventDeferred  = "deferred"
+	eventBounced   = "bounced"
+
+	eventQuarantined = "quarantined"
+)
+
+type event struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	Key    string    `json:"key,omitempty"`
+	From   string    `json:"from"`
+	To     []string  `json:"to"`
+	Host   string    `json:"host"`
+	Retry  int       `json:"retry"`
+	Reason string    `json:"reason,omitempty"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// hub fans delivery events out to subscribers, slow subscribers miss events rather
+// than hold up delivery
+type hub struct {
+	mu   sync.Mutex
+	subs map[chan event]struct{}
+}
+
+var events = &hub{subs: make(map[chan event]struct{})}
+
+func (h *hub) subscribe() chan event {
+	ch := make(chan event, 64)
+
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch
+}
+
+func (h *hub) unsubscribe(ch chan event) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+func (h *hub) publish(typ string, key []byte, msg *emailq.Msg, reason error) {
+	e := event{
+		Time:  time.Now().UTC(),
+		Type:  typ,
+		Key:   string(key),
+		From:  msg.From,
+		To:    msg.To,
+		Host:  msg.Host,
+		Retry: msg.Retry,
+
+		Metadata: msg.Metadata,
+	}
+
+	if reason != nil {
+		e.Reason = reason.Error()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
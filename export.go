@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"github.com/oliverjanik/scalemail/emailq"
+)
+
+// toolFlags are the queue flags of the offline subcommands
+func toolFlags(fs *flag.FlagSet) (url *string, n *int, key, blobs *string) {
+	url = fs.String("queue", "", "Queue store as for the daemon, the bolt file emails.db if empty")
+	n = fs.Int("shards", 1, "Number of bolt files the queue is spread across")
+	key = fs.String("queue-key", "", "Key file the message bodies are encrypted with")
+	blobs = fs.String("blob-dir", "", "Directory large message bodies are kept in")
+	fs.DurationVar(&boltOpts.Timeout, "bolt-timeout", lockTimeout, "How long to wait for another process holding emails.db before giving up, forever if 0")
+	return
+}
+
+func openTool(url string, n int, key, blobs string) emailq.Queue {
+	if err := storage(key, blobs); err != nil {
+		log.Fatal(err)
+	}
+
+	queue, err := openQueue(url, n)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return queue
+}
+
+// runExport implements `scalemail export [file]`, writing the queue as JSON lines to file
+// or stdout, optionally with an .eml file per message
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	url, n, key, blobs := toolFlags(fs)
+	eml := fs.String("eml", "", "Also write every message body to an .eml file in this directory")
+	fs.BoolVar(&boltOpts.ReadOnly, "read-only", false, "Open emails.db read-only, messages out for delivery are left out")
+	fs.Parse(args)
+
+	queue := openTool(*url, *n, *key, *blobs)
+	defer queue.Close()
+
+	// a stopped daemon has nothing out for delivery, shared queues only give up stale ones
+	if !boltOpts.ReadOnly {
+		if err := queue.Recover(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if fs.NArg() > 0 {
+		f, err := os.Create(fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	l := queue.(emailq.Lister)
+	count, err := emailq.ExportJSON(context.Background(), l, w)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Exported", count, "messages")
+
+	if *eml != "" {
+		count, err = emailq.ExportEML(context.Background(), l, *eml)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Wrote", count, ".eml files to", *eml)
+	}
+}
+
+// runImport implements `scalemail import [file]`, queueing the pending messages of an
+// export read from file or stdin
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	url, n, key, blobs := toolFlags(fs)
+	fs.Parse(args)
+
+	queue := openTool(*url, *n, *key, *blobs)
+	defer queue.Close()
+
+	var r io.Reader = os.Stdin
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	count, err := emailq.ImportJSON(context.Background(), queue, r)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Imported", count, "messages")
+}
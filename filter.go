@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/oliverjanik/scalemail/daemon"
+)
+
+// how long a content filter may take per message
+const filterTimeout = time.Minute
+
+// filter builds the content filter configured by -filter: an http(s) URL the message is
+// POSTed to, or a command run with the message on stdin. Either way the envelope is passed
+// alongside (X-Mail-From, X-Rcpt-To and X-Client-IP headers, or MAIL_FROM, RCPT_TO and
+// CLIENT_IP environment variables) and the verdict is:
+//
+//	accept   HTTP 2xx or exit status 0, a non-empty body or stdout replaces the message
+//	reject   an X-SMTP-Reply header, or a non-zero exit with an SMTP reply on stdout, e.g. "550 Spam"
+//
+// Anything else, a filter that's down included, defers the message with 451. An accepting
+// HTTP filter may tag the message with X-Metadata headers of key=value, e.g. campaign=spring,
+// kept with it in the queue.
+func filter(spec string) daemon.FilterFunc {
+	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		return func(msg *daemon.Msg) string {
+			return httpFilter(spec, msg)
+		}
+	}
+
+	args := strings.Fields(spec)
+	return func(msg *daemon.Msg) string {
+		return execFilter(args, msg)
+	}
+}
+
+func httpFilter(url string, msg *daemon.Msg) string {
+	ctx, cancel := context.WithTimeout(context.Background(), filterTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(msg.Data))
+	if err != nil {
+		log.Println("Error calling content filter:", err)
+		return "451 Content filter unavailable"
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Content-Type", "message/rfc822")
+	req.Header.Set("X-Mail-From", msg.From)
+	req.Header.Set("X-Client-IP", msg.IP)
+	for _, to := range msg.To {
+		req.Header.Add("X-Rcpt-To", to)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Println("Error calling content filter:", err)
+		return "451 Content filter unavailable"
+	}
+	defer resp.Body.Close()
+
+	if reply := resp.Header.Get("X-SMTP-Reply"); reply != "" {
+		return verdict(reply)
+	}
+
+	if resp.StatusCode/100 != 2 {
+		log.Println("Content filter failed:", resp.Status)
+		return "451 Content filter unavailable"
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Println("Error reading content filter response:", err)
+		return "451 Content filter unavailable"
+	}
+
+	if len(body) > 0 {
+		msg.Data = body
+	}
+
+	for _, h := range resp.Header.Values("X-Metadata") {
+		k, v, ok := strings.Cut(h, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			log.Printf("Content filter gave invalid metadata %q\n", h)
+			continue
+		}
+
+		if msg.Metadata == nil {
+			msg.Metadata = make(map[string]string)
+		}
+		msg.Metadata[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+
+	return ""
+}
+
+func execFilter(args []string, msg *daemon.Msg) string {
+	ctx, cancel := context.WithTimeout(context.Background(), filterTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(msg.Data)
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"MAIL_FROM="+msg.From,
+		"RCPT_TO="+strings.Join(msg.To, ","),
+		"CLIENT_IP="+msg.IP,
+	)
+
+	out, err := cmd.Output()
+	if _, ok := err.(*exec.ExitError); ok {
+		line, _ := bufio.NewReader(bytes.NewReader(out)).ReadString('\n')
+		return verdict(strings.TrimSpace(line))
+	}
+
+	if err != nil {
+		log.Println("Error running content filter:", err)
+		return "451 Content filter unavailable"
+	}
+
+	if len(out) > 0 {
+		msg.Data = out
+	}
+
+	return ""
+}
+
+// verdict passes on a rejection from the filter if it is a valid 4xx or 5xx reply
+func verdict(reply string) string {
+	if len(reply) >= 4 && (reply[0] == '4' || reply[0] == '5') && reply[1] >= '0' && reply[1] <= '9' &&
+		reply[2] >= '0' && reply[2] <= '9' && reply[3] == ' ' && !strings.ContainsAny(reply, "\r\n") {
+		return reply
+	}
+
+	log.Printf("Content filter gave an invalid reply %q\n", reply)
+	return "451 Content filter failed"
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/oliverjanik/scalemail/emailq"
+)
+
+// leased messages older than this are considered abandoned when checking a live queue
+const staleOutgoing = time.Hour
+
+// checker is implemented by queues that support integrity checks
+type checker interface {
+	Check(staleAfter time.Duration, repair bool) (*emailq.Report, error)
+}
+
+// runFsck implements `scalemail fsck`, an offline integrity check of the queue
+func runFsck(args []string) {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "Release the leases of stale messages out for delivery")
+	n := fs.Int("shards", 1, "Number of bolt files the queue is spread across")
+	fs.DurationVar(&boltOpts.Timeout, "bolt-timeout", lockTimeout, "How long to wait for another process holding emails.db before giving up, forever if 0")
+	fs.Parse(args)
+
+	// only a repair writes, other checks may run alongside each other
+	boltOpts.ReadOnly = !*repair
+
+	queue, err := openQueue("", *n)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer queue.Close()
+
+	// offline nothing is being sent, so every lease is stale
+	r, err := queue.(checker).Check(0, *repair)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	printReport(r)
+
+	if !r.Healthy() {
+		queue.Close()
+		os.Exit(1)
+	}
+}
+
+func printReport(r *emailq.Report) {
+	fmt.Printf("incoming:     %v\n", r.Incoming)
+	fmt.Printf("outgoing:     %v\n", r.Outgoing)
+	fmt.Printf("dead:         %v\n", r.Dead)
+	fmt.Printf("size:         %v bytes\n", r.Size)
+	fmt.Printf("free pages:   %v (%v pending)\n", r.FreePages, r.PendingFree)
+	fmt.Printf("corrupt:      %v %v\n", len(r.Corrupt), strings.Join(r.Corrupt, " "))
+	fmt.Printf("bad keys:     %v %v\n", len(r.BadKeys), strings.Join(r.BadKeys, " "))
+	fmt.Printf("stale:        %v, repaired %v\n", len(r.Stale), r.Repaired)
+
+	if r.Healthy() {
+		fmt.Println("OK")
+	}
+}
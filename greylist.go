@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// greylister keeps greylist entries next to the queue
+type greylister interface {
+	Greylist(ip, from, to string, delay, expire time.Duration) (bool, error)
+	PruneGreylist(expire time.Duration) (int, error)
+}
+
+// greylist returns the daemon's Greylist check, a tuple that can't be looked up passes
+func greylist(g greylister, delay, expire time.Duration) func(ip, from, to string) bool {
+	go func() {
+		for range time.Tick(time.Hour) {
+			if n, err := g.PruneGreylist(expire); err != nil {
+				log.Println("Error pruning greylist:", err)
+			} else if n > 0 {
+				log.Println("Pruned", n, "greylist entries")
+			}
+		}
+	}()
+
+	return func(ip, from, to string) bool {
+		pass, err := g.Greylist(ip, from, to, delay, expire)
+		if err != nil {
+			log.Println("Error greylisting:", err)
+			return true
+		}
+
+		if !pass {
+			log.Println("Greylisted", ip, from, "->", to)
+		}
+		return pass
+	}
+}
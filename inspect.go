@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oliverjanik/scalemail/emailq"
+)
+
+// lister pages through queued messages and dead letters
+type lister interface {
+	ListPending(ctx context.Context, f emailq.Filter) ([]emailq.Delivery, error)
+	ListDead(ctx context.Context, f emailq.Filter) ([]emailq.Delivery, error)
+}
+
+type queuedMsg struct {
+	Key       string    `json:"key"`
+	Created   time.Time `json:"created"`
+	Host      string    `json:"host"`
+	From      string    `json:"from"`
+	To        []string  `json:"to"`
+	Retry     int       `json:"retry"`
+	LastError string    `json:"last_error,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Code      int       `json:"code,omitempty"`
+	Size      int       `json:"size"`
+
+	Delivered *time.Time        `json:"delivered,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// listPending lists messages waiting for delivery, see listFilter for the parameters
+func listPending(w http.ResponseWriter, r *http.Request) {
+	list(w, r, lister.ListPending)
+}
+
+// listDead lists dead letters, see listFilter for the parameters
+func listDead(w http.ResponseWriter, r *http.Request) {
+	list(w, r, lister.ListDead)
+}
+
+type deadStat struct {
+	Host   string `json:"host"`
+	Reason string `json:"reason"`
+	Code   int    `json:"code,omitempty"`
+	Count  int    `json:"count"`
+}
+
+// deadStats counts the dead letters selected like listDead by destination domain, reason and
+// reply code, most first. Pages through all of them, limit= and after= are ignored.
+func deadStats(w http.ResponseWriter, r *http.Request) {
+	l, ok := q.(lister)
+	if !ok {
+		http.Error(w, "Queue does not support listing", http.StatusNotImplemented)
+		return
+	}
+
+	f, err := listFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.After, f.Limit = nil, 1000
+
+	ctx, cancel := context.WithTimeout(r.Context(), listTimeout)
+	defer cancel()
+
+	counts := make(map[deadStat]int)
+	for {
+		page, err := l.ListDead(ctx, f)
+		if errors.Is(err, context.DeadlineExceeded) {
+			http.Error(w, "Counting took too long, narrow down the filter", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(page) == 0 {
+			break
+		}
+
+		for _, d := range page {
+			counts[deadStat{Host: strings.ToLower(d.Msg.Host), Reason: d.Msg.DeadReason, Code: d.Msg.DeadCode}]++
+		}
+		f.After = page[len(page)-1].Key
+	}
+
+	stats := []deadStat{}
+	for s, n := range counts {
+		s.Count = n
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Count != stats[j].Count {
+			return stats[i].Count > stats[j].Count
+		}
+		if stats[i].Host != stats[j].Host {
+			return stats[i].Host < stats[j].Host
+		}
+		return stats[i].Reason < stats[j].Reason || stats[i].Reason == stats[j].Reason && stats[i].Code < stats[j].Code
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func list(w http.ResponseWriter, r *http.Request, fn func(lister, context.Context, emailq.Filter) ([]emailq.Delivery, error)) {
+	l, ok := q.(lister)
+	if !ok {
+		http.Error(w, "Queue does not support listing", http.StatusNotImplemented)
+		return
+	}
+
+	listPage(w, r, func(ctx context.Context, f emailq.Filter) ([]emailq.Delivery, error) { return fn(l, ctx, f) })
+}
+
+// listPage writes the page fn finds for the filter of r, giving up after listTimeout or
+// when the client goes away
+func listPage(w http.ResponseWriter, r *http.Request, fn func(context.Context, emailq.Filter) ([]emailq.Delivery, error)) {
+	f, err := listFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), listTimeout)
+	defer cancel()
+
+	page, err := fn(ctx, f)
+	if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(w, "Listing took too long, narrow down the filter", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	msgs := []queuedMsg{}
+	for _, d := range page {
+		m := d.Msg
+		qm := queuedMsg{string(d.Key), m.Created, m.Host, m.From, m.To, m.Retry, m.LastError, m.DeadReason, m.DeadCode, len(m.Data), nil, m.Metadata}
+		if !m.Delivered.IsZero() {
+			qm.Delivered = &m.Delivered
+		}
+		msgs = append(msgs, qm)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msgs)
+}
+
+// listFilter reads ?host=, from=, since= and until= (RFC 3339), min_retry=, reason=,
+// meta=key=value as often as needed, limit= and after=, the key of the last message of the
+// previous page
+func listFilter(r *http.Request) (f emailq.Filter, err error) {
+	f.Host = r.FormValue("host")
+	f.From = r.FormValue("from")
+	f.Reason = r.FormValue("reason")
+
+	r.ParseForm()
+	for _, kv := range r.Form["meta"] {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return f, fmt.Errorf("Invalid meta, expected key=value: %s", kv)
+		}
+		if f.Metadata == nil {
+			f.Metadata = make(map[string]string)
+		}
+		f.Metadata[k] = v
+	}
+
+	if v := r.FormValue("after"); v != "" {
+		f.After = []byte(v)
+	}
+
+	if v := r.FormValue("since"); v != "" {
+		if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, err
+		}
+	}
+	if v := r.FormValue("until"); v != "" {
+		if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, err
+		}
+	}
+
+	if v := r.FormValue("min_retry"); v != "" {
+		if f.MinRetry, err = strconv.Atoi(v); err != nil {
+			return f, err
+		}
+	}
+	if v := r.FormValue("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil {
+			return f, err
+		}
+	}
+
+	return f, nil
+}
+
+// bulker changes many queued messages at once
+type bulker interface {
+	RetryDead(ctx context.Context, f emailq.Filter) (int, error)
+	KillPending(ctx context.Context, f emailq.Filter) (int, error)
+	DeletePending(ctx context.Context, f emailq.Filter) (int, error)
+	DeleteDead(ctx context.Context, f emailq.Filter) (int, error)
+}
+
+// retryDead queues the dead letters selected like listDead for delivery again
+func retryDead(w http.ResponseWriter, r *http.Request) {
+	bulkAction(w, r, "Retried dead letters:", bulker.RetryDead)
+}
+
+// killPending dead-letters the messages selected like listPending
+func killPending(w http.ResponseWriter, r *http.Request) {
+	bulkAction(w, r, "Killed pending messages:", bulker.KillPending)
+}
+
+// deletePending drops the messages selected like listPending
+func deletePending(w http.ResponseWriter, r *http.Request) {
+	bulkAction(w, r, "Deleted pending messages:", bulker.DeletePending)
+}
+
+// deleteDead drops the dead letters selected like listDead
+func deleteDead(w http.ResponseWriter, r *http.Request) {
+	bulkAction(w, r, "Deleted dead letters:", bulker.DeleteDead)
+}
+
+// bulkAction runs fn over the filtered messages, an empty filter needs ?all=1 so a
+// forgotten parameter doesn't hit the whole queue. A client going away stops it between
+// chunks, what was changed by then stays changed.
+func bulkAction(w http.ResponseWriter, r *http.Request, done string, fn func(bulker, context.Context, emailq.Filter) (int, error)) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, ok := q.(bulker)
+	if !ok {
+		http.Error(w, "Queue does not support bulk operations", http.StatusNotImplemented)
+		return
+	}
+
+	f, err := listFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if f.Host == "" && f.From == "" && f.Since.IsZero() && f.Until.IsZero() && f.MinRetry == 0 && f.Reason == "" && len(f.Metadata) == 0 && r.FormValue("all") != "1" {
+		http.Error(w, "No filter given, use all=1 to select all messages", http.StatusBadRequest)
+		return
+	}
+
+	n, err := fn(b, r.Context(), f)
+	if err != nil {
+		log.Println(done, n, "before failing:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Println(done, n)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"count": n})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"time"
+
+	"github.com/oliverjanik/scalemail/emailq"
+)
+
+// journaler keeps a record of delivery attempts for finding out what happened to a message
+// after the fact
+type journaler interface {
+	Journal(e emailq.Entry) error
+	ListJournal(ctx context.Context, f emailq.JournalFilter) ([]emailq.Entry, error)
+	PurgeJournal(retention time.Duration, keep int) (int, error)
+}
+
+// journal records every delivery attempt, nil without -journal
+var journal journaler
+
+var journalPurged = expvar.NewInt("journal_purged")
+
+// journalAttempt records sending msg under key that started at start, mx and err are what
+// send returned
+func journalAttempt(key []byte, msg *emailq.Msg, mx string, start time.Time, result string, err error) {
+	if journal == nil {
+		return
+	}
+
+	e := emailq.EntryFor(key, msg)
+	e.Time, e.Duration, e.MX, e.Result = start, time.Since(start), mx, result
+
+	// the end of DATA is only accepted with 250
+	e.Code = 250
+	if err != nil {
+		e.Code, e.Error = 0, err.Error()
+
+		var reply *textproto.Error
+		if errors.As(err, &reply) {
+			e.Code = reply.Code
+		}
+	}
+
+	if err = journal.Journal(e); err != nil {
+		log.Println("Error journaling attempt:", err)
+	}
+}
+
+// journalLoop enforces the journal retention every hour
+func journalLoop(j journaler, retention time.Duration, keep int) {
+	for {
+		n, err := j.PurgeJournal(retention, keep)
+		if err != nil {
+			log.Println("Error purging journal:", err)
+		} else if n > 0 {
+			journalPurged.Add(int64(n))
+			log.Println("Purged", n, "journal entries")
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
+
+type journalEntry struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Key       string    `json:"key"`
+	MessageID string    `json:"message_id,omitempty"`
+	From      string    `json:"from"`
+	To        []string  `json:"to"`
+	Host      string    `json:"host"`
+	MX        string    `json:"mx,omitempty"`
+	Code      int       `json:"code,omitempty"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+	Duration  float64   `json:"duration"` // seconds
+}
+
+// listJournal lists delivery attempts oldest first, selected by ?key=, message_id=, host=,
+// since= and until= (RFC 3339), paged by limit= and after=, the id of the last entry
+func listJournal(w http.ResponseWriter, r *http.Request) {
+	j, ok := q.(journaler)
+	if !ok {
+		http.Error(w, "Queue does not support the journal", http.StatusNotImplemented)
+		return
+	}
+
+	f := emailq.JournalFilter{
+		Key:       r.FormValue("key"),
+		MessageID: r.FormValue("message_id"),
+		Host:      r.FormValue("host"),
+		After:     r.FormValue("after"),
+	}
+
+	var err error
+	if v := r.FormValue("since"); v != "" {
+		if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.FormValue("until"); v != "" {
+		if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.FormValue("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), listTimeout)
+	defer cancel()
+
+	page, err := j.ListJournal(ctx, f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	list := []journalEntry{}
+	for _, e := range page {
+		list = append(list, journalEntry{e.ID, e.Time, e.Key, e.MessageID, e.From, e.To, e.Host, e.MX, e.Code, e.Result, e.Error, e.Duration.Seconds()})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oliverjanik/scalemail/daemon"
+)
+
+// TLS modes of a listener
+const (
+	listenTLSOptional = "optional" // STARTTLS offered when configured
+	listenTLSRequire  = "require"  // STARTTLS before MAIL or AUTH
+	listenTLSImplicit = "implicit" // TLS from the first byte (port 465)
+)
+
+// listener is an inbound address with the policy that applies to its connections
+type listener struct {
+	Addr    string
+	Proxy   bool   // connections start with a PROXY protocol header
+	MaxSize int    // overrides -max-size when set
+	TLS     string // one of the listenTLS* modes
+	Auth    bool   // MAIL needs AUTH or a client certificate
+	PTR     string // overrides -ptr when set, "off" disables
+
+	// overrides -relay-networks when RelaySet, empty allows everyone like the flag
+	Relay    []*net.IPNet
+	RelaySet bool
+
+	GreetingDelay time.Duration // pause before the banner to catch early talkers
+}
+
+// listeners is a repeatable flag, relay networks are separated by semicolons:
+//
+//	-listen :25,proxy=true,greeting-delay=5s -listen :587,tls=require,auth=true
+//	-listen :25,ptr=reject -listen :465,tls=implicit,auth=true,max-size=52428800 -listen 10.0.0.1:25,relay=10.0.0.0/8;192.168.0.0/16
+type listeners []*listener
+
+var inbound listeners
+
+func (ls *listeners) String() string {
+	var s []string
+	for _, l := range *ls {
+		s = append(s, l.Addr)
+	}
+
+	return strings.Join(s, " ")
+}
+
+func (ls *listeners) Set(value string) error {
+	l, err := parseListener(value)
+	if err != nil {
+		return err
+	}
+
+	*ls = append(*ls, l)
+	return nil
+}
+
+func parseListener(value string) (*listener, error) {
+	parts := strings.Split(value, ",")
+	if parts[0] == "" {
+		return nil, fmt.Errorf("Invalid listener %q, expected host:port", value)
+	}
+
+	l := &listener{Addr: parts[0], TLS: listenTLSOptional}
+
+	for _, opt := range parts[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid listener option %q", opt)
+		}
+
+		var err error
+		switch kv[0] {
+		case "proxy":
+			l.Proxy, err = strconv.ParseBool(kv[1])
+		case "max-size":
+			l.MaxSize, err = strconv.Atoi(kv[1])
+		case "greeting-delay":
+			l.GreetingDelay, err = time.ParseDuration(kv[1])
+		case "tls":
+			switch kv[1] {
+			case listenTLSOptional, listenTLSRequire, listenTLSImplicit:
+				l.TLS = kv[1]
+			default:
+				err = fmt.Errorf("expected optional, require or implicit")
+			}
+		case "auth":
+			l.Auth, err = strconv.ParseBool(kv[1])
+		case "ptr":
+			switch kv[1] {
+			case "off", daemon.PTRCheck, daemon.PTRReject:
+				l.PTR = kv[1]
+			default:
+				err = fmt.Errorf("expected off, check or reject")
+			}
+		case "relay":
+			l.Relay, err = parseNetworks(strings.Replace(kv[1], ";", ",", -1))
+			l.RelaySet = true
+		default:
+			return nil, fmt.Errorf("Unknown listener option %q", kv[0])
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for listener option %q: %v", kv[0], err)
+		}
+	}
+
+	return l, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+var crlf = []byte("\r\n")
+
+// is7bit reports whether data can go to a server without 8BITMIME as is
+func is7bit(data []byte) bool {
+	for _, b := range data {
+		if b >= 0x80 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// downgrade re-encodes 8bit MIME parts as quoted-printable for a server without 8BITMIME,
+// walking into multipart and message/rfc822 parts. Data must have CRLF line endings.
+// DKIM signatures over converted parts no longer verify, which can't be helped.
+func downgrade(data []byte) []byte {
+	header, body := splitEntity(data)
+
+	// a bare message without MIME headers needs them once its body is encoded
+	if header != nil && fieldValue(header, "MIME-Version") == "" && !is7bit(body) {
+		header = append(append([]byte(nil), header...), "MIME-Version: 1.0\r\n"...)
+	}
+
+	return downgradeEntity(header, body)
+}
+
+func downgradeEntity(header, body []byte) []byte {
+	var out bytes.Buffer
+
+	mediatype, params, _ := mime.ParseMediaType(fieldValue(header, "Content-Type"))
+	cte := strings.ToLower(fieldValue(header, "Content-Transfer-Encoding"))
+
+	switch {
+	case is7bit(body) || cte == "base64" || cte == "quoted-printable" || cte == "binary":
+		// nothing to do, or nothing we can do for binary
+		out.Write(header)
+		out.Write(crlf)
+		out.Write(body)
+	case strings.HasPrefix(mediatype, "multipart/") && params["boundary"] != "":
+		out.Write(header)
+		out.Write(crlf)
+		out.Write(downgradeMultipart(body, params["boundary"]))
+	case mediatype == "message/rfc822":
+		// encoding a message/rfc822 part isn't allowed, its content is converted instead
+		out.Write(header)
+		out.Write(crlf)
+		part, partBody := splitEntity(body)
+		out.Write(downgradeEntity(part, partBody))
+	default:
+		out.Write(removeField(header, "Content-Transfer-Encoding"))
+		out.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+		w := quotedprintable.NewWriter(&out)
+		w.Write(body)
+		w.Close()
+	}
+
+	return out.Bytes()
+}
+
+// downgradeMultipart converts each body part between the boundary delimiters, preamble
+// and epilogue are kept as they are
+func downgradeMultipart(body []byte, boundary string) []byte {
+	var out, part bytes.Buffer
+	delim := []byte("--" + boundary)
+	inPart, closed := false, false
+
+	for _, line := range bytes.SplitAfter(body, crlf) {
+		rest := bytes.TrimRight(bytes.TrimPrefix(line, delim), " \t\r\n")
+		if closed || !bytes.HasPrefix(line, delim) || len(rest) > 0 && !bytes.Equal(rest, []byte("--")) {
+			part.Write(line)
+			continue
+		}
+
+		// the CRLF before a delimiter belongs to the delimiter
+		p := part.Bytes()
+		end := bytes.HasSuffix(p, crlf)
+		if end {
+			p = p[:len(p)-2]
+		}
+
+		if inPart {
+			p = downgradePart(p)
+		}
+
+		out.Write(p)
+		if end {
+			out.Write(crlf)
+		}
+		out.Write(line)
+
+		part.Reset()
+		inPart = len(rest) == 0
+		closed = !inPart
+	}
+
+	if inPart {
+		out.Write(downgradePart(part.Bytes()))
+	} else {
+		out.Write(part.Bytes())
+	}
+
+	return out.Bytes()
+}
+
+func downgradePart(part []byte) []byte {
+	header, body := splitEntity(part)
+	return downgradeEntity(header, body)
+}
+
+// splitEntity returns the header fields, each ending with CRLF, and the body after the
+// empty line. Without an empty line everything is header.
+func splitEntity(data []byte) (header, body []byte) {
+	if bytes.HasPrefix(data, crlf) {
+		return []byte{}, data[2:]
+	}
+
+	i := bytes.Index(data, []byte("\r\n\r\n"))
+	if i < 0 {
+		return data, nil
+	}
+
+	return data[:i+2], data[i+4:]
+}
+
+// fieldValue returns the trimmed value of the first header field called name
+func fieldValue(header []byte, name string) string {
+	r := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(header), bytes.NewReader(crlf))))
+	h, _ := r.ReadMIMEHeader()
+
+	return strings.TrimSpace(h.Get(name))
+}
+
+// removeField drops every header field called name, including its continuation lines
+func removeField(header []byte, name string) []byte {
+	var out []byte
+	skip := false
+
+	for _, line := range bytes.SplitAfter(header, crlf) {
+		if len(line) > 0 && line[0] != ' ' && line[0] != '\t' {
+			i := bytes.IndexByte(line, ':')
+			skip = i > 0 && strings.EqualFold(strings.TrimSpace(string(line[:i])), name)
+		}
+
+		if !skip {
+			out = append(out, line...)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/oliverjanik/scalemail/daemon"
+	"github.com/oliverjanik/scalemail/emailq"
+)
+
+// reportTmpl is a delivery status notification (RFC 3464): a note for people, the status of
+// each recipient and the original message or, with RET=HDRS, its headers
+var reportTmpl = template.Must(template.New("report").Parse(strings.Replace(`From: Mail Delivery System <MAILER-DAEMON@{{.Localname}}>
+To: <{{.Msg.From}}>
+Subject: {{.Subject}}: {{.Msg.Host}}
+Date: {{.Date}}
+Message-ID: {{.MessageID}}
+Auto-Submitted: auto-replied
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=delivery-status; boundary="{{.Boundary}}"
+
+--{{.Boundary}}
+Content-Type: text/plain; charset=utf-8
+
+This is an automatically generated message from {{.Localname}}.
+
+{{.Text}}
+{{range .Recipients}}
+    {{.Addr}}{{end}}
+{{if .Err}}
+Last error: {{.Err}}
+{{end}}
+--{{.Boundary}}
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; {{.Localname}}{{if .Msg.EnvID}}
+Original-Envelope-Id: {{.Msg.EnvID}}{{end}}
+Arrival-Date: {{.Arrival}}
+{{range .Recipients}}
+{{if .Original}}Original-Recipient: {{.Original}}
+{{end}}Final-Recipient: rfc822; {{.Addr}}
+Action: {{$.Action}}
+Status: {{$.Status}}{{if $.MX}}
+Remote-MTA: dns; {{$.MX}}{{end}}{{if $.Diagnostic}}
+Diagnostic-Code: smtp; {{$.Diagnostic}}{{end}}
+{{end}}
+--{{.Boundary}}
+Content-Type: {{if .Headers}}text/rfc822-headers{{else}}message/rfc822{{end}}
+
+`, "\n", "\r\n", -1)))
+
+// report is a delivery status notification to the sender of Msg about some of its recipients
+type report struct {
+	Msg     *emailq.Msg
+	To      []string
+	Action  string // failed, delayed or delivered
+	Subject string
+	Text    string
+	MX      string // server that answered, if any
+	Err     error
+}
+
+// warnDelayed queues a one-off "still trying" notice to the sender of a message that
+// has been undelivered for longer than delayWarning
+func warnDelayed(key []byte, msg *emailq.Msg, cause error) {
+	// never warn about messages from before Created was tracked
+	if delayWarning == 0 || msg.Warned || msg.Created.IsZero() {
+		return
+	}
+
+	// scheduled messages are only late from their release time
+	start := msg.Created
+	if msg.NotBefore.After(start) {
+		start = msg.NotBefore
+	}
+
+	age := time.Since(start)
+	if age < delayWarning {
+		return
+	}
+
+	reply, sent := notify(report{
+		Msg:     msg,
+		To:      notified(msg, "DELAY"),
+		Action:  "delayed",
+		Subject: "Delivery delayed",
+		Text: fmt.Sprintf("Your message to the following recipients has not been delivered yet. It was queued\r\n"+
+			"%v ago. We will keep trying and let you know if it ultimately fails. You do\r\n"+
+			"not need to resend it.", age.Truncate(time.Minute)),
+		Err: cause,
+	})
+	if !sent {
+		return
+	}
+	if reply != "" {
+		log.Println("Error queueing delay warning, trying again on the next retry:", reply)
+		return
+	}
+
+	// only once the notice is queued, a failed one is tried again
+	if err := q.MarkWarned(key); err != nil {
+		log.Println("Error marking delay warning:", err)
+	}
+}
+
+// notifyFailed tells the sender of msg that it bounced for cause, mx is the server that
+// refused it
+func notifyFailed(msg *emailq.Msg, mx string, cause error) {
+	reply, _ := notify(report{
+		Msg:     msg,
+		To:      notified(msg, "FAILURE"),
+		Action:  "failed",
+		Subject: "Undelivered Mail Returned to Sender",
+		Text:    "Your message could not be delivered to the following recipients:",
+		MX:      mx,
+		Err:     cause,
+	})
+	if reply != "" {
+		log.Println("Error queueing failure notice:", reply)
+	}
+}
+
+// notifyDelivered tells the sender of msg it was delivered to mx, for recipients that asked
+// with NOTIFY=SUCCESS
+func notifyDelivered(msg *emailq.Msg, mx string) {
+	reply, _ := notify(report{
+		Msg:     msg,
+		To:      notified(msg, "SUCCESS"),
+		Action:  "delivered",
+		Subject: "Delivery Status Notification (Success)",
+		Text:    "Your message was delivered to the following recipients:",
+		MX:      mx,
+	})
+	if reply != "" {
+		log.Println("Error queueing success notice:", reply)
+	}
+}
+
+// notify queues r for the sender, sent is false if there's nobody to tell: no recipient asked
+// for it, or the sender is null, as it is for notices themselves, or has no domain such as
+// <postmaster>. The reply is submit's.
+func notify(r report) (reply string, sent bool) {
+	if len(r.To) == 0 || r.Msg.From == "" {
+		return "", false
+	}
+	if _, ok := domainOf(r.Msg.From); !ok {
+		return "", false
+	}
+
+	data, err := r.render()
+	if err != nil {
+		log.Println("Error rendering delivery status notification:", err)
+		return "", false
+	}
+
+	log.Printf("Notifying sender %s: %s\n", r.Msg.From, r.Action)
+	return submit(&daemon.Msg{
+		To:   []string{r.Msg.From},
+		Data: data,
+
+		Metadata: r.Msg.Metadata,
+	}), true
+}
+
+func (r report) render() ([]byte, error) {
+	type recipient struct{ Addr, Original string }
+
+	var rcpts []recipient
+	for _, to := range r.To {
+		rcpts = append(rcpts, recipient{to, r.Msg.ORcpt[to]})
+	}
+
+	status, diagnostic := statusOf(r.Action, r.Err)
+	headers := r.Msg.Ret == "HDRS"
+	boundary := randomHex(12)
+
+	var buf bytes.Buffer
+	err := reportTmpl.Execute(&buf, map[string]interface{}{
+		"Localname":  localname,
+		"MessageID":  noticeID(),
+		"Date":       time.Now().Format(time.RFC1123Z),
+		"Arrival":    r.Msg.Created.Format(time.RFC1123Z),
+		"Boundary":   boundary,
+		"Msg":        r.Msg,
+		"Subject":    r.Subject,
+		"Text":       r.Text,
+		"Recipients": rcpts,
+		"Action":     r.Action,
+		"Status":     status,
+		"MX":         r.MX,
+		"Diagnostic": diagnostic,
+		"Err":        r.Err,
+		"Headers":    headers,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	original := normalize(r.Msg.Data)
+	if headers {
+		if i := bytes.Index(original, []byte("\r\n\r\n")); i >= 0 {
+			original = original[:i+2]
+		}
+	}
+	buf.Write(original)
+	if !bytes.HasSuffix(original, []byte("\r\n")) {
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("--" + boundary + "--\r\n")
+
+	return buf.Bytes(), nil
+}
+
+var enhancedStatus = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}\b`)
+
+// statusOf is the Status (RFC 3463) and Diagnostic-Code of a report, the enhanced status of
+// the reply that caused it when it has one
+func statusOf(action string, cause error) (status, diagnostic string) {
+	switch action {
+	case "delivered":
+		status = "2.0.0"
+	case "delayed":
+		status = "4.0.0"
+	default:
+		// ran out of retries on temporary failures
+		status = "4.4.7"
+	}
+
+	var reply *textproto.Error
+	if !errors.As(cause, &reply) {
+		return status, ""
+	}
+
+	diagnostic = strconv.Itoa(reply.Code) + " " + strings.ReplaceAll(reply.Msg, "\n", " ")
+	if s := enhancedStatus.FindString(reply.Msg); s != "" {
+		return s, diagnostic
+	}
+	if reply.Code >= 500 {
+		return "5.0.0", diagnostic
+	}
+
+	return status, diagnostic
+}
+
+// notified are the recipients of msg whose NOTIFY asks for kind notices
+func notified(msg *emailq.Msg, kind string) (to []string) {
+	for _, rcpt := range msg.To {
+		if wantsNotify(msg, rcpt, kind) {
+			to = append(to, rcpt)
+		}
+	}
+
+	return to
+}
+
+// wantsNotify reports whether the DSN NOTIFY option of rcpt asks for kind (SUCCESS, FAILURE
+// or DELAY) notices. Without NOTIFY failures and delays are reported.
+func wantsNotify(msg *emailq.Msg, rcpt, kind string) bool {
+	notify, ok := msg.Notify[rcpt]
+	if !ok {
+		return kind != "SUCCESS"
+	}
+
+	for _, n := range strings.Split(notify, ",") {
+		if n == kind {
+			return true
+		}
+	}
+
+	return false
+}
+
+// noticeID makes a Message-ID for a notice sent by the server, receivers refuse mail
+// without one
+func noticeID() string {
+	return "<" + randomHex(12) + "." + strconv.FormatInt(time.Now().Unix(), 10) + "@" + localname + ">"
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
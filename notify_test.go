@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oliverjanik/scalemail/emailq"
+)
+
+func TestReport(t *testing.T) {
+	msg := &emailq.Msg{
+		From:    "sender@example.org",
+		Host:    "example.com",
+		To:      []string{"a@example.com", "b@example.com", "c@example.com"},
+		Data:    []byte("Subject: hello\r\nMessage-ID: <1@example.org>\r\n\r\nsecret body\r\n"),
+		Created: time.Now(),
+		Ret:     "HDRS",
+		EnvID:   "env-1",
+		Notify:  map[string]string{"b@example.com": "NEVER", "c@example.com": "SUCCESS,FAILURE"},
+		ORcpt:   map[string]string{"a@example.com": "rfc822;alias@example.com"},
+	}
+
+	to := notified(msg, "FAILURE")
+	if strings.Join(to, ",") != "a@example.com,c@example.com" {
+		t.Fatal("NOTIFY not honored:", to)
+	}
+
+	r := report{Msg: msg, To: to, Action: "failed", Subject: "Undelivered", MX: "mx.example.com",
+		Err: &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}}
+	data, err := r.render()
+	if err != nil {
+		t.Fatal("Error rendering:", err)
+	}
+
+	report := string(data)
+	for _, want := range []string{
+		"\r\nMessage-ID: <",
+		"report-type=delivery-status",
+		"\r\nOriginal-Envelope-Id: env-1\r\n",
+		"\r\n\r\nOriginal-Recipient: rfc822;alias@example.com\r\nFinal-Recipient: rfc822; a@example.com\r\nAction: failed\r\nStatus: 5.1.1\r\nRemote-MTA: dns; mx.example.com\r\nDiagnostic-Code: smtp; 550 5.1.1 No such user\r\n",
+		"\r\n\r\nFinal-Recipient: rfc822; c@example.com\r\n",
+		"Content-Type: text/rfc822-headers\r\n\r\nSubject: hello\r\n",
+	} {
+		if !strings.Contains(report, want) {
+			t.Fatalf("Report lacks %q:\n%s", want, report)
+		}
+	}
+	if strings.Contains(report, "secret body") || strings.Contains(report, "b@example.com") {
+		t.Fatal("Report returns the body with RET=HDRS or a recipient that asked for NEVER:\n", report)
+	}
+
+	if status, _ := statusOf("failed", &textproto.Error{Code: 451, Msg: "Try later"}); status != "4.4.7" {
+		t.Fatal("Unexpected status of exhausted retries:", status)
+	}
+}
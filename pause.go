@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// pauser holds back delivery to destination domains, e.g. while a provider is blocking us
+type pauser interface {
+	PauseHost(host string) error
+	ResumeHost(host string) error
+	PausedHosts() ([]string, error)
+}
+
+// pause lists paused domains, POST ?host= pauses delivery to one
+func pause(w http.ResponseWriter, r *http.Request) {
+	p, ok := q.(pauser)
+	if !ok {
+		http.Error(w, "Queue does not support pausing", http.StatusNotImplemented)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		pauseAction(w, r, "paused", p.PauseHost)
+		return
+	}
+
+	hosts, err := p.PausedHosts()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if hosts == nil {
+		hosts = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hosts)
+}
+
+// resume delivers to the paused domain ?host= again
+func resume(w http.ResponseWriter, r *http.Request) {
+	p, ok := q.(pauser)
+	if !ok {
+		http.Error(w, "Queue does not support pausing", http.StatusNotImplemented)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pauseAction(w, r, "resumed", p.ResumeHost)
+}
+
+func pauseAction(w http.ResponseWriter, r *http.Request, done string, fn func(host string) error) {
+	host := r.FormValue("host")
+	if host == "" {
+		http.Error(w, "Missing host", http.StatusBadRequest)
+		return
+	}
+
+	if err := fn(host); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("Delivery to", host, done)
+	w.WriteHeader(http.StatusNoContent)
+}
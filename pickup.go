@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/oliverjanik/scalemail/daemon"
+)
+
+// Pickup directory layout. Applications drop message.eml (written elsewhere and renamed in,
+// so it is never seen half-written) with an optional message.env sidecar holding the envelope:
+//
+//	{"from": "sender@example.com", "to": ["rcpt@example.org"]}
+//
+// A from of "<>" submits with the null reverse-path, as bounces and other notifications must.
+// An optional "send_at" (RFC 3339) holds the message until then, "metadata" is an object of
+// strings queued with it, e.g. {"campaign": "spring"}.
+// Without a sidecar the envelope is taken from the From, To, Cc and Bcc headers.
+// Files are claimed by renaming them into work/ and end up in done/ or failed/. Those left in
+// work/ by an instance that stopped halfway are put back after pickupStale, and may be queued
+// twice.
+const (
+	pickupWork   = "work"
+	pickupDone   = "done"
+	pickupFailed = "failed"
+)
+
+// how long after being claimed a file still in work/ is taken for abandoned, enqueueing one
+// takes far less
+const pickupStale = 5 * time.Minute
+
+type envelope struct {
+	From   string    `json:"from"`
+	To     []string  `json:"to"`
+	SendAt time.Time `json:"send_at"`
+
+	Metadata map[string]string `json:"metadata"`
+}
+
+func pickupLoop(dir string, interval time.Duration) {
+	for _, sub := range []string{pickupWork, pickupDone, pickupFailed} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			log.Println("Error creating pickup directory:", err)
+			return
+		}
+	}
+
+	for {
+		if err := recoverPickup(dir, time.Now().Add(-pickupStale)); err != nil {
+			log.Println("Error recovering pickup work directory:", err)
+		}
+
+		names, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+		if err != nil {
+			log.Println("Error scanning pickup directory:", err)
+		}
+
+		for _, name := range names {
+			pickup(dir, filepath.Base(name))
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// pickup claims, enqueues and files away a single message
+func pickup(dir, name string) {
+	sidecar := strings.TrimSuffix(name, ".eml") + ".env"
+	work := filepath.Join(dir, pickupWork)
+
+	// claim atomically, another instance may have got there first
+	if err := os.Rename(filepath.Join(dir, name), filepath.Join(work, name)); err != nil {
+		return
+	}
+
+	// the claim time, for recoverPickup
+	now := time.Now()
+	os.Chtimes(filepath.Join(work, name), now, now)
+
+	hasSidecar := os.Rename(filepath.Join(dir, sidecar), filepath.Join(work, sidecar)) == nil
+
+	err := enqueueFile(filepath.Join(work, name), filepath.Join(work, sidecar), hasSidecar)
+
+	dest := pickupDone
+	if err != nil {
+		log.Println("Error picking up", name+":", err)
+		dest = pickupFailed
+	} else {
+		log.Println("Picked up", name)
+	}
+
+	os.Rename(filepath.Join(work, name), filepath.Join(dir, dest, name))
+	if hasSidecar {
+		os.Rename(filepath.Join(work, sidecar), filepath.Join(dir, dest, sidecar))
+	}
+}
+
+// recoverPickup moves messages claimed before cutoff and still in work/ back into dir for the
+// next scan, the sidecar first so the message is never seen without it
+func recoverPickup(dir string, cutoff time.Time) error {
+	work := filepath.Join(dir, pickupWork)
+
+	names, err := filepath.Glob(filepath.Join(work, "*.eml"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range names {
+		fi, err := os.Stat(path)
+		if err != nil || fi.ModTime().After(cutoff) {
+			continue
+		}
+
+		name := filepath.Base(path)
+		sidecar := strings.TrimSuffix(name, ".eml") + ".env"
+		if err = os.Rename(filepath.Join(work, sidecar), filepath.Join(dir, sidecar)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err = os.Rename(path, filepath.Join(dir, name)); err != nil {
+			return err
+		}
+
+		log.Println("Recovered abandoned pickup", name)
+	}
+
+	return nil
+}
+
+func enqueueFile(path, sidecar string, hasSidecar bool) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var env envelope
+	var nullSender bool
+	if hasSidecar {
+		b, err := ioutil.ReadFile(sidecar)
+		if err != nil {
+			return err
+		}
+
+		if err = json.Unmarshal(b, &env); err != nil {
+			return err
+		}
+
+		if env.From == "<>" {
+			env.From = ""
+			nullSender = true
+		}
+	} else {
+		if env, err = headerEnvelope(data); err != nil {
+			return err
+		}
+
+		data = stripHeader(data, "Bcc")
+	}
+
+	if env.From == "" && !nullSender || len(env.To) == 0 {
+		return errors.New("Envelope needs a sender and at least one recipient")
+	}
+
+	for _, to := range env.To {
+		if !strings.Contains(to, "@") {
+			return errors.New("Invalid recipient: " + to)
+		}
+	}
+
+	return enqueue(&daemon.Msg{
+		From: env.From,
+		To:   env.To,
+		Data: data,
+
+		HoldUntil: env.SendAt,
+		Metadata:  env.Metadata,
+	})
+}
+
+// headerEnvelope derives sender and recipients from message headers
+func headerEnvelope(data []byte) (env envelope, err error) {
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return env, err
+	}
+
+	from, err := mail.ParseAddress(m.Header.Get("From"))
+	if err != nil {
+		return env, err
+	}
+	env.From = from.Address
+
+	for _, h := range []string{"To", "Cc", "Bcc"} {
+		list, err := m.Header.AddressList(h)
+		if err == mail.ErrHeaderNotPresent {
+			continue
+		}
+		if err != nil {
+			return env, err
+		}
+
+		for _, a := range list {
+			env.To = append(env.To, a.Address)
+		}
+	}
+
+	return env, nil
+}
+
+// stripHeader removes header field name (including folded continuation lines) from the header section
+func stripHeader(data []byte, name string) []byte {
+	var out bytes.Buffer
+	prefix := strings.ToLower(name) + ":"
+
+	r := bufio.NewReader(bytes.NewReader(data))
+	skipping, inHeader := false, true
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if inHeader {
+			switch {
+			case len(bytes.TrimRight(line, "\r\n")) == 0:
+				inHeader = false
+			case line[0] != ' ' && line[0] != '\t': // continuation lines keep the previous decision
+				skipping = strings.HasPrefix(strings.ToLower(string(line)), prefix)
+			}
+		}
+
+		if !inHeader || !skipping {
+			out.Write(line)
+		}
+
+		if err != nil {
+			return out.Bytes()
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oliverjanik/scalemail/emailq"
+)
+
+// newPickup makes a pickup directory and an empty queue for its messages
+func newPickup(t *testing.T) string {
+	saved := q
+	t.Cleanup(func() { q = saved })
+	q = emailq.NewMemory()
+
+	dir := t.TempDir()
+	for _, sub := range []string{pickupWork, pickupDone, pickupFailed} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func drop(t *testing.T, dir, name, content string) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// filed checks name ended up in sub of dir and nowhere else
+func filed(t *testing.T, dir, sub, name string) {
+	t.Helper()
+
+	for _, d := range []string{"", pickupWork, pickupDone, pickupFailed} {
+		_, err := os.Stat(filepath.Join(dir, d, name))
+		if d == sub && err != nil {
+			t.Fatal(name, "not filed in", sub+":", err)
+		}
+		if d != sub && err == nil {
+			t.Fatal(name, "left in", d)
+		}
+	}
+}
+
+func queued(t *testing.T) []emailq.Delivery {
+	t.Helper()
+
+	batch, err := q.PopBatch(context.Background(), 10)
+	if err != nil {
+		t.Fatal("Error popping:", err)
+	}
+
+	return batch
+}
+
+func TestPickupSidecar(t *testing.T) {
+	dir := newPickup(t)
+
+	drop(t, dir, "a.eml", "Subject: hi\r\n\r\nbody\r\n")
+	drop(t, dir, "a.env", `{"from": "sender@example.org", "to": ["rcpt@example.com"], "metadata": {"campaign": "spring"}}`)
+	pickup(dir, "a.eml")
+
+	filed(t, dir, pickupDone, "a.eml")
+	filed(t, dir, pickupDone, "a.env")
+
+	batch := queued(t)
+	if len(batch) != 1 {
+		t.Fatal("Expected 1 message, got", len(batch))
+	}
+	if m := batch[0].Msg; m.From != "sender@example.org" || strings.Join(m.To, ",") != "rcpt@example.com" || m.Metadata["campaign"] != "spring" {
+		t.Fatal("Envelope not taken from the sidecar:", m.From, m.To, m.Metadata)
+	}
+}
+
+func TestPickupHeaders(t *testing.T) {
+	dir := newPickup(t)
+
+	drop(t, dir, "a.eml", "From: Sender <sender@example.org>\r\nTo: a@example.com\r\nBcc: hidden@example.com,\r\n other@example.com\r\nSubject: hi\r\n\r\nBcc: in the body\r\n")
+	pickup(dir, "a.eml")
+
+	filed(t, dir, pickupDone, "a.eml")
+
+	batch := queued(t)
+	if len(batch) != 1 {
+		t.Fatal("Expected 1 message, got", len(batch))
+	}
+	m := batch[0].Msg
+	if m.From != "sender@example.org" || strings.Join(m.To, ",") != "a@example.com,hidden@example.com,other@example.com" {
+		t.Fatal("Envelope not taken from the headers:", m.From, m.To)
+	}
+	if data := string(m.Data); strings.Contains(data, "hidden") || strings.Contains(data, "other@") || !strings.Contains(data, "Bcc: in the body") {
+		t.Fatal("Bcc not stripped from the header only:", data)
+	}
+}
+
+func TestPickupNullSender(t *testing.T) {
+	dir := newPickup(t)
+
+	drop(t, dir, "a.eml", "Subject: bounce\r\n\r\nbody\r\n")
+	drop(t, dir, "a.env", `{"from": "<>", "to": ["rcpt@example.com"]}`)
+	pickup(dir, "a.eml")
+
+	filed(t, dir, pickupDone, "a.eml")
+
+	if batch := queued(t); len(batch) != 1 || batch[0].Msg.From != "" {
+		t.Fatal("Null sender not queued:", batch)
+	}
+}
+
+func TestPickupFailed(t *testing.T) {
+	dir := newPickup(t)
+
+	drop(t, dir, "a.eml", "Subject: hi\r\n\r\nbody\r\n")
+	drop(t, dir, "a.env", `{"from": "sender@example.org", "to": []}`)
+	pickup(dir, "a.eml")
+
+	drop(t, dir, "b.eml", "Subject: no envelope\r\n\r\nbody\r\n")
+	pickup(dir, "b.eml")
+
+	filed(t, dir, pickupFailed, "a.eml")
+	filed(t, dir, pickupFailed, "a.env")
+	filed(t, dir, pickupFailed, "b.eml")
+
+	if batch := queued(t); len(batch) != 0 {
+		t.Fatal("Failed pickups queued:", len(batch))
+	}
+}
+
+func TestRecoverPickup(t *testing.T) {
+	dir := newPickup(t)
+	work := filepath.Join(dir, pickupWork)
+
+	drop(t, work, "old.eml", "Subject: hi\r\n\r\nbody\r\n")
+	drop(t, work, "old.env", `{"from": "sender@example.org", "to": ["rcpt@example.com"]}`)
+	drop(t, work, "new.eml", "Subject: hi\r\n\r\nbody\r\n")
+
+	claimed := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(work, "old.eml"), claimed, claimed)
+
+	if err := recoverPickup(dir, time.Now().Add(-pickupStale)); err != nil {
+		t.Fatal("Error recovering:", err)
+	}
+
+	// still being picked up by another instance
+	filed(t, dir, pickupWork, "new.eml")
+
+	filed(t, dir, "", "old.eml")
+	filed(t, dir, "", "old.env")
+
+	pickup(dir, "old.eml")
+	filed(t, dir, pickupDone, "old.eml")
+	if batch := queued(t); len(batch) != 1 || batch[0].Msg.From != "sender@example.org" {
+		t.Fatal("Recovered message not queued:", batch)
+	}
+}
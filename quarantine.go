@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/oliverjanik/scalemail/daemon"
+	"github.com/oliverjanik/scalemail/emailq"
+)
+
+// quarantiner holds messages flagged by policy aside from the delivery queue
+type quarantiner interface {
+	Quarantine(msg *emailq.Msg, reason string) error
+	Quarantined() ([]emailq.Delivery, error)
+	Release(key []byte) error
+	DeleteQuarantined(key []byte) error
+}
+
+// hold quarantines msg split by destination host, a queue without quarantine delivers it
+func hold(msg *daemon.Msg) error {
+	h, ok := q.(quarantiner)
+	if !ok {
+		log.Println("Queue has no quarantine, delivering flagged message from session", msg.Session)
+		return enqueue(msg)
+	}
+
+	msgs, err := group(msg)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range msgs {
+		if err := h.Quarantine(m, msg.QuarantineReason); err != nil {
+			log.Print(err)
+			continue
+		}
+		events.publish(eventQuarantined, nil, m, errors.New(msg.QuarantineReason))
+		log.Println("Quarantined email from session", msg.Session+":", msg.QuarantineReason)
+	}
+
+	return nil
+}
+
+type heldMsg struct {
+	Key     string    `json:"key"`
+	Created time.Time `json:"created"`
+	From    string    `json:"from"`
+	To      []string  `json:"to"`
+	Reason  string    `json:"reason"`
+	Size    int       `json:"size"`
+}
+
+// quarantine lists held messages, ?key= returns one message as is
+func quarantine(w http.ResponseWriter, r *http.Request) {
+	h, ok := q.(quarantiner)
+	if !ok {
+		http.Error(w, "Queue does not support quarantine", http.StatusNotImplemented)
+		return
+	}
+
+	held, err := h.Quarantined()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if key := r.FormValue("key"); key != "" {
+		for _, d := range held {
+			if string(d.Key) == key {
+				w.Header().Set("Content-Type", "message/rfc822")
+				w.Write(d.Msg.Data)
+				return
+			}
+		}
+
+		http.NotFound(w, r)
+		return
+	}
+
+	list := []heldMsg{}
+	for _, d := range held {
+		list = append(list, heldMsg{string(d.Key), d.Msg.Created, d.Msg.From, d.Msg.To, d.Msg.QuarantineReason, len(d.Msg.Data)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// releaseQuarantined queues the held message ?key= for delivery
+func releaseQuarantined(w http.ResponseWriter, r *http.Request) {
+	quarantineAction(w, r, "released", quarantiner.Release)
+}
+
+// deleteQuarantined drops the held message ?key=
+func deleteQuarantined(w http.ResponseWriter, r *http.Request) {
+	quarantineAction(w, r, "deleted", quarantiner.DeleteQuarantined)
+}
+
+func quarantineAction(w http.ResponseWriter, r *http.Request, done string, fn func(quarantiner, []byte) error) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h, ok := q.(quarantiner)
+	if !ok {
+		http.Error(w, "Queue does not support quarantine", http.StatusNotImplemented)
+		return
+	}
+
+	key := r.FormValue("key")
+	if key == "" {
+		http.Error(w, "Missing key", http.StatusBadRequest)
+		return
+	}
+
+	switch err := fn(h, []byte(key)); {
+	case errors.Is(err, emailq.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("Quarantined email", key, done)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"expvar"
+	"log"
+
+	"github.com/oliverjanik/scalemail/emailq"
+)
+
+var queueEvents = expvar.NewMap("queue")
+
+// deadReasons counts dead letters by their DeadReason
+var deadReasons = expvar.NewMap("dead_reasons")
+
+// queueCounter counts messages moving through the queue for /metrics
+type queueCounter struct{}
+
+func (queueCounter) OnPush(key []byte, msg *emailq.Msg) { queueEvents.Add("pushed", 1) }
+func (queueCounter) OnPop(key []byte, msg *emailq.Msg)  { queueEvents.Add("popped", 1) }
+func (queueCounter) OnDelivered(key []byte)             { queueEvents.Add("delivered", 1) }
+
+func (queueCounter) OnRetry(key []byte, msg *emailq.Msg, cause error) {
+	queueEvents.Add("retried", 1)
+}
+
+func (queueCounter) OnKill(key []byte, msg *emailq.Msg, cause error) {
+	deadReasons.Add(msg.DeadReason, 1)
+	if msg.DeadReason == emailq.ReasonExpired {
+		queueEvents.Add("expired", 1)
+		return
+	}
+	queueEvents.Add("killed", 1)
+}
+
+func (queueCounter) OnCorrupt(c emailq.Corrupt) {
+	queueEvents.Add("corrupt", 1)
+	log.Printf("Queue value %s doesn't decode, set aside: %s\n", c.Key, c.Error)
+}
+
+// metered queues count and time their operations themselves
+type metered interface {
+	Metrics() emailq.Metrics
+}
+
+// publishMetrics exposes the counters and commit times of the queue on /metrics
+func publishMetrics(m metered) {
+	expvar.Publish("queue_metrics", expvar.Func(func() interface{} { return m.Metrics() }))
+}
+
+// sizer queues report messages and bytes per state, what fills the disk rather than the count
+type sizer interface {
+	Sizes() (emailq.Sizes, error)
+}
+
+// publishSizes exposes the messages and bytes per state of the queue on /metrics
+func publishSizes(s sizer) {
+	expvar.Publish("queue_size", expvar.Func(func() interface{} {
+		sz, err := s.Sizes()
+		if err != nil {
+			return err.Error()
+		}
+		return sz
+	}))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/oliverjanik/scalemail/daemon"
+)
+
+// how long a recipient lookup may take
+const rcptCheckTimeout = 10 * time.Second
+
+const (
+	rcptUnknown     = "550 5.1.1 No such user here"
+	rcptUnavailable = "451 4.3.0 Recipient verification unavailable, try again later"
+)
+
+// rcptValidator builds the RCPT time check of local recipients from the -recipients table
+// and the -rcpt-check lookup, either may be absent. The lookup is an http(s) URL queried
+// with GET ?rcpt=address, or a command run with "--" and the address as its last arguments:
+//
+//	valid     HTTP 2xx or exit status 0
+//	unknown   HTTP 404 or exit status 1, refused with 550
+//
+// Anything else, a lookup that's down included, defers the recipient with 451.
+func rcptValidator(mailbox func(string) bool, spec string) daemon.RcptValidator {
+	var lookup func(addr string) string
+	switch {
+	case spec == "":
+	case strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://"):
+		lookup = func(addr string) string { return httpRcptCheck(spec, addr) }
+	default:
+		args := strings.Fields(spec)
+		lookup = func(addr string) string { return execRcptCheck(args, addr) }
+	}
+
+	if mailbox == nil && lookup == nil {
+		return nil
+	}
+
+	return func(addr string) string {
+		if mailbox != nil && !mailbox(addr) {
+			return rcptUnknown
+		}
+
+		if lookup != nil {
+			return lookup(addr)
+		}
+		return ""
+	}
+}
+
+func httpRcptCheck(base, addr string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), rcptCheckTimeout)
+	defer cancel()
+
+	sep := "?"
+	if strings.Contains(base, "?") {
+		sep = "&"
+	}
+
+	req, err := http.NewRequest("GET", base+sep+"rcpt="+url.QueryEscape(addr), nil)
+	if err != nil {
+		log.Println("Error checking recipient:", err)
+		return rcptUnavailable
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		log.Println("Error checking recipient:", err)
+		return rcptUnavailable
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return ""
+	case resp.StatusCode == http.StatusNotFound:
+		return rcptUnknown
+	}
+
+	log.Println("Recipient check failed:", resp.Status)
+	return rcptUnavailable
+}
+
+func execRcptCheck(args []string, addr string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), rcptCheckTimeout)
+	defer cancel()
+
+	// an address starting with "-" must not pass for an option
+	argv := append(append([]string(nil), args[1:]...), "--", addr)
+	cmd := exec.CommandContext(ctx, args[0], argv...)
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err == nil {
+		return ""
+	}
+
+	if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == 1 {
+		return rcptUnknown
+	}
+
+	log.Println("Error running recipient check:", err)
+	return rcptUnavailable
+}
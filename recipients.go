@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// loadRecipients reads the local recipient table, one address per line, blank lines and
+// # comments are skipped. The returned lookup ignores case.
+func loadRecipients(path string) (func(addr string) bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	table := make(map[string]bool)
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		table[strings.ToLower(line)] = true
+	}
+
+	if err = s.Err(); err != nil {
+		return nil, err
+	}
+
+	return func(addr string) bool {
+		return table[strings.ToLower(addr)]
+	}, nil
+}
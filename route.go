@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TLS modes of a route
+const (
+	tlsNone     = "none"     // plaintext only
+	tlsStartTLS = "starttls" // opportunistic STARTTLS, certificate not verified
+	tlsRequire  = "require"  // mandatory STARTTLS with verified certificate
+	tlsImplicit = "implicit" // TLS from the first byte (port 465)
+)
+
+// route describes how mail for a destination domain leaves the server
+type route struct {
+	Domain   string // destination domain, "*" matches any domain
+	Host     string // smarthost, empty means deliver directly to MX
+	Port     int
+	TLS      string
+	Auth     string // plain, login or cram-md5, empty means no AUTH
+	Username string
+	Password string
+}
+
+// routes is a repeatable flag:
+//
+//	-route "example.com=smtp.example.net:587,tls=require,auth=plain,user=u,pass=p"
+//
+// The user and pass values run up to the next option, so they may contain commas.
+type routes []*route
+
+var (
+	outbound routes
+
+	// TLS sessions per MX host, so repeated connections resume instead of doing a full handshake
+	tlsSessions tls.ClientSessionCache
+
+	directRoute = &route{Domain: "*", Port: 25, TLS: tlsStartTLS}
+)
+
+// how long connecting to one address may take before the next one is tried
+const connectTimeout = 30 * time.Second
+
+// how long the server may take at each step, RFC 5321 section 4.5.3.2
+const (
+	greetingTimeout  = 5 * time.Minute  // 220 greeting, also EHLO, STARTTLS and AUTH
+	commandTimeout   = 5 * time.Minute  // MAIL, RCPT and QUIT
+	dataInitTimeout  = 2 * time.Minute  // DATA until the 354
+	dataBlockTimeout = 3 * time.Minute  // each write of the message
+	dataTermTimeout  = 10 * time.Minute // final dot until the reply
+)
+
+// routeOptions are the options a route takes after the destination
+var routeOptions = map[string]bool{"tls": true, "auth": true, "user": true, "pass": true}
+
+func (rs *routes) String() string {
+	var s []string
+	for _, r := range *rs {
+		s = append(s, r.Domain+"="+net.JoinHostPort(r.Host, strconv.Itoa(r.Port)))
+	}
+
+	return strings.Join(s, " ")
+}
+
+func (rs *routes) Set(value string) error {
+	r, err := parseRoute(value)
+	if err != nil {
+		return err
+	}
+
+	*rs = append(*rs, r)
+	return nil
+}
+
+func parseRoute(value string) (*route, error) {
+	parts := strings.Split(value, ",")
+
+	dest := strings.SplitN(parts[0], "=", 2)
+	if len(dest) != 2 || dest[0] == "" {
+		return nil, fmt.Errorf("Invalid route %q, expected domain=host:port", value)
+	}
+
+	r := &route{
+		Domain: strings.ToLower(dest[0]),
+		Host:   dest[1],
+		Port:   25,
+		TLS:    tlsStartTLS,
+	}
+
+	if host, port, err := net.SplitHostPort(dest[1]); err == nil {
+		r.Host = host
+		if r.Port, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("Invalid port in route %q", value)
+		}
+	}
+
+	if r.Port == 465 {
+		r.TLS = tlsImplicit
+	}
+
+	// user and pass may contain commas, up to the next option they are part of the value
+	var cont *string
+	for _, opt := range parts[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if cont != nil && (len(kv) != 2 || !routeOptions[kv[0]]) {
+			*cont += "," + opt
+			continue
+		}
+		cont = nil
+
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid route option %q", opt)
+		}
+
+		switch kv[0] {
+		case "tls":
+			switch kv[1] {
+			case tlsNone, tlsStartTLS, tlsRequire, tlsImplicit:
+				r.TLS = kv[1]
+			default:
+				return nil, fmt.Errorf("Unknown TLS mode %q", kv[1])
+			}
+		case "auth":
+			switch kv[1] {
+			case "plain", "login", "cram-md5":
+				r.Auth = kv[1]
+			default:
+				return nil, fmt.Errorf("Unknown AUTH mechanism %q", kv[1])
+			}
+		case "user":
+			r.Username, cont = kv[1], &r.Username
+		case "pass":
+			r.Password, cont = kv[1], &r.Password
+		default:
+			return nil, fmt.Errorf("Unknown route option %q", kv[0])
+		}
+	}
+
+	return r, nil
+}
+
+// routeFor finds the route for destination domain, exact matches win over the "*" wildcard
+func routeFor(domain string) *route {
+	domain = strings.ToLower(domain)
+
+	var wildcard *route
+	for _, r := range outbound {
+		if r.Domain == domain {
+			return r
+		}
+
+		if r.Domain == "*" && wildcard == nil {
+			wildcard = r
+		}
+	}
+
+	if wildcard != nil {
+		return wildcard
+	}
+
+	return directRoute
+}
+
+// timedConn gives each read and write the timeout of the step the conversation is at, so a
+// server that stops answering is given up on whichever step it stalls
+type timedConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timedConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *timedConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// client is a connection to a server, step sets the timeout of what comes next
+type client struct {
+	*smtp.Client
+	conn *timedConn
+}
+
+func (c *client) step(timeout time.Duration) {
+	c.conn.timeout = timeout
+}
+
+// connect dials hosts in order until one of them greets, per RFC 5321 section 5.1 a
+// connection failure moves on to the next. Then it performs the TLS and AUTH steps the route
+// asks for, failing those is up to the server that greeted and isn't tried elsewhere.
+// Returns the host connected to or, if none was, the last one tried and its error.
+func (r *route) connect(hosts []string) (host string, c *client, err error) {
+	for _, host = range hosts {
+		if c, err = r.dial(host); err == nil {
+			break
+		}
+
+		log.Println("Error connecting to", host+":", err)
+	}
+	if err != nil {
+		return host, nil, err
+	}
+
+	if err = r.handshake(c, r.tlsConfig(host)); err != nil {
+		c.Close()
+		return host, nil, err
+	}
+
+	return host, c, nil
+}
+
+func (r *route) tlsConfig(host string) *tls.Config {
+	return &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: r.TLS == tlsStartTLS,
+		ClientSessionCache: tlsSessions,
+	}
+}
+
+// dial connects to host trying each of its addresses in turn until one greets
+func (r *route) dial(host string) (*client, error) {
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		var c *client
+		if c, err = r.dialAddr(host, net.JoinHostPort(addr, strconv.Itoa(r.Port))); err == nil {
+			return c, nil
+		}
+	}
+
+	return nil, err
+}
+
+func (r *route) dialAddr(host, addr string) (*client, error) {
+	raw, err := net.DialTimeout("tcp", addr, connectTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	timed := &timedConn{raw, greetingTimeout}
+	var conn net.Conn = timed
+	if r.TLS == tlsImplicit {
+		conn = tls.Client(conn, r.tlsConfig(host))
+	}
+
+	// reads the greeting
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &client{c, timed}, nil
+}
+
+func (r *route) handshake(c *client, config *tls.Config) error {
+	if err := c.Hello(localname); err != nil {
+		return err
+	}
+
+	if r.TLS == tlsStartTLS || r.TLS == tlsRequire {
+		ok, _ := c.Extension("STARTTLS")
+		if !ok && r.TLS == tlsRequire {
+			return errors.New("Server does not support mandatory STARTTLS")
+		}
+
+		if ok {
+			if err := c.StartTLS(config); err != nil {
+				return err
+			}
+		}
+	}
+
+	if r.Auth == "" {
+		return nil
+	}
+
+	var auth smtp.Auth
+	switch r.Auth {
+	case "plain":
+		auth = smtp.PlainAuth("", r.Username, r.Password, config.ServerName)
+	case "login":
+		auth = &loginAuth{r.Username, r.Password}
+	case "cram-md5":
+		auth = smtp.CRAMMD5Auth(r.Username, r.Password)
+	}
+
+	return c.Auth(auth)
+}
+
+// loginAuth implements the non-standard but widespread AUTH LOGIN mechanism
+type loginAuth struct {
+	username, password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("Unencrypted connection")
+	}
+
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+
+	return nil, fmt.Errorf("Unexpected LOGIN challenge %q", fromServer)
+}
@@ -0,0 +1,73 @@
+package main
+
+import "testing"
+
+func TestParseRoute(t *testing.T) {
+	cases := []struct {
+		value string
+		want  route
+	}{
+		{"example.com=smtp.example.net", route{Domain: "example.com", Host: "smtp.example.net", Port: 25, TLS: tlsStartTLS}},
+		{"Example.COM=smtp.example.net:587", route{Domain: "example.com", Host: "smtp.example.net", Port: 587, TLS: tlsStartTLS}},
+		{"*=smtp.example.net:465", route{Domain: "*", Host: "smtp.example.net", Port: 465, TLS: tlsImplicit}},
+		{"*=smtp.example.net:465,tls=none", route{Domain: "*", Host: "smtp.example.net", Port: 465, TLS: tlsNone}},
+		{"example.com=[::1]:2525,tls=require", route{Domain: "example.com", Host: "::1", Port: 2525, TLS: tlsRequire}},
+		{"example.com=smtp.example.net:587,tls=require,auth=plain,user=u,pass=p", route{Domain: "example.com", Host: "smtp.example.net", Port: 587, TLS: tlsRequire, Auth: "plain", Username: "u", Password: "p"}},
+		{"example.com=smtp.example.net,auth=login,user=a,b,pass=c,d=e,", route{Domain: "example.com", Host: "smtp.example.net", Port: 25, TLS: tlsStartTLS, Auth: "login", Username: "a,b", Password: "c,d=e,"}},
+		{"example.com=smtp.example.net,pass=x,,auth=cram-md5", route{Domain: "example.com", Host: "smtp.example.net", Port: 25, TLS: tlsStartTLS, Auth: "cram-md5", Password: "x,"}},
+	}
+
+	for _, c := range cases {
+		r, err := parseRoute(c.value)
+		if err != nil {
+			t.Fatal("Error parsing", c.value+":", err)
+		}
+		if *r != c.want {
+			t.Fatalf("Route %q parsed as %+v", c.value, *r)
+		}
+	}
+
+	for _, value := range []string{
+		"",
+		"smtp.example.net",
+		"=smtp.example.net",
+		"example.com=smtp.example.net:smtp",
+		"example.com=smtp.example.net,tls=always",
+		"example.com=smtp.example.net,auth=xoauth2",
+		"example.com=smtp.example.net,port=587",
+		"example.com=smtp.example.net,tls",
+	} {
+		if r, err := parseRoute(value); err == nil {
+			t.Fatalf("Malformed route %q accepted: %+v", value, *r)
+		}
+	}
+}
+
+func TestRouteFor(t *testing.T) {
+	defer func(saved routes) { outbound = saved }(outbound)
+
+	outbound = nil
+	for _, value := range []string{"example.com=exact.example.net", "*=wildcard.example.net", "*=second.example.net", "other.example=other.example.net"} {
+		if err := outbound.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct{ domain, host string }{
+		{"example.com", "exact.example.net"},
+		{"EXAMPLE.com", "exact.example.net"},
+		{"other.example", "other.example.net"},
+		{"sub.example.com", "wildcard.example.net"},
+		{"example.org", "wildcard.example.net"},
+	}
+	for _, c := range cases {
+		if r := routeFor(c.domain); r.Host != c.host {
+			t.Fatalf("Route for %s goes to %q, expected %q", c.domain, r.Host, c.host)
+		}
+	}
+
+	outbound = outbound[:1]
+	if r := routeFor("example.org"); r != directRoute {
+		t.Fatal("Expected direct delivery without a wildcard, got", r.Host)
+	}
+}
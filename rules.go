@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/oliverjanik/scalemail/daemon"
+)
+
+// loadRules reads the SMTP time rules file, see daemon.ParseRules for the format
+func loadRules(path string) ([]*daemon.Rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return daemon.ParseRules(f)
+}
+
+// reloadRulesOnHangup rereads the rules file on SIGHUP, a file that fails to load leaves the
+// current rules in place
+func reloadRulesOnHangup(path string, rules *daemon.Rules) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+
+	for range ch {
+		r, err := loadRules(path)
+		if err != nil {
+			log.Println("Error reloading rules:", err)
+			continue
+		}
+
+		rules.Set(r)
+		log.Println("Reloaded", len(r), "rules from", path)
+	}
+}
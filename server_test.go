@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/oliverjanik/scalemail/daemon"
+)
+
+func TestGroup(t *testing.T) {
+	msg := &daemon.Msg{From: "sender@example.org", To: []string{`"a@b"@example.com`, "c@example.com", "d@other.example"}}
+
+	msgs, err := group(msg)
+	if err != nil || len(msgs) != 2 {
+		t.Fatal("Unexpected grouping:", msgs, err)
+	}
+	for _, m := range msgs {
+		if m.Host != "example.com" && m.Host != "other.example" || m.Host == "example.com" && len(m.To) != 2 {
+			t.Fatal("Recipients grouped under the wrong host:", m.Host, m.To)
+		}
+	}
+
+	for _, to := range []string{"postmaster", "user@"} {
+		if _, err = group(&daemon.Msg{To: []string{"c@example.com", to}}); !errors.Is(err, errNoDomain) {
+			t.Fatal("Recipient without a domain not refused:", to, err)
+		}
+	}
+}
+
+func TestByPreference(t *testing.T) {
+	cases := []struct {
+		mx    []*net.MX
+		prefs []uint16
+	}{
+		{nil, nil},
+		{[]*net.MX{{Host: "a.", Pref: 10}}, []uint16{10}},
+		{[]*net.MX{{Host: "c.", Pref: 30}, {Host: "a.", Pref: 10}, {Host: "b.", Pref: 20}}, []uint16{10, 20, 30}},
+		{[]*net.MX{{Host: "b1.", Pref: 20}, {Host: "a.", Pref: 5}, {Host: "b2.", Pref: 20}, {Host: "c.", Pref: 50}}, []uint16{5, 20, 20, 50}},
+	}
+
+	for _, c := range cases {
+		sorted := byPreference(c.mx, rand.New(rand.NewSource(1)).Shuffle)
+		if len(sorted) != len(c.prefs) {
+			t.Fatal("Records lost:", sorted)
+		}
+		for i, mx := range sorted {
+			if mx.Pref != c.prefs[i] {
+				t.Fatalf("Record %d out of preference order: %v", i, mx)
+			}
+		}
+	}
+
+	// each of the records sharing the best preference comes first for some seed
+	seen := make(map[string]bool)
+	for seed := int64(0); seed < 50; seed++ {
+		mx := []*net.MX{{Host: "b.", Pref: 20}, {Host: "x1.", Pref: 10}, {Host: "x2.", Pref: 10}, {Host: "x3.", Pref: 10}}
+		sorted := byPreference(mx, rand.New(rand.NewSource(seed)).Shuffle)
+		if sorted[3].Host != "b." {
+			t.Fatal("Least preferred record not last:", sorted[3].Host)
+		}
+		seen[sorted[0].Host] = true
+	}
+	if len(seen) != 3 {
+		t.Fatal("Equal preferences not shuffled, first were only", seen)
+	}
+}